@@ -17,6 +17,8 @@ import (
 	"github.com/EXCCoin/exccd/exccutil"
 	"github.com/btcsuite/btclog"
 	"github.com/btcsuite/go-flags"
+
+	"github.com/EXCCoin/gominer/stratum"
 )
 
 const (
@@ -38,14 +40,30 @@ var (
 	defaultRPCPortSimNet  = "19556"
 	defaultAPIHost        = "localhost"
 	defaultAPIPort        = "3333"
+	defaultStratumPort    = "3334"
 	defaultLogDir         = filepath.Join(minerHomeDir, defaultLogDirname)
 	defaultAutocalibrate  = 500
 
+	defaultPoolMaxFailures   = 3
+	defaultPoolMaxReconnects = 5
+	defaultPoolNoWorkTimeout = 5 * time.Minute
+	defaultPoolProbeInterval = 10 * time.Minute
+	defaultPoolKeepAlive     = 15 * time.Second
+	defaultPoolTimeout       = 2 * time.Minute
+	defaultPoolShareTimeout  = 30 * time.Second
+	defaultWorkRefresh       = 5 * time.Second
+	defaultShutdownGrace     = 10 * time.Second
+	defaultStratumDifficulty = 1.0
+
 	minIntensity  = 8
-	maxIntensity  = 31
+	maxIntensity  = 20
 	minTempTarget = uint32(60)
 	maxTempTarget = uint32(84)
-	maxWorkSize   = uint32(0xFFFFFFFF - 255)
+
+	// maxWorkSize caps the solver runs per iteration, which is 2^12 at
+	// the maximum intensity, so that reloaded settings and calibration
+	// are applied within a reasonable time.
+	maxWorkSize = uint32(1) << (maxIntensity - minIntensity)
 )
 
 type config struct {
@@ -66,6 +84,8 @@ type config struct {
 
 	// Status API options
 	APIListeners []string `long:"apilisten" description:"Add an interface/port to expose miner status API"`
+	APIUser      string   `long:"apiuser" description:"Username for the control API"`
+	APIPassword  string   `long:"apipass" default-mask:"-" description:"Password for the control API -- The control API is disabled unless set"`
 
 	// RPC connection options
 	RPCUser     string `short:"u" long:"rpcuser" description:"RPC username"`
@@ -79,25 +99,51 @@ type config struct {
 
 	Benchmark bool `short:"B" long:"benchmark" description:"Run in benchmark mode."`
 
+	// Solo mining options
+	GBT        bool   `long:"gbt" description:"Use getblocktemplate with long polling and submitblock instead of getwork for solo mining"`
+	MiningAddr string `long:"miningaddr" description:"Pay the block reward to this address instead of the daemon's mining address (requires --gbt)"`
+	miningAddr exccutil.Address
+
+	// Stratum server options
+	StratumListen     string  `long:"stratum-listen" description:"Serve the work fetched with getwork or received from the pool to other miners over stratum on this interface/port, submitting their shares meeting the target of the work upstream (default port: 3334)"`
+	StratumDifficulty float64 `long:"stratum-difficulty" description:"Share difficulty sent to the miners connected to the stratum server"`
+
+	Backend    string `long:"backend" description:"Solver backend to use {cuda, cpu}"`
+	CPUThreads int    `long:"cputhreads" description:"Number of threads used by the cpu backend (default: number of logical CPUs)"`
+
 	TestNet       bool `long:"testnet" description:"Connect to testnet"`
 	SimNet        bool `long:"simnet" description:"Connect to the simulation test network"`
 	TLSSkipVerify bool `long:"skipverify" description:"Do not verify tls certificates (not recommended!)"`
 
-	Autocalibrate     string `short:"A" long:"autocalibrate" description:"Time target in milliseconds to spend executing hashes on the device during each iteration. Single global value or a comma separated list."`
+	Autocalibrate     string `short:"A" long:"autocalibrate" description:"Time target in milliseconds to spend executing the solver on the device during each iteration, used unless an intensity or work size is given. Single global value or a comma separated list."`
 	AutocalibrateInts []int
 	Devices           string `short:"D" long:"devices" description:"Single device ID or a comma separated list of device IDs to use."`
 	DeviceIDs         []int
-	Intensity         string `short:"i" long:"intensity" description:"Intensities (the work size is 2^intensity) per device. Single global value or a comma separated list."`
+	Intensity         string `short:"i" long:"intensity" description:"Intensities (the work size is 2^(intensity-8) solver runs, from 8 to 20) per device. Single global value or a comma separated list."`
 	IntensityInts     []int
 	TempTarget        string `short:"t" long:"temptarget" description:"Target temperature in Celsius to maintain via automatic fan control. (Requires --experimental flag)"`
 	TempTargetInts    []uint32
-	WorkSize          string `short:"W" long:"worksize" description:"The explicitly declared sizes of the work to do per device (overrides intensity). Single global value or a comma separated list."`
+	WorkSize          string `short:"W" long:"worksize" description:"The explicitly declared number of solver runs per iteration per device, up to 4096 (overrides intensity). Single global value or a comma separated list."`
 	WorkSizeInts      []uint32
+	WorkRefresh       time.Duration `long:"workrefresh" description:"Interval between polls for new work with getwork, or checks for new pool work in case a job notification was missed"`
+	ShutdownGrace     time.Duration `long:"shutdowngrace" description:"Time allowed on shutdown to submit the solutions already found and get the pool's response to them (0 to exit right away)"`
 
 	// Pool related options
-	Pool         string `short:"o" long:"pool" description:"Pool to connect to (e.g.stratum+tcp://pool:port)"`
-	PoolUser     string `short:"m" long:"pooluser" description:"Pool username"`
-	PoolPassword string `short:"n" long:"poolpass" default-mask:"-" description:"Pool password"`
+	Pool              []string      `short:"o" long:"pool" description:"Pool to connect to (e.g.stratum+tcp://pool:port) -- Specify multiple times to add failover pools in priority order"`
+	PoolUser          []string      `short:"m" long:"pooluser" description:"Pool username -- Specify once per pool or once for all pools"`
+	PoolPassword      []string      `short:"n" long:"poolpass" default-mask:"-" description:"Pool password -- Specify once per pool or once for all pools"`
+	PoolMaxFailures   int           `long:"poolmaxfailures" description:"Number of consecutive connection or authorization failures before switching to the next pool"`
+	PoolMaxReconnects int           `long:"poolmaxreconnects" description:"Number of attempts to reconnect to a pool after losing the connection before it counts as a failure (0 to retry forever)"`
+	PoolNoWorkTimeout time.Duration `long:"poolnoworktimeout" description:"Switch to the next pool when no work was received for this long (0 to disable)"`
+	PoolProbeInterval time.Duration `long:"poolprobeinterval" description:"Interval to check whether a higher priority pool is available again (0 to disable)"`
+	PoolKeepAlive     time.Duration `long:"poolkeepalive" description:"Period of the TCP keepalive probes sent on connections to pools (0 to disable)"`
+	PoolTimeout       time.Duration `long:"pooltimeout" description:"Reconnect to a pool which sent no job notification or response for this long, as when the connection is half-open (0 to disable)"`
+	PoolShareTimeout  time.Duration `long:"poolsharetimeout" description:"Reconnect to a pool which did not respond to a submitted share within this time (0 to disable)"`
+	PoolCert          string        `long:"poolcert" description:"Certificate authority bundle used to verify stratum+ssl:// and stratum+tls:// pools instead of the system roots"`
+	PoolDialect       string        `long:"pooldialect" description:"Stratum dialect spoken by the pools whose URL does not select one with zip301+tcp:// or zip301+ssl:// {decred, zip301}"`
+	PoolTranscript    string        `long:"pooltranscript" description:"Record the messages exchanged with pools to this file, one JSON object per line, to report pool issues (the pool password is redacted)"`
+	ReplayTranscript  string        `long:"replaytranscript" description:"Replay a transcript recorded with --pooltranscript through the stratum client, without connecting to the pool, and exit"`
+	Pools             []stratum.PoolConfig
 }
 
 // removeDuplicateAddresses returns a new slice with all duplicate entries in
@@ -229,6 +275,80 @@ func cleanAndExpandPath(path string) string {
 	return filepath.Clean(os.ExpandEnv(path))
 }
 
+// parseIntList parses the single value or the comma separated list of values
+// of the named setting.
+func parseIntList(name, s string) ([]int, error) {
+	values := strings.Split(s, ",")
+	ints := make([]int, len(values))
+	for i, value := range values {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("Could not convert %v value (%v) "+
+				"to int: %v", name, value, err)
+		}
+		ints[i] = n
+	}
+	return ints, nil
+}
+
+// validateDeviceTuning parses the autocalibrations, intensities and work sizes
+// of cfg and checks they are within range.  The autocalibration defaults to
+// defaultAutocalibrate when none is set.  It is used both when the miner is
+// started and when the config is reloaded.
+func validateDeviceTuning(cfg *config) error {
+	var err error
+	cfg.AutocalibrateInts = []int{defaultAutocalibrate}
+	if cfg.Autocalibrate != "" {
+		cfg.AutocalibrateInts, err = parseIntList("autocalibrate",
+			cfg.Autocalibrate)
+		if err != nil {
+			return err
+		}
+	}
+	for _, autocalibrate := range cfg.AutocalibrateInts {
+		if autocalibrate < 1 {
+			return fmt.Errorf("Autocalibration %v must be at least 1 ms",
+				autocalibrate)
+		}
+	}
+
+	cfg.IntensityInts = nil
+	if cfg.Intensity != "" {
+		cfg.IntensityInts, err = parseIntList("intensity", cfg.Intensity)
+		if err != nil {
+			return err
+		}
+	}
+	for _, intensity := range cfg.IntensityInts {
+		if intensity < minIntensity || intensity > maxIntensity {
+			return fmt.Errorf("Intensity %v not within range %v to %v",
+				intensity, minIntensity, maxIntensity)
+		}
+	}
+
+	cfg.WorkSizeInts = nil
+	if cfg.WorkSize != "" {
+		workSizes, err := parseIntList("worksize", cfg.WorkSize)
+		if err != nil {
+			return err
+		}
+		for _, workSize := range workSizes {
+			if workSize < 1 {
+				return fmt.Errorf("Too small WorkSize passed: %v, "+
+					"min 1", workSize)
+			}
+			if workSize > int(maxWorkSize) {
+				return fmt.Errorf("Too big WorkSize passed: %v, "+
+					"max %v", workSize, maxWorkSize)
+			}
+			cfg.WorkSizeInts = append(cfg.WorkSizeInts,
+				uint32(workSize))
+		}
+	}
+
+	return nil
+}
+
 // loadConfig initializes and parses the config using a config file and command
 // line options.
 //
@@ -250,6 +370,19 @@ func loadConfig() (*config, []string, error) {
 		RPCServer:  defaultRPCServer,
 		RPCCert:    defaultRPCCertFile,
 		ClKernel:   defaultClKernel,
+		Backend:    defaultBackend,
+
+		PoolMaxFailures:   defaultPoolMaxFailures,
+		PoolMaxReconnects: defaultPoolMaxReconnects,
+		PoolNoWorkTimeout: defaultPoolNoWorkTimeout,
+		PoolProbeInterval: defaultPoolProbeInterval,
+		PoolKeepAlive:     defaultPoolKeepAlive,
+		PoolTimeout:       defaultPoolTimeout,
+		PoolShareTimeout:  defaultPoolShareTimeout,
+		WorkRefresh:       defaultWorkRefresh,
+		ShutdownGrace:     defaultShutdownGrace,
+		PoolDialect:       stratum.DialectDecred,
+		StratumDifficulty: defaultStratumDifficulty,
 	}
 
 	// Create the home directory if it doesn't already exist.
@@ -323,41 +456,150 @@ func loadConfig() (*config, []string, error) {
 		fmt.Fprintln(os.Stderr, err)
 		return nil, nil, err
 	}
+	switch {
+	case cfg.TestNet:
+		activeNetParams = &testNetParams
+	case cfg.SimNet:
+		activeNetParams = &simNetParams
+	}
 
-	// Check the autocalibrations if the user is setting that.
-	if len(cfg.Autocalibrate) > 0 {
-		// Parse a list like -A 450,600
-		if strings.Contains(cfg.Autocalibrate, ",") {
-			specifiedAutocalibrates := strings.Split(cfg.Autocalibrate, ",")
-			cfg.AutocalibrateInts = make([]int, len(specifiedAutocalibrates))
-			for i := range specifiedAutocalibrates {
-				j, err := strconv.Atoi(specifiedAutocalibrates[i])
-				if err != nil {
-					err := fmt.Errorf("Could not convert autocalibration "+
-						"(%v) to int: %s", specifiedAutocalibrates[i],
-						err.Error())
-					fmt.Fprintln(os.Stderr, err)
-					return nil, nil, err
-				}
+	// Validate the solver backend.
+	if cfg.Backend != BackendCUDA && cfg.Backend != BackendCPU {
+		err := fmt.Errorf("%s: unknown backend %v -- supported backends "+
+			"are %v and %v", funcName, cfg.Backend, BackendCUDA,
+			BackendCPU)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+	if cfg.CPUThreads < 0 {
+		err := fmt.Errorf("%s: cputhreads must not be negative", funcName)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+	if cfg.CPUThreads == 0 {
+		cfg.CPUThreads = runtime.NumCPU()
+	}
 
-				cfg.AutocalibrateInts[i] = j
-			}
-			// Use specified device like -A 600
-		} else {
-			cfg.AutocalibrateInts = make([]int, 1)
-			i, err := strconv.Atoi(cfg.Autocalibrate)
-			if err != nil {
-				err := fmt.Errorf("Could not convert autocalibration %v "+
-					"to int: %s", cfg.Autocalibrate, err.Error())
-				fmt.Fprintln(os.Stderr, err)
-				return nil, nil, err
-			}
+	// Validate the solo mining options.
+	if cfg.GBT && len(cfg.Pool) > 0 {
+		err := fmt.Errorf("%s: --gbt is only supported for solo mining "+
+			"and can't be used with --pool", funcName)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+	if cfg.PoolTranscript != "" && len(cfg.Pool) == 0 {
+		err := fmt.Errorf("%s: --pooltranscript requires --pool",
+			funcName)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+	if cfg.StratumListen != "" && (cfg.GBT || cfg.Benchmark) {
+		err := fmt.Errorf("%s: --stratum-listen is only supported for "+
+			"pool mining and solo mining with getwork", funcName)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+	if cfg.StratumDifficulty <= 0 {
+		err := fmt.Errorf("%s: stratum-difficulty must be positive",
+			funcName)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+	if cfg.MiningAddr != "" {
+		if !cfg.GBT {
+			err := fmt.Errorf("%s: --miningaddr requires --gbt", funcName)
+			fmt.Fprintln(os.Stderr, err)
+			return nil, nil, err
+		}
 
-			cfg.AutocalibrateInts[0] = i
+		addr, err := exccutil.DecodeAddress(cfg.MiningAddr)
+		if err != nil {
+			err := fmt.Errorf("%s: invalid mining address %v: %v",
+				funcName, cfg.MiningAddr, err)
+			fmt.Fprintln(os.Stderr, err)
+			return nil, nil, err
 		}
-		// Apply default
-	} else {
-		cfg.AutocalibrateInts = []int{defaultAutocalibrate}
+		if !addr.IsForNet(activeNetParams.Params) {
+			err := fmt.Errorf("%s: mining address %v is not for %v",
+				funcName, cfg.MiningAddr, activeNetParams.Name)
+			fmt.Fprintln(os.Stderr, err)
+			return nil, nil, err
+		}
+		cfg.miningAddr = addr
+	}
+
+	// Pair every pool with its credentials.  A single user or password
+	// applies to all pools.
+	if len(cfg.PoolUser) > 1 && len(cfg.PoolUser) != len(cfg.Pool) {
+		err := fmt.Errorf("%s: %d pool users given for %d pools", funcName,
+			len(cfg.PoolUser), len(cfg.Pool))
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+	if len(cfg.PoolPassword) > 1 && len(cfg.PoolPassword) != len(cfg.Pool) {
+		err := fmt.Errorf("%s: %d pool passwords given for %d pools",
+			funcName, len(cfg.PoolPassword), len(cfg.Pool))
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+	if cfg.PoolMaxFailures < 1 {
+		err := fmt.Errorf("%s: poolmaxfailures must be at least 1", funcName)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+	if cfg.WorkRefresh <= 0 {
+		err := fmt.Errorf("%s: workrefresh must be positive", funcName)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+	if cfg.ShutdownGrace < 0 {
+		err := fmt.Errorf("%s: shutdowngrace may not be negative",
+			funcName)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+	if cfg.PoolMaxReconnects < 0 {
+		err := fmt.Errorf("%s: poolmaxreconnects may not be negative",
+			funcName)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+	if cfg.PoolKeepAlive < 0 || cfg.PoolTimeout < 0 ||
+		cfg.PoolShareTimeout < 0 {
+		err := fmt.Errorf("%s: poolkeepalive, pooltimeout and "+
+			"poolsharetimeout may not be negative", funcName)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+	if !stratum.ValidDialect(cfg.PoolDialect) {
+		err := fmt.Errorf("%s: unknown pool dialect %v", funcName,
+			cfg.PoolDialect)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+	for i, pool := range cfg.Pool {
+		pc := stratum.PoolConfig{URL: pool}
+		switch len(cfg.PoolUser) {
+		case 0:
+		case 1:
+			pc.User = cfg.PoolUser[0]
+		default:
+			pc.User = cfg.PoolUser[i]
+		}
+		switch len(cfg.PoolPassword) {
+		case 0:
+		case 1:
+			pc.Pass = cfg.PoolPassword[0]
+		default:
+			pc.Pass = cfg.PoolPassword[i]
+		}
+		cfg.Pools = append(cfg.Pools, pc)
+	}
+
+	// Check the autocalibrations, intensities and work sizes.
+	if err := validateDeviceTuning(&cfg); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
 	}
 
 	// Check the devices if the user is setting that.
@@ -393,50 +635,6 @@ func loadConfig() (*config, []string, error) {
 		}
 	}
 
-	// Check the intensity if the user is setting that.
-	if len(cfg.Intensity) > 0 {
-		// Parse a list like -i 29,30
-		if strings.Contains(cfg.Intensity, ",") {
-			specifiedIntensities := strings.Split(cfg.Intensity, ",")
-			cfg.IntensityInts = make([]int, len(specifiedIntensities))
-			for i := range specifiedIntensities {
-				j, err := strconv.Atoi(specifiedIntensities[i])
-				if err != nil {
-					err := fmt.Errorf("Could not convert intensity "+
-						"(%v) to int: %s", specifiedIntensities[i],
-						err.Error())
-					fmt.Fprintln(os.Stderr, err)
-					return nil, nil, err
-				}
-
-				cfg.IntensityInts[i] = j
-			}
-			// Use specified intensity like -i 29
-		} else {
-			cfg.IntensityInts = make([]int, 1)
-			i, err := strconv.Atoi(cfg.Intensity)
-			if err != nil {
-				err := fmt.Errorf("Could not convert intensity %v "+
-					"to int: %s", cfg.Intensity, err.Error())
-				fmt.Fprintln(os.Stderr, err)
-				return nil, nil, err
-			}
-
-			cfg.IntensityInts[0] = i
-		}
-	}
-
-	for i := range cfg.IntensityInts {
-		if (cfg.IntensityInts[i] < minIntensity) ||
-			(cfg.IntensityInts[i] > maxIntensity) {
-			err := fmt.Errorf("Intensity %v not within "+
-				"range %v to %v.", cfg.IntensityInts[i], minIntensity,
-				maxIntensity)
-			fmt.Fprintln(os.Stderr, err)
-			return nil, nil, err
-		}
-	}
-
 	// Check the temptarget if the user is setting that.
 	if len(cfg.TempTarget) > 0 {
 		if !cfg.Experimental {
@@ -499,60 +697,6 @@ func loadConfig() (*config, []string, error) {
 		}
 	}
 
-	// Check the work size if the user is setting that.
-	if len(cfg.WorkSize) > 0 {
-		// Parse a list like -W 536870912,1073741824
-		if strings.Contains(cfg.WorkSize, ",") {
-			specifiedWorkSizes := strings.Split(cfg.WorkSize, ",")
-			cfg.WorkSizeInts = make([]uint32, len(specifiedWorkSizes))
-			for i := range specifiedWorkSizes {
-				j, err := strconv.Atoi(specifiedWorkSizes[i])
-				if err != nil {
-					err := fmt.Errorf("Could not convert worksize "+
-						"(%v) to int: %s", specifiedWorkSizes[i],
-						err.Error())
-					fmt.Fprintln(os.Stderr, err)
-					return nil, nil, err
-				}
-
-				cfg.WorkSizeInts[i] = uint32(j)
-			}
-			// Use specified worksize like -W 1073741824
-		} else {
-			cfg.WorkSizeInts = make([]uint32, 1)
-			i, err := strconv.Atoi(cfg.WorkSize)
-			if err != nil {
-				err := fmt.Errorf("Could not convert worksize %v "+
-					"to int: %s", cfg.WorkSize, err.Error())
-				fmt.Fprintln(os.Stderr, err)
-				return nil, nil, err
-			}
-
-			cfg.WorkSizeInts[0] = uint32(i)
-		}
-	}
-
-	for i := range cfg.WorkSizeInts {
-		if cfg.WorkSizeInts[i] < 256 {
-			err := fmt.Errorf("Too small WorkSize passed: %v, min 256",
-				cfg.WorkSizeInts[i])
-			fmt.Fprintln(os.Stderr, err)
-			return nil, nil, err
-		}
-		if cfg.WorkSizeInts[i] > maxWorkSize {
-			err := fmt.Errorf("Too big WorkSize passed: %v, max %v",
-				cfg.WorkSizeInts[i], maxWorkSize)
-			fmt.Fprintln(os.Stderr, err)
-			return nil, nil, err
-		}
-		if cfg.WorkSizeInts[i]%256 != 0 {
-			err := fmt.Errorf("Work size %v not a multiple of 256",
-				cfg.WorkSizeInts[i])
-			fmt.Fprintln(os.Stderr, err)
-			return nil, nil, err
-		}
-	}
-
 	// Special show command to list supported subsystems and exit.
 	if cfg.DebugLevel == "show" {
 		fmt.Println("Supported subsystems", supportedSubsystems())
@@ -575,22 +719,39 @@ func loadConfig() (*config, []string, error) {
 		cfg.APIListeners = normalizeAddresses(cfg.APIListeners, defaultAPIPort)
 	}
 
+	if cfg.StratumListen != "" {
+		cfg.StratumListen = normalizeAddress(cfg.StratumListen,
+			defaultStratumPort)
+	}
+
+	// The control API is served next to the status API.
+	if (cfg.APIUser != "" || cfg.APIPassword != "") && len(cfg.APIListeners) == 0 {
+		err := fmt.Errorf("%s: --apiuser and --apipass require --apilisten",
+			funcName)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+	if cfg.APIUser != "" && cfg.APIPassword == "" {
+		err := fmt.Errorf("%s: --apiuser requires --apipass", funcName)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+
 	// Handle environment variable expansion in the RPC certificate path.
 	cfg.RPCCert = cleanAndExpandPath(cfg.RPCCert)
-
-	var defaultRPCPort string
-	switch {
-	case cfg.TestNet:
-		defaultRPCPort = defaultRPCPortTestNet
-	case cfg.SimNet:
-		defaultRPCPort = defaultRPCPortSimNet
-	default:
-		defaultRPCPort = defaultRPCPortMainNet
+	if cfg.PoolCert != "" {
+		cfg.PoolCert = cleanAndExpandPath(cfg.PoolCert)
+	}
+	if cfg.PoolTranscript != "" {
+		cfg.PoolTranscript = cleanAndExpandPath(cfg.PoolTranscript)
+	}
+	if cfg.ReplayTranscript != "" {
+		cfg.ReplayTranscript = cleanAndExpandPath(cfg.ReplayTranscript)
 	}
 
 	// Add default port to RPC server based on --testnet flag
 	// if needed.
-	cfg.RPCServer = normalizeAddress(cfg.RPCServer, defaultRPCPort)
+	cfg.RPCServer = normalizeAddress(cfg.RPCServer, activeNetParams.rpcPort)
 
 	// Warn about missing config file only after all other configuration is
 	// done.  This prevents the warning on help messages and invalid
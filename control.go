@@ -0,0 +1,258 @@
+// Copyright (c) 2018 The ExchangeCoin team
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// controlRequest models a JSON-RPC request to the control API.
+type controlRequest struct {
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+	ID     interface{}       `json:"id"`
+}
+
+// controlError models the error of a failed control API call.
+type controlError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// controlResponse models a JSON-RPC response of the control API.
+type controlResponse struct {
+	JSONRPC string        `json:"jsonrpc"`
+	Result  interface{}   `json:"result"`
+	Error   *controlError `json:"error"`
+	ID      interface{}   `json:"id"`
+}
+
+// JSON-RPC error codes returned by the control API.
+const (
+	controlErrParse          = -32700
+	controlErrMethodNotFound = -32601
+	controlErrInvalidParams  = -32602
+	controlErrInternal       = -32603
+)
+
+// controlHandler handles a control API method.  An error of type
+// *controlError is returned as is, other errors as internal errors.
+type controlHandler func(params []json.RawMessage) (interface{}, error)
+
+// controlHandlers maps the control API methods to their handlers.
+var controlHandlers = map[string]controlHandler{
+	"help":        handleHelp,
+	"pause":       handlePause,
+	"resume":      handleResume,
+	"switchPool":  handleSwitchPool,
+	"setLogLevel": handleSetLogLevel,
+	"shutdown":    handleShutdown,
+}
+
+// controlHelp describes the usage of the control API methods.
+var controlHelp = map[string]string{
+	"help":        "help: list the available methods",
+	"pause":       "pause [device]: pause the device with the passed index, or all devices",
+	"resume":      "resume [device]: resume the device with the passed index, or all devices",
+	"switchPool":  "switchPool pool: switch to the pool with the passed priority, the first pool being 0",
+	"setLogLevel": "setLogLevel level: set the log level as with --debuglevel",
+	"shutdown":    "shutdown: stop mining and exit",
+}
+
+// invalidParams returns an invalid params error for method.
+func invalidParams(method string) *controlError {
+	return &controlError{
+		Code:    controlErrInvalidParams,
+		Message: "Invalid parameters, usage: " + controlHelp[method],
+	}
+}
+
+func (e *controlError) Error() string {
+	return e.Message
+}
+
+// parseParams decodes the positional params into args, of which only the
+// first required are mandatory.
+func parseParams(method string, params []json.RawMessage, required int, args ...interface{}) error {
+	if len(params) < required || len(params) > len(args) {
+		return invalidParams(method)
+	}
+	for i, param := range params {
+		if err := json.Unmarshal(param, args[i]); err != nil {
+			return invalidParams(method)
+		}
+	}
+	return nil
+}
+
+func handleHelp(params []json.RawMessage) (interface{}, error) {
+	if err := parseParams("help", params, 0); err != nil {
+		return nil, err
+	}
+	var usage []string
+	for _, method := range []string{"help", "pause", "resume",
+		"switchPool", "setLogLevel", "shutdown"} {
+		usage = append(usage, controlHelp[method])
+	}
+	return usage, nil
+}
+
+// devicesParam returns the devices selected by the optional device index
+// parameter of method.
+func devicesParam(method string, params []json.RawMessage) ([]*Device, error) {
+	var index *int
+	if err := parseParams(method, params, 0, &index); err != nil {
+		return nil, err
+	}
+	if index == nil {
+		return m.devices, nil
+	}
+	d := m.Device(*index)
+	if d == nil {
+		return nil, &controlError{
+			Code:    controlErrInvalidParams,
+			Message: fmt.Sprintf("No device #%d", *index),
+		}
+	}
+	return []*Device{d}, nil
+}
+
+func handlePause(params []json.RawMessage) (interface{}, error) {
+	devices, err := devicesParam("pause", params)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range devices {
+		d.Pause()
+	}
+	return nil, nil
+}
+
+func handleResume(params []json.RawMessage) (interface{}, error) {
+	devices, err := devicesParam("resume", params)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range devices {
+		d.Resume()
+	}
+	return nil, nil
+}
+
+func handleSwitchPool(params []json.RawMessage) (interface{}, error) {
+	var pool int
+	if err := parseParams("switchPool", params, 1, &pool); err != nil {
+		return nil, err
+	}
+	if m.pools == nil {
+		return nil, fmt.Errorf("Not mining on a pool")
+	}
+	if err := m.pools.SwitchPool(pool); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func handleSetLogLevel(params []json.RawMessage) (interface{}, error) {
+	var level string
+	if err := parseParams("setLogLevel", params, 1, &level); err != nil {
+		return nil, err
+	}
+	// The levels are validated first so that none is set unless all are
+	// valid.
+	if err := checkDebugLevels(level); err != nil {
+		return nil, &controlError{
+			Code:    controlErrInvalidParams,
+			Message: err.Error(),
+		}
+	}
+	parseAndSetDebugLevels(level)
+	mainLog.Infof("Log level set to %s", level)
+	return nil, nil
+}
+
+// handleShutdown only validates the request, the miner is stopped by
+// serveControl once the reply has been written.
+func handleShutdown(params []json.RawMessage) (interface{}, error) {
+	if err := parseParams("shutdown", params, 0); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// controlAuthorized returns whether the request carries the credentials set
+// with --apiuser and --apipass.  The credentials are hashed before the
+// comparison to keep it constant time regardless of their length.
+func controlAuthorized(req *http.Request) bool {
+	user, pass, ok := req.BasicAuth()
+	if !ok {
+		return false
+	}
+	gotUser := sha256.Sum256([]byte(user))
+	gotPass := sha256.Sum256([]byte(pass))
+	wantUser := sha256.Sum256([]byte(cfg.APIUser))
+	wantPass := sha256.Sum256([]byte(cfg.APIPassword))
+	userOK := subtle.ConstantTimeCompare(gotUser[:], wantUser[:])
+	passOK := subtle.ConstantTimeCompare(gotPass[:], wantPass[:])
+	return userOK&passOK == 1
+}
+
+// serveControl serves the JSON-RPC control API, which is only available with
+// HTTP basic authentication.
+func serveControl(w http.ResponseWriter, req *http.Request) {
+	if !controlAuthorized(req) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="gominer"`)
+		http.Error(w, "401 Unauthorized.", http.StatusUnauthorized)
+		return
+	}
+	if req.Method != "POST" {
+		http.Error(w, "405 Method Not Allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request controlRequest
+	resp := controlResponse{JSONRPC: "2.0"}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		resp.Error = &controlError{
+			Code:    controlErrParse,
+			Message: fmt.Sprintf("Invalid request: %v", err),
+		}
+	} else if handler, ok := controlHandlers[request.Method]; !ok {
+		resp.ID = request.ID
+		resp.Error = &controlError{
+			Code:    controlErrMethodNotFound,
+			Message: fmt.Sprintf("Unknown method %q", request.Method),
+		}
+	} else {
+		resp.ID = request.ID
+		mainLog.Debugf("Control API call %s from %s", request.Method,
+			req.RemoteAddr)
+		result, err := handler(request.Params)
+		switch err := err.(type) {
+		case nil:
+			resp.Result = result
+		case *controlError:
+			resp.Error = err
+		default:
+			resp.Error = &controlError{
+				Code:    controlErrInternal,
+				Message: err.Error(),
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+
+	if request.Method == "shutdown" && resp.Error == nil {
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		mainLog.Warn("Shutdown requested through the control API, exiting...")
+		m.Stop()
+	}
+}
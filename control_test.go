@@ -0,0 +1,153 @@
+// Copyright (c) 2018 The ExchangeCoin team
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EXCCoin/exccd/chaincfg"
+
+	"github.com/EXCCoin/gominer/stratum"
+	"github.com/EXCCoin/gominer/stratum/stratumtest"
+
+	"github.com/btcsuite/btclog"
+)
+
+// controlTimeout is how long the control API may take to answer a call in the
+// tests, which is well past the time a pool switch is given to start.
+const controlTimeout = 10 * time.Second
+
+// callControl calls method of the control API with params as the user of the
+// configuration and returns the response.
+func callControl(t *testing.T, method string, params ...interface{}) controlResponse {
+	t.Helper()
+	if params == nil {
+		params = []interface{}{}
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"method": method,
+		"params": params,
+		"id":     1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", "/control",
+		strings.NewReader(string(body)))
+	req.SetBasicAuth(cfg.APIUser, cfg.APIPassword)
+	rec := httptest.NewRecorder()
+
+	done := make(chan struct{})
+	go func() {
+		serveControl(rec, req)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(controlTimeout):
+		t.Fatalf("Control API call %s did not return", method)
+	}
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Control API call %s returned status %d", method,
+			rec.Code)
+	}
+	var resp controlResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// setControlMiner points the control API to a miner mining on pools for the
+// duration of the test.
+func setControlMiner(t *testing.T, pools *stratum.Failover) {
+	savedCfg, savedMiner := cfg, m
+	cfg = &config{APIUser: "user", APIPassword: "pass"}
+	m = &Miner{pools: pools}
+	t.Cleanup(func() { cfg, m = savedCfg, savedMiner })
+}
+
+func TestControlSwitchPoolAllDown(t *testing.T) {
+	var pools []stratum.PoolConfig
+	var servers []*stratumtest.Server
+	for i := 0; i < 2; i++ {
+		srv, err := stratumtest.NewServer(stratumtest.Config{
+			ChainParams: &chaincfg.SimNetParams,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Close()
+		servers = append(servers, srv)
+		pools = append(pools, stratum.PoolConfig{
+			URL:  srv.URL(),
+			User: "worker",
+			Pass: "x",
+		})
+	}
+	f, err := stratum.NewFailover(stratum.FailoverConfig{
+		Pools:         pools,
+		ChainParams:   &chaincfg.SimNetParams,
+		MaxReconnects: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Stop()
+	setControlMiner(t, f)
+
+	// With every pool down the pools are reconnected to forever, which
+	// must not hold the call.
+	pool := f.Pool()
+	for _, srv := range servers {
+		srv.Close()
+	}
+	select {
+	case <-pool.Done():
+	case <-time.After(controlTimeout):
+		t.Fatal("Connection to the closed pool not lost")
+	}
+
+	for i := range pools {
+		resp := callControl(t, "switchPool", i)
+		if resp.Error == nil {
+			t.Errorf("Switch to pool %d with every pool down "+
+				"succeeded", i)
+		}
+	}
+}
+
+func TestControlSetLogLevel(t *testing.T) {
+	setControlMiner(t, nil)
+	defer setLogLevels("off")
+	setLogLevels("info")
+
+	tests := []struct {
+		level string
+		ok    bool
+		minr  btclog.Level
+	}{
+		{"MINR=debug,BOGUS=trace", false, btclog.LevelInfo},
+		{"MINR=debug,POOL=loud", false, btclog.LevelInfo},
+		{"show", false, btclog.LevelInfo},
+		{"MINR=debug,POOL=trace", true, btclog.LevelDebug},
+		{"warn", true, btclog.LevelWarn},
+	}
+	for _, test := range tests {
+		resp := callControl(t, "setLogLevel", test.level)
+		if (resp.Error == nil) != test.ok {
+			t.Errorf("Level %q: got error %v, want ok %v", test.level,
+				resp.Error, test.ok)
+		}
+		if level := minrLog.Level(); level != test.minr {
+			t.Errorf("Level %q: MINR level %v, want %v", test.level,
+				level, test.minr)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2018 The ExchangeCoin team
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/EXCCoin/gominer/equihash"
+)
+
+// cpuSolver runs the pure Go Equihash solver.
+type cpuSolver struct {
+	threads int
+	solver  *equihash.Solver
+}
+
+// Init allocates the solver memory.
+func (s *cpuSolver) Init() error {
+	solver, err := equihash.NewSolver(activeNetParams.N,
+		activeNetParams.K, s.threads)
+	if err != nil {
+		return err
+	}
+	s.solver = solver
+	return nil
+}
+
+// Solve runs the solver over the header, which is interrupted between the
+// rounds of the algorithm once ctx is done.  The nonce is already serialized
+// in the header so it is not used.
+func (s *cpuSolver) Solve(ctx context.Context, header []byte, nonce uint32, found func(solution []byte)) error {
+	return s.solver.Solve(ctx, header, found)
+}
+
+// Release drops the solver so its memory can be reclaimed.
+func (s *cpuSolver) Release() {
+	s.solver = nil
+}
+
+// NewCPUDevice returns a device mining on the CPU with the given number of
+// threads.
+func NewCPUDevice(index int, threads int, workDone chan WorkResult) (*Device, error) {
+	if threads < 1 {
+		return nil, fmt.Errorf("invalid number of CPU threads %d", threads)
+	}
+
+	d := &Device{
+		index:      index,
+		deviceName: fmt.Sprintf("%d threads", threads),
+		deviceType: DeviceTypeCPU,
+		kind:       DeviceKindCPU,
+		solver:     &cpuSolver{threads: threads},
+		quit:       make(chan struct{}),
+		workReady:  make(chan struct{}, 1),
+		workDone:   workDone,
+	}
+
+	d.configureWorkSize(cfg)
+	d.started = uint32(time.Now().Unix())
+
+	return d, nil
+}
+
+// newCPUMinerDevs adds a single CPU device using all configured threads to m.
+func newCPUMinerDevs(m *Miner) (*Miner, int, error) {
+	newDevice, err := NewCPUDevice(0, cfg.CPUThreads, m.workDone)
+	if err != nil {
+		return nil, 0, err
+	}
+	m.devices = append(m.devices, newDevice)
+
+	return m, 1, nil
+}
@@ -0,0 +1,298 @@
+// Copyright (c) 2016 The Decred developers.
+// Copyright (c) 2018 The ExchangeCoin team
+
+//go:build !nocuda
+// +build !nocuda
+
+package main
+
+/*
+#cgo CXXFLAGS: -O3 -march=x86-64 -mtune=generic -Wall -Werror
+#cgo CFLAGS: -O3 -march=x86-64 -mtune=generic -Wall -Werror
+#cgo !windows LDFLAGS: -L. -leqcuda1445
+#cgo windows LDFLAGS: -L. -leqcuda1445
+#include "eqcuda1445/eqcuda1445.h"
+*/
+import "C"
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/EXCCoin/gominer/equihash"
+	"github.com/EXCCoin/gominer/nvml"
+
+	"github.com/EXCCoin/gominer/cu"
+	cptr "github.com/mattn/go-pointer"
+)
+
+// defaultBackend is the solver backend used unless --backend is given.
+const defaultBackend = BackendCUDA
+
+//export equihashProxyGominer
+func equihashProxyGominer(userData unsafe.Pointer, solution unsafe.Pointer) C.int {
+	solver := cptr.Restore(userData).(*cudaSolver)
+	csol := C.GoBytes(solution, C.int(equihash.SolutionSize(activeNetParams.N, activeNetParams.K)))
+	solver.found(csol)
+	return 0
+}
+
+var deviceLibraryInitialized = false
+
+// cudaSolver runs the eqcuda1445 solver on a CUDA device.
+type cudaSolver struct {
+	deviceID cu.Device
+	ptr      unsafe.Pointer
+	found    func(solution []byte)
+}
+
+// Init locks the calling goroutine to its OS thread and sets up the CUDA
+// device for it.
+func (s *cudaSolver) Init() error {
+	// Need to have this stuff here for a device vs thread issue.
+	runtime.LockOSThread()
+
+	cu.DeviceReset()
+	cu.SetDevice(s.deviceID)
+	cu.SetDeviceFlags(cu.DeviceScheduleBlockingSync)
+
+	// kernel is built with nvcc, not an api call so must be done
+	// at compile time.
+
+	s.ptr = cptr.Save(s)
+	return nil
+}
+
+// Solve executes the kernel, which reports each solution back through
+// equihashProxyGominer.  A kernel run cannot be interrupted, so ctx is only
+// checked before starting it.
+func (s *cudaSolver) Solve(ctx context.Context, header []byte, nonce uint32, found func(solution []byte)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.found = found
+	C.EquihashSolveCuda(unsafe.Pointer(&header[0]), C.uint32_t(len(header)), C.uint32_t(nonce), s.ptr)
+	return nil
+}
+
+// Release resets the CUDA device.
+func (s *cudaSolver) Release() {
+	if s.ptr != nil {
+		cptr.Unref(s.ptr)
+		s.ptr = nil
+	}
+	cu.SetDevice(s.deviceID)
+	cu.DeviceReset()
+}
+
+// listCUDADevices prints a list of CUDA capable GPUs present.
+func listCUDADevices() {
+	// CUDA devices
+	// Because mumux3/3/cuda/cu likes to panic instead of error.
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Println("No CUDA Capable GPUs present")
+		}
+	}()
+	devices, _ := getCUDevices()
+	for i, dev := range devices {
+		fmt.Printf("CUDA Capable GPU #%d: %s\n", i, dev.Name())
+	}
+}
+
+func NewCuDevice(index int, order int, deviceID cu.Device, workDone chan WorkResult) (*Device, error) {
+	d := &Device{
+		index:       index,
+		deviceName:  deviceID.Name(),
+		deviceType:  DeviceTypeGPU,
+		kind:        DeviceKindNVML,
+		solver:      &cudaSolver{deviceID: deviceID},
+		quit:        make(chan struct{}),
+		workReady:   make(chan struct{}, 1),
+		workDone:    workDone,
+		fanPercent:  0,
+		temperature: 0,
+		tempTarget:  0,
+	}
+
+	if !deviceLibraryInitialized {
+		err := nvml.Init()
+		if err != nil {
+			minrLog.Errorf("NVML Init error: %v", err)
+		} else {
+			deviceLibraryInitialized = true
+		}
+	}
+	fanPercent, temperature := deviceStats(d.index)
+	// Newer cards will idle with the fan off so just check if we got
+	// a good temperature reading
+	if temperature != 0 {
+		atomic.StoreUint32(&d.fanPercent, fanPercent)
+		atomic.StoreUint32(&d.temperature, temperature)
+		d.fanTempActive = true
+	}
+
+	// Check if temperature target is specified
+	if len(cfg.TempTargetInts) > 0 {
+		// Apply the first setting as a global setting
+		d.tempTarget = cfg.TempTargetInts[0]
+
+		// Override with the per-device setting if it exists
+		for i := range cfg.TempTargetInts {
+			if i == order {
+				d.tempTarget = uint32(cfg.TempTargetInts[order])
+			}
+		}
+		d.fanControlActive = true
+	}
+
+	// validate that we can actually do fan control
+	fanControlNotWorking := false
+	if d.tempTarget > 0 {
+		// validate that fan control is supported
+		if !d.fanControlSupported(d.kind) {
+			return nil, fmt.Errorf("temperature target of %v for device #%v; "+
+				"fan control is not supported on device kind %v", d.tempTarget,
+				index, d.kind)
+		}
+		if !d.fanTempActive {
+			minrLog.Errorf("DEV #%d ignoring temperature target of %v; "+
+				"could not get initial %v read", index, d.tempTarget, d.kind)
+			fanControlNotWorking = true
+		}
+		if fanControlNotWorking {
+			d.tempTarget = 0
+			d.fanControlActive = false
+		}
+	}
+
+	d.order = order
+	d.configureWorkSize(cfg)
+	d.started = uint32(time.Now().Unix())
+
+	return d, nil
+}
+
+func deviceStats(index int) (uint32, uint32) {
+	fanPercent := uint32(0)
+	temperature := uint32(0)
+
+	dh, err := nvml.DeviceGetHandleByIndex(index)
+	if err != nil {
+		minrLog.Errorf("NVML DeviceGetHandleByIndex error: %v", err)
+		return fanPercent, temperature
+	}
+
+	nvmlFanSpeed, err := nvml.DeviceFanSpeed(dh)
+	if err != nil {
+		minrLog.Debugf("NVML DeviceFanSpeed error: %v", err)
+	} else {
+		fanPercent = uint32(nvmlFanSpeed)
+	}
+
+	nvmlTemp, err := nvml.DeviceTemperature(dh)
+	if err != nil {
+		minrLog.Debugf("NVML DeviceTemperature error: %v", err)
+	} else {
+		temperature = uint32(nvmlTemp)
+	}
+
+	return fanPercent, temperature
+}
+
+// unsupported -- just here for compilation
+func fanControlSet(index int, fanCur uint32, tempTargetType string, fanChangeLevel string) {
+	minrLog.Errorf("NVML fanControl() reached but shouldn't have been")
+}
+
+func getInfo() ([]cu.Device, error) {
+	cu.Init(0)
+	ids := cu.DeviceGetCount()
+	minrLog.Infof("%v GPUs", ids)
+	var CUdevices []cu.Device
+	for i := 0; i < ids; i++ {
+		dev := cu.DeviceGet(i)
+		CUdevices = append(CUdevices, dev)
+		minrLog.Infof("%v: %v", i, dev.Name())
+	}
+	return CUdevices, nil
+}
+
+// getCUDevices returns the list of devices for the given platform.
+func getCUDevices() ([]cu.Device, error) {
+	cu.Init(0)
+
+	version := cu.Version()
+	fmt.Println(version)
+
+	maj := version / 1000
+	min := version % 100
+
+	minMajor := 5
+	minMinor := 5
+
+	if maj < minMajor || (maj == minMajor && min < minMinor) {
+		return nil, fmt.Errorf("Driver does not support CUDA %v.%v API", minMajor, minMinor)
+	}
+
+	var numDevices int
+	numDevices = cu.DeviceGetCount()
+	if numDevices < 1 {
+		return nil, fmt.Errorf("No devices found")
+	}
+	devices := make([]cu.Device, numDevices)
+	for i := 0; i < numDevices; i++ {
+		dev := cu.DeviceGet(i)
+		devices[i] = dev
+	}
+	return devices, nil
+}
+
+// newCUDAMinerDevs adds a Device for every allowed CUDA capable GPU to m.
+func newCUDAMinerDevs(m *Miner) (*Miner, int, error) {
+	deviceListIndex := 0
+	deviceListEnabledCount := 0
+
+	CUdeviceIDs, err := getInfo()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// XXX Can probably combine these bits with the opencl ones once
+	// I decide what to do about the types.
+
+	for _, CUDeviceID := range CUdeviceIDs {
+		miningAllowed := false
+
+		// Enforce device restrictions if they exist
+		if len(cfg.DeviceIDs) > 0 {
+			for _, i := range cfg.DeviceIDs {
+				if deviceListIndex == i {
+					miningAllowed = true
+				}
+			}
+		} else {
+			miningAllowed = true
+		}
+
+		if miningAllowed {
+			newDevice, err := NewCuDevice(deviceListIndex, deviceListEnabledCount, CUDeviceID, m.workDone)
+			deviceListEnabledCount++
+			m.devices = append(m.devices, newDevice)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		deviceListIndex++
+	}
+
+	return m, deviceListEnabledCount, nil
+}
+
+// Return the GPU library in use.
+func gpuLib() string {
+	return "CUDA"
+}
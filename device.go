@@ -2,46 +2,23 @@
 
 package main
 
-/*
-#cgo CXXFLAGS: -O3 -march=x86-64 -mtune=generic -Wall -Werror
-#cgo CFLAGS: -O3 -march=x86-64 -mtune=generic -Wall -Werror
-#cgo !windows LDFLAGS: -L. -leqcuda1445
-#cgo windows LDFLAGS: -L. -leqcuda1445
-#include "eqcuda1445/eqcuda1445.h"
-*/
-import "C"
 import (
 	"bytes"
-	"encoding/binary"
+	"context"
 	"fmt"
 	"runtime"
 	"sync"
 	"sync/atomic"
 	"time"
-	"unsafe"
 
 	"github.com/EXCCoin/exccd/blockchain"
-	"github.com/EXCCoin/exccd/chaincfg"
-	"github.com/EXCCoin/exccd/wire"
 
-	"github.com/EXCCoin/gominer/nvml"
+	"github.com/EXCCoin/gominer/equihash"
+	"github.com/EXCCoin/gominer/stratum"
 	"github.com/EXCCoin/gominer/util"
 	"github.com/EXCCoin/gominer/work"
-
-	"github.com/EXCCoin/gominer/cu"
-	cptr "github.com/mattn/go-pointer"
 )
 
-//export equihashProxyGominer
-func equihashProxyGominer(userData unsafe.Pointer, solution unsafe.Pointer) C.int {
-	device := cptr.Restore(userData).(*Device)
-	csol := C.GoBytes(solution, C.int(equihashSolutionSize(chaincfg.MainNetParams.N, chaincfg.MainNetParams.K)))
-	device.handleEquihashSolution(csol)
-	return 0
-}
-
-var deviceLibraryInitialized = false
-
 // Constants for fan and temperature bits
 const (
 	ChangeLevelNone           = "None"
@@ -50,7 +27,9 @@ const (
 	DeviceKindAMDGPU          = "AMDGPU"
 	DeviceKindADL             = "ADL"
 	DeviceKindNVML            = "NVML"
+	DeviceKindCPU             = "CPU"
 	DeviceTypeGPU             = "GPU"
+	DeviceTypeCPU             = "CPU"
 	FanControlHysteresis      = uint32(3)
 	FanControlAdjustmentLarge = uint32(10)
 	FanControlAdjustmentSmall = uint32(5)
@@ -63,12 +42,25 @@ const (
 
 type Device struct {
 	// The following variables must only be used atomically.
-	fanPercent  uint32
-	temperature uint32
+	fanPercent       uint32
+	temperature      uint32
+	hwErrors         uint64
+	allDiffOneShares uint64
+
+	// workSwitches counts the times the device switched to new work,
+	// which took switchLatency nanoseconds altogether since the work was
+	// received and lastSwitchLatency the last time.
+	workSwitches      uint64
+	switchLatency     uint64
+	lastSwitchLatency int64
+
+	// preempt is set when clean work is pending, to stop the current
+	// iteration.  It is only set and cleared with workMtx held.
+	preempt uint32
 
 	sync.Mutex
-	index int
-	cuda  bool
+	index  int
+	solver Solver
 
 	deviceName               string
 	deviceType               string
@@ -79,33 +71,73 @@ type Device struct {
 	kind                     string
 	tempTarget               uint32
 
-	// Items for CUDA device
-	cuDeviceID     cu.Device
-	cuInSize       int64
-	cuOutputBuffer []float64
-
-	workSize uint32
-
-	// extraNonce is the device extraNonce, where the first
-	// byte is the device ID (supporting up to 255 devices)
-	// while the last 3 bytes is the extraNonce value. If
-	// the extraNonce goes through all 0x??FFFFFF values,
-	// it will reset to 0x??000000.
-	extraNonce    uint32
-	currentWorkID uint32
+	// order is the position of the device among the selected devices,
+	// which picks its entry of the per device settings.
+	order int
+
+	// workSize is the number of solver runs, each on a new nonce, done
+	// per iteration before checking for new work.  When calibrationTarget
+	// is set it is adjusted after every iteration to keep the iteration
+	// time close to the target.
+	workSize          uint32
+	calibrationTarget time.Duration
+
+	// The extranonce2 space of the work is split in partitions equal
+	// ranges, one per device, so that devices never mine the same work.
+	// extraNonce2 counts the values of the range of the device used so
+	// far and extraNonce2Range is the size of the ranges for the current
+	// work.
+	partition        int
+	partitions       int
+	extraNonce2      uint64
+	extraNonce2Range uint64
+	currentWorkID    uint32
 
 	midstate  [8]uint32
 	lastBlock [16]uint32
 
+	// equihashInput is the input passed to the solver for the current
+	// run, which solutions are verified against before submission.
+	equihashInput []byte
+
 	work     work.Work
-	newWork  chan *work.Work
 	workDone chan WorkResult
 	hasWork  bool
 
-	started          uint32
-	allDiffOneShares uint64
-	validShares      uint64
-	invalidShares    uint64
+	// pendingWork is the latest work set for the device which it did not
+	// switch to yet, newer work replacing it rather than being queued
+	// behind it, with pendingSince being when the first work it replaced
+	// was received.  workReady is signalled whenever it is set.
+	workMtx      sync.Mutex
+	pendingWork  *work.Work
+	pendingSince time.Time
+	workReady    chan struct{}
+
+	// reloadedCfg is the config reloaded since the last iteration, which
+	// the device applies before the next one.  It is protected by workMtx.
+	reloadedCfg *config
+
+	// cancelRun interrupts the current solver run, when stopping or when
+	// clean work preempts it.  It is protected by workMtx.
+	cancelRun context.CancelFunc
+
+	// nonce counts the nonces used so far within the nonceRange nonces of
+	// the partition of the device, which keeps devices from solving the
+	// same headers even when the extranonce2 is too small to split.
+	nonce      uint64
+	nonceRange uint64
+
+	started       uint32
+	validShares   uint64
+	invalidShares uint64
+
+	// paused holds the reasons the device is paused for, with resume
+	// being closed once none is left.  They are protected by pauseMtx
+	// rather than the device mutex, which is held while handing solutions
+	// to the miner.
+	pauseMtx sync.Mutex
+	paused   pauseReason
+	resume   chan struct{}
 
 	quit chan struct{}
 }
@@ -117,15 +149,252 @@ func (d *Device) Run() {
 	}
 }
 
+// Stop stops the device, interrupting its current solver run.
 func (d *Device) Stop() {
 	close(d.quit)
+	d.workMtx.Lock()
+	if d.cancelRun != nil {
+		d.cancelRun()
+	}
+	d.workMtx.Unlock()
 }
 
+// SetWork hands new work to the device, replacing any work it did not switch
+// to yet.  The device switches to it once its current iteration finishes, or
+// right away for clean work, which preempts the current iteration and
+// interrupts its solver run.
 func (d *Device) SetWork(w *work.Work) {
-	d.newWork <- w
+	d.workMtx.Lock()
+	if d.pendingWork == nil {
+		d.pendingSince = w.Received
+	}
+	d.pendingWork = w
+	if w.Clean {
+		atomic.StoreUint32(&d.preempt, 1)
+		if d.cancelRun != nil {
+			d.cancelRun()
+		}
+	}
+	d.workMtx.Unlock()
+
+	select {
+	case d.workReady <- struct{}{}:
+	default:
+	}
+}
+
+// hasPendingWork returns whether there is work the device did not switch to
+// yet.
+func (d *Device) hasPendingWork() bool {
+	d.workMtx.Lock()
+	defer d.workMtx.Unlock()
+	return d.pendingWork != nil
+}
+
+// takeWork returns the pending work, or nil if there is none, along with
+// when the first work it replaced was received, and clears it along with any
+// preemption for it.
+func (d *Device) takeWork() (*work.Work, time.Time) {
+	d.workMtx.Lock()
+	defer d.workMtx.Unlock()
+	w, since := d.pendingWork, d.pendingSince
+	d.pendingWork = nil
+	atomic.StoreUint32(&d.preempt, 0)
+	return w, since
+}
+
+// startRun returns the context of a new solver run, which is done right away
+// when the device is stopping or preempted already.
+func (d *Device) startRun() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	d.workMtx.Lock()
+	d.cancelRun = cancel
+	preempted := atomic.LoadUint32(&d.preempt) != 0
+	d.workMtx.Unlock()
+
+	select {
+	case <-d.quit:
+		cancel()
+	default:
+	}
+	if preempted {
+		cancel()
+	}
+	return ctx
+}
+
+// endRun releases the context of the solver run which just ended.
+func (d *Device) endRun() {
+	d.workMtx.Lock()
+	cancel := d.cancelRun
+	d.cancelRun = nil
+	d.workMtx.Unlock()
+	cancel()
+}
+
+// Reload hands the device a reloaded config, which it takes its work size
+// settings from once its current iteration finishes.
+func (d *Device) Reload(c *config) {
+	d.workMtx.Lock()
+	d.reloadedCfg = c
+	d.workMtx.Unlock()
+}
+
+// applyReloadedConfig applies the config reloaded since the last iteration,
+// if any.
+func (d *Device) applyReloadedConfig() {
+	d.workMtx.Lock()
+	c := d.reloadedCfg
+	d.reloadedCfg = nil
+	d.workMtx.Unlock()
+	if c == nil {
+		return
+	}
+
+	workSize, calibrationTarget := d.workSize, d.calibrationTarget
+	d.configureWorkSize(c)
+	switch {
+	case d.calibrationTarget == 0 && d.workSize != workSize:
+		minrLog.Infof("DEV #%d: Work size set to %d", d.index,
+			d.workSize)
+	case d.calibrationTarget != calibrationTarget:
+		minrLog.Infof("DEV #%d: Autocalibrating work size towards %v",
+			d.index, d.calibrationTarget)
+	case d.calibrationTarget != 0:
+		// Keep the calibrated work size when the target did not
+		// change.
+		d.workSize = workSize
+	}
+}
+
+// WorkSwitchLatency returns the average and last time the device took to
+// switch to new work since it was received, and how many times it switched.
+func (d *Device) WorkSwitchLatency() (time.Duration, time.Duration, uint64) {
+	switches := atomic.LoadUint64(&d.workSwitches)
+	if switches == 0 {
+		return 0, 0, 0
+	}
+	total := atomic.LoadUint64(&d.switchLatency)
+	last := atomic.LoadInt64(&d.lastSwitchLatency)
+	return time.Duration(total / switches), time.Duration(last), switches
+}
+
+// pauseReason is a set of reasons for a device to pause mining.
+type pauseReason uint8
+
+const (
+	// pauseUser is set while paused through the control API.
+	pauseUser pauseReason = 1 << iota
+
+	// pauseNoPool is set while the pool is unavailable, so that no time
+	// is spent on outdated work.
+	pauseNoPool
+)
+
+// pause pauses the device for reason.  It returns false if it was already
+// paused for it.
+func (d *Device) pause(reason pauseReason) bool {
+	d.pauseMtx.Lock()
+	defer d.pauseMtx.Unlock()
+	if d.paused&reason != 0 {
+		return false
+	}
+	if d.paused == 0 {
+		d.resume = make(chan struct{})
+	}
+	d.paused |= reason
+	return true
 }
 
-func (d *Device) PrintStats() {
+// unpause clears reason for the device to be paused, resuming it once there
+// is none left.  It returns false if it was not paused for reason.
+func (d *Device) unpause(reason pauseReason) bool {
+	d.pauseMtx.Lock()
+	defer d.pauseMtx.Unlock()
+	if d.paused&reason == 0 {
+		return false
+	}
+	d.paused &^= reason
+	if d.paused == 0 {
+		close(d.resume)
+		d.resume = nil
+	}
+	return true
+}
+
+// pausedFor returns the reasons the device is paused for.
+func (d *Device) pausedFor() pauseReason {
+	d.pauseMtx.Lock()
+	defer d.pauseMtx.Unlock()
+	return d.paused
+}
+
+// Pause stops the device from mining once its current solver run finishes,
+// until Resume is called.  It returns false if the device was already paused.
+func (d *Device) Pause() bool {
+	return d.pause(pauseUser)
+}
+
+// Resume resumes mining on a paused device.  It returns false if the device
+// was not paused.
+func (d *Device) Resume() bool {
+	return d.unpause(pauseUser)
+}
+
+// Paused returns whether the device was paused with Pause.
+func (d *Device) Paused() bool {
+	return d.pausedFor()&pauseUser != 0
+}
+
+// SetIdle makes the device idle while the pool is unavailable, or lets it
+// mine again.
+func (d *Device) SetIdle(idle bool) {
+	if idle {
+		d.pause(pauseNoPool)
+	} else {
+		d.unpause(pauseNoPool)
+	}
+}
+
+// Idle returns whether the device is idle because the pool is unavailable.
+func (d *Device) Idle() bool {
+	return d.pausedFor()&pauseNoPool != 0
+}
+
+// waitResume blocks while the device is paused, keeping up with new work so
+// that mining resumes on the latest job.  It returns false if the device was
+// stopped in the meantime.
+func (d *Device) waitResume() bool {
+	d.pauseMtx.Lock()
+	resume, paused := d.resume, d.paused
+	d.pauseMtx.Unlock()
+	if resume == nil {
+		return true
+	}
+
+	if paused&pauseUser != 0 {
+		minrLog.Infof("DEV #%d Paused", d.index)
+	} else {
+		minrLog.Infof("DEV #%d Idle until the pool is available", d.index)
+	}
+	for {
+		select {
+		case <-resume:
+			minrLog.Infof("DEV #%d Resumed", d.index)
+			return true
+		case <-d.workReady:
+			if w, since := d.takeWork(); w != nil {
+				d.switchWork(w, since)
+			}
+		case <-d.quit:
+			return false
+		}
+	}
+}
+
+// PrintStats logs the statistics of the device, including its effective hash
+// rate from the shares accepted by pools when shares is not nil.
+func (d *Device) PrintStats(shares *stratum.ShareStats) {
 	secondsElapsed := uint32(time.Now().Unix()) - d.started
 	if secondsElapsed == 0 {
 		return
@@ -135,7 +404,12 @@ func (d *Device) PrintStats() {
 	defer d.Unlock()
 
 	averageHashRate, fanPercent, temperature := d.Status()
-	log := fmt.Sprintf("DEV #%d (%s) (%v) (allDiffOneShares=%d)", d.index, d.deviceName, util.FormatHashRate(averageHashRate), d.allDiffOneShares)
+	log := fmt.Sprintf("DEV #%d (%s) (%v) (allDiffOneShares=%d)", d.index, d.deviceName, util.FormatHashRate(averageHashRate), atomic.LoadUint64(&d.allDiffOneShares))
+
+	if shares != nil {
+		log = fmt.Sprintf("%s (Effective=%v)", log,
+			util.FormatHashRate(shares.DeviceEffectiveHashRate(d.index)))
+	}
 
 	if fanPercent != 0 {
 		log = fmt.Sprintf("%s (Fan=%v%%)", log, fanPercent)
@@ -145,6 +419,15 @@ func (d *Device) PrintStats() {
 		log = fmt.Sprintf("%s (T=%vC)", log, temperature)
 	}
 
+	if hwErrors := atomic.LoadUint64(&d.hwErrors); hwErrors != 0 {
+		log = fmt.Sprintf("%s (HW=%d)", log, hwErrors)
+	}
+
+	if avg, last, switches := d.WorkSwitchLatency(); switches != 0 {
+		log = fmt.Sprintf("%s (Switch=%v avg, %v last)", log,
+			avg.Round(time.Millisecond), last.Round(time.Millisecond))
+	}
+
 	minrLog.Info(log)
 }
 
@@ -169,7 +452,8 @@ func (d *Device) UpdateFanTemp() {
 func (d *Device) Status() (float64, uint32, uint32) {
 	secondsElapsed := uint32(time.Now().Unix()) - d.started
 
-	averageHashRate := float64(d.allDiffOneShares) / float64(secondsElapsed)
+	averageHashRate := float64(atomic.LoadUint64(&d.allDiffOneShares)) /
+		float64(secondsElapsed)
 
 	fanPercent := atomic.LoadUint32(&d.fanPercent)
 	temperature := atomic.LoadUint32(&d.temperature)
@@ -178,12 +462,11 @@ func (d *Device) Status() (float64, uint32, uint32) {
 }
 
 func (d *Device) Release() {
-	cu.SetDevice(d.cuDeviceID)
-	cu.DeviceReset()
+	d.solver.Release()
 }
 
 func (d *Device) handleEquihashSolution(solution []byte) {
-	minrLog.Tracef("GPU #%d: Found candidate: %08x, workID %08x, timestamp %08x",
+	minrLog.Tracef("DEV #%d: Found candidate: %08x, workID %08x, timestamp %08x",
 		d.index, solution, util.Uint32EndiannessSwap(d.currentWorkID), d.lastBlock[work.TimestampWord])
 
 	// Assess the work. If it's below target, it'll be rejected
@@ -193,24 +476,48 @@ func (d *Device) handleEquihashSolution(solution []byte) {
 }
 
 func (d *Device) updateCurrentWork() {
-	var w *work.Work
-	if d.hasWork {
-		// If we already have work, we just need to check if there's new one without blocking if there's not.
-		select {
-		case w = <-d.newWork:
-		default:
+	// If we already have work, we just need to check if there's new one
+	// without blocking if there's not.  If we don't have work, we block
+	// until we do.  We need to watch for quit events too.
+	w, since := d.takeWork()
+	for w == nil {
+		if d.hasWork {
 			return
 		}
-	} else {
-		// If we don't have work, we block until we do. We need to watch for quit events too.
 		select {
-		case w = <-d.newWork:
+		case <-d.workReady:
+			w, since = d.takeWork()
 		case <-d.quit:
 			return
 		}
 	}
+	d.switchWork(w, since)
+}
 
+// switchWork makes w the current work of the device, the switch latency being
+// measured from since, when the first work newer than the current one was
+// received.
+func (d *Device) switchWork(w *work.Work, since time.Time) {
 	d.work = *w
+	if !since.IsZero() {
+		latency := time.Since(since)
+		atomic.AddUint64(&d.workSwitches, 1)
+		atomic.AddUint64(&d.switchLatency, uint64(latency))
+		atomic.StoreInt64(&d.lastSwitchLatency, int64(latency))
+		minrLog.Tracef("DEV #%d: Switched to job %v after %v", d.index,
+			w.JobID, latency)
+	}
+
+	// Warn once when the pool leaves too little extranonce2 for every
+	// device to get a range of its own.
+	extraNonce2Range := util.ExtraNonce2Range(d.work.ExtraNonce2Size,
+		d.partitions)
+	if extraNonce2Range == 0 && (d.extraNonce2Range != 0 || !d.hasWork) {
+		minrLog.Warnf("DEV #%d: Extranonce2 of %d bytes too small to "+
+			"split among %d devices, only the nonce is split",
+			d.index, d.work.ExtraNonce2Size, d.partitions)
+	}
+	d.extraNonce2Range = extraNonce2Range
 
 	// Bump and set the work ID if the work is new.
 	d.currentWorkID++
@@ -387,13 +694,24 @@ func (d *Device) foundCandidate(ts uint32, solution []byte) {
 	d.Lock()
 	defer d.Unlock()
 
+	// Verify the solution on the host so that broken solutions from
+	// faulty hardware or solvers are never sent to the pool or daemon.
+	err := equihash.Verify(activeNetParams.N, activeNetParams.K,
+		d.equihashInput, solution)
+	if err != nil {
+		atomic.AddUint64(&d.hwErrors, 1)
+		minrLog.Errorf("DEV #%d Discarding invalid solution %x: %v",
+			d.index, solution, err)
+		return
+	}
+
 	// Construct the final block header.
 	copy(d.work.BlockHeader.EquihashSolution[:], solution)
 
 	hashNum := d.work.BlockHeader.BlockHash()
 	hashNumBig := blockchain.HashToBig(&hashNum)
 
-	d.allDiffOneShares++
+	atomic.AddUint64(&d.allDiffOneShares, 1)
 
 	if !cfg.Benchmark {
 		// Assess versus the pool or daemon target.
@@ -410,40 +728,93 @@ func (d *Device) foundCandidate(ts uint32, solution []byte) {
 				minrLog.Errorf("Error submitting work: %v", errStr)
 			} else {
 				result := WorkResult{
-					data:  data[:work.GetworkDataLen],
-					jobID: d.work.JobID,
+					data:   data[:work.GetworkDataLen],
+					jobID:  d.work.JobID,
+					device: d.index,
 				}
 
-				d.workDone <- result
+				// Never wait for the submission queue since
+				// this runs from the solver callback.
+				select {
+				case d.workDone <- result:
+				default:
+					minrLog.Errorf("DEV #%d Submission queue "+
+						"full, dropping solution for job %v",
+						d.index, result.jobID)
+				}
 			}
 		}
 	}
 }
 
-func (d *Device) runDevice() error {
-	// Bump the extraNonce for the device it's running on
-	// when you begin mining. This ensures each GPU is doing
-	// different work. If the extraNonce has already been
-	// set for valid work, restore that.
-	d.extraNonce += uint32(d.index) << 24
-	d.lastBlock[work.Nonce1Word] = util.Uint32EndiannessSwap(d.extraNonce)
+// configureWorkSize sets the work size of the device from the --worksize or
+// --intensity setting of c for it, or enables autocalibration towards the
+// --autocalibrate time target when neither is given.  The first setting of a
+// list is applied to devices without a setting of their own.
+func (d *Device) configureWorkSize(c *config) {
+	order := d.order
+	d.calibrationTarget = 0
+	switch {
+	case len(c.WorkSizeInts) > 0:
+		d.workSize = c.WorkSizeInts[0]
+		if order < len(c.WorkSizeInts) {
+			d.workSize = c.WorkSizeInts[order]
+		}
 
-	// Need to have this stuff here for a device vs thread issue.
-	runtime.LockOSThread()
+	case len(c.IntensityInts) > 0:
+		intensity := c.IntensityInts[0]
+		if order < len(c.IntensityInts) {
+			intensity = c.IntensityInts[order]
+		}
+		d.workSize = 1 << uint(intensity-minIntensity)
+
+	default:
+		target := c.AutocalibrateInts[0]
+		if order < len(c.AutocalibrateInts) {
+			target = c.AutocalibrateInts[order]
+		}
+		d.workSize = 1
+		d.calibrationTarget = time.Duration(target) * time.Millisecond
+	}
+}
 
-	cu.DeviceReset()
-	cu.SetDevice(d.cuDeviceID)
-	cu.SetDeviceFlags(cu.DeviceScheduleBlockingSync)
+// calibrate adjusts the work size so that an iteration takes about as long as
+// the calibration target, given that the last one took elapsed.
+func (d *Device) calibrate(elapsed time.Duration) {
+	perRun := elapsed / time.Duration(d.workSize)
+	if perRun <= 0 {
+		return
+	}
 
-	// kernel is built with nvcc, not an api call so must be done
-	// at compile time.
+	workSize := uint64(d.calibrationTarget / perRun)
+	if workSize < 1 {
+		workSize = 1
+	}
+	if workSize > uint64(maxWorkSize) {
+		workSize = uint64(maxWorkSize)
+	}
+	if uint32(workSize) != d.workSize {
+		minrLog.Debugf("DEV #%d: Autocalibrated work size from %d to %d "+
+			"(%v per run, target %v)", d.index, d.workSize, workSize,
+			perRun, d.calibrationTarget)
+		d.workSize = uint32(workSize)
+	}
+}
 
-	deviceptr := cptr.Save(d)
-	defer cptr.Unref(deviceptr)
+func (d *Device) runDevice() error {
+	err := d.solver.Init()
+	if err != nil {
+		return err
+	}
 
-	minrLog.Infof("Started GPU #%d: %s", d.index, d.deviceName)
+	minrLog.Infof("Started %s #%d: %s", d.deviceType, d.index, d.deviceName)
 
 	for {
+		if !d.waitResume() {
+			return nil
+		}
+
+		d.applyReloadedConfig()
 		d.updateCurrentWork()
 
 		select {
@@ -452,10 +823,10 @@ func (d *Device) runDevice() error {
 		default:
 		}
 
-		// Increment extraNonce.
-		util.RolloverExtraNonce(&d.extraNonce)
-		d.lastBlock[work.Nonce1Word] = util.Uint32EndiannessSwap(d.extraNonce)
-		binary.LittleEndian.PutUint64(d.work.BlockHeader.ExtraData[:], uint64(d.extraNonce))
+		// Roll the extranonce2 within the range of the device.
+		d.extraNonce2++
+		util.PutExtraNonce2(d.work.ExtraNonce2(), d.partition,
+			d.extraNonce2Range, d.extraNonce2)
 
 		// Update the timestamp. Only solo work allows you to roll the timestamp.
 		ts := d.work.JobTime
@@ -465,243 +836,75 @@ func (d *Device) runDevice() error {
 		}
 		d.lastBlock[work.TimestampWord] = util.Uint32EndiannessSwap(ts)
 
-		// Generate and set nonce
-		nonce, err := wire.RandomUint64()
-		if err != nil {
-			minrLog.Errorf("Unexpected error while generating random nonce: %v", err)
-			nonce = 0
-		}
-
-		d.work.BlockHeader.Nonce = uint32(nonce) // TODO
-
-		// Execute the kernel and follow its execution time.
+		// Execute the kernel workSize times and follow the execution
+		// time.
 		currentTime := time.Now()
+		algo := activeNetParams.Algorithm(d.work.BlockHeader.Height)
+		runs := uint32(0)
+		for ; runs < d.workSize; runs++ {
+			select {
+			case <-d.quit:
+				return nil
+			default:
+			}
+			// New work ends the iteration for the device to switch
+			// to it before the next run, clean work having
+			// interrupted the current run already.
+			if d.pausedFor() != 0 || d.hasPendingWork() {
+				break
+			}
 
-		algo := chaincfg.TestNetParams.Algorithm(d.work.BlockHeader.Height)
-		equihashInput, err := d.work.BlockHeader.SerializeEquihashHeaderBytes(algo)
-		if err != nil {
-			continue
-		}
-
-		minrLog.Tracef("EquihashSolveCuda(workId=%d, blockHeight=%d, nonce=%d, extraNonce=%d)", d.currentWorkID, d.work.BlockHeader.Height, d.work.BlockHeader.Nonce, d.extraNonce)
-		C.EquihashSolveCuda(unsafe.Pointer(&equihashInput[0]), C.uint32_t(len(equihashInput)), C.uint32_t(d.work.BlockHeader.Nonce), deviceptr)
-
-		elapsedTime := time.Since(currentTime)
-		minrLog.Tracef("GPU #%d: Kernel execution to read time: %v", d.index, elapsedTime)
-	}
-}
+			// Use the next nonce of the range of the device.
+			d.nonce++
+			d.work.BlockHeader.Nonce = uint32(uint64(d.partition)*
+				d.nonceRange + d.nonce%d.nonceRange)
 
-// ListDevices prints a list of CUDA capable GPUs present.
-func ListDevices() {
-	// CUDA devices
-	// Because mumux3/3/cuda/cu likes to panic instead of error.
-	defer func() {
-		if r := recover(); r != nil {
-			fmt.Println("No CUDA Capable GPUs present")
-		}
-	}()
-	devices, _ := getCUDevices()
-	for i, dev := range devices {
-		fmt.Printf("CUDA Capable GPU #%d: %s\n", i, dev.Name())
-	}
-}
-
-func NewCuDevice(index int, order int, deviceID cu.Device, workDone chan WorkResult) (*Device, error) {
-	d := &Device{
-		index:       index,
-		cuDeviceID:  deviceID,
-		deviceName:  deviceID.Name(),
-		deviceType:  DeviceTypeGPU,
-		cuda:        true,
-		kind:        DeviceKindNVML,
-		quit:        make(chan struct{}),
-		newWork:     make(chan *work.Work, 5),
-		workDone:    workDone,
-		fanPercent:  0,
-		temperature: 0,
-		tempTarget:  0,
-	}
-
-	d.cuInSize = 21
-
-	if !deviceLibraryInitialized {
-		err := nvml.Init()
-		if err != nil {
-			minrLog.Errorf("NVML Init error: %v", err)
-		} else {
-			deviceLibraryInitialized = true
-		}
-	}
-	fanPercent, temperature := deviceStats(d.index)
-	// Newer cards will idle with the fan off so just check if we got
-	// a good temperature reading
-	if temperature != 0 {
-		atomic.StoreUint32(&d.fanPercent, fanPercent)
-		atomic.StoreUint32(&d.temperature, temperature)
-		d.fanTempActive = true
-	}
+			equihashInput, err := d.work.BlockHeader.SerializeEquihashHeaderBytes(algo)
+			if err != nil {
+				atomic.AddUint64(&d.hwErrors, 1)
+				minrLog.Errorf("DEV #%d: Unable to serialize the "+
+					"equihash input of job %v: %v", d.index,
+					d.work.JobID, err)
+				break
+			}
 
-	// Check if temperature target is specified
-	if len(cfg.TempTargetInts) > 0 {
-		// Apply the first setting as a global setting
-		d.tempTarget = cfg.TempTargetInts[0]
+			d.equihashInput = equihashInput
 
-		// Override with the per-device setting if it exists
-		for i := range cfg.TempTargetInts {
-			if i == order {
-				d.tempTarget = uint32(cfg.TempTargetInts[order])
+			minrLog.Tracef("Solve(workId=%d, blockHeight=%d, nonce=%d, extraNonce2=%x)", d.currentWorkID, d.work.BlockHeader.Height, d.work.BlockHeader.Nonce, d.work.ExtraNonce2())
+			ctx := d.startRun()
+			err = d.solver.Solve(ctx, equihashInput,
+				d.work.BlockHeader.Nonce, d.handleEquihashSolution)
+			d.endRun()
+			if err == context.Canceled {
+				// Stopped or preempted by clean work.
+				break
+			}
+			if err != nil {
+				return err
 			}
 		}
-		d.fanControlActive = true
-	}
-
-	// validate that we can actually do fan control
-	fanControlNotWorking := false
-	if d.tempTarget > 0 {
-		// validate that fan control is supported
-		if !d.fanControlSupported(d.kind) {
-			return nil, fmt.Errorf("temperature target of %v for device #%v; "+
-				"fan control is not supported on device kind %v", d.tempTarget,
-				index, d.kind)
-		}
-		if !d.fanTempActive {
-			minrLog.Errorf("DEV #%d ignoring temperature target of %v; "+
-				"could not get initial %v read", index, d.tempTarget, d.kind)
-			fanControlNotWorking = true
-		}
-		if fanControlNotWorking {
-			d.tempTarget = 0
-			d.fanControlActive = false
-		}
-	}
-
-	d.started = uint32(time.Now().Unix())
-
-	// Autocalibrate?
 
-	return d, nil
-}
-
-func equihashSolutionSize(n, k int) int {
-	return 1 << uint32(k) * (n/(k+1) + 1) / 8
-}
-
-func deviceStats(index int) (uint32, uint32) {
-	fanPercent := uint32(0)
-	temperature := uint32(0)
-
-	dh, err := nvml.DeviceGetHandleByIndex(index)
-	if err != nil {
-		minrLog.Errorf("NVML DeviceGetHandleByIndex error: %v", err)
-		return fanPercent, temperature
-	}
-
-	nvmlFanSpeed, err := nvml.DeviceFanSpeed(dh)
-	if err != nil {
-		minrLog.Debugf("NVML DeviceFanSpeed error: %v", err)
-	} else {
-		fanPercent = uint32(nvmlFanSpeed)
-	}
-
-	nvmlTemp, err := nvml.DeviceTemperature(dh)
-	if err != nil {
-		minrLog.Debugf("NVML DeviceTemperature error: %v", err)
-	} else {
-		temperature = uint32(nvmlTemp)
-	}
-
-	return fanPercent, temperature
-}
-
-// unsupported -- just here for compilation
-func fanControlSet(index int, fanCur uint32, tempTargetType string, fanChangeLevel string) {
-	minrLog.Errorf("NVML fanControl() reached but shouldn't have been")
-}
+		elapsedTime := time.Since(currentTime)
+		minrLog.Tracef("DEV #%d: Kernel execution to read time: %v (%d runs)", d.index, elapsedTime, runs)
 
-func getInfo() ([]cu.Device, error) {
-	cu.Init(0)
-	ids := cu.DeviceGetCount()
-	minrLog.Infof("%v GPUs", ids)
-	var CUdevices []cu.Device
-	for i := 0; i < ids; i++ {
-		dev := cu.DeviceGet(i)
-		CUdevices = append(CUdevices, dev)
-		minrLog.Infof("%v: %v", i, dev.Name())
+		if d.calibrationTarget > 0 && runs == d.workSize {
+			d.calibrate(elapsedTime)
+		}
 	}
-	return CUdevices, nil
 }
 
-// getCUDevices returns the list of devices for the given platform.
-func getCUDevices() ([]cu.Device, error) {
-	cu.Init(0)
-
-	version := cu.Version()
-	fmt.Println(version)
-
-	maj := version / 1000
-	min := version % 100
-
-	minMajor := 5
-	minMinor := 5
-
-	if maj < minMajor || (maj == minMajor && min < minMinor) {
-		return nil, fmt.Errorf("Driver does not support CUDA %v.%v API", minMajor, minMinor)
-	}
-
-	var numDevices int
-	numDevices = cu.DeviceGetCount()
-	if numDevices < 1 {
-		return nil, fmt.Errorf("No devices found")
-	}
-	devices := make([]cu.Device, numDevices)
-	for i := 0; i < numDevices; i++ {
-		dev := cu.DeviceGet(i)
-		devices[i] = dev
-	}
-	return devices, nil
+// ListDevices prints a list of the devices usable by each backend.
+func ListDevices() {
+	listCUDADevices()
+	fmt.Printf("CPU #0: %d logical processors\n", runtime.NumCPU())
 }
 
+// newMinerDevs adds the devices of the configured backend to m.
 func newMinerDevs(m *Miner) (*Miner, int, error) {
-	deviceListIndex := 0
-	deviceListEnabledCount := 0
-
-	CUdeviceIDs, err := getInfo()
-	if err != nil {
-		return nil, 0, err
+	switch cfg.Backend {
+	case BackendCPU:
+		return newCPUMinerDevs(m)
+	default:
+		return newCUDAMinerDevs(m)
 	}
-
-	// XXX Can probably combine these bits with the opencl ones once
-	// I decide what to do about the types.
-
-	for _, CUDeviceID := range CUdeviceIDs {
-		miningAllowed := false
-
-		// Enforce device restrictions if they exist
-		if len(cfg.DeviceIDs) > 0 {
-			for _, i := range cfg.DeviceIDs {
-				if deviceListIndex == i {
-					miningAllowed = true
-				}
-			}
-		} else {
-			miningAllowed = true
-		}
-
-		if miningAllowed {
-			newDevice, err := NewCuDevice(deviceListIndex, deviceListEnabledCount, CUDeviceID, m.workDone)
-			deviceListEnabledCount++
-			m.devices = append(m.devices, newDevice)
-			if err != nil {
-				return nil, 0, err
-			}
-		}
-		deviceListIndex++
-	}
-
-	return m, deviceListEnabledCount, nil
-}
-
-// Return the GPU library in use.
-func gpuLib() string {
-	return "CUDA"
 }
@@ -0,0 +1,136 @@
+// Copyright (c) 2018 The ExchangeCoin team
+
+package equihash
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// blake2bIV is the BLAKE2b initialization vector.
+var blake2bIV = [8]uint64{
+	0x6a09e667f3bcc908, 0xbb67ae8584caa73b, 0x3c6ef372fe94f82b,
+	0xa54ff53a5f1d36f1, 0x510e527fade682d1, 0x9b05688c2b3e6c1f,
+	0x1f83d9abfb41bd6b, 0x5be0cd19137e2179,
+}
+
+// blake2bSigma is the message word permutation schedule for each round.
+var blake2bSigma = [12][16]byte{
+	{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15},
+	{14, 10, 4, 8, 9, 15, 13, 6, 1, 12, 0, 2, 11, 7, 5, 3},
+	{11, 8, 12, 0, 5, 2, 15, 13, 10, 14, 3, 6, 7, 1, 9, 4},
+	{7, 9, 3, 1, 13, 12, 11, 14, 2, 6, 5, 10, 4, 0, 15, 8},
+	{9, 0, 5, 7, 2, 4, 10, 15, 14, 1, 11, 12, 6, 8, 3, 13},
+	{2, 12, 6, 10, 0, 11, 8, 3, 4, 13, 7, 5, 15, 14, 1, 9},
+	{12, 5, 1, 15, 14, 13, 4, 10, 0, 7, 6, 3, 9, 2, 8, 11},
+	{13, 11, 7, 14, 12, 1, 3, 9, 5, 0, 15, 4, 8, 6, 2, 10},
+	{6, 15, 14, 9, 11, 3, 0, 8, 12, 2, 13, 7, 1, 4, 10, 5},
+	{10, 2, 8, 4, 7, 6, 1, 5, 15, 11, 9, 14, 3, 12, 13, 0},
+	{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15},
+	{14, 10, 4, 8, 9, 15, 13, 6, 1, 12, 0, 2, 11, 7, 5, 3},
+}
+
+const blake2bBlockSize = 128
+
+// blake2bState is a minimal BLAKE2b implementation which, unlike
+// golang.org/x/crypto/blake2b, allows setting the personalization bytes of
+// the parameter block as required by Equihash.  It is a value type so a
+// state that has absorbed the block header can be cheaply copied for every
+// hash index.
+type blake2bState struct {
+	h    [8]uint64
+	t    uint64
+	buf  [blake2bBlockSize]byte
+	n    int
+	size int
+}
+
+// newBlake2b returns a BLAKE2b state producing size byte digests (at most 64)
+// using the passed 16 byte personalization string.
+func newBlake2b(size int, personal []byte) blake2bState {
+	var s blake2bState
+	s.h = blake2bIV
+	s.size = size
+
+	// Parameter block: digest length, no key, fanout 1 and depth 1.
+	s.h[0] ^= uint64(size) | 1<<16 | 1<<24
+	s.h[6] ^= binary.LittleEndian.Uint64(personal[0:8])
+	s.h[7] ^= binary.LittleEndian.Uint64(personal[8:16])
+	return s
+}
+
+// Write absorbs p into the state.  The last block is always kept buffered
+// since it has to be compressed with the finalization flag set.
+func (s *blake2bState) Write(p []byte) {
+	for len(p) > 0 {
+		if s.n == blake2bBlockSize {
+			s.t += blake2bBlockSize
+			s.compress(false)
+			s.n = 0
+		}
+		c := copy(s.buf[s.n:], p)
+		s.n += c
+		p = p[c:]
+	}
+}
+
+// Sum finalizes a copy of the state and writes the digest to out, which must
+// be at least as long as the configured digest size.
+func (s *blake2bState) Sum(out []byte) {
+	d := *s
+	d.t += uint64(d.n)
+	for i := d.n; i < blake2bBlockSize; i++ {
+		d.buf[i] = 0
+	}
+	d.compress(true)
+
+	var tmp [64]byte
+	for i, v := range d.h {
+		binary.LittleEndian.PutUint64(tmp[i*8:], v)
+	}
+	copy(out, tmp[:d.size])
+}
+
+// compress runs the BLAKE2b compression function over the buffered block.
+func (s *blake2bState) compress(last bool) {
+	var m [16]uint64
+	for i := range m {
+		m[i] = binary.LittleEndian.Uint64(s.buf[i*8:])
+	}
+
+	v := [16]uint64{
+		s.h[0], s.h[1], s.h[2], s.h[3], s.h[4], s.h[5], s.h[6], s.h[7],
+		blake2bIV[0], blake2bIV[1], blake2bIV[2], blake2bIV[3],
+		blake2bIV[4] ^ s.t, blake2bIV[5], blake2bIV[6], blake2bIV[7],
+	}
+	if last {
+		v[14] = ^v[14]
+	}
+
+	g := func(a, b, c, d int, x, y uint64) {
+		v[a] += v[b] + x
+		v[d] = bits.RotateLeft64(v[d]^v[a], -32)
+		v[c] += v[d]
+		v[b] = bits.RotateLeft64(v[b]^v[c], -24)
+		v[a] += v[b] + y
+		v[d] = bits.RotateLeft64(v[d]^v[a], -16)
+		v[c] += v[d]
+		v[b] = bits.RotateLeft64(v[b]^v[c], -63)
+	}
+
+	for r := 0; r < 12; r++ {
+		sg := &blake2bSigma[r]
+		g(0, 4, 8, 12, m[sg[0]], m[sg[1]])
+		g(1, 5, 9, 13, m[sg[2]], m[sg[3]])
+		g(2, 6, 10, 14, m[sg[4]], m[sg[5]])
+		g(3, 7, 11, 15, m[sg[6]], m[sg[7]])
+		g(0, 5, 10, 15, m[sg[8]], m[sg[9]])
+		g(1, 6, 11, 12, m[sg[10]], m[sg[11]])
+		g(2, 7, 8, 13, m[sg[12]], m[sg[13]])
+		g(3, 4, 9, 14, m[sg[14]], m[sg[15]])
+	}
+
+	for i := range s.h {
+		s.h[i] ^= v[i] ^ v[i+8]
+	}
+}
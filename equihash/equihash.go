@@ -0,0 +1,119 @@
+// Copyright (c) 2018 The ExchangeCoin team
+
+// Package equihash implements the Equihash proof-of-work in pure Go.
+//
+// It provides a CPU solver for the parameter sets used by ExchangeCoin, which
+// produces solutions in the same compressed format as the CUDA solver found in
+// eqcuda1445.
+package equihash
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// personalPrefix is the BLAKE2b personalization prefix used by Equihash.  It
+// is followed by the little endian encoded n and k parameters.
+const personalPrefix = "ZcashPoW"
+
+// params holds the values derived from the Equihash (n, k) parameters.
+type params struct {
+	n, k           int
+	digitBits      int
+	digitBytes     int
+	hashBytes      int
+	hashesPerBlake int
+	blakeOutBytes  int
+	proofSize      int
+	numIndices     int
+}
+
+// newParams validates n and k and returns the derived parameters.
+func newParams(n, k int) (*params, error) {
+	if k < 1 || n <= 0 || n%8 != 0 || n%(k+1) != 0 || n > 512 {
+		return nil, fmt.Errorf("invalid equihash parameters (n=%d, k=%d)",
+			n, k)
+	}
+	digitBits := n / (k + 1)
+	if digitBits+1 > 32 {
+		return nil, fmt.Errorf("equihash digit size %d is too big", digitBits)
+	}
+
+	hashesPerBlake := 512 / n
+	return &params{
+		n:              n,
+		k:              k,
+		digitBits:      digitBits,
+		digitBytes:     (digitBits + 7) / 8,
+		hashBytes:      n / 8,
+		hashesPerBlake: hashesPerBlake,
+		blakeOutBytes:  hashesPerBlake * n / 8,
+		proofSize:      1 << uint(k),
+		numIndices:     2 << uint(digitBits),
+	}, nil
+}
+
+// SolutionSize returns the size in bytes of a compressed Equihash(n, k)
+// solution.
+func SolutionSize(n, k int) int {
+	return (1 << uint(k)) * (n/(k+1) + 1) / 8
+}
+
+// newBaseState returns a BLAKE2b state which has already absorbed the header.
+// Row hashes are derived from it by appending the little endian block number.
+func (p *params) newBaseState(header []byte) blake2bState {
+	var personal [16]byte
+	copy(personal[:], personalPrefix)
+	binary.LittleEndian.PutUint32(personal[8:], uint32(p.n))
+	binary.LittleEndian.PutUint32(personal[12:], uint32(p.k))
+
+	s := newBlake2b(p.blakeOutBytes, personal[:])
+	s.Write(header)
+	return s
+}
+
+// blakeBlock computes the BLAKE2b output holding the hashes of the
+// hashesPerBlake consecutive indices starting at block*hashesPerBlake.
+func (p *params) blakeBlock(base *blake2bState, block uint32, out []byte) {
+	var le [4]byte
+	binary.LittleEndian.PutUint32(le[:], block)
+	s := *base
+	s.Write(le[:])
+	s.Sum(out)
+}
+
+// compressIndices packs the solution indices into the minimal big endian
+// encoding of digitBits+1 bits per index.
+func (p *params) compressIndices(indices []uint32, out []byte) {
+	width := uint(p.digitBits + 1)
+	var acc uint64
+	var accBits uint
+	j := 0
+	for _, idx := range indices {
+		acc = acc<<width | uint64(idx)
+		accBits += width
+		for accBits >= 8 {
+			accBits -= 8
+			out[j] = byte(acc >> accBits)
+			j++
+		}
+	}
+}
+
+// expandIndices is the inverse of compressIndices.
+func (p *params) expandIndices(solution []byte, indices []uint32) {
+	width := uint(p.digitBits + 1)
+	mask := uint64(1)<<width - 1
+	var acc uint64
+	var accBits uint
+	i := 0
+	for _, b := range solution {
+		acc = acc<<8 | uint64(b)
+		accBits += 8
+		if accBits >= width {
+			accBits -= width
+			indices[i] = uint32(acc>>accBits) & uint32(mask)
+			i++
+		}
+	}
+}
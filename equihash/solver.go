@@ -0,0 +1,382 @@
+// Copyright (c) 2018 The ExchangeCoin team
+
+package equihash
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// The solver sorts the rows of every round into buckets by the leading bits
+// of the digit that has to collide next.  The remaining restBits of the digit
+// are compared inside a bucket, which holds at most maxSlots rows so that a
+// row can refer to its two parents with a single packed uint32:
+//
+//	bucket << 2*slotBits | slot0 << slotBits | slot1
+const (
+	restBits = 4
+	restMask = 1<<restBits - 1
+	slotBits = 6
+	slotMask = 1<<slotBits - 1
+	maxSlots = 1 << slotBits
+)
+
+// level holds the rows resulting from a single round of the algorithm.
+type level struct {
+	// stride is the number of hash bytes stored per row.
+	stride int
+
+	// hashes holds the remaining hash bits of every row while trees holds
+	// the original index (first level) or the packed parents of a row.
+	hashes []byte
+	trees  []uint32
+
+	// starts holds the first row of every bucket plus the total number
+	// of rows as its last element.
+	starts []uint32
+}
+
+// Solver is a multi-threaded CPU implementation of Wagner's algorithm for
+// Equihash.  All memory is allocated by NewSolver and reused by every call to
+// Solve, so a Solver must not be used concurrently.
+type Solver struct {
+	p       *params
+	threads int
+
+	bucketBits uint
+	numBuckets int
+	skipBytes  int
+	maxRows    uint32
+
+	levels []level
+
+	// counts holds per thread row counts for every bucket of the level
+	// being built, which are turned into write offsets once counted.
+	counts [][]uint32
+
+	// ctx is the context of the current run, which the rows are
+	// generated and collided under.
+	ctx context.Context
+}
+
+// cancelCheckInterval is the number of blocks hashed or buckets collided
+// between checks for the run being canceled.
+const cancelCheckInterval = 256
+
+// NewSolver returns a solver for Equihash(n, k) which spreads its work over
+// the given number of threads.  Only parameters with byte aligned digits of up
+// to 24 bits, such as (144, 5), are supported.
+func NewSolver(n, k, threads int) (*Solver, error) {
+	p, err := newParams(n, k)
+	if err != nil {
+		return nil, err
+	}
+	if p.digitBits%8 != 0 || p.digitBits > 24 {
+		return nil, fmt.Errorf("unsupported equihash parameters for the "+
+			"cpu solver (n=%d, k=%d)", n, k)
+	}
+	if threads < 1 {
+		return nil, fmt.Errorf("invalid number of solver threads %d",
+			threads)
+	}
+
+	s := &Solver{
+		p:          p,
+		threads:    threads,
+		bucketBits: uint(p.digitBits - restBits),
+		numBuckets: 1 << uint(p.digitBits-restBits),
+		skipBytes:  (p.digitBits - restBits) / 8,
+	}
+
+	// Every round is expected to yield about as many rows as the first
+	// one, so only a little headroom is needed.
+	s.maxRows = uint32(p.numIndices + p.numIndices/16)
+
+	// Rows of consecutive levels alternate between two hash buffers since
+	// only the previous level's hashes are needed to build the next one.
+	// The trees of all levels are kept to recover the solution indices.
+	var buffers [2][]byte
+	s.levels = make([]level, k)
+	for r := range s.levels {
+		l := &s.levels[r]
+		l.stride = (k+1-r)*p.digitBytes - s.skipBytes
+		if buffers[r%2] == nil {
+			buffers[r%2] = make([]byte, int(s.maxRows)*l.stride)
+		}
+		l.hashes = buffers[r%2]
+		l.trees = make([]uint32, s.maxRows)
+		l.starts = make([]uint32, s.numBuckets+1)
+	}
+
+	s.counts = make([][]uint32, threads)
+	for t := range s.counts {
+		s.counts[t] = make([]uint32, s.numBuckets)
+	}
+
+	return s, nil
+}
+
+// emitFunc is called for every row produced while building a level.
+type emitFunc func(bucket, tree uint32, hash []byte)
+
+// walkFunc emits the rows derived from the range [from, to) of its input.
+type walkFunc func(from, to int, emit emitFunc)
+
+// parallel splits [0, n) among the solver threads and waits for fn to finish
+// on all of them.  fn is called for every thread, even with an empty range.
+func (s *Solver) parallel(n int, fn func(thread, from, to int)) {
+	var wg sync.WaitGroup
+	chunk := (n + s.threads - 1) / s.threads
+	for t := 0; t < s.threads; t++ {
+		from, to := t*chunk, (t+1)*chunk
+		if from > n {
+			from = n
+		}
+		if to > n {
+			to = n
+		}
+		wg.Add(1)
+		go func(t, from, to int) {
+			defer wg.Done()
+			fn(t, from, to)
+		}(t, from, to)
+	}
+	wg.Wait()
+}
+
+// bucket returns the bucket of a row from the leading bytes of its digit.
+func (s *Solver) bucket(digit []byte) uint32 {
+	var v uint32
+	for i := 0; i < s.p.digitBytes; i++ {
+		v = v<<8 | uint32(digit[i])
+	}
+	return v >> restBits
+}
+
+// fill builds the next level from the rows emitted by walk over [0, n).  The
+// input is walked twice, first to count the rows of every bucket and then to
+// store them, so walk must emit the same rows in the same order both times.
+// Rows that do not fit into their bucket are dropped.
+func (s *Solver) fill(next *level, n int, walk walkFunc) {
+	s.parallel(n, func(t, from, to int) {
+		counts := s.counts[t]
+		for i := range counts {
+			counts[i] = 0
+		}
+		walk(from, to, func(bucket, tree uint32, hash []byte) {
+			counts[bucket]++
+		})
+	})
+
+	// Turn the counts into per thread write offsets.
+	var total uint32
+	for b := 0; b < s.numBuckets; b++ {
+		next.starts[b] = total
+		var size uint32
+		for t := range s.counts {
+			c := s.counts[t][b]
+			s.counts[t][b] = total + size
+			size += c
+		}
+		if size > maxSlots {
+			size = maxSlots
+		}
+		if total+size > s.maxRows {
+			size = s.maxRows - total
+		}
+		total += size
+	}
+	next.starts[s.numBuckets] = total
+
+	s.parallel(n, func(t, from, to int) {
+		offsets := s.counts[t]
+		walk(from, to, func(bucket, tree uint32, hash []byte) {
+			pos := offsets[bucket]
+			offsets[bucket]++
+			if pos >= next.starts[bucket+1] {
+				return
+			}
+			next.trees[pos] = tree
+			copy(next.hashes[int(pos)*next.stride:], hash[:next.stride])
+		})
+	})
+}
+
+// generate returns a walkFunc emitting the initial rows, which are the
+// BLAKE2b hashes of the header for every index.
+func (s *Solver) generate(base *blake2bState) walkFunc {
+	p := s.p
+	return func(from, to int, emit emitFunc) {
+		out := make([]byte, p.blakeOutBytes)
+		for block := from; block < to; block++ {
+			if (block-from)%cancelCheckInterval == 0 &&
+				s.ctx.Err() != nil {
+				return
+			}
+			p.blakeBlock(base, uint32(block), out)
+			for i := 0; i < p.hashesPerBlake; i++ {
+				index := block*p.hashesPerBlake + i
+				if index >= p.numIndices {
+					break
+				}
+				hash := out[i*p.hashBytes : (i+1)*p.hashBytes]
+				emit(s.bucket(hash), uint32(index), hash[s.skipBytes:])
+			}
+		}
+	}
+}
+
+// forEachPair calls fn for every pair of rows of the bucket range [from, to)
+// of cur which collide on the current digit.  The slots passed to fn are
+// relative to the start of the bucket.
+func (s *Solver) forEachPair(cur *level, from, to int, fn func(bucket, slot0, slot1 uint32, row0, row1 []byte)) {
+	var groups [1 << restBits][maxSlots]uint8
+	var sizes [1 << restBits]int
+	for b := from; b < to; b++ {
+		if (b-from)%cancelCheckInterval == 0 && s.ctx.Err() != nil {
+			return
+		}
+		start := int(cur.starts[b])
+		end := int(cur.starts[b+1])
+
+		for i := range sizes {
+			sizes[i] = 0
+		}
+		for slot := 0; slot < end-start; slot++ {
+			rest := cur.hashes[(start+slot)*cur.stride] & restMask
+			groups[rest][sizes[rest]] = uint8(slot)
+			sizes[rest]++
+		}
+
+		for rest, size := range sizes {
+			group := groups[rest][:size]
+			for i := 0; i < len(group); i++ {
+				pos0 := (start + int(group[i])) * cur.stride
+				row0 := cur.hashes[pos0 : pos0+cur.stride]
+				for j := i + 1; j < len(group); j++ {
+					pos1 := (start + int(group[j])) * cur.stride
+					row1 := cur.hashes[pos1 : pos1+cur.stride]
+					fn(uint32(b), uint32(group[i]),
+						uint32(group[j]), row0, row1)
+				}
+			}
+		}
+	}
+}
+
+// collide returns a walkFunc emitting the rows of the next level from the
+// collisions found in the buckets of cur.
+func (s *Solver) collide(cur *level) walkFunc {
+	return func(from, to int, emit emitFunc) {
+		xor := make([]byte, cur.stride)
+		s.forEachPair(cur, from, to, func(bucket, slot0, slot1 uint32, row0, row1 []byte) {
+			var nonzero byte
+			for i := 1; i < len(row0); i++ {
+				xor[i] = row0[i] ^ row1[i]
+				nonzero |= xor[i]
+			}
+			// Rows which xor to zero before the final round only
+			// lead to solutions with duplicate indices.
+			if nonzero == 0 {
+				return
+			}
+			tree := bucket<<(2*slotBits) | slot0<<slotBits | slot1
+			digit := xor[1:]
+			emit(s.bucket(digit), tree, digit[s.skipBytes:])
+		})
+	}
+}
+
+// indices recovers the indices of the row of level r described by tree into
+// out, ordering the halves of every subtree by their first index.
+func (s *Solver) indices(r int, tree uint32, out []uint32) {
+	if r == 0 {
+		out[0] = tree
+		return
+	}
+
+	prev := &s.levels[r-1]
+	start := prev.starts[tree>>(2*slotBits)]
+	half := len(out) / 2
+	s.indices(r-1, prev.trees[start+(tree>>slotBits)&slotMask], out[:half])
+	s.indices(r-1, prev.trees[start+tree&slotMask], out[half:])
+	if out[0] > out[half] {
+		for i := 0; i < half; i++ {
+			out[i], out[half+i] = out[half+i], out[i]
+		}
+	}
+}
+
+// Solve runs the solver over the passed equihash input, which must already
+// contain the nonce, and calls found with every compressed solution.  A run
+// takes several seconds for the parameters used by ExchangeCoin, so ctx is
+// checked between the rounds of the algorithm and regularly within them,
+// ctx.Err() being returned without any solution once it is done.
+func (s *Solver) Solve(ctx context.Context, header []byte, found func(solution []byte)) error {
+	p := s.p
+	base := p.newBaseState(header)
+	s.ctx = ctx
+	defer func() { s.ctx = nil }()
+
+	// The rows of an interrupted round are incomplete, which does not
+	// matter since the run is abandoned right after it.
+	numBlocks := (p.numIndices + p.hashesPerBlake - 1) / p.hashesPerBlake
+	s.fill(&s.levels[0], numBlocks, s.generate(&base))
+	for r := 1; r < p.k; r++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		s.fill(&s.levels[r], s.numBuckets, s.collide(&s.levels[r-1]))
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// The last round requires the final two digits to collide, which
+	// means the rows have to be equal apart from their bucket.
+	last := &s.levels[p.k-1]
+	var mtx sync.Mutex
+	var candidates []uint32
+	s.parallel(s.numBuckets, func(t, from, to int) {
+		s.forEachPair(last, from, to, func(bucket, slot0, slot1 uint32, row0, row1 []byte) {
+			for i := 1; i < len(row0); i++ {
+				if row0[i] != row1[i] {
+					return
+				}
+			}
+			mtx.Lock()
+			candidates = append(candidates,
+				bucket<<(2*slotBits)|slot0<<slotBits|slot1)
+			mtx.Unlock()
+		})
+	})
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	indices := make([]uint32, p.proofSize)
+	sorted := make([]uint32, p.proofSize)
+	for _, tree := range candidates {
+		s.indices(p.k, tree, indices)
+
+		copy(sorted, indices)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		distinct := true
+		for i := 1; i < len(sorted); i++ {
+			if sorted[i] == sorted[i-1] {
+				distinct = false
+				break
+			}
+		}
+		if !distinct {
+			continue
+		}
+
+		solution := make([]byte, SolutionSize(p.n, p.k))
+		p.compressIndices(indices, solution)
+		found(solution)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2018 The ExchangeCoin team
+
+package equihash
+
+import (
+	"context"
+	"encoding/binary"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// testInput is the input of the Equihash test vectors of Zcash, which is
+// followed by a 32 byte little endian nonce.
+const testInput = "Equihash is an asymmetric PoW based on the Generalised " +
+	"Birthday problem."
+
+// testHeader returns the equihash input of the test vectors for nonce.
+func testHeader(nonce uint32) []byte {
+	header := make([]byte, len(testInput)+32)
+	copy(header, testInput)
+	binary.LittleEndian.PutUint32(header[len(testInput):], nonce)
+	return header
+}
+
+// knownAnswers lists the solutions of small parameter sets for the test input.
+// The first (96, 5) solution for nonce 1 is the one of the Zcash test vectors.
+var knownAnswers = []struct {
+	n, k      int
+	nonce     uint32
+	solutions [][]uint32
+}{
+	{96, 5, 1, [][]uint32{
+		{2261, 15185, 36112, 104243, 23779, 118390, 118332, 130041,
+			32642, 69878, 76925, 80080, 45858, 116805, 92842, 111026,
+			15972, 115059, 85191, 90330, 68190, 122819, 81830, 91132,
+			23460, 49807, 52426, 80391, 69567, 114474, 104973, 122568},
+		{16700, 46276, 21232, 43153, 22398, 58511, 47922, 71816,
+			23370, 26222, 39248, 40137, 65375, 85794, 69749, 73259,
+			23599, 72821, 42250, 52383, 35267, 75893, 52152, 57181,
+			27137, 101117, 45804, 92838, 29548, 29574, 37737, 113624},
+	}},
+	{96, 5, 2, [][]uint32{
+		{6005, 59843, 55560, 70361, 39140, 77856, 44238, 57702,
+			32125, 121969, 108032, 116542, 37925, 75404, 48671, 111682,
+			6937, 93582, 53272, 77545, 13715, 40867, 73187, 77853,
+			7348, 70313, 24935, 24978, 25967, 41062, 58694, 110036},
+	}},
+	{48, 5, 1, [][]uint32{
+		{8, 229, 29, 139, 230, 351, 452, 507, 30, 374, 265, 424, 65, 90,
+			219, 502, 46, 255, 79, 262, 49, 51, 96, 203, 47, 182, 168,
+			366, 123, 411, 414, 504},
+	}},
+	{48, 5, 2, [][]uint32{
+		{45, 425, 358, 364, 85, 93, 268, 403, 99, 138, 160, 360, 151, 205,
+			303, 332, 61, 199, 288, 294, 104, 477, 384, 387, 106, 444, 279,
+			389, 164, 493, 202, 349},
+	}},
+}
+
+// compress returns the compressed Equihash(n, k) solution of indices.
+func compress(t *testing.T, n, k int, indices []uint32) []byte {
+	t.Helper()
+	p, err := newParams(n, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	solution := make([]byte, SolutionSize(n, k))
+	p.compressIndices(indices, solution)
+	return solution
+}
+
+func TestSolveKnownAnswers(t *testing.T) {
+	for _, test := range knownAnswers {
+		for _, threads := range []int{1, 3} {
+			s, err := NewSolver(test.n, test.k, threads)
+			if err != nil {
+				t.Fatalf("NewSolver(%d, %d): %v", test.n, test.k, err)
+			}
+			p := s.p
+
+			header := testHeader(test.nonce)
+			var found [][]uint32
+			err = s.Solve(context.Background(), header, func(solution []byte) {
+				if err := Verify(test.n, test.k, header, solution); err != nil {
+					t.Errorf("(%d, %d) nonce %d: invalid solution: %v",
+						test.n, test.k, test.nonce, err)
+				}
+				indices := make([]uint32, p.proofSize)
+				p.expandIndices(solution, indices)
+				found = append(found, indices)
+			})
+			if err != nil {
+				t.Fatalf("(%d, %d) nonce %d: %v", test.n, test.k,
+					test.nonce, err)
+			}
+
+			// The order solutions are found in depends on the threads.
+			sort.Slice(found, func(i, j int) bool {
+				return found[i][0] < found[j][0]
+			})
+			if !reflect.DeepEqual(found, test.solutions) {
+				t.Errorf("(%d, %d) nonce %d with %d threads: got "+
+					"solutions %v, want %v", test.n, test.k,
+					test.nonce, threads, found, test.solutions)
+			}
+		}
+	}
+}
+
+func TestCompressIndices(t *testing.T) {
+	for _, test := range knownAnswers {
+		p, err := newParams(test.n, test.k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range test.solutions {
+			solution := compress(t, test.n, test.k, want)
+			indices := make([]uint32, p.proofSize)
+			p.expandIndices(solution, indices)
+			if !reflect.DeepEqual(indices, want) {
+				t.Errorf("(%d, %d): indices %v expanded to %v",
+					test.n, test.k, want, indices)
+			}
+		}
+	}
+}
+
+func TestNewSolverParams(t *testing.T) {
+	tests := []struct {
+		n, k, threads int
+		ok            bool
+	}{
+		{48, 5, 1, true},
+		{96, 5, 4, true},
+		{200, 9, 1, false}, // 20 bit digits are not byte aligned
+		{96, 5, 0, false},
+		{100, 5, 1, false},
+		{96, 0, 1, false},
+	}
+	for _, test := range tests {
+		_, err := NewSolver(test.n, test.k, test.threads)
+		if (err == nil) != test.ok {
+			t.Errorf("NewSolver(%d, %d, %d): got error %v, want ok %v",
+				test.n, test.k, test.threads, err, test.ok)
+		}
+	}
+}
+
+func TestSolveCanceled(t *testing.T) {
+	s, err := NewSolver(96, 5, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = s.Solve(ctx, testHeader(1), func(solution []byte) {
+		t.Errorf("Canceled run found solution %x", solution)
+	})
+	if err != context.Canceled {
+		t.Errorf("Canceled run returned %v, want %v", err,
+			context.Canceled)
+	}
+
+	// The solver is still usable after an interrupted run.
+	var solutions int
+	err = s.Solve(context.Background(), testHeader(1), func([]byte) {
+		solutions++
+	})
+	if err != nil || solutions != len(knownAnswers[0].solutions) {
+		t.Errorf("Run after cancelation found %d solutions (error %v), "+
+			"want %d", solutions, err, len(knownAnswers[0].solutions))
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2018 The ExchangeCoin team
+
+package equihash
+
+import (
+	"errors"
+	"sort"
+)
+
+// Errors returned by Verify for invalid solutions.
+var (
+	ErrSolutionSize   = errors.New("wrong solution size")
+	ErrDuplicateIndex = errors.New("duplicate index")
+	ErrOutOfOrder     = errors.New("indices out of order")
+	ErrNonZeroXor     = errors.New("nonzero xor")
+)
+
+// Verify checks that solution is a valid compressed Equihash(n, k) solution
+// for the passed equihash input, which must include the nonce.  The indices
+// must be distinct, the halves of every subtree ordered by their first index
+// and the hashes of every subtree must xor to zero on the leading digits
+// collided at its round, and on all bits at the root.
+func Verify(n, k int, header, solution []byte) error {
+	p, err := newParams(n, k)
+	if err != nil {
+		return err
+	}
+	if len(solution) != SolutionSize(n, k) {
+		return ErrSolutionSize
+	}
+
+	indices := make([]uint32, p.proofSize)
+	p.expandIndices(solution, indices)
+
+	sorted := make([]uint32, len(indices))
+	copy(sorted, indices)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i] == sorted[i-1] {
+			return ErrDuplicateIndex
+		}
+	}
+
+	base := p.newBaseState(header)
+	hash := make([]byte, p.hashBytes)
+	return p.verifyRec(&base, indices, hash, k)
+}
+
+// verifyRec computes the xor of the hashes of the subtree of round r holding
+// indices into hash and checks the tree ordering and collisions.
+func (p *params) verifyRec(base *blake2bState, indices []uint32, hash []byte, r int) error {
+	if r == 0 {
+		out := make([]byte, p.blakeOutBytes)
+		p.blakeBlock(base, indices[0]/uint32(p.hashesPerBlake), out)
+		offset := int(indices[0]%uint32(p.hashesPerBlake)) * p.hashBytes
+		copy(hash, out[offset:offset+p.hashBytes])
+		return nil
+	}
+
+	half := len(indices) / 2
+	if indices[0] >= indices[half] {
+		return ErrOutOfOrder
+	}
+
+	hash0 := make([]byte, p.hashBytes)
+	hash1 := make([]byte, p.hashBytes)
+	if err := p.verifyRec(base, indices[:half], hash0, r-1); err != nil {
+		return err
+	}
+	if err := p.verifyRec(base, indices[half:], hash1, r-1); err != nil {
+		return err
+	}
+	for i := range hash {
+		hash[i] = hash0[i] ^ hash1[i]
+	}
+
+	zeroBits := p.n
+	if r < p.k {
+		zeroBits = r * p.digitBits
+	}
+	i := 0
+	for ; i < zeroBits/8; i++ {
+		if hash[i] != 0 {
+			return ErrNonZeroXor
+		}
+	}
+	if rem := uint(zeroBits % 8); rem != 0 && hash[i]>>(8-rem) != 0 {
+		return ErrNonZeroXor
+	}
+
+	return nil
+}
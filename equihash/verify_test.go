@@ -0,0 +1,106 @@
+// Copyright (c) 2018 The ExchangeCoin team
+
+package equihash
+
+import "testing"
+
+func TestVerifyKnownAnswers(t *testing.T) {
+	for _, test := range knownAnswers {
+		header := testHeader(test.nonce)
+		for _, indices := range test.solutions {
+			solution := compress(t, test.n, test.k, indices)
+			if err := Verify(test.n, test.k, header, solution); err != nil {
+				t.Errorf("(%d, %d) nonce %d: valid solution %v "+
+					"rejected: %v", test.n, test.k, test.nonce,
+					indices, err)
+			}
+		}
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	const n, k = 96, 5
+	valid := knownAnswers[0].solutions[0]
+	header := testHeader(knownAnswers[0].nonce)
+
+	// modify returns a copy of the valid indices changed by fn.
+	modify := func(fn func(indices []uint32)) []uint32 {
+		indices := append([]uint32(nil), valid...)
+		fn(indices)
+		return indices
+	}
+
+	tests := []struct {
+		name    string
+		indices []uint32
+		want    error
+	}{{
+		name: "duplicate index",
+		indices: modify(func(indices []uint32) {
+			indices[9] = indices[8]
+		}),
+		want: ErrDuplicateIndex,
+	}, {
+		name: "duplicate subtree",
+		indices: modify(func(indices []uint32) {
+			copy(indices[16:], indices[:16])
+		}),
+		want: ErrDuplicateIndex,
+	}, {
+		name: "swapped halves",
+		indices: modify(func(indices []uint32) {
+			for i := 0; i < 16; i++ {
+				indices[i], indices[16+i] = indices[16+i], indices[i]
+			}
+		}),
+		want: ErrOutOfOrder,
+	}, {
+		name: "swapped leaves",
+		indices: modify(func(indices []uint32) {
+			indices[0], indices[1] = indices[1], indices[0]
+		}),
+		want: ErrOutOfOrder,
+	}, {
+		name: "changed index",
+		indices: modify(func(indices []uint32) {
+			indices[1]++
+		}),
+		want: ErrNonZeroXor,
+	}, {
+		name: "changed last index",
+		indices: modify(func(indices []uint32) {
+			indices[31]--
+		}),
+		want: ErrNonZeroXor,
+	}}
+	for _, test := range tests {
+		solution := compress(t, n, k, test.indices)
+		err := Verify(n, k, header, solution)
+		if err != test.want {
+			t.Errorf("%s: got error %v, want %v", test.name, err,
+				test.want)
+		}
+	}
+
+	// The solution of another nonce does not collide.
+	solution := compress(t, n, k, valid)
+	if err := Verify(n, k, testHeader(3), solution); err != ErrNonZeroXor {
+		t.Errorf("wrong header: got error %v, want %v", err,
+			ErrNonZeroXor)
+	}
+
+	// Solutions must have the exact compressed size.
+	for _, size := range []int{0, len(solution) - 1, len(solution) + 1} {
+		wrong := make([]byte, size)
+		copy(wrong, solution)
+		if err := Verify(n, k, header, wrong); err != ErrSolutionSize {
+			t.Errorf("%d byte solution: got error %v, want %v", size,
+				err, ErrSolutionSize)
+		}
+	}
+
+	// Invalid parameters are reported rather than checked against.
+	if err := Verify(100, 5, header, solution); err == nil {
+		t.Error("Verify accepted invalid parameters (100, 5)")
+	}
+}
@@ -0,0 +1,680 @@
+// Copyright (c) 2018 The ExchangeCoin team
+
+// Package exccdtest provides a fake exccd serving the getwork and
+// getblocktemplate JSON-RPCs over authenticated HTTPS, which issues work and
+// records the solutions submitted for it, to exercise solo mining without a
+// running daemon.
+package exccdtest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/EXCCoin/exccd/blockchain"
+	"github.com/EXCCoin/exccd/chaincfg"
+	"github.com/EXCCoin/exccd/chaincfg/chainhash"
+	"github.com/EXCCoin/exccd/exccutil"
+	"github.com/EXCCoin/exccd/wire"
+
+	"github.com/EXCCoin/gominer/equihash"
+	"github.com/EXCCoin/gominer/util"
+	"github.com/EXCCoin/gominer/work"
+)
+
+// JSON-RPC error codes used by exccd.
+const (
+	ErrCodeMisc            = -1
+	ErrCodeDeserialization = -22
+	ErrCodeMethodNotFound  = -32601
+	ErrCodeInvalidParams   = -32602
+)
+
+// maxWorks is the number of works for the current block solutions are
+// accepted for.
+const maxWorks = 16
+
+// Amounts paid by the coinbase of the blocks, in atoms.
+const (
+	orgSubsidy  = 1e8
+	blockReward = 5e8
+)
+
+var (
+	// orgScript is the script of the coinbase output paying the subsidy
+	// of the organization.
+	orgScript = append(append([]byte{0xa9, 0x14}, make([]byte, 20)...),
+		0x87)
+
+	// payoutScript is the script of the coinbase output paying the block
+	// reward to the mining address of the daemon.
+	payoutScript = append(append([]byte{0x76, 0xa9, 0x14},
+		bytes.Repeat([]byte{0x01}, 20)...), 0x88, 0xac)
+)
+
+// Submission is a solution submitted with getwork, or a block submitted with
+// submitblock, along with its outcome.
+type Submission struct {
+	Data   []byte
+	Header wire.BlockHeader
+
+	// Block is the submitted block, nil for getwork.
+	Block *wire.MsgBlock
+
+	Accepted bool
+
+	// Reason holds why the solution was rejected.
+	Reason string
+}
+
+// Config holds the options of a server.
+type Config struct {
+	// ChainParams are the parameters of the network the work is for.
+	ChainParams *chaincfg.Params
+
+	// User and Pass are the RPC credentials.
+	User string
+	Pass string
+
+	// NoTLS serves plain HTTP instead of HTTPS.
+	NoTLS bool
+
+	// Target is the target solutions are checked against, the proof of
+	// work limit of the network by default.
+	Target *big.Int
+
+	// Verify checks the solution of a header against its Equihash input,
+	// equihash.Verify with the parameters of the network when it is nil.
+	// Tests not solving work for real replace it.
+	Verify func(input, solution []byte) error
+}
+
+// fault is a failure injected into the reply to a request.
+type fault struct {
+	status  int
+	code    int
+	message string
+}
+
+// issuedWork is work returned by getwork, or as block template by
+// getblocktemplate.  The block of the work holds its coinbase only.
+type issuedWork struct {
+	header   wire.BlockHeader
+	target   *big.Int
+	coinbase *wire.MsgTx
+}
+
+// Server is a fake exccd for tests.
+type Server struct {
+	cfg  Config
+	http *httptest.Server
+
+	mtx         sync.Mutex
+	works       map[chainhash.Hash]*issuedWork
+	order       []chainhash.Hash
+	current     *issuedWork
+	height      uint32
+	target      *big.Int
+	faults      []fault
+	getWorks    int
+	submissions []Submission
+
+	// templateID identifies the current work for long polling, and
+	// changed is closed once it changes.
+	templateID    uint64
+	changed       chan struct{}
+	templateCalls int
+
+	// quit is closed to end the long polling requests on Close.
+	quit      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewServer starts a server and generates its first work.
+func NewServer(cfg Config) (*Server, error) {
+	if cfg.ChainParams == nil {
+		return nil, errors.New("No chain parameters")
+	}
+
+	s := &Server{
+		cfg:     cfg,
+		works:   make(map[chainhash.Hash]*issuedWork),
+		target:  cfg.Target,
+		changed: make(chan struct{}),
+		quit:    make(chan struct{}),
+	}
+	if s.target == nil {
+		s.target = cfg.ChainParams.PowLimit
+	}
+	if err := s.NewBlock(); err != nil {
+		return nil, err
+	}
+
+	s.http = httptest.NewUnstartedServer(http.HandlerFunc(s.serveHTTP))
+	if cfg.NoTLS {
+		s.http.Start()
+	} else {
+		s.http.StartTLS()
+	}
+	return s, nil
+}
+
+// Addr returns the address to use as RPC server.
+func (s *Server) Addr() string {
+	return s.http.Listener.Addr().String()
+}
+
+// CertPEM returns the PEM encoded certificate of the server, to be written to
+// the RPC certificate file, or nil when serving plain HTTP.
+func (s *Server) CertPEM() []byte {
+	cert := s.http.Certificate()
+	if cert == nil {
+		return nil
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
+
+// Close stops the server, ending the long polling requests.
+func (s *Server) Close() {
+	s.closeOnce.Do(func() {
+		close(s.quit)
+		s.http.Close()
+	})
+}
+
+// NewBlock generates work on top of a new block, which makes the solutions
+// for all previous work stale.
+func (s *Server) NewBlock() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var header wire.BlockHeader
+	if _, err := rand.Read(header.PrevBlock[:]); err != nil {
+		return err
+	}
+	s.height++
+	s.works = make(map[chainhash.Hash]*issuedWork)
+	s.order = s.order[:0]
+	return s.addWork(&header)
+}
+
+// NewWork generates new work for the current block, as when transactions
+// were added.  Solutions for the previous work are still accepted.
+func (s *Server) NewWork() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	header := wire.BlockHeader{PrevBlock: s.current.header.PrevBlock}
+	return s.addWork(&header)
+}
+
+// addWork fills in header with a new coinbase and makes it the current work.
+// It must be called with the mutex held.
+func (s *Server) addWork(header *wire.BlockHeader) error {
+	coinbase, err := newCoinbase(s.height)
+	if err != nil {
+		return err
+	}
+	block := wire.MsgBlock{Transactions: []*wire.MsgTx{coinbase}}
+	header.Version = 1
+	header.MerkleRoot = merkleRoot(block.Transactions)
+	header.Bits = blockchain.BigToCompact(s.target)
+	header.Height = s.height
+	header.Timestamp = time.Unix(time.Now().Unix(), 0)
+	block.Header = *header
+	header.Size = uint32(block.SerializeSize())
+
+	if len(s.order) == maxWorks {
+		delete(s.works, s.order[0])
+		s.order = s.order[1:]
+	}
+	w := &issuedWork{header: *header, target: s.target, coinbase: coinbase}
+	s.works[header.MerkleRoot] = w
+	s.order = append(s.order, header.MerkleRoot)
+	s.current = w
+
+	s.templateID++
+	close(s.changed)
+	s.changed = make(chan struct{})
+	return nil
+}
+
+// newCoinbase returns a coinbase for the block at height, which pays the
+// subsidy of the organization, commits to the height and pays the reward to
+// the mining address of the daemon.  Its signature script holds a random
+// extranonce, so that every work has its own merkle root.
+func newCoinbase(height uint32) (*wire.MsgTx, error) {
+	sigScript := make([]byte, 12)
+	binary.LittleEndian.PutUint32(sigScript, height)
+	if _, err := rand.Read(sigScript[4:]); err != nil {
+		return nil, err
+	}
+	commitment := []byte{0x6a, 0x04, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(commitment[2:], height)
+
+	tx := wire.NewMsgTx()
+	tx.AddTxIn(&wire.TxIn{
+		PreviousOutPoint: *wire.NewOutPoint(&chainhash.Hash{},
+			wire.MaxPrevOutIndex, wire.TxTreeRegular),
+		Sequence:        wire.MaxTxInSequenceNum,
+		ValueIn:         orgSubsidy + blockReward,
+		SignatureScript: sigScript,
+	})
+	tx.AddTxOut(wire.NewTxOut(orgSubsidy, orgScript))
+	tx.AddTxOut(wire.NewTxOut(0, commitment))
+	tx.AddTxOut(wire.NewTxOut(blockReward, payoutScript))
+	return tx, nil
+}
+
+// merkleRoot returns the merkle root of the regular transactions of a block.
+func merkleRoot(txs []*wire.MsgTx) chainhash.Hash {
+	utxs := make([]*exccutil.Tx, 0, len(txs))
+	for _, tx := range txs {
+		utxs = append(utxs, exccutil.NewTx(tx))
+	}
+	merkles := blockchain.BuildMerkleTreeStore(utxs)
+	return *merkles[len(merkles)-1]
+}
+
+// CurrentWork returns the header of the work returned by getwork.
+func (s *Server) CurrentWork() wire.BlockHeader {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.current.header
+}
+
+// SetTarget sets the target of the work generated from now on.  The compact
+// bits of the header are derived from it while solutions are checked against
+// the exact target.
+func (s *Server) SetTarget(target *big.Int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.target = target
+}
+
+// FailNext makes the next request fail with a JSON-RPC error.
+func (s *Server) FailNext(code int, message string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.faults = append(s.faults, fault{code: code, message: message})
+}
+
+// FailNextStatus makes the next request fail with the HTTP status and body.
+func (s *Server) FailNextStatus(status int, body string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.faults = append(s.faults, fault{status: status, message: body})
+}
+
+// TemplateCalls returns the number of getblocktemplate requests, including
+// those which failed.
+func (s *Server) TemplateCalls() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.templateCalls
+}
+
+// GetWorkCalls returns the number of getwork requests for work.
+func (s *Server) GetWorkCalls() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.getWorks
+}
+
+// Submissions returns the solutions submitted so far.
+func (s *Server) Submissions() []Submission {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return append([]Submission(nil), s.submissions...)
+}
+
+// request models a JSON-RPC request.
+type request struct {
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+	ID     interface{}       `json:"id"`
+}
+
+// rpcError models the error of a JSON-RPC reply.
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// reply models a JSON-RPC reply.
+type reply struct {
+	Result interface{} `json:"result"`
+	Error  *rpcError   `json:"error"`
+	ID     interface{} `json:"id"`
+}
+
+// templateTx models a transaction of a getblocktemplate result.
+type templateTx struct {
+	Data string `json:"data"`
+	Hash string `json:"hash"`
+}
+
+// blockTemplateResult models the result of getblocktemplate, whose header
+// commits to the coinbase.
+type blockTemplateResult struct {
+	Header        string       `json:"header"`
+	CoinbaseTxn   *templateTx  `json:"coinbasetxn"`
+	Transactions  []templateTx `json:"transactions"`
+	STransactions []templateTx `json:"stransactions"`
+	Target        string       `json:"target"`
+	LongPollID    string       `json:"longpollid"`
+}
+
+// getWorkResult models the result of getwork without data.
+type getWorkResult struct {
+	Data   string `json:"data"`
+	Target string `json:"target"`
+}
+
+// authorized returns whether the request carries the RPC credentials.
+func (s *Server) authorized(r *http.Request) bool {
+	user, pass, ok := r.BasicAuth()
+	return ok &&
+		subtle.ConstantTimeCompare([]byte(user), []byte(s.cfg.User)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(pass), []byte(s.cfg.Pass)) == 1
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="exccd RPC"`)
+		http.Error(w, "401 Unauthorized.", http.StatusUnauthorized)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req request
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "400 Bad Request: "+err.Error(),
+			http.StatusBadRequest)
+		return
+	}
+
+	s.mtx.Lock()
+	if req.Method == "getblocktemplate" {
+		s.templateCalls++
+	}
+	var injected *fault
+	if len(s.faults) != 0 {
+		injected = &s.faults[0]
+		s.faults = s.faults[1:]
+	}
+	s.mtx.Unlock()
+
+	resp := reply{ID: req.ID}
+	switch {
+	case injected != nil && injected.status != 0:
+		http.Error(w, injected.message, injected.status)
+		return
+	case injected != nil:
+		resp.Error = &rpcError{injected.code, injected.message}
+	case req.Method == "getblocktemplate":
+		tmpl, rerr := s.getBlockTemplate(r.Context(), req.Params)
+		if rerr != nil {
+			resp.Error = rerr
+			break
+		}
+		resp.Result = tmpl
+	case req.Method == "submitblock":
+		reason, rerr := s.submitBlock(req.Params)
+		if rerr != nil {
+			resp.Error = rerr
+			break
+		}
+		if reason != "" {
+			resp.Result = reason
+		}
+	case req.Method != "getwork":
+		resp.Error = &rpcError{ErrCodeMethodNotFound, "Method not found"}
+	case len(req.Params) == 0:
+		resp.Result = s.getWork()
+	default:
+		var data string
+		if err := json.Unmarshal(req.Params[0], &data); err != nil {
+			resp.Error = &rpcError{ErrCodeInvalidParams, err.Error()}
+			break
+		}
+		accepted, rerr := s.submitWork(data)
+		if rerr != nil {
+			resp.Error = rerr
+			break
+		}
+		resp.Result = accepted
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&resp)
+}
+
+// getWork returns the current work, with the header padded to
+// work.GetworkDataLen as for hashing and the target in little endian.
+func (s *Server) getWork() *getWorkResult {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.getWorks++
+
+	header, _ := s.current.header.Bytes()
+	data := make([]byte, work.GetworkDataLen)
+	copy(data, header)
+	data[wire.MaxBlockHeaderPayload] = 0x80
+	data[len(data)-9] |= 0x01
+	binary.BigEndian.PutUint64(data[len(data)-8:],
+		wire.MaxBlockHeaderPayload*8)
+
+	target := make([]byte, 32)
+	b := s.current.target.Bytes()
+	copy(target[32-len(b):], b)
+
+	return &getWorkResult{
+		Data:   hex.EncodeToString(data),
+		Target: hex.EncodeToString(util.Reverse(target)),
+	}
+}
+
+// getBlockTemplate returns the current work as block template.  A long polling
+// request, made with the id of the current template, waits for the next one.
+func (s *Server) getBlockTemplate(ctx context.Context, params []json.RawMessage) (*blockTemplateResult, *rpcError) {
+	var request struct {
+		Mode       string `json:"mode"`
+		LongPollID string `json:"longpollid"`
+	}
+	if len(params) != 0 {
+		if err := json.Unmarshal(params[0], &request); err != nil {
+			return nil, &rpcError{ErrCodeInvalidParams, err.Error()}
+		}
+	}
+	if request.Mode != "" && request.Mode != "template" {
+		return nil, &rpcError{ErrCodeInvalidParams,
+			"Invalid mode " + request.Mode}
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for request.LongPollID == strconv.FormatUint(s.templateID, 10) {
+		changed := s.changed
+		s.mtx.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			s.mtx.Lock()
+			return nil, &rpcError{ErrCodeMisc, "Request canceled"}
+		case <-s.quit:
+			s.mtx.Lock()
+			return nil, &rpcError{ErrCodeMisc, "Server shutting down"}
+		}
+		s.mtx.Lock()
+	}
+
+	header, err := s.current.header.Bytes()
+	if err != nil {
+		return nil, &rpcError{ErrCodeMisc, err.Error()}
+	}
+	var coinbase bytes.Buffer
+	if err := s.current.coinbase.Serialize(&coinbase); err != nil {
+		return nil, &rpcError{ErrCodeMisc, err.Error()}
+	}
+	return &blockTemplateResult{
+		Header: hex.EncodeToString(header),
+		CoinbaseTxn: &templateTx{
+			Data: hex.EncodeToString(coinbase.Bytes()),
+			Hash: s.current.coinbase.TxHash().String(),
+		},
+		Transactions:  []templateTx{},
+		STransactions: []templateTx{},
+		Target:        fmt.Sprintf("%064x", s.current.target),
+		LongPollID:    strconv.FormatUint(s.templateID, 10),
+	}, nil
+}
+
+// submitBlock checks a block submitted with submitblock and records it.  It
+// returns why the block is rejected, or an empty string if it is accepted.
+func (s *Server) submitBlock(params []json.RawMessage) (string, *rpcError) {
+	if len(params) == 0 {
+		return "", &rpcError{ErrCodeInvalidParams, "Missing block"}
+	}
+	var data string
+	if err := json.Unmarshal(params[0], &data); err != nil {
+		return "", &rpcError{ErrCodeInvalidParams, err.Error()}
+	}
+	b, err := hex.DecodeString(data)
+	if err != nil {
+		return "", &rpcError{ErrCodeDeserialization, err.Error()}
+	}
+	var block wire.MsgBlock
+	if err := block.Deserialize(bytes.NewReader(b)); err != nil {
+		return "", &rpcError{ErrCodeDeserialization,
+			"Block decode failed: " + err.Error()}
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	sub := Submission{Data: b, Header: block.Header, Block: &block}
+	sub.Reason = s.checkBlock(&block)
+	sub.Accepted = sub.Reason == ""
+	s.submissions = append(s.submissions, sub)
+	return sub.Reason, nil
+}
+
+// submitWork checks a solution submitted with getwork and records it.
+func (s *Server) submitWork(data string) (bool, *rpcError) {
+	b, err := hex.DecodeString(data)
+	if err != nil {
+		return false, &rpcError{ErrCodeInvalidParams, err.Error()}
+	}
+	if len(b) < wire.MaxBlockHeaderPayload {
+		return false, &rpcError{ErrCodeInvalidParams, fmt.Sprintf(
+			"Argument must be at least %d bytes (not %d)",
+			wire.MaxBlockHeaderPayload, len(b))}
+	}
+	var header wire.BlockHeader
+	if err := header.FromBytes(b[:wire.MaxBlockHeaderPayload]); err != nil {
+		return false, &rpcError{ErrCodeInvalidParams, err.Error()}
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	sub := Submission{Data: b, Header: header}
+	sub.Reason = s.checkSolution(&header)
+	sub.Accepted = sub.Reason == ""
+	s.submissions = append(s.submissions, sub)
+	return sub.Accepted, nil
+}
+
+// checkBlock returns why the solved block is rejected, or an empty string if
+// it is accepted.  The work of the block is found from its coinbase, since
+// the miner may change its outputs and thus the merkle root.  It must be
+// called with the mutex held.
+func (s *Server) checkBlock(block *wire.MsgBlock) string {
+	if len(block.Transactions) == 0 ||
+		len(block.Transactions[0].TxIn) == 0 {
+		return "block without coinbase"
+	}
+	sigScript := block.Transactions[0].TxIn[0].SignatureScript
+	var w *issuedWork
+	for _, hash := range s.order {
+		issued := s.works[hash]
+		if bytes.Equal(issued.coinbase.TxIn[0].SignatureScript, sigScript) {
+			w = issued
+			break
+		}
+	}
+	if w == nil || w.header.PrevBlock != block.Header.PrevBlock {
+		return "stale work"
+	}
+	if block.Header.MerkleRoot != merkleRoot(block.Transactions) {
+		return "bad merkle root"
+	}
+	if int(block.Header.Size) != block.SerializeSize() {
+		return "wrong block size"
+	}
+	return s.checkHeader(&block.Header, w)
+}
+
+// checkSolution returns why the solved header is rejected, or an empty string
+// if it is accepted.  It must be called with the mutex held.
+func (s *Server) checkSolution(header *wire.BlockHeader) string {
+	w, ok := s.works[header.MerkleRoot]
+	if !ok || w.header.PrevBlock != header.PrevBlock {
+		return "stale work"
+	}
+	return s.checkHeader(header, w)
+}
+
+// checkHeader returns why the solved header for work w is rejected, or an
+// empty string if it is accepted.
+func (s *Server) checkHeader(header *wire.BlockHeader, w *issuedWork) string {
+	if header.Timestamp.Before(w.header.Timestamp) {
+		return "timestamp before the work timestamp"
+	}
+	if header.Timestamp.After(time.Now().Add(2 * time.Hour)) {
+		return "timestamp too far in the future"
+	}
+
+	params := s.cfg.ChainParams
+	input, err := header.SerializeEquihashHeaderBytes(
+		params.Algorithm(header.Height))
+	if err != nil {
+		return err.Error()
+	}
+	verify := s.cfg.Verify
+	if verify == nil {
+		verify = func(input, solution []byte) error {
+			return equihash.Verify(params.N, params.K, input,
+				solution)
+		}
+	}
+	err = verify(input, header.EquihashSolution[:])
+	if err != nil {
+		return "invalid solution: " + err.Error()
+	}
+
+	hash := header.BlockHash()
+	if blockchain.HashToBig(&hash).Cmp(w.target) > 0 {
+		return "hash above target"
+	}
+	return ""
+}
@@ -0,0 +1,411 @@
+// Copyright (c) 2018 The ExchangeCoin team
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/EXCCoin/exccd/blockchain"
+	"github.com/EXCCoin/exccd/chaincfg/chainhash"
+	"github.com/EXCCoin/exccd/exccutil"
+	"github.com/EXCCoin/exccd/txscript"
+	"github.com/EXCCoin/exccd/wire"
+
+	"github.com/EXCCoin/gominer/work"
+)
+
+const (
+	// templatePollInterval is how often a new block template is requested
+	// when the daemon does not support long polling or a request failed.
+	templatePollInterval = 5 * time.Second
+
+	// maxTemplates is the number of block templates for the current tip
+	// kept to accept solutions for.
+	maxTemplates = 10
+)
+
+// rpcRequest models a JSON-RPC request.
+type rpcRequest struct {
+	JSONRPC string        `json:"jsonrpc"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+	ID      int           `json:"id"`
+}
+
+// rpcResponse models a JSON-RPC response with a raw result.
+type rpcResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int
+		Message string
+	} `json:"error"`
+}
+
+// rpcCall calls method with params on the configured RPC server and decodes
+// the result into result.  The call is aborted once ctx is done.
+func rpcCall(ctx context.Context, method string, params []interface{}, result interface{}) error {
+	protocol := "http"
+	if !cfg.NoTLS {
+		protocol = "https"
+	}
+	url := protocol + "://" + cfg.RPCServer
+
+	reqBody, err := json.Marshal(&rpcRequest{
+		JSONRPC: "2.0",
+		Method:  method,
+		Params:  params,
+		ID:      1,
+	})
+	if err != nil {
+		return err
+	}
+	httpRequest, err := http.NewRequest("POST", url, bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	httpRequest = httpRequest.WithContext(ctx)
+	httpRequest.Close = true
+	httpRequest.Header.Set("Content-Type", "application/json")
+	httpRequest.SetBasicAuth(cfg.RPCUser, cfg.RPCPassword)
+
+	httpClient, err := newHTTPClient(cfg)
+	if err != nil {
+		return err
+	}
+	httpResponse, err := httpClient.Do(httpRequest)
+	if err != nil {
+		return err
+	}
+
+	body, err := ioutil.ReadAll(httpResponse.Body)
+	httpResponse.Body.Close()
+	if err != nil {
+		return fmt.Errorf("error reading json reply: %v", err)
+	}
+
+	if httpResponse.StatusCode != http.StatusOK {
+		return fmt.Errorf("error calling %s (%s): %s", method,
+			httpResponse.Status, body)
+	}
+
+	var res rpcResponse
+	err = json.Unmarshal(body, &res)
+	if err != nil {
+		return err
+	}
+	if res.Error != nil {
+		return fmt.Errorf("JSONRPC Error %d: %s", res.Error.Code,
+			res.Error.Message)
+	}
+	if result == nil || len(res.Result) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(res.Result, result)
+}
+
+// templateTx models a transaction of a getblocktemplate result.
+type templateTx struct {
+	Data string `json:"data"`
+	Hash string `json:"hash"`
+}
+
+// getBlockTemplateResult models the fields of a getblocktemplate result used
+// by the miner.  Header holds the serialized header of the template, which
+// commits to the coinbase and the regular and stake transactions.
+type getBlockTemplateResult struct {
+	Header        string       `json:"header"`
+	CoinbaseTxn   *templateTx  `json:"coinbasetxn"`
+	Transactions  []templateTx `json:"transactions"`
+	STransactions []templateTx `json:"stransactions"`
+	Target        string       `json:"target"`
+	LongPollID    string       `json:"longpollid"`
+}
+
+// GetBlockTemplate makes a getblocktemplate RPC call.  If longPollID is set
+// the call blocks until the daemon has a template differing from the one it
+// identifies.
+func GetBlockTemplate(ctx context.Context, longPollID string) (*getBlockTemplateResult, error) {
+	request := map[string]interface{}{
+		"mode":         "template",
+		"capabilities": []string{"coinbasetxn", "longpoll"},
+	}
+	if longPollID != "" {
+		request["longpollid"] = longPollID
+	}
+
+	var res getBlockTemplateResult
+	err := rpcCall(ctx, "getblocktemplate", []interface{}{request}, &res)
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// decodeTemplateTx deserializes a transaction of a block template.
+func decodeTemplateTx(tx *templateTx) (*wire.MsgTx, error) {
+	data, err := hex.DecodeString(tx.Data)
+	if err != nil {
+		return nil, err
+	}
+	var msgTx wire.MsgTx
+	err = msgTx.Deserialize(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return &msgTx, nil
+}
+
+// templateBlock builds the block described by a getblocktemplate result.
+func templateBlock(tmpl *getBlockTemplateResult) (*wire.MsgBlock, error) {
+	var block wire.MsgBlock
+
+	header, err := hex.DecodeString(tmpl.Header)
+	if err != nil {
+		return nil, err
+	}
+	if len(header) < wire.MaxBlockHeaderPayload {
+		return nil, fmt.Errorf("Wrong header length: got %d, expected %d",
+			len(header), wire.MaxBlockHeaderPayload)
+	}
+	err = block.Header.Deserialize(bytes.NewReader(header))
+	if err != nil {
+		return nil, err
+	}
+
+	if tmpl.CoinbaseTxn == nil {
+		return nil, fmt.Errorf("block template without coinbase")
+	}
+	coinbase, err := decodeTemplateTx(tmpl.CoinbaseTxn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid coinbase: %v", err)
+	}
+	block.Transactions = append(block.Transactions, coinbase)
+	for i := range tmpl.Transactions {
+		tx, err := decodeTemplateTx(&tmpl.Transactions[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid transaction %v: %v",
+				tmpl.Transactions[i].Hash, err)
+		}
+		block.Transactions = append(block.Transactions, tx)
+	}
+	for i := range tmpl.STransactions {
+		tx, err := decodeTemplateTx(&tmpl.STransactions[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid stake transaction %v: %v",
+				tmpl.STransactions[i].Hash, err)
+		}
+		block.STransactions = append(block.STransactions, tx)
+	}
+
+	return &block, nil
+}
+
+// setPayoutAddress redirects the coinbase outputs paying the block reward
+// to the daemon's mining address to addr instead, and updates the merkle root
+// and size in the header accordingly.  The reward outputs are identified as
+// those sharing the script of the last coinbase output, which leaves other
+// outputs such as subsidy or height commitments untouched.
+func setPayoutAddress(block *wire.MsgBlock, addr exccutil.Address) error {
+	pkScript, err := txscript.PayToAddrScript(addr)
+	if err != nil {
+		return err
+	}
+
+	coinbase := block.Transactions[0]
+	if len(coinbase.TxOut) == 0 {
+		return fmt.Errorf("coinbase without outputs")
+	}
+	payout := coinbase.TxOut[len(coinbase.TxOut)-1].PkScript
+	payout = append([]byte(nil), payout...)
+	for _, txOut := range coinbase.TxOut {
+		if bytes.Equal(txOut.PkScript, payout) {
+			txOut.PkScript = pkScript
+		}
+	}
+
+	txns := make([]*exccutil.Tx, 0, len(block.Transactions))
+	for _, tx := range block.Transactions {
+		txns = append(txns, exccutil.NewTx(tx))
+	}
+	merkles := blockchain.BuildMerkleTreeStore(txns)
+	block.Header.MerkleRoot = *merkles[len(merkles)-1]
+	block.Header.Size = uint32(block.SerializeSize())
+
+	return nil
+}
+
+// blockTemplates holds the blocks of the templates for the current tip which
+// devices may still be working on, keyed by job ID.
+type blockTemplates struct {
+	sync.Mutex
+	blocks map[string]*wire.MsgBlock
+	order  []string
+	tip    chainhash.Hash
+	nextID uint64
+}
+
+func newBlockTemplates() *blockTemplates {
+	return &blockTemplates{
+		blocks: make(map[string]*wire.MsgBlock),
+	}
+}
+
+// add stores the block of a new template and returns the work for it.  The
+// templates of older tips are dropped since solutions for them are stale.
+func (t *blockTemplates) add(tmpl *getBlockTemplateResult) (*work.Work, error) {
+	block, err := templateBlock(tmpl)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.miningAddr != nil {
+		err = setPayoutAddress(block, cfg.miningAddr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var target *big.Int
+	if tmpl.Target != "" {
+		target, _ = new(big.Int).SetString(tmpl.Target, 16)
+		if target == nil {
+			return nil, fmt.Errorf("invalid target %v", tmpl.Target)
+		}
+	} else {
+		target = blockchain.CompactToBig(block.Header.Bits)
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	if block.Header.PrevBlock != t.tip {
+		t.blocks = make(map[string]*wire.MsgBlock)
+		t.order = t.order[:0]
+		t.tip = block.Header.PrevBlock
+	}
+	if len(t.order) == maxTemplates {
+		delete(t.blocks, t.order[0])
+		t.order = t.order[1:]
+	}
+
+	t.nextID++
+	jobID := strconv.FormatUint(t.nextID, 16)
+	t.blocks[jobID] = block
+	t.order = append(t.order, jobID)
+
+	ts := uint32(block.Header.Timestamp.Unix())
+	return work.NewWork(block.Header, target, ts, uint32(time.Now().Unix()),
+		true, jobID), nil
+}
+
+// block returns the solved block for the header serialized in data and the
+// job it was found for, or nil if the job is no longer current.
+func (t *blockTemplates) block(data []byte, jobID string) (*wire.MsgBlock, error) {
+	t.Lock()
+	template, ok := t.blocks[jobID]
+	t.Unlock()
+	if !ok {
+		return nil, nil
+	}
+
+	block := *template
+	err := block.Header.Deserialize(bytes.NewReader(data[:wire.MaxBlockHeaderPayload]))
+	if err != nil {
+		return nil, err
+	}
+	return &block, nil
+}
+
+// SubmitBlock makes a submitblock RPC call for the solved header serialized in
+// data.  It returns false without error if the job is no longer current.
+func (m *Miner) SubmitBlock(data []byte, jobID string) (bool, error) {
+	block, err := m.templates.block(data, jobID)
+	if err != nil {
+		return false, err
+	}
+	if block == nil {
+		return false, nil
+	}
+
+	var buf bytes.Buffer
+	err = block.Serialize(&buf)
+	if err != nil {
+		return false, err
+	}
+
+	// A null result means the block was accepted, otherwise the reason
+	// for rejecting it is returned.
+	var reason *string
+	err = rpcCall(context.Background(), "submitblock",
+		[]interface{}{hex.EncodeToString(buf.Bytes())}, &reason)
+	if err != nil {
+		return false, err
+	}
+	if reason != nil {
+		return false, fmt.Errorf("block %v rejected: %s",
+			block.BlockHash(), *reason)
+	}
+
+	minrLog.Infof("Submitted block %v (height %d)", block.BlockHash(),
+		block.Header.Height)
+	return true, nil
+}
+
+// templateThread keeps the devices working on the latest block template,
+// long polling the daemon for new ones.
+func (m *Miner) templateThread() {
+	defer m.wg.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-m.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var longPollID string
+	for {
+		tmpl, err := GetBlockTemplate(ctx, longPollID)
+		if err == nil {
+			var w *work.Work
+			w, err = m.templates.add(tmpl)
+			if err == nil {
+				for _, d := range m.devices {
+					d.SetWork(w)
+				}
+				longPollID = tmpl.LongPollID
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			minrLog.Errorf("Error in getblocktemplate: %v", err)
+			longPollID = ""
+		}
+
+		// Long polling requests return once there is a new template.
+		if longPollID != "" {
+			continue
+		}
+		select {
+		case <-m.quit:
+			return
+		case <-time.After(templatePollInterval):
+		}
+	}
+}
@@ -0,0 +1,352 @@
+// Copyright (c) 2018 The ExchangeCoin team
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EXCCoin/exccd/blockchain"
+	"github.com/EXCCoin/exccd/chaincfg"
+	"github.com/EXCCoin/exccd/chaincfg/chainhash"
+	"github.com/EXCCoin/exccd/exccutil"
+	"github.com/EXCCoin/exccd/txscript"
+	"github.com/EXCCoin/exccd/wire"
+
+	"github.com/EXCCoin/gominer/exccdtest"
+	"github.com/EXCCoin/gominer/work"
+)
+
+// testPayoutAddress returns the address the tests pay the block reward to.
+func testPayoutAddress(t *testing.T) (exccutil.Address, []byte) {
+	t.Helper()
+	addr, err := exccutil.NewAddressScriptHashFromHash(
+		bytes.Repeat([]byte{0x02}, 20), &chaincfg.SimNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkScript, err := txscript.PayToAddrScript(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr, pkScript
+}
+
+// getTemplate returns the current block template of the daemon.
+func getTemplate(t *testing.T) *getBlockTemplateResult {
+	t.Helper()
+	tmpl, err := GetBlockTemplate(context.Background(), "")
+	if err != nil {
+		t.Fatalf("GetBlockTemplate: %v", err)
+	}
+	return tmpl
+}
+
+// templateTip returns the tip the templates of m are for.
+func templateTip(m *Miner) chainhash.Hash {
+	m.templates.Lock()
+	defer m.templates.Unlock()
+	return m.templates.tip
+}
+
+// waitFor waits for cond to hold, failing the test after timeout.
+func waitFor(t *testing.T, what string, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTemplateBlock(t *testing.T) {
+	srv := newTestDaemon(t)
+	tmpl := getTemplate(t)
+	block, err := templateBlock(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := srv.CurrentWork()
+	if block.Header.BlockHash() != header.BlockHash() {
+		t.Errorf("Template block with header %v, want %v", block.Header,
+			header)
+	}
+	if len(block.Transactions) != 1 || len(block.STransactions) != 0 {
+		t.Fatalf("Template block with %d transactions and %d stake "+
+			"transactions, want the coinbase only",
+			len(block.Transactions), len(block.STransactions))
+	}
+	if hash := block.Transactions[0].TxHash(); hash.String() !=
+		tmpl.CoinbaseTxn.Hash {
+		t.Errorf("Template block with coinbase %v, want %v", hash,
+			tmpl.CoinbaseTxn.Hash)
+	}
+
+	tests := []struct {
+		name   string
+		change func(tmpl *getBlockTemplateResult)
+		err    string
+	}{{
+		name: "short header",
+		change: func(tmpl *getBlockTemplateResult) {
+			tmpl.Header = tmpl.Header[:len(tmpl.Header)-2]
+		},
+		err: "header length",
+	}, {
+		name: "no coinbase",
+		change: func(tmpl *getBlockTemplateResult) {
+			tmpl.CoinbaseTxn = nil
+		},
+		err: "without coinbase",
+	}, {
+		name: "invalid coinbase",
+		change: func(tmpl *getBlockTemplateResult) {
+			tmpl.CoinbaseTxn = &templateTx{Data: "00"}
+		},
+		err: "invalid coinbase",
+	}, {
+		name: "invalid transaction",
+		change: func(tmpl *getBlockTemplateResult) {
+			tmpl.Transactions = []templateTx{{Data: "00"}}
+		},
+		err: "invalid transaction",
+	}, {
+		name: "invalid stake transaction",
+		change: func(tmpl *getBlockTemplateResult) {
+			tmpl.STransactions = []templateTx{{Data: "zz"}}
+		},
+		err: "invalid stake transaction",
+	}}
+	for _, test := range tests {
+		changed := *tmpl
+		test.change(&changed)
+		_, err := templateBlock(&changed)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, want one about %q", test.name,
+				err, test.err)
+		}
+	}
+}
+
+func TestSetPayoutAddress(t *testing.T) {
+	newTestDaemon(t)
+	tmpl := getTemplate(t)
+	block, err := templateBlock(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig, err := templateBlock(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The daemon pays the subsidy of the organization first, then commits
+	// to the height before paying the reward, here in two outputs.
+	coinbase := block.Transactions[0]
+	if len(coinbase.TxOut) != 3 {
+		t.Fatalf("Coinbase with %d outputs, want 3", len(coinbase.TxOut))
+	}
+	reward := coinbase.TxOut[2]
+	coinbase.TxOut = append(coinbase.TxOut, wire.NewTxOut(reward.Value,
+		append([]byte(nil), reward.PkScript...)))
+
+	addr, pkScript := testPayoutAddress(t)
+	if err := setPayoutAddress(block, addr); err != nil {
+		t.Fatal(err)
+	}
+	for i, txOut := range coinbase.TxOut {
+		want := pkScript
+		if i < 2 {
+			want = orig.Transactions[0].TxOut[i].PkScript
+		}
+		if !bytes.Equal(txOut.PkScript, want) {
+			t.Errorf("Coinbase output %d pays to %x, want %x", i,
+				txOut.PkScript, want)
+		}
+	}
+
+	merkles := blockchain.BuildMerkleTreeStore([]*exccutil.Tx{
+		exccutil.NewTx(coinbase),
+	})
+	if root := *merkles[len(merkles)-1]; block.Header.MerkleRoot != root ||
+		root == orig.Header.MerkleRoot {
+		t.Errorf("Header with merkle root %v, want %v",
+			block.Header.MerkleRoot, root)
+	}
+	if size := block.SerializeSize(); block.Header.Size != uint32(size) {
+		t.Errorf("Header with size %d, want %d", block.Header.Size, size)
+	}
+
+	coinbase.TxOut = nil
+	if err := setPayoutAddress(block, addr); err == nil {
+		t.Error("Payout address set for a coinbase without outputs")
+	}
+}
+
+func TestBlockTemplates(t *testing.T) {
+	srv := newTestDaemon(t)
+	templates := newBlockTemplates()
+	data := make([]byte, work.GetworkDataLen)
+
+	// Only the last templates for the tip are kept.
+	var jobs []string
+	for i := 0; i <= maxTemplates; i++ {
+		if i > 0 {
+			if err := srv.NewWork(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		w, err := templates.add(getTemplate(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Target.Cmp(maxTestTarget) != 0 {
+			t.Errorf("Work with target %064x, want %064x", w.Target,
+				maxTestTarget)
+		}
+		jobs = append(jobs, w.JobID)
+	}
+	for i, jobID := range jobs {
+		block, err := templates.block(data, jobID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (block != nil) != (i > 0) {
+			t.Errorf("Template %d of %d kept: %v", i+1, len(jobs),
+				block != nil)
+		}
+	}
+
+	// A template for a new tip drops all others.
+	if err := srv.NewBlock(); err != nil {
+		t.Fatal(err)
+	}
+	w, err := templates.add(getTemplate(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, jobID := range append(jobs, w.JobID) {
+		block, err := templates.block(data, jobID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (block != nil) != (jobID == w.JobID) {
+			t.Errorf("Template %v kept after the tip changed: %v",
+				jobID, block != nil)
+		}
+	}
+}
+
+func TestSubmitBlockRoundTrip(t *testing.T) {
+	srv := newTestDaemon(t)
+	addr, pkScript := testPayoutAddress(t)
+	cfg.miningAddr = addr
+	m := &Miner{templates: newBlockTemplates()}
+
+	w, err := m.templates.add(getTemplate(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := solveWork(t, w)
+	accepted, err := m.SubmitBlock(data, w.JobID)
+	if err != nil || !accepted {
+		t.Fatalf("Block not accepted (error %v)", err)
+	}
+	subs := srv.Submissions()
+	if len(subs) != 1 || !subs[0].Accepted || subs[0].Block == nil {
+		t.Fatalf("Daemon recorded submissions %+v, want one accepted "+
+			"block", subs)
+	}
+	coinbase := subs[0].Block.Transactions[0]
+	payout := coinbase.TxOut[len(coinbase.TxOut)-1].PkScript
+	if !bytes.Equal(payout, pkScript) {
+		t.Errorf("Block pays to %x, want %x", payout, pkScript)
+	}
+
+	// The daemon rejects blocks with an invalid solution.
+	invalid := append([]byte(nil), data...)
+	invalid[wire.MaxBlockHeaderPayload-1] ^= 1
+	_, err = m.SubmitBlock(invalid, w.JobID)
+	if err == nil || !strings.Contains(err.Error(), "invalid solution") {
+		t.Errorf("Block with invalid solution submitted with error %v",
+			err)
+	}
+
+	// Solutions for the templates of a previous tip are dropped.
+	if err := srv.NewBlock(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.templates.add(getTemplate(t)); err != nil {
+		t.Fatal(err)
+	}
+	accepted, err = m.SubmitBlock(data, w.JobID)
+	if err != nil || accepted {
+		t.Errorf("Block for dropped template accepted %v (error %v)",
+			accepted, err)
+	}
+	if n := len(srv.Submissions()); n != 2 {
+		t.Errorf("Daemon got %d blocks, want 2", n)
+	}
+}
+
+func TestTemplateThread(t *testing.T) {
+	srv := newTestDaemon(t)
+	m := &Miner{
+		templates: newBlockTemplates(),
+		quit:      make(chan struct{}),
+	}
+	m.wg.Add(1)
+	go m.templateThread()
+	defer func() {
+		close(m.quit)
+		done := make(chan struct{})
+		go func() {
+			m.wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(controlTimeout):
+			t.Error("Template thread not stopped while long polling")
+		}
+	}()
+
+	// The first template is followed by a long poll, which returns once
+	// there is a new block.
+	waitFor(t, "long poll", controlTimeout, func() bool {
+		return srv.TemplateCalls() == 2
+	})
+	if tip := srv.CurrentWork().PrevBlock; templateTip(m) != tip {
+		t.Errorf("Templates for tip %v, want %v", templateTip(m), tip)
+	}
+	if err := srv.NewBlock(); err != nil {
+		t.Fatal(err)
+	}
+	tip := srv.CurrentWork().PrevBlock
+	waitFor(t, "template for the new block", controlTimeout, func() bool {
+		return templateTip(m) == tip && srv.TemplateCalls() == 3
+	})
+
+	// After a failed long poll, the template is requested again after the
+	// poll interval before long polling again.
+	srv.FailNext(exccdtest.ErrCodeMisc, "Server busy")
+	if err := srv.NewWork(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "failed long poll", controlTimeout, func() bool {
+		return srv.TemplateCalls() == 4
+	})
+	start := time.Now()
+	waitFor(t, "new long poll", templatePollInterval+controlTimeout,
+		func() bool {
+			return srv.TemplateCalls() == 6
+		})
+	if d := time.Since(start); d < templatePollInterval/2 {
+		t.Errorf("Template requested again after %v", d)
+	}
+}
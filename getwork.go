@@ -197,6 +197,30 @@ func GetWork() (*work.Work, error) {
 	return w, nil
 }
 
+// newPoolTLSConfig returns the TLS configuration for secure stratum pools,
+// which verifies the pool certificates against the --poolcert bundle if one
+// is given and honors --skipverify.
+func newPoolTLSConfig(cfg *config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: cfg.TLSSkipVerify,
+	}
+	if cfg.PoolCert != "" {
+		pem, err := ioutil.ReadFile(cfg.PoolCert)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %v",
+				cfg.PoolCert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+}
+
 // GetPoolWork gets work from a stratum enabled pool
 func GetPoolWork(pool *stratum.Stratum) (*work.Work, error) {
 	// Get Next work for stratum and mark it as used
@@ -285,27 +309,19 @@ func GetWorkSubmit(data []byte) (bool, error) {
 }
 
 // GetPoolWorkSubmit sends the result to the stratum enabled pool
-func GetPoolWorkSubmit(data []byte, pool *stratum.Stratum, jobID string) (bool, error) {
+func GetPoolWorkSubmit(data []byte, pool *stratum.Stratum, jobID string, device int) (bool, error) {
+	// The pool is only locked to prepare the submission, the write to
+	// the connection being done without holding up the pool.
 	pool.Lock()
-	defer pool.Unlock()
-	sub, err := pool.PrepSubmit(data, jobID)
-	if err != nil {
-		return false, err
-	}
-
-	// JSON encode.
-	m, err := json.Marshal(sub)
+	sub, err := pool.PrepSubmit(data, jobID, device)
+	pool.Unlock()
 	if err != nil {
 		return false, err
 	}
 
 	// Send.
-	poolLog.Tracef("%s", m)
-	_, err = pool.Conn.Write(m)
-	if err != nil {
-		return false, err
-	}
-	_, err = pool.Conn.Write([]byte("\n"))
+	poolLog.Tracef("%v", sub)
+	err = pool.Send(sub)
 	if err != nil {
 		return false, err
 	}
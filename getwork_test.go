@@ -0,0 +1,192 @@
+// Copyright (c) 2018 The ExchangeCoin team
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EXCCoin/exccd/chaincfg"
+	"github.com/EXCCoin/exccd/wire"
+
+	"github.com/EXCCoin/gominer/exccdtest"
+	"github.com/EXCCoin/gominer/internal/testsolution"
+	"github.com/EXCCoin/gominer/work"
+)
+
+// maxTestTarget is the target of the work of the tests, which any hash meets.
+var maxTestTarget = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256),
+	big.NewInt(1))
+
+// newTestDaemon starts a daemon serving getwork over HTTPS and points the
+// RPC settings of the configuration to it for the duration of the test.
+func newTestDaemon(t *testing.T) *exccdtest.Server {
+	t.Helper()
+	srv, err := exccdtest.NewServer(exccdtest.Config{
+		ChainParams: &chaincfg.SimNetParams,
+		User:        "user",
+		Pass:        "pass",
+		Target:      maxTestTarget,
+		Verify:      testsolution.Verify,
+	})
+	if err != nil {
+		t.Fatalf("Unable to start daemon: %v", err)
+	}
+	t.Cleanup(srv.Close)
+
+	certFile := filepath.Join(t.TempDir(), "rpc.cert")
+	if err := ioutil.WriteFile(certFile, srv.CertPEM(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	saved := cfg
+	cfg = &config{
+		RPCServer:   srv.Addr(),
+		RPCUser:     "user",
+		RPCPassword: "pass",
+		RPCCert:     certFile,
+	}
+	t.Cleanup(func() { cfg = saved })
+	return srv
+}
+
+// solveWork solves w with the test solution and returns the data submitted
+// with getwork, as done by the devices.
+func solveWork(t *testing.T, w *work.Work) []byte {
+	t.Helper()
+	algo := chaincfg.SimNetParams.Algorithm(w.BlockHeader.Height)
+	input, err := w.BlockHeader.SerializeEquihashHeaderBytes(algo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(w.BlockHeader.EquihashSolution[:], testsolution.Solution(input))
+
+	data := make([]byte, 0, work.GetworkDataLen)
+	buf := bytes.NewBuffer(data)
+	if err := w.BlockHeader.Serialize(buf); err != nil {
+		t.Fatal(err)
+	}
+	return data[:work.GetworkDataLen]
+}
+
+func TestGetWorkRoundTrip(t *testing.T) {
+	srv := newTestDaemon(t)
+
+	w, err := GetWork()
+	if err != nil {
+		t.Fatalf("GetWork: %v", err)
+	}
+	header := srv.CurrentWork()
+	if w.BlockHeader.MerkleRoot != header.MerkleRoot ||
+		w.BlockHeader.PrevBlock != header.PrevBlock ||
+		w.BlockHeader.Height != header.Height {
+		t.Errorf("Got work for header %v, want %v", w.BlockHeader, header)
+	}
+	if w.Target.Cmp(maxTestTarget) != 0 {
+		t.Errorf("Got target %064x, want %064x", w.Target, maxTestTarget)
+	}
+	if w.JobTime != uint32(header.Timestamp.Unix()) {
+		t.Errorf("Got job time %d, want %d", w.JobTime,
+			header.Timestamp.Unix())
+	}
+	if srv.GetWorkCalls() != 1 {
+		t.Errorf("Daemon got %d getwork calls, want 1", srv.GetWorkCalls())
+	}
+
+	// The solution is accepted once, with a rolled timestamp.
+	w.BlockHeader.Timestamp = w.BlockHeader.Timestamp.Add(time.Second)
+	accepted, err := GetWorkSubmit(solveWork(t, w))
+	if err != nil || !accepted {
+		t.Fatalf("Solution not accepted (error %v)", err)
+	}
+	subs := srv.Submissions()
+	if len(subs) != 1 || !subs[0].Accepted {
+		t.Fatalf("Daemon recorded submissions %+v, want one accepted",
+			subs)
+	}
+	if !subs[0].Header.Timestamp.Equal(w.BlockHeader.Timestamp) {
+		t.Errorf("Daemon got timestamp %v, want %v",
+			subs[0].Header.Timestamp, w.BlockHeader.Timestamp)
+	}
+
+	// Solutions for the previous block are stale.
+	if err := srv.NewBlock(); err != nil {
+		t.Fatal(err)
+	}
+	accepted, err = GetWorkSubmit(solveWork(t, w))
+	if err != nil || accepted {
+		t.Fatalf("Stale solution accepted %v (error %v)", accepted, err)
+	}
+	subs = srv.Submissions()
+	if len(subs) != 2 || subs[1].Reason != "stale work" {
+		t.Errorf("Daemon recorded submissions %+v, want the second one "+
+			"stale", subs)
+	}
+}
+
+func TestGetWorkInvalidSolution(t *testing.T) {
+	srv := newTestDaemon(t)
+	w, err := GetWork()
+	if err != nil {
+		t.Fatalf("GetWork: %v", err)
+	}
+	data := solveWork(t, w)
+	data[wire.MaxBlockHeaderPayload-1] ^= 1
+	accepted, err := GetWorkSubmit(data)
+	if err != nil || accepted {
+		t.Fatalf("Invalid solution accepted %v (error %v)", accepted, err)
+	}
+	subs := srv.Submissions()
+	if len(subs) != 1 || !strings.HasPrefix(subs[0].Reason,
+		"invalid solution") {
+		t.Errorf("Daemon recorded submissions %+v, want one invalid", subs)
+	}
+}
+
+func TestGetWorkTarget(t *testing.T) {
+	srv := newTestDaemon(t)
+	target := new(big.Int).Lsh(big.NewInt(0x1234), 200)
+	srv.SetTarget(target)
+	if err := srv.NewWork(); err != nil {
+		t.Fatal(err)
+	}
+	w, err := GetWork()
+	if err != nil {
+		t.Fatalf("GetWork: %v", err)
+	}
+	if w.Target.Cmp(target) != 0 {
+		t.Errorf("Got target %064x, want %064x", w.Target, target)
+	}
+}
+
+func TestGetWorkErrors(t *testing.T) {
+	srv := newTestDaemon(t)
+
+	srv.FailNext(exccdtest.ErrCodeMisc, "Block not found")
+	_, err := GetWork()
+	if err == nil || !strings.Contains(err.Error(), "Block not found") {
+		t.Errorf("GetWork with JSON-RPC error returned %v", err)
+	}
+
+	srv.FailNextStatus(503, "Loading block index")
+	_, err = GetWork()
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("GetWork with HTTP 503 returned %v", err)
+	}
+
+	srv.FailNext(exccdtest.ErrCodeMisc, "Node not synced")
+	_, err = GetWorkSubmit(make([]byte, work.GetworkDataLen))
+	if err == nil || !strings.Contains(err.Error(), "Node not synced") {
+		t.Errorf("GetWorkSubmit with JSON-RPC error returned %v", err)
+	}
+
+	cfg.RPCPassword = "wrong"
+	_, err = GetWork()
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("GetWork with wrong credentials returned %v", err)
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright (c) 2018 The ExchangeCoin team
+
+// Package testsolution provides the Equihash solutions the fake daemons and
+// pools of the tests expect.  Solving the Equihash of the network takes far
+// too long for the tests, which are about the messages exchanged rather than
+// the solutions.  The solution is derived from the whole input nonetheless,
+// for the servers to check the header rebuilt from a submission.
+package testsolution
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"errors"
+
+	"github.com/EXCCoin/exccd/wire"
+)
+
+// Solution returns the solution expected for the Equihash input of a header.
+func Solution(input []byte) []byte {
+	sum := sha512.Sum512(input)
+	next := sha512.Sum512(sum[:])
+	solution := append(sum[:], next[:]...)
+	return solution[:len(wire.BlockHeader{}.EquihashSolution)]
+}
+
+// Verify checks the solution of a submitted header against the one expected
+// for its Equihash input.
+func Verify(input, solution []byte) error {
+	if !bytes.Equal(solution, Solution(input)) {
+		return errors.New("Solution does not match the header")
+	}
+	return nil
+}
@@ -7,7 +7,11 @@ import (
 	"os/signal"
 	"runtime"
 	"runtime/pprof"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/EXCCoin/gominer/stratum"
 )
 
 var (
@@ -30,6 +34,11 @@ func gominerMain() error {
 
 	// Show version at startup.
 	mainLog.Infof("Version %s %s (Go version %s)", version(), gpuLib(), runtime.Version())
+	mainLog.Infof("Mining on %s", activeNetParams.Name)
+
+	if cfg.ReplayTranscript != "" {
+		return replayTranscript(cfg.ReplayTranscript)
+	}
 
 	// Enable http profiling server if requested.
 	if cfg.Profile != "" {
@@ -84,12 +93,27 @@ func gominerMain() error {
 		go RunMonitor(m)
 	}
 
+	// SIGHUP reloads the config file.  The first SIGINT or SIGTERM stops
+	// the miner, giving it the shutdown grace period to submit the
+	// solutions already found, while another one abandons them.
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 	go func() {
-		<-c
-		mainLog.Warn("Got Control+C, exiting...")
-		m.Stop()
+		stopping := false
+		for sig := range c {
+			switch {
+			case sig == syscall.SIGHUP:
+				reloadConfig(m)
+			case !stopping:
+				mainLog.Warnf("Got %v, exiting...", sig)
+				stopping = true
+				m.Stop()
+			default:
+				mainLog.Warnf("Got %v again, exiting without "+
+					"submitting the solutions left", sig)
+				m.Abort()
+			}
+		}
 	}()
 
 	m.Run()
@@ -97,6 +121,35 @@ func gominerMain() error {
 	return nil
 }
 
+// replayTranscript replays a pool transcript through the stratum client and
+// reports whether the client behaved as recorded.
+func replayTranscript(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		mainLog.Errorf("Unable to open transcript: %v", err)
+		return err
+	}
+	entries, err := stratum.ReadTranscript(f)
+	f.Close()
+	if err != nil {
+		mainLog.Errorf("Unable to read transcript: %v", err)
+		return err
+	}
+
+	pool, err := stratum.Replay(entries, activeNetParams.Params)
+	if err != nil {
+		mainLog.Errorf("Replay of %v diverged: %v", path, err)
+		return err
+	}
+	mainLog.Infof("Replayed %d entries of %v", len(entries), path)
+	if pool != nil {
+		mainLog.Infof("Final state: %v, accepted: %v, rejected: %v",
+			pool.State(), atomic.LoadUint64(&pool.ValidShares),
+			atomic.LoadUint64(&pool.InvalidShares))
+	}
+	return nil
+}
+
 func main() {
 	// Use all processor cores.
 	runtime.GOMAXPROCS(runtime.NumCPU())
@@ -0,0 +1,20 @@
+// Copyright (c) 2018 The ExchangeCoin team
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestMain(tm *testing.M) {
+	// The loggers write to the log rotator, which is not initialized by
+	// the tests, so the logs are discarded.
+	pr, pw := io.Pipe()
+	go io.Copy(ioutil.Discard, pr)
+	logRotatorPipe = pw
+	setLogLevels("off")
+	os.Exit(tm.Run())
+}
@@ -0,0 +1,186 @@
+// Copyright (c) 2018 The ExchangeCoin team
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/EXCCoin/gominer/stratum"
+)
+
+// metricSample is a single sample of a metric with its rendered labels.
+type metricSample struct {
+	labels string
+	value  float64
+}
+
+// labelValueReplacer escapes label values for the text exposition format.
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricLabels renders the passed label name and value pairs.
+func metricLabels(pairs ...string) string {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf, `%s="%s"`, pairs[i],
+			labelValueReplacer.Replace(pairs[i+1]))
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
+
+// writeMetric writes a metric with its samples in the Prometheus text
+// exposition format.
+func writeMetric(w io.Writer, name, typ, help string, samples ...metricSample) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+	for _, s := range samples {
+		fmt.Fprintf(w, "%s%s %s\n", name, s.labels,
+			strconv.FormatFloat(s.value, 'g', -1, 64))
+	}
+}
+
+// getMinerMetrics serves the miner and device statistics to Prometheus.
+func getMinerMetrics(w http.ResponseWriter, req *http.Request) {
+	var buf bytes.Buffer
+	var shares *stratum.ShareStats
+
+	valid, rejected, stale, _, _ := m.Status()
+	writeMetric(&buf, "gominer_shares_accepted_total", "counter",
+		"Number of shares or blocks accepted.",
+		metricSample{value: float64(valid)})
+	writeMetric(&buf, "gominer_shares_rejected_total", "counter",
+		"Number of shares or blocks rejected.",
+		metricSample{value: float64(rejected)})
+	writeMetric(&buf, "gominer_shares_stale_total", "counter",
+		"Number of shares or blocks found for outdated work.",
+		metricSample{value: float64(stale)})
+	writeMetric(&buf, "gominer_uptime_seconds", "gauge",
+		"Number of seconds since the miner started.",
+		metricSample{value: float64(uint32(time.Now().Unix()) - m.started)})
+
+	if m.pools != nil {
+		priority, pc := m.pools.Active()
+		pool := m.pools.Pool()
+		pool.Lock()
+		diff := pool.Diff
+		pool.Unlock()
+		connected := 0.0
+		if pool.Connected() {
+			connected = 1
+		}
+		labels := metricLabels("pool", pc.URL,
+			"priority", strconv.Itoa(priority))
+
+		writeMetric(&buf, "gominer_pool_difficulty", "gauge",
+			"Share difficulty set by the active pool.",
+			metricSample{labels, diff})
+		writeMetric(&buf, "gominer_pool_connected", "gauge",
+			"Whether the worker is authorized on the active pool.",
+			metricSample{labels, connected})
+		writeMetric(&buf, "gominer_pool_reconnects_total", "counter",
+			"Number of times the connection to a pool was reestablished.",
+			metricSample{value: float64(m.pools.Reconnects())})
+
+		stats := m.pools.Shares().Stats()
+		var rejects []metricSample
+		for _, reason := range stratum.RejectReasons {
+			rejects = append(rejects, metricSample{
+				metricLabels("reason", reason.String()),
+				float64(stats.Rejected[reason]),
+			})
+		}
+		writeMetric(&buf, "gominer_pool_shares_rejected_total", "counter",
+			"Number of shares rejected by pools per reason.", rejects...)
+		writeMetric(&buf, "gominer_pool_share_responses_total", "counter",
+			"Number of responses of pools to submitted shares.",
+			metricSample{value: float64(stats.Responses)})
+		writeMetric(&buf, "gominer_pool_share_latency_seconds_total", "counter",
+			"Total time pools took to respond to submitted shares.",
+			metricSample{value: stats.TotalLatency.Seconds()})
+		var addrs []string
+		for addr := range stats.PoolLatency {
+			addrs = append(addrs, addr)
+		}
+		sort.Strings(addrs)
+		var rtts, lastRTTs []metricSample
+		for _, addr := range addrs {
+			latency := stats.PoolLatency[addr]
+			labels := metricLabels("address", addr)
+			rtts = append(rtts, metricSample{labels,
+				latency.Average().Seconds()})
+			lastRTTs = append(lastRTTs, metricSample{labels,
+				latency.Last.Seconds()})
+		}
+		writeMetric(&buf, "gominer_pool_share_rtt_average_seconds", "gauge",
+			"Average time each pool took to respond to submitted shares.",
+			rtts...)
+		writeMetric(&buf, "gominer_pool_share_rtt_last_seconds", "gauge",
+			"Time each pool took to respond to the last submitted share.",
+			lastRTTs...)
+		writeMetric(&buf, "gominer_pool_effective_solution_rate", "gauge",
+			"Average number of difficulty 1 solutions per second accounted for by accepted shares.",
+			metricSample{value: stats.EffectiveHashRate()})
+		shares = &stats
+	}
+
+	var rates, effectiveRates, solutions, hwErrors, temperatures, fans []metricSample
+	var switches, switchLatencies []metricSample
+	for _, d := range m.devices {
+		d.UpdateFanTemp()
+		rate, fanPercent, temperature := d.Status()
+		labels := metricLabels("device", strconv.Itoa(d.index),
+			"name", d.deviceName)
+
+		rates = append(rates, metricSample{labels, rate})
+		if shares != nil {
+			effectiveRates = append(effectiveRates, metricSample{labels,
+				shares.DeviceEffectiveHashRate(d.index)})
+		}
+		solutions = append(solutions, metricSample{labels,
+			float64(atomic.LoadUint64(&d.allDiffOneShares))})
+		hwErrors = append(hwErrors, metricSample{labels,
+			float64(atomic.LoadUint64(&d.hwErrors))})
+		latency, _, n := d.WorkSwitchLatency()
+		switches = append(switches, metricSample{labels, float64(n)})
+		switchLatencies = append(switchLatencies, metricSample{labels,
+			latency.Seconds() * float64(n)})
+		if d.fanTempActive {
+			temperatures = append(temperatures,
+				metricSample{labels, float64(temperature)})
+			fans = append(fans, metricSample{labels, float64(fanPercent)})
+		}
+	}
+	writeMetric(&buf, "gominer_device_solution_rate", "gauge",
+		"Average number of valid solutions found per second.", rates...)
+	writeMetric(&buf, "gominer_device_effective_solution_rate", "gauge",
+		"Average number of difficulty 1 solutions per second accounted for by accepted shares.",
+		effectiveRates...)
+	writeMetric(&buf, "gominer_device_solutions_total", "counter",
+		"Number of valid solutions found.", solutions...)
+	writeMetric(&buf, "gominer_device_hw_errors_total", "counter",
+		"Number of invalid solutions discarded.", hwErrors...)
+	writeMetric(&buf, "gominer_device_work_switches_total", "counter",
+		"Number of times the device switched to new work.", switches...)
+	writeMetric(&buf, "gominer_device_work_switch_latency_seconds_total", "counter",
+		"Total time the device took to switch to new work since it was received.",
+		switchLatencies...)
+	writeMetric(&buf, "gominer_device_temperature_celsius", "gauge",
+		"Device temperature.", temperatures...)
+	writeMetric(&buf, "gominer_device_fan_percent", "gauge",
+		"Device fan speed.", fans...)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
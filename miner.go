@@ -9,12 +9,14 @@ import (
 	"time"
 
 	"github.com/EXCCoin/gominer/stratum"
+	"github.com/EXCCoin/gominer/util"
 	"github.com/EXCCoin/gominer/work"
 )
 
 type WorkResult struct {
-	data  []byte
-	jobID string
+	data   []byte
+	jobID  string
+	device int
 }
 
 type Miner struct {
@@ -28,26 +30,82 @@ type Miner struct {
 	workDone         chan WorkResult
 	quit             chan struct{}
 	needsWorkRefresh chan struct{}
+	stopOnce         sync.Once
 	wg               sync.WaitGroup
-	pool             *stratum.Stratum
+	pools            *stratum.Failover
+	templates        *blockTemplates
+
+	// transcript records the sessions with the pools when enabled.
+	transcript *stratum.Transcript
+
+	// server serves the work fetched with getwork to other miners when
+	// running a stratum server.
+	server *stratum.Server
+
+	// devicesWg and submitWg track the devices and the submission
+	// workers, which are waited for on shutdown before the pool is
+	// disconnected so that the solutions found are submitted.
+	devicesWg sync.WaitGroup
+	submitWg  sync.WaitGroup
+
+	// abort is closed to abandon the solutions left to submit on
+	// shutdown.
+	abort     chan struct{}
+	abortOnce sync.Once
 }
 
 func NewMiner() (*Miner, error) {
 	m := &Miner{
-		workDone:         make(chan WorkResult, 10),
+		workDone:         make(chan WorkResult, submitQueueLen),
 		quit:             make(chan struct{}),
-		needsWorkRefresh: make(chan struct{}),
+		needsWorkRefresh: make(chan struct{}, 1),
+		abort:            make(chan struct{}),
 	}
 
 	m.devices = make([]*Device, 0)
 
 	// If needed, start pool code.
-	if cfg.Pool != "" && !cfg.Benchmark {
-		s, err := stratum.StratumConn(cfg.Pool, cfg.PoolUser, cfg.PoolPassword, cfg.Proxy, cfg.ProxyUser, cfg.ProxyPass, version())
+	if len(cfg.Pools) > 0 && !cfg.Benchmark {
+		tlsConfig, err := newPoolTLSConfig(cfg)
 		if err != nil {
 			return nil, err
 		}
-		m.pool = s
+		if cfg.PoolTranscript != "" {
+			m.transcript, err = stratum.CreateTranscript(
+				cfg.PoolTranscript)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to record the pool "+
+					"transcript: %v", err)
+			}
+			poolLog.Infof("Recording the pool transcript to %v",
+				cfg.PoolTranscript)
+		}
+		f, err := stratum.NewFailover(stratum.FailoverConfig{
+			Pools:           cfg.Pools,
+			Proxy:           cfg.Proxy,
+			ProxyUser:       cfg.ProxyUser,
+			ProxyPass:       cfg.ProxyPass,
+			Version:         version(),
+			Dialect:         cfg.PoolDialect,
+			TLS:             tlsConfig,
+			ChainParams:     activeNetParams.Params,
+			MaxFailures:     cfg.PoolMaxFailures,
+			MaxReconnects:   cfg.PoolMaxReconnects,
+			NoWorkTimeout:   cfg.PoolNoWorkTimeout,
+			ProbeInterval:   cfg.PoolProbeInterval,
+			Transcript:      m.transcript,
+			KeepAlive:       cfg.PoolKeepAlive,
+			ReadTimeout:     cfg.PoolTimeout,
+			ResponseTimeout: cfg.PoolShareTimeout,
+		})
+		if err != nil {
+			return nil, err
+		}
+		m.pools = f
+	}
+
+	if cfg.GBT && !cfg.Benchmark {
+		m.templates = newBlockTemplates()
 	}
 
 	m, deviceListEnabledCount, err := newMinerDevs(m)
@@ -59,96 +117,142 @@ func NewMiner() (*Miner, error) {
 		return nil, fmt.Errorf("No devices started")
 	}
 
+	if cfg.StratumListen != "" {
+		s, err := stratum.NewServer(stratum.ServerConfig{
+			Listen:      cfg.StratumListen,
+			ChainParams: activeNetParams.Params,
+			Difficulty:  cfg.StratumDifficulty,
+			Submit:      m.submitServerWork,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Unable to start the stratum "+
+				"server: %v", err)
+		}
+		m.server = s
+	}
+
 	m.started = uint32(time.Now().Unix())
 
 	return m, nil
 }
 
-func (m *Miner) workSubmitThread() {
+// workRefreshThread hands new work to the devices as soon as the pool sends
+// a job, or as found polling the daemon with getwork.  The pool is polled as
+// well in case a job notification was missed.
+func (m *Miner) workRefreshThread() {
 	defer m.wg.Done()
 
+	t := time.NewTicker(cfg.WorkRefresh)
+	defer t.Stop()
+
+	// last is the work last handed to the devices with getwork, which is
+	// only handed to them again once it changed.
+	var last *work.Work
+
 	for {
-		select {
-		case <-m.quit:
-			return
-		case workResult := <-m.workDone:
-			// Only use that is we are not using a pool.
-			if m.pool == nil {
-				accepted, err := GetWorkSubmit(workResult.data)
+		// newJobs signals that the pool sent a job, to hand the
+		// devices the new work without waiting.
+		var newJobs <-chan struct{}
+
+		// Only use that is we are not using a pool.
+		if m.pools == nil {
+			w, err := GetWork()
+			if err != nil {
+				minrLog.Errorf("Error in getwork: %v", err)
+			} else if last == nil ||
+				w.BlockHeader.BlockHash() != last.BlockHeader.BlockHash() {
+				// Work on top of a new block makes the previous
+				// work stale.
+				w.Clean = last == nil ||
+					w.BlockHeader.PrevBlock != last.BlockHeader.PrevBlock
+				m.dispatchWork(m.serveWork(w))
+				last = w
+			}
+		} else {
+			pool := m.pools.Pool()
+			newJobs = pool.NewJobs()
+			pool.Lock()
+			if pool.PoolWork.NewWork {
+				w, err := GetPoolWork(pool)
+				pool.Unlock()
 				if err != nil {
-					atomic.AddUint64(&m.invalidShares, 1)
-					minrLog.Errorf("Error submitting work: %v", err)
+					minrLog.Errorf("Error in getpoolwork: %v", err)
 				} else {
-					if accepted {
-						atomic.AddUint64(&m.validShares, 1)
-						minrLog.Debugf("Submitted work successfully: %v", accepted)
-					} else {
-						atomic.AddUint64(&m.invalidShares, 1)
-					}
-
-					m.needsWorkRefresh <- struct{}{}
+					m.dispatchWork(m.serveWork(w))
 				}
 			} else {
-				submitted, err := GetPoolWorkSubmit(workResult.data, m.pool, workResult.jobID)
-				if err != nil {
-					switch err {
-					case stratum.ErrStratumStaleWork:
-						atomic.AddUint64(&m.staleShares, 1)
-						minrLog.Debugf("Share submitted to pool was stale")
-
-					default:
-						atomic.AddUint64(&m.invalidShares, 1)
-						minrLog.Errorf("Error submitting work to pool: %v", err)
-					}
-				} else {
-					if submitted {
-						minrLog.Debugf("Submitted work to pool successfully: %v", submitted)
-					}
-					m.needsWorkRefresh <- struct{}{}
-				}
+				pool.Unlock()
 			}
 		}
+		select {
+		case <-m.quit:
+			return
+		case <-t.C:
+		case <-m.needsWorkRefresh:
+		case <-newJobs:
+		}
 	}
 }
 
-func (m *Miner) workRefreshThread() {
+// dispatchWork hands work to all devices, each of them mining it within its
+// own extranonce2 and nonce ranges.  Work the devices did not switch to yet
+// is replaced.
+func (m *Miner) dispatchWork(w *work.Work) {
+	for _, d := range m.devices {
+		d.SetWork(w)
+	}
+}
+
+// serveWork hands work fetched with getwork or received from the pool to the
+// workers of the stratum server, if any, and returns the work for the devices,
+// which is mined within an extranonce never assigned to the workers.  The work
+// is left to the devices when it can't be shared with the workers.
+func (m *Miner) serveWork(w *work.Work) *work.Work {
+	if m.server == nil {
+		return w
+	}
+	if err := m.server.SetWork(w); err != nil {
+		minrLog.Errorf("Error serving work: %v", err)
+		return w
+	}
+	return m.server.LocalWork(w)
+}
+
+// poolStateThread keeps the devices idle while the active pool is not usable,
+// so that they do not mine outdated work.
+func (m *Miner) poolStateThread() {
 	defer m.wg.Done()
 
-	t := time.NewTicker(5 * time.Second)
+	// The state is checked periodically as well since the active pool may
+	// be switched without the previous one changing its state.
+	t := time.NewTicker(time.Second)
 	defer t.Stop()
 
+	idle := false
 	for {
-		// Only use that is we are not using a pool.
-		if m.pool == nil {
-			w, err := GetWork()
-			if err != nil {
-				minrLog.Errorf("Error in getwork: %v", err)
+		pool := m.pools.Pool()
+		changed := pool.StateChanged()
+		state := pool.State()
+		if (state != stratum.StateAuthorized) != idle {
+			idle = !idle
+			_, pc := m.pools.Active()
+			if idle {
+				minrLog.Warnf("Pool %v is %v, idling devices", pc.URL,
+					state)
 			} else {
-				for _, d := range m.devices {
-					d.SetWork(w)
-				}
+				minrLog.Infof("Pool %v is %v, resuming devices", pc.URL,
+					state)
 			}
-		} else {
-			m.pool.Lock()
-			if m.pool.PoolWork.NewWork {
-				w, err := GetPoolWork(m.pool)
-				m.pool.Unlock()
-				if err != nil {
-					minrLog.Errorf("Error in getpoolwork: %v", err)
-				} else {
-					for _, d := range m.devices {
-						d.SetWork(w)
-					}
-				}
-			} else {
-				m.pool.Unlock()
+			for _, d := range m.devices {
+				d.SetIdle(idle)
 			}
 		}
+
 		select {
 		case <-m.quit:
 			return
+		case <-changed:
 		case <-t.C:
-		case <-m.needsWorkRefresh:
 		}
 	}
 }
@@ -166,32 +270,11 @@ func (m *Miner) printStatsThread() {
 		case <-t.C:
 		}
 
-		if !cfg.Benchmark {
-			valid, rejected, stale, total, utility := m.Status()
-
-			if cfg.Pool != "" {
-				minrLog.Infof("Global stats: Accepted: %v, Rejected: %v, Stale: %v, Total: %v",
-					valid,
-					rejected,
-					stale,
-					total,
-				)
-				secondsElapsed := uint32(time.Now().Unix()) - m.started
-				if (secondsElapsed / 60) > 0 {
-					minrLog.Infof("Global utility (accepted shares/min): %v", utility)
-				}
-			} else {
-				minrLog.Infof("Global stats: Accepted: %v, Rejected: %v, Total: %v",
-					valid,
-					rejected,
-					total,
-				)
-			}
-		}
-
 		for _, d := range m.devices {
 			d.UpdateFanTemp()
-			d.PrintStats()
+		}
+		m.printStats()
+		for _, d := range m.devices {
 			if d.fanControlActive {
 				d.fanControl()
 			}
@@ -199,24 +282,122 @@ func (m *Miner) printStatsThread() {
 	}
 }
 
-func (m *Miner) Run() {
-	m.wg.Add(len(m.devices))
+// printStats logs the global share stats and the stats of every device.
+func (m *Miner) printStats() {
+	var shares *stratum.ShareStats
+	if !cfg.Benchmark {
+		valid, rejected, stale, total, utility := m.Status()
+
+		if m.pools != nil {
+			minrLog.Infof("Global stats: Accepted: %v, Rejected: %v, Stale: %v, Total: %v",
+				valid,
+				rejected,
+				stale,
+				total,
+			)
+			secondsElapsed := uint32(time.Now().Unix()) - m.started
+			if (secondsElapsed / 60) > 0 {
+				minrLog.Infof("Global utility (accepted shares/min): %v", utility)
+			}
+
+			stats := m.pools.Shares().Stats()
+			shares = &stats
+			var hashRate float64
+			for _, d := range m.devices {
+				rate, _, _ := d.Status()
+				hashRate += rate
+			}
+			minrLog.Infof("Global hash rate: %v (effective %v)",
+				util.FormatHashRate(hashRate),
+				util.FormatHashRate(stats.EffectiveHashRate()))
+		} else {
+			minrLog.Infof("Global stats: Accepted: %v, Rejected: %v, Total: %v",
+				valid,
+				rejected,
+				total,
+			)
+		}
+
+		if m.server != nil {
+			stats := m.server.Stats()
+			minrLog.Infof("Stratum server: Workers: %v, Accepted: %v, "+
+				"Rejected: %v, Stale: %v, Forwarded: %v, Errors: %v",
+				stats.Workers,
+				stats.Accepted,
+				stats.Rejected,
+				stats.Stale,
+				stats.Forwarded,
+				stats.ForwardErrors,
+			)
+			for _, w := range m.server.Workers() {
+				if !w.Connected {
+					continue
+				}
+				minrLog.Infof("Stratum worker %v: Accepted: %v, "+
+					"Rejected: %v, Stale: %v, Forwarded: %v, "+
+					"Effective hash rate: %v", w.Name,
+					w.Accepted, w.Rejected, w.Stale, w.Forwarded,
+					util.FormatHashRate(w.EffectiveHashRate()))
+			}
+		}
+	}
 
 	for _, d := range m.devices {
+		d.PrintStats(shares)
+	}
+}
+
+// watchdogThread notifies the watchdog of the service manager every interval,
+// along with the share stats, until the miner stops.
+func (m *Miner) watchdogThread(interval time.Duration) {
+	defer m.wg.Done()
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-m.quit:
+			return
+		case <-t.C:
+		}
+
+		valid, rejected, stale, _, _ := m.Status()
+		err := sdNotify(fmt.Sprintf("WATCHDOG=1\nSTATUS=Accepted: %v, "+
+			"Rejected: %v, Stale: %v", valid, rejected, stale))
+		if err != nil {
+			mainLog.Warnf("Unable to notify the service manager: %v", err)
+		}
+	}
+}
+
+// Run runs the devices until the miner is stopped.  The solutions found are
+// then submitted within the shutdown grace period before disconnecting from
+// the pool, and the final stats are logged.
+func (m *Miner) Run() {
+	m.devicesWg.Add(len(m.devices))
+
+	for i, d := range m.devices {
+		d.partition = i
+		d.partitions = len(m.devices)
+		// The nonce space is split the same way as the extranonce2.
+		d.nonceRange = util.ExtraNonce2Range(4, d.partitions)
 		device := d
 		go func() {
 			device.Run()
 			device.Release()
-			m.wg.Done()
+			m.devicesWg.Done()
 		}()
 	}
 
-	m.wg.Add(1)
-	go m.workSubmitThread()
+	m.submitWg.Add(submitWorkers)
+	for i := 0; i < submitWorkers; i++ {
+		go m.workSubmitThread()
+	}
 
 	if cfg.Benchmark {
 		minrLog.Warn("Running in BENCHMARK mode! No real mining taking place!")
-		w := &work.Work{}
+		w := &work.Work{ExtraNonce2Size: work.SoloExtraNonce2Size}
 		w.BlockHeader.FromBytes([]byte{6, 0, 0, 0, 254, 122, 189, 44, 76, 62, 223, 111, 1, 219, 247, 151, 98, 58, 211,
 			148, 251, 40, 66, 90, 218, 43, 222, 56, 253, 180, 154, 189, 95, 114, 246, 4, 231, 184, 29, 242, 25, 197, 18,
 			189, 140, 31, 202, 156, 190, 237, 126, 234, 83, 181, 27, 202, 76, 218, 38, 62, 123, 10, 80, 159, 223, 150, 171,
@@ -231,28 +412,153 @@ func (m *Miner) Run() {
 		for _, d := range m.devices {
 			d.SetWork(w)
 		}
+	} else if m.templates != nil {
+		m.wg.Add(1)
+		go m.templateThread()
 	} else {
 		m.wg.Add(1)
 		go m.workRefreshThread()
 	}
 
+	if m.pools != nil {
+		m.wg.Add(1)
+		go m.poolStateThread()
+	}
+
 	m.wg.Add(1)
 	go m.printStatsThread()
 
+	if interval := sdWatchdogInterval(); interval > 0 {
+		m.wg.Add(1)
+		go m.watchdogThread(interval)
+	}
+	if err := sdNotify("READY=1"); err != nil {
+		mainLog.Warnf("Unable to notify the service manager: %v", err)
+	}
+
+	<-m.quit
+	m.devicesWg.Wait()
+	m.drainSubmissions()
+	if m.server != nil {
+		m.server.Stop()
+	}
+	if m.pools != nil {
+		m.pools.Stop()
+	}
+	m.submitWg.Wait()
 	m.wg.Wait()
+	if m.transcript != nil {
+		m.transcript.Close()
+	}
+
+	minrLog.Infof("Final stats after %v:",
+		time.Duration(uint32(time.Now().Unix())-m.started)*time.Second)
+	m.printStats()
+}
+
+// drainSubmissions submits the solutions found by the devices before they
+// stopped, and waits for the pool to respond to them.  The solutions left are
+// abandoned once the shutdown grace period ends.
+func (m *Miner) drainSubmissions() {
+	// The devices stopped, so nothing is sent to workDone anymore.
+	close(m.workDone)
+	done := make(chan struct{})
+	go func() {
+		m.submitWg.Wait()
+		close(done)
+	}()
+
+	grace := time.NewTimer(cfg.ShutdownGrace)
+	defer grace.Stop()
+	t := time.NewTicker(100 * time.Millisecond)
+	defer t.Stop()
+
+	for done != nil || m.pendingShares() > 0 {
+		select {
+		case <-done:
+			done = nil
+		case <-t.C:
+		case <-m.abort:
+			return
+		case <-grace.C:
+			minrLog.Warnf("Shutdown grace period of %v ended, abandoning "+
+				"%d solutions and %d shares awaiting a response",
+				cfg.ShutdownGrace, len(m.workDone), m.pendingShares())
+			m.Abort()
+			return
+		}
+	}
 }
 
+// pendingShares returns the number of shares submitted to the pool which it
+// did not respond to yet.
+func (m *Miner) pendingShares() int {
+	if m.pools == nil {
+		return 0
+	}
+	return m.pools.PendingShares()
+}
+
+// Stop stops all devices.  Run then submits the solutions they found and
+// disconnects from the pool.  It may be called more than once, only the first
+// call has an effect.
 func (m *Miner) Stop() {
-	close(m.quit)
+	m.stopOnce.Do(func() {
+		if err := sdNotify("STOPPING=1"); err != nil {
+			mainLog.Warnf("Unable to notify the service manager: %v", err)
+		}
+		close(m.quit)
+		for _, d := range m.devices {
+			d.Stop()
+		}
+	})
+}
+
+// Abort abandons the solutions left to submit on shutdown rather than waiting
+// for the grace period to end.
+func (m *Miner) Abort() {
+	m.abortOnce.Do(func() {
+		close(m.abort)
+	})
+}
+
+// Reload applies the settings of a reloaded config which do not require a
+// restart, which are the work size settings of the devices.
+func (m *Miner) Reload(c *config) {
+	for _, d := range m.devices {
+		d.Reload(c)
+	}
+}
+
+// Device returns the device with the passed index, or nil if there is none.
+func (m *Miner) Device(index int) *Device {
+	for _, d := range m.devices {
+		if d.index == index {
+			return d
+		}
+	}
+	return nil
+}
+
+// Pause pauses all devices.  Stats, the pool connection and work updates are
+// kept while paused.
+func (m *Miner) Pause() {
+	for _, d := range m.devices {
+		d.Pause()
+	}
+}
+
+// Resume resumes all paused devices.
+func (m *Miner) Resume() {
 	for _, d := range m.devices {
-		d.Stop()
+		d.Resume()
 	}
 }
 
 func (m *Miner) Status() (uint64, uint64, uint64, uint64, float64) {
-	if cfg.Pool != "" {
-		valid := atomic.LoadUint64(&m.pool.ValidShares)
-		rejected := atomic.LoadUint64(&m.pool.InvalidShares)
+	if m.pools != nil {
+		valid := m.pools.ValidShares()
+		rejected := m.pools.InvalidShares()
 		stale := atomic.LoadUint64(&m.staleShares)
 		total := valid + rejected + stale
 
@@ -264,7 +570,8 @@ func (m *Miner) Status() (uint64, uint64, uint64, uint64, float64) {
 
 	valid := atomic.LoadUint64(&m.validShares)
 	rejected := atomic.LoadUint64(&m.invalidShares)
-	total := valid + rejected
+	stale := atomic.LoadUint64(&m.staleShares)
+	total := valid + rejected + stale
 
-	return valid, rejected, 0, total, 0
+	return valid, rejected, stale, total, 0
 }
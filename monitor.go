@@ -3,8 +3,10 @@ package main
 import (
 	"encoding/json"
 	"net/http"
+	"sync/atomic"
 	"time"
 
+	"github.com/EXCCoin/gominer/stratum"
 	"github.com/EXCCoin/gominer/util"
 )
 
@@ -17,8 +19,9 @@ type MinerStatus struct {
 	Started         uint32  `json:"started"`
 	Uptime          uint32  `json:"uptime"`
 
-	Devices []*DeviceStatus `json:"devices"`
-	Pool    *PoolStatus     `json:"pool,omitempty"`
+	Devices       []*DeviceStatus      `json:"devices"`
+	Pool          *PoolStatus          `json:"pool,omitempty"`
+	StratumServer *StratumServerStatus `json:"stratumServer,omitempty"`
 }
 
 type DeviceStatus struct {
@@ -29,39 +32,141 @@ type DeviceStatus struct {
 	HashRate          float64 `json:"hashRate"`
 	HashRateFormatted string  `json:"hashRateFormatted"`
 
+	// EffectiveHashRate is the rate the shares accepted by pools account
+	// for, only set once the device had shares accepted.
+	EffectiveHashRate          float64 `json:"effectiveHashRate,omitempty"`
+	EffectiveHashRateFormatted string  `json:"effectiveHashRateFormatted,omitempty"`
+
 	FanPercent  uint32 `json:"fanPercent"`
 	Temperature uint32 `json:"temperature"`
 
+	HWErrors uint64 `json:"hwErrors"`
+	Paused   bool   `json:"paused"`
+	Idle     bool   `json:"idle"`
+
+	// WorkSwitches is the number of times the device switched to new
+	// work, which took WorkSwitchLatency seconds on average and
+	// LastWorkSwitchLatency the last time since the work was received.
+	WorkSwitches          uint64  `json:"workSwitches"`
+	WorkSwitchLatency     float64 `json:"workSwitchLatency"`
+	LastWorkSwitchLatency float64 `json:"lastWorkSwitchLatency"`
+
 	Started uint32 `json:"started"`
 }
 
 type PoolStatus struct {
-	Started uint32 `json:"started"`
-	Uptime  uint32 `json:"uptime"`
+	URL      string `json:"url"`
+	Priority int    `json:"priority"`
+	State    string `json:"state"`
+	Started  uint32 `json:"started"`
+	Uptime   uint32 `json:"uptime"`
+
+	// RejectReasons counts the shares rejected by all pools per reason
+	// and AverageLatency is the average time in seconds pools took to
+	// respond to a share.
+	RejectReasons  map[string]uint64 `json:"rejectReasons"`
+	AverageLatency float64           `json:"averageLatency"`
+	RecentShares   []*ShareStatus    `json:"recentShares"`
+
+	// Latencies holds the round-trip times of the responses of every pool
+	// to shares, by pool address.
+	Latencies map[string]*LatencyStatus `json:"latencies"`
+
+	// EffectiveHashRate is the rate of difficulty 1 solutions the shares
+	// accepted by pools account for.
+	EffectiveHashRate          float64 `json:"effectiveHashRate"`
+	EffectiveHashRateFormatted string  `json:"effectiveHashRateFormatted"`
+}
+
+// LatencyStatus describes the round-trip times in seconds of the responses of
+// a pool to shares.
+type LatencyStatus struct {
+	Responses uint64  `json:"responses"`
+	Average   float64 `json:"average"`
+	Min       float64 `json:"min"`
+	Max       float64 `json:"max"`
+	Last      float64 `json:"last"`
+}
+
+// ShareStatus describes a share submitted to a pool, with the latency in
+// seconds.
+type ShareStatus struct {
+	Pool       string  `json:"pool"`
+	Device     int     `json:"device"`
+	JobID      string  `json:"jobID"`
+	Difficulty float64 `json:"difficulty"`
+	Submitted  int64   `json:"submitted"`
+	Latency    float64 `json:"latency"`
+	Accepted   bool    `json:"accepted"`
+	Reason     string  `json:"reason,omitempty"`
+	Code       int     `json:"code,omitempty"`
+	Message    string  `json:"message,omitempty"`
+}
+
+// StratumServerStatus describes the stratum server serving work to other
+// miners and the shares of its workers.
+type StratumServerStatus struct {
+	Listen           string `json:"listen"`
+	ConnectedWorkers int    `json:"connectedWorkers"`
+	Accepted         uint64 `json:"accepted"`
+	Rejected         uint64 `json:"rejected"`
+	Stale            uint64 `json:"stale"`
+	Forwarded        uint64 `json:"forwarded"`
+
+	// ForwardErrors is the number of shares meeting the target of the
+	// work which could not be submitted upstream.
+	ForwardErrors uint64 `json:"forwardErrors"`
+
+	Workers []*WorkerStatus `json:"workers"`
+}
+
+// WorkerStatus describes a worker of the stratum server over all its
+// connections.
+type WorkerStatus struct {
+	Name      string `json:"name"`
+	Connected bool   `json:"connected"`
+	Accepted  uint64 `json:"accepted"`
+	Rejected  uint64 `json:"rejected"`
+	Stale     uint64 `json:"stale"`
+	Forwarded uint64 `json:"forwarded"`
+	LastShare int64  `json:"lastShare,omitempty"`
+
+	EffectiveHashRate          float64 `json:"effectiveHashRate"`
+	EffectiveHashRateFormatted string  `json:"effectiveHashRateFormatted"`
 }
 
 var (
 	m *Miner
 )
 
+// RunMonitor serves the API on every listener of the configuration.  The API
+// has a mux of its own so the profiling server, which uses the default one,
+// does not expose it, the control endpoint in particular.
 func RunMonitor(tm *Miner) {
 	m = tm
 
 	if len(cfg.APIListeners) != 0 {
-		http.HandleFunc("/", getMinerStatus)
+		mux := http.NewServeMux()
+		mux.HandleFunc("/", getMinerStatus)
+		mux.HandleFunc("/metrics", getMinerMetrics)
+		if cfg.APIPassword != "" {
+			mux.HandleFunc("/control", serveControl)
+		}
 
 		for _, addr := range cfg.APIListeners {
-			err := http.ListenAndServe(addr, nil)
-
-			if err != nil {
-				mainLog.Warnf("Unable to create monitor: %v", err)
-				return
-			}
+			go func(addr string) {
+				err := http.ListenAndServe(addr, mux)
+				if err != nil {
+					mainLog.Warnf("Unable to create monitor on %s: %v",
+						addr, err)
+				}
+			}(addr)
 		}
 	}
 }
 
 func getMinerStatus(w http.ResponseWriter, req *http.Request) {
+	var shares stratum.ShareStats
 	ms := &MinerStatus{
 		Started: m.started,
 		Uptime:  uint32(time.Now().Unix()) - m.started,
@@ -76,22 +181,99 @@ func getMinerStatus(w http.ResponseWriter, req *http.Request) {
 		ms.TotalShares = total
 		ms.SharesPerMinute = sharesPerMinute
 
-		if cfg.Pool != "" {
+		if m.pools != nil {
+			priority, pc := m.pools.Active()
+			pool := m.pools.Pool()
+			started := pool.Started
 			ms.Pool = &PoolStatus{
-				Started: m.started,
-				Uptime:  uint32(time.Now().Unix()) - m.started,
+				URL:      pc.URL,
+				Priority: priority,
+				State:    pool.State().String(),
+				Started:  started,
+				Uptime:   uint32(time.Now().Unix()) - started,
+			}
+
+			stats := m.pools.Shares().Stats()
+			shares = stats
+			ms.Pool.EffectiveHashRate = stats.EffectiveHashRate()
+			ms.Pool.EffectiveHashRateFormatted =
+				util.FormatHashRate(ms.Pool.EffectiveHashRate)
+			ms.Pool.RejectReasons = make(map[string]uint64)
+			for _, reason := range stratum.RejectReasons {
+				ms.Pool.RejectReasons[reason.String()] =
+					stats.Rejected[reason]
+			}
+			ms.Pool.AverageLatency = stats.AverageLatency().Seconds()
+			ms.Pool.Latencies = make(map[string]*LatencyStatus)
+			for addr, latency := range stats.PoolLatency {
+				ms.Pool.Latencies[addr] = &LatencyStatus{
+					Responses: latency.Responses,
+					Average:   latency.Average().Seconds(),
+					Min:       latency.Min.Seconds(),
+					Max:       latency.Max.Seconds(),
+					Last:      latency.Last.Seconds(),
+				}
+			}
+			for _, share := range m.pools.Shares().Recent() {
+				ss := &ShareStatus{
+					Pool:       share.Pool,
+					Device:     share.Device,
+					JobID:      share.JobID,
+					Difficulty: share.Difficulty,
+					Submitted:  share.Submitted.Unix(),
+					Latency:    share.Latency.Seconds(),
+					Accepted:   share.Accepted,
+				}
+				if !share.Accepted {
+					ss.Reason = share.Reason.String()
+					ss.Code = share.Code
+					ss.Message = share.Message
+				}
+				ms.Pool.RecentShares = append(ms.Pool.RecentShares, ss)
 			}
 		}
 	}
 
+	if m.server != nil {
+		stats := m.server.Stats()
+		ms.StratumServer = &StratumServerStatus{
+			Listen:           m.server.Addr().String(),
+			ConnectedWorkers: stats.Workers,
+			Accepted:         stats.Accepted,
+			Rejected:         stats.Rejected,
+			Stale:            stats.Stale,
+			Forwarded:        stats.Forwarded,
+			ForwardErrors:    stats.ForwardErrors,
+		}
+		for _, worker := range m.server.Workers() {
+			ws := &WorkerStatus{
+				Name:              worker.Name,
+				Connected:         worker.Connected,
+				Accepted:          worker.Accepted,
+				Rejected:          worker.Rejected,
+				Stale:             worker.Stale,
+				Forwarded:         worker.Forwarded,
+				EffectiveHashRate: worker.EffectiveHashRate(),
+			}
+			ws.EffectiveHashRateFormatted =
+				util.FormatHashRate(ws.EffectiveHashRate)
+			if !worker.LastShare.IsZero() {
+				ws.LastShare = worker.LastShare.Unix()
+			}
+			ms.StratumServer.Workers = append(
+				ms.StratumServer.Workers, ws)
+		}
+	}
+
 	for _, d := range m.devices {
 		d.UpdateFanTemp()
 
 		averageHashRate,
 			fanPercent,
 			temperature := d.Status()
+		switchLatency, lastSwitchLatency, switches := d.WorkSwitchLatency()
 
-		ms.Devices = append(ms.Devices, &DeviceStatus{
+		ds := &DeviceStatus{
 			Index:             d.index,
 			DeviceName:        d.deviceName,
 			DeviceType:        d.deviceType,
@@ -99,8 +281,21 @@ func getMinerStatus(w http.ResponseWriter, req *http.Request) {
 			HashRateFormatted: util.FormatHashRate(averageHashRate),
 			FanPercent:        fanPercent,
 			Temperature:       temperature,
+			HWErrors:          atomic.LoadUint64(&d.hwErrors),
+			Paused:            d.Paused(),
+			Idle:              d.Idle(),
 			Started:           d.started,
-		})
+
+			WorkSwitches:          switches,
+			WorkSwitchLatency:     switchLatency.Seconds(),
+			LastWorkSwitchLatency: lastSwitchLatency.Seconds(),
+		}
+		if _, ok := shares.DeviceDifficulty[d.index]; ok {
+			ds.EffectiveHashRate = shares.DeviceEffectiveHashRate(d.index)
+			ds.EffectiveHashRateFormatted =
+				util.FormatHashRate(ds.EffectiveHashRate)
+		}
+		ms.Devices = append(ms.Devices, ds)
 	}
 
 	w.Header().Add("Content-Type", "application/json")
@@ -0,0 +1,44 @@
+// Copyright (c) 2018 The ExchangeCoin team
+
+//go:build nocuda
+// +build nocuda
+
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// defaultBackend is the solver backend used unless --backend is given.
+const defaultBackend = BackendCPU
+
+// errNoCUDA is returned when the CUDA backend is selected in a binary built
+// with the nocuda tag.
+var errNoCUDA = errors.New("CUDA support was not compiled in (built " +
+	"with the nocuda tag)")
+
+// listCUDADevices reports that no CUDA devices can be used.
+func listCUDADevices() {
+	fmt.Println("CUDA support was not compiled in")
+}
+
+// deviceStats is a stub for builds without NVML.
+func deviceStats(index int) (uint32, uint32) {
+	return 0, 0
+}
+
+// unsupported -- just here for compilation
+func fanControlSet(index int, fanCur uint32, tempTargetType string, fanChangeLevel string) {
+	minrLog.Errorf("fanControl() reached but shouldn't have been")
+}
+
+// newCUDAMinerDevs always fails since CUDA support was not compiled in.
+func newCUDAMinerDevs(m *Miner) (*Miner, int, error) {
+	return nil, 0, errNoCUDA
+}
+
+// Return the GPU library in use.
+func gpuLib() string {
+	return "CPU"
+}
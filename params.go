@@ -0,0 +1,39 @@
+// Copyright (c) 2013-2015 The btcsuite developers
+// Copyright (c) 2015-2016 The Decred developers
+// Copyright (c) 2018 The ExchangeCoin team
+
+package main
+
+import (
+	"github.com/EXCCoin/exccd/chaincfg"
+)
+
+// activeNetParams is a pointer to the parameters specific to the currently
+// active network.  It is set by loadConfig from the --testnet and --simnet
+// flags and used for headers, solutions and targets throughout the miner.
+var activeNetParams = &mainNetParams
+
+// params is used to group parameters for various networks such as the main
+// network and test networks.
+type params struct {
+	*chaincfg.Params
+	rpcPort string
+}
+
+// mainNetParams contains parameters specific to the main network.
+var mainNetParams = params{
+	Params:  &chaincfg.MainNetParams,
+	rpcPort: defaultRPCPortMainNet,
+}
+
+// testNetParams contains parameters specific to the test network.
+var testNetParams = params{
+	Params:  &chaincfg.TestNetParams,
+	rpcPort: defaultRPCPortTestNet,
+}
+
+// simNetParams contains parameters specific to the simulation test network.
+var simNetParams = params{
+	Params:  &chaincfg.SimNetParams,
+	rpcPort: defaultRPCPortSimNet,
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2018 The ExchangeCoin team
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/btcsuite/go-flags"
+)
+
+// reloadConfig reloads the config file and the command line, as on SIGHUP.
+// Only the debug levels and the work size settings of the devices are
+// applied.  Changes to the network, the backend or the devices are rejected
+// since they require a restart, while other settings are left as they are.
+func reloadConfig(m *Miner) {
+	mainLog.Infof("Reloading config file %v", cfg.ConfigFile)
+	if err := sdNotify("RELOADING=1"); err != nil {
+		mainLog.Warnf("Unable to notify the service manager: %v", err)
+	}
+	defer func() {
+		if err := sdNotify("READY=1"); err != nil {
+			mainLog.Warnf("Unable to notify the service manager: %v", err)
+		}
+	}()
+
+	c, err := parseReloadedConfig(cfg.ConfigFile, os.Args[1:])
+	if err != nil {
+		mainLog.Errorf("Unable to reload config: %v", err)
+		return
+	}
+
+	// The debug levels were validated, so they are applied in full.
+	parseAndSetDebugLevels(c.DebugLevel)
+	m.Reload(c)
+}
+
+// parseReloadedConfig parses the config file and the command line arguments
+// args into a new config with the reloadable settings validated and parsed.
+// Unlike loadConfig, it has no side effects on the running miner, and it fails
+// when the network, the backend or the devices differ from the running config.
+func parseReloadedConfig(configFile string, args []string) (*config, error) {
+	c := config{
+		ConfigFile: configFile,
+		DebugLevel: defaultLogLevel,
+		Backend:    defaultBackend,
+	}
+	parser := flags.NewParser(&c, flags.PassDoubleDash)
+	err := flags.NewIniParser(parser).ParseFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	// The command line takes precedence as when the miner was started.
+	if _, err := parser.ParseArgs(args); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case c.TestNet != cfg.TestNet || c.SimNet != cfg.SimNet:
+		return nil, fmt.Errorf("The network can only be changed with " +
+			"a restart")
+	case c.Backend != cfg.Backend:
+		return nil, fmt.Errorf("The backend can only be changed with " +
+			"a restart")
+	case c.Devices != cfg.Devices:
+		return nil, fmt.Errorf("The devices can only be changed with " +
+			"a restart")
+	}
+
+	if err := checkDebugLevels(c.DebugLevel); err != nil {
+		return nil, err
+	}
+
+	if err := validateDeviceTuning(&c); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// checkDebugLevels validates debugLevel as parseAndSetDebugLevels does,
+// without setting any level, so that an invalid debug level is rejected as a
+// whole rather than partially applied.
+func checkDebugLevels(debugLevel string) error {
+	if !strings.Contains(debugLevel, ",") && !strings.Contains(debugLevel, "=") {
+		if !validLogLevel(debugLevel) {
+			return fmt.Errorf("The specified debug level [%v] is "+
+				"invalid", debugLevel)
+		}
+		return nil
+	}
+
+	for _, logLevelPair := range strings.Split(debugLevel, ",") {
+		fields := strings.Split(logLevelPair, "=")
+		if len(fields) != 2 {
+			return fmt.Errorf("The specified debug level contains an "+
+				"invalid subsystem/level pair [%v]", logLevelPair)
+		}
+		if _, exists := subsystemLoggers[fields[0]]; !exists {
+			return fmt.Errorf("The specified subsystem [%v] is invalid "+
+				"-- supported subsytems %v", fields[0],
+				supportedSubsystems())
+		}
+		if !validLogLevel(fields[1]) {
+			return fmt.Errorf("The specified debug level [%v] is "+
+				"invalid", fields[1])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2018 The ExchangeCoin team
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseReloadedConfig(t *testing.T) {
+	saved := cfg
+	cfg = &config{
+		DebugLevel: defaultLogLevel,
+		Backend:    defaultBackend,
+		Devices:    "0,1",
+		Intensity:  "10",
+	}
+	defer func() { cfg = saved }()
+
+	otherBackend := BackendCPU
+	if defaultBackend == BackendCPU {
+		otherBackend = BackendCUDA
+	}
+
+	tests := []struct {
+		name string
+		file string
+		args []string
+
+		// err is a part of the error, which is expected when set.
+		err           string
+		debugLevel    string
+		autocalibrate []int
+		intensity     []int
+		workSize      []uint32
+	}{{
+		name:          "unchanged",
+		file:          "devices=0,1\nintensity=10\n",
+		debugLevel:    defaultLogLevel,
+		autocalibrate: []int{defaultAutocalibrate},
+		intensity:     []int{10},
+	}, {
+		name: "reloadable settings",
+		file: "devices=0,1\ndebuglevel=MINR=trace,POOL=debug\n" +
+			"autocalibrate=300,400\nintensity=12,20\nworksize=1,4096\n",
+		debugLevel:    "MINR=trace,POOL=debug",
+		autocalibrate: []int{300, 400},
+		intensity:     []int{12, 20},
+		workSize:      []uint32{1, 4096},
+	}, {
+		name:          "command line precedence",
+		file:          "devices=0,1\nintensity=10\n",
+		args:          []string{"--intensity=14", "-d", "debug"},
+		debugLevel:    "debug",
+		autocalibrate: []int{defaultAutocalibrate},
+		intensity:     []int{14},
+	}, {
+		name: "network",
+		file: "devices=0,1\ntestnet=1\n",
+		err:  "network",
+	}, {
+		name: "backend",
+		file: "devices=0,1\nbackend=" + otherBackend + "\n",
+		err:  "backend",
+	}, {
+		name: "devices",
+		file: "devices=0\n",
+		err:  "devices",
+	}, {
+		name: "debug level show",
+		file: "devices=0,1\ndebuglevel=show\n",
+		err:  "debug level",
+	}, {
+		name: "invalid subsystem",
+		file: "devices=0,1\ndebuglevel=MINR=trace,FOO=debug\n",
+		err:  "subsystem",
+	}, {
+		name: "intensity out of range",
+		file: "devices=0,1\nintensity=10,21\n",
+		err:  "Intensity 21",
+	}, {
+		name: "worksize out of range",
+		file: "devices=0,1\nworksize=4097\n",
+		err:  "WorkSize passed: 4097",
+	}, {
+		name: "invalid autocalibrate",
+		file: "devices=0,1\nautocalibrate=fast\n",
+		err:  "autocalibrate",
+	}, {
+		name: "unknown option",
+		file: "devices=0,1\nturbo=1\n",
+		err:  "turbo",
+	}}
+
+	dir := t.TempDir()
+	for _, test := range tests {
+		configFile := filepath.Join(dir, "gominer.conf")
+		err := ioutil.WriteFile(configFile, []byte(test.file), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := parseReloadedConfig(configFile, test.args)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got error %v, want one about %q",
+					test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if c.DebugLevel != test.debugLevel ||
+			!reflect.DeepEqual(c.AutocalibrateInts, test.autocalibrate) ||
+			!reflect.DeepEqual(c.IntensityInts, test.intensity) ||
+			!reflect.DeepEqual(c.WorkSizeInts, test.workSize) {
+			t.Errorf("%s: got debug level %q, autocalibrate %v, "+
+				"intensity %v and worksize %v, want %q, %v, %v and %v",
+				test.name, c.DebugLevel, c.AutocalibrateInts,
+				c.IntensityInts, c.WorkSizeInts, test.debugLevel,
+				test.autocalibrate, test.intensity, test.workSize)
+		}
+	}
+}
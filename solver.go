@@ -0,0 +1,27 @@
+// Copyright (c) 2018 The ExchangeCoin team
+
+package main
+
+import "context"
+
+// Solver backends which may be selected with --backend.
+const (
+	BackendCUDA = "cuda"
+	BackendCPU  = "cpu"
+)
+
+// Solver is implemented by the Equihash solvers a Device can drive.
+type Solver interface {
+	// Init prepares the solver for mining.  It is called from the
+	// goroutine running the device before the first call to Solve.
+	Init() error
+
+	// Solve searches for solutions of the serialized equihash input
+	// using the passed nonce and calls found with every solution.  It
+	// returns ctx.Err() when it is interrupted by ctx being done, which
+	// solvers check as often as they can.
+	Solve(ctx context.Context, header []byte, nonce uint32, found func(solution []byte)) error
+
+	// Release frees the resources held by the solver.
+	Release()
+}
@@ -0,0 +1,559 @@
+// Copyright (c) 2018 The ExchangeCoin team
+
+// Package codec encodes and decodes the JSON-RPC messages of the stratum
+// protocol spoken by ExchangeCoin pools.  Messages from the pool are decoded
+// into typed structs, with responses being correlated with the requests they
+// answer through the map of pending requests.  Malformed messages are
+// reported as errors instead of causing panics.
+//
+// Pools speak one of two dialects of the protocol, which differ in the jobs
+// they send: the Decred dialect splits the header in coinbase parts while the
+// ZIP-301 dialect sends the fields of the header directly.
+package codec
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+	"time"
+)
+
+// Methods of the stratum protocol.
+const (
+	MethodSubscribe           = "mining.subscribe"
+	MethodAuthorize           = "mining.authorize"
+	MethodExtraNonceSubscribe = "mining.extranonce.subscribe"
+	MethodSubmit              = "mining.submit"
+	MethodNotify              = "mining.notify"
+	MethodSetDifficulty       = "mining.set_difficulty"
+	MethodSetTarget           = "mining.set_target"
+	MethodSetExtraNonce       = "mining.set_extranonce"
+	MethodShowMessage         = "client.show_message"
+	MethodReconnect           = "client.reconnect"
+	MethodGetVersion          = "client.get_version"
+)
+
+// Error codes sent by pools in the errors of responses.
+const (
+	ErrCodeOther          = 20
+	ErrCodeJobNotFound    = 21
+	ErrCodeDuplicateShare = 22
+	ErrCodeLowDifficulty  = 23
+	ErrCodeUnauthorized   = 24
+	ErrCodeNotSubscribed  = 25
+)
+
+// ErrUnknownMethod indicates that a message from the pool is for a method
+// the codec does not know about.
+var ErrUnknownMethod = errors.New("Unknown method")
+
+// Request is a request sent to the pool.
+type Request struct {
+	ID     uint64        `json:"id"`
+	Method string        `json:"method"`
+	Params []interface{} `json:"params"`
+}
+
+// Reply is the reply to a request from the pool.
+type Reply struct {
+	ID     json.RawMessage `json:"id"`
+	Result interface{}     `json:"result"`
+	Error  *Error          `json:"error"`
+}
+
+// Error is the error of a response.  Pools send it either as an object with
+// a code and a message or as an array of the code, the message and a
+// traceback.
+type Error struct {
+	Code    int
+	Message string
+}
+
+// Message is a message received from the pool, either the response to a
+// request when it has no method, or a notification or a request from the pool.
+type Message struct {
+	ID     json.RawMessage   `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+	Result json.RawMessage   `json:"result"`
+	Error  *Error            `json:"error"`
+}
+
+// Notify holds the job sent with mining.notify.  The header of the work is
+// the version, the previous block hash, the first coinbase part, the extra
+// data and the second coinbase part.
+type Notify struct {
+	JobID          string
+	PrevHash       string
+	CoinbasePart1  string
+	CoinbasePart2  string
+	MerkleBranches []string
+	Version        string
+	Bits           string
+	Time           string
+	CleanJobs      bool
+}
+
+// SetDifficulty holds the share difficulty sent with mining.set_difficulty.
+type SetDifficulty struct {
+	Difficulty float64
+}
+
+// SetTarget holds the share target sent with mining.set_target.
+type SetTarget struct {
+	Target *big.Int
+}
+
+// SetExtraNonce holds the extranonce sent with mining.set_extranonce.
+type SetExtraNonce struct {
+	ExtraNonce1     string
+	ExtraNonce2Size int
+}
+
+// ShowMessage holds the message sent with client.show_message.
+type ShowMessage struct {
+	Message string
+}
+
+// Reconnect holds the pool to connect to sent with client.reconnect.  Host
+// and Port are empty when the miner is to reconnect to the same pool.
+type Reconnect struct {
+	Host string
+	Port string
+	Wait time.Duration
+}
+
+// GetVersion is the client.get_version request, which has no params.
+type GetVersion struct{}
+
+// SubscribeResult is the result of mining.subscribe.
+type SubscribeResult struct {
+	SubscriptionID  string
+	ExtraNonce1     string
+	ExtraNonce2Size int
+}
+
+// paramDecoder decodes the params of a notification or a request from the
+// pool and resultDecoder the result of the response to a request.
+type (
+	paramDecoder  func(params []json.RawMessage) (interface{}, error)
+	resultDecoder func(result json.RawMessage) (interface{}, error)
+)
+
+// paramDecoders maps the methods of the notifications and requests from the
+// pool to the decoders of their params.
+var paramDecoders = map[string]paramDecoder{
+	MethodNotify:        decodeNotify,
+	MethodSetDifficulty: decodeSetDifficulty,
+	MethodSetTarget:     decodeSetTarget,
+	MethodSetExtraNonce: decodeSetExtraNonce,
+	MethodShowMessage:   decodeShowMessage,
+	MethodReconnect:     decodeReconnect,
+	MethodGetVersion:    decodeGetVersion,
+}
+
+// resultDecoders maps the methods of the requests to the pool to the decoders
+// of the results of their responses.
+var resultDecoders = map[string]resultDecoder{
+	MethodSubscribe:           decodeSubscribeResult,
+	MethodAuthorize:           decodeBoolResult,
+	MethodExtraNonceSubscribe: decodeBoolResult,
+	MethodSubmit:              decodeBoolResult,
+}
+
+// Dialect is a dialect of the protocol, which decodes the messages whose
+// params or results differ between dialects.
+type Dialect struct {
+	name    string
+	params  map[string]paramDecoder
+	results map[string]resultDecoder
+}
+
+// Supported dialects.
+var (
+	// Decred is the dialect of ExchangeCoin pools, inherited from Decred
+	// pools.
+	Decred = newDialect("decred", nil, nil)
+
+	// ZIP301 is the dialect of Equihash pools described by ZIP 301.
+	ZIP301 = newDialect("zip301", map[string]paramDecoder{
+		MethodNotify: decodeNotifyZIP301,
+	}, map[string]resultDecoder{
+		MethodSubscribe: decodeSubscribeResultZIP301,
+	})
+)
+
+// newDialect returns a dialect decoding the messages with the default
+// decoders, except for those overridden by params and results.
+func newDialect(name string, params map[string]paramDecoder, results map[string]resultDecoder) *Dialect {
+	d := &Dialect{
+		name:    name,
+		params:  make(map[string]paramDecoder),
+		results: make(map[string]resultDecoder),
+	}
+	for method, decode := range paramDecoders {
+		d.params[method] = decode
+	}
+	for method, decode := range params {
+		d.params[method] = decode
+	}
+	for method, decode := range resultDecoders {
+		d.results[method] = decode
+	}
+	for method, decode := range results {
+		d.results[method] = decode
+	}
+	return d
+}
+
+// String returns the name of the dialect.
+func (d *Dialect) String() string {
+	return d.name
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (code %d)", e.Message, e.Code)
+}
+
+// UnmarshalJSON decodes an error sent as an object, an array or a string.
+// Since the error is all that is known about a failed request, fields of an
+// unexpected type are kept as text rather than failing the whole response.
+func (e *Error) UnmarshalJSON(b []byte) error {
+	var code, message json.RawMessage
+	switch {
+	case bytes.HasPrefix(b, []byte("{")):
+		var obj struct {
+			Code    json.RawMessage `json:"code"`
+			Message json.RawMessage `json:"message"`
+		}
+		if err := json.Unmarshal(b, &obj); err != nil {
+			return err
+		}
+		code, message = obj.Code, obj.Message
+
+	case bytes.HasPrefix(b, []byte("[")):
+		var arr []json.RawMessage
+		if err := json.Unmarshal(b, &arr); err != nil {
+			return err
+		}
+		if len(arr) > 0 {
+			code = arr[0]
+		}
+		if len(arr) > 1 {
+			message = arr[1]
+		}
+
+	default:
+		message = b
+	}
+
+	var n number
+	if json.Unmarshal(code, &n) == nil {
+		e.Code, _ = strconv.Atoi(string(n))
+	}
+	if json.Unmarshal(message, &e.Message) != nil {
+		e.Message = string(message)
+	}
+	return nil
+}
+
+// Encode writes the request followed by a newline to w with a single write.
+func (r *Request) Encode(w io.Writer) error {
+	return encode(w, r)
+}
+
+// Encode writes the reply followed by a newline to w with a single write.
+func (r *Reply) Encode(w io.Writer) error {
+	return encode(w, r)
+}
+
+func encode(w io.Writer, msg interface{}) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// Decode decodes a line received from the pool.
+func Decode(line []byte) (*Message, error) {
+	var msg Message
+	if err := json.Unmarshal(line, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// IsResponse returns whether the message is the response to a request.
+func (m *Message) IsResponse() bool {
+	return m.Method == ""
+}
+
+// RequestID returns the id of the request the message responds to, which is
+// false when it is missing, null or not an id sent by the miner.
+func (m *Message) RequestID() (uint64, bool) {
+	if len(m.ID) == 0 || string(m.ID) == "null" {
+		return 0, false
+	}
+	var id uint64
+	if err := json.Unmarshal(m.ID, &id); err != nil {
+		return 0, false
+	}
+	return id, true
+}
+
+// DecodeParams decodes the params of a notification or a request from the
+// pool into its typed struct.  ErrUnknownMethod is returned for methods
+// without a decoder.
+func (m *Message) DecodeParams() (interface{}, error) {
+	return Decred.DecodeParams(m)
+}
+
+// DecodeResult decodes the result of the response to a request for method:
+// a *SubscribeResult for mining.subscribe and a bool for the other requests.
+func DecodeResult(method string, result json.RawMessage) (interface{}, error) {
+	return Decred.DecodeResult(method, result)
+}
+
+// DecodeParams decodes the params of a notification or a request from the
+// pool into its typed struct as sent in the dialect.  ErrUnknownMethod is
+// returned for methods without a decoder.
+func (d *Dialect) DecodeParams(m *Message) (interface{}, error) {
+	decode, ok := d.params[m.Method]
+	if !ok {
+		return nil, ErrUnknownMethod
+	}
+	params, err := decode(m.Params)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s: %v", m.Method, err)
+	}
+	return params, nil
+}
+
+// DecodeResult decodes the result of the response to a request for method as
+// sent in the dialect: a *SubscribeResult for mining.subscribe and a bool for
+// the other requests.
+func (d *Dialect) DecodeResult(method string, result json.RawMessage) (interface{}, error) {
+	decode, ok := d.results[method]
+	if !ok {
+		return nil, ErrUnknownMethod
+	}
+	res, err := decode(result)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s result: %v", method, err)
+	}
+	return res, nil
+}
+
+// decodeParams decodes the positional params into args, of which only the
+// first required are mandatory.  Extra params are ignored.
+func decodeParams(params []json.RawMessage, required int, args ...interface{}) error {
+	if len(params) < required {
+		return fmt.Errorf("Expected %d params, got %d", required,
+			len(params))
+	}
+	for i, param := range params {
+		if i == len(args) {
+			break
+		}
+		if err := json.Unmarshal(param, args[i]); err != nil {
+			return fmt.Errorf("Param %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// checkHex returns an error unless s is hex encoded data of size bytes, or of
+// any size when size is negative.
+func checkHex(name, s string, size int) error {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("Invalid %s: %v", name, err)
+	}
+	if size >= 0 && len(b) != size {
+		return fmt.Errorf("Invalid %s length %d", name, len(b))
+	}
+	return nil
+}
+
+func decodeNotify(params []json.RawMessage) (interface{}, error) {
+	var n Notify
+	err := decodeParams(params, 9, &n.JobID, &n.PrevHash, &n.CoinbasePart1,
+		&n.CoinbasePart2, &n.MerkleBranches, &n.Version, &n.Bits, &n.Time,
+		&n.CleanJobs)
+	if err != nil {
+		return nil, err
+	}
+	if n.JobID == "" {
+		return nil, errors.New("Empty job id")
+	}
+	for _, field := range []struct {
+		name, value string
+		size        int
+	}{
+		{"previous hash", n.PrevHash, 32},
+		{"coinbase part 1", n.CoinbasePart1, -1},
+		{"coinbase part 2", n.CoinbasePart2, -1},
+		{"version", n.Version, 4},
+		{"bits", n.Bits, 4},
+		{"time", n.Time, 4},
+	} {
+		if err := checkHex(field.name, field.value, field.size); err != nil {
+			return nil, err
+		}
+	}
+	return &n, nil
+}
+
+func decodeSetDifficulty(params []json.RawMessage) (interface{}, error) {
+	var d SetDifficulty
+	if err := decodeParams(params, 1, &d.Difficulty); err != nil {
+		return nil, err
+	}
+	if d.Difficulty <= 0 {
+		return nil, fmt.Errorf("Invalid difficulty %v", d.Difficulty)
+	}
+	return &d, nil
+}
+
+// decodeSetTarget decodes the target of mining.set_target, which is sent as a
+// big-endian 256-bit number.
+func decodeSetTarget(params []json.RawMessage) (interface{}, error) {
+	var target string
+	if err := decodeParams(params, 1, &target); err != nil {
+		return nil, err
+	}
+	if err := checkHex("target", target, 32); err != nil {
+		return nil, err
+	}
+	t, _ := new(big.Int).SetString(target, 16)
+	if t.Sign() == 0 {
+		return nil, errors.New("Zero target")
+	}
+	return &SetTarget{Target: t}, nil
+}
+
+func decodeSetExtraNonce(params []json.RawMessage) (interface{}, error) {
+	var x SetExtraNonce
+	err := decodeParams(params, 2, &x.ExtraNonce1, &x.ExtraNonce2Size)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkHex("extranonce1", x.ExtraNonce1, -1); err != nil {
+		return nil, err
+	}
+	if x.ExtraNonce2Size < 0 {
+		return nil, fmt.Errorf("Invalid extranonce2 size %d",
+			x.ExtraNonce2Size)
+	}
+	return &x, nil
+}
+
+func decodeShowMessage(params []json.RawMessage) (interface{}, error) {
+	var m ShowMessage
+	if err := decodeParams(params, 1, &m.Message); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// number is a number that pools may send as a JSON number or as a string.
+type number string
+
+func (n *number) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*n = number(s)
+		return nil
+	}
+	var i int64
+	if err := json.Unmarshal(b, &i); err != nil {
+		return err
+	}
+	*n = number(strconv.FormatInt(i, 10))
+	return nil
+}
+
+func decodeReconnect(params []json.RawMessage) (interface{}, error) {
+	var host string
+	var port, wait number
+	if err := decodeParams(params, 0, &host, &port, &wait); err != nil {
+		return nil, err
+	}
+	r := &Reconnect{Host: host, Port: string(port)}
+	if (r.Host == "") != (r.Port == "") {
+		return nil, errors.New("Host and port must both be set")
+	}
+	if wait != "" {
+		seconds, err := strconv.ParseUint(string(wait), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid wait: %v", err)
+		}
+		r.Wait = time.Duration(seconds) * time.Second
+	}
+	return r, nil
+}
+
+func decodeGetVersion(params []json.RawMessage) (interface{}, error) {
+	return &GetVersion{}, nil
+}
+
+// decodeSubscribeResult decodes the result of mining.subscribe, which is the
+// subscriptions, the extranonce1 and the extranonce2 size.  Pools do not
+// agree on the form of the subscriptions: some send a single
+// ["mining.notify", id] pair and others a list of pairs.
+func decodeSubscribeResult(result json.RawMessage) (interface{}, error) {
+	var res []json.RawMessage
+	if err := json.Unmarshal(result, &res); err != nil {
+		return nil, err
+	}
+	var subscriptions json.RawMessage
+	var r SubscribeResult
+	err := decodeParams(res, 3, &subscriptions, &r.ExtraNonce1,
+		&r.ExtraNonce2Size)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkHex("extranonce1", r.ExtraNonce1, -1); err != nil {
+		return nil, err
+	}
+	if r.ExtraNonce2Size < 0 {
+		return nil, fmt.Errorf("Invalid extranonce2 size %d",
+			r.ExtraNonce2Size)
+	}
+
+	// The subscription id is informative only, so subscriptions of an
+	// unexpected form are ignored.
+	var pair []string
+	var pairs [][]string
+	if json.Unmarshal(subscriptions, &pair) == nil {
+		pairs = [][]string{pair}
+	} else {
+		json.Unmarshal(subscriptions, &pairs)
+	}
+	for _, pair := range pairs {
+		if len(pair) == 2 && pair[0] == MethodNotify {
+			r.SubscriptionID = pair[1]
+		}
+	}
+	return &r, nil
+}
+
+// decodeBoolResult decodes a boolean result, with null meaning false as sent
+// along with an error.
+func decodeBoolResult(result json.RawMessage) (interface{}, error) {
+	var ok bool
+	if len(result) == 0 {
+		return false, nil
+	}
+	if err := json.Unmarshal(result, &ok); err != nil {
+		return nil, err
+	}
+	return ok, nil
+}
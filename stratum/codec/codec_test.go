@@ -0,0 +1,134 @@
+// Copyright (c) 2018 The ExchangeCoin team
+
+package codec
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// resultMethods are the methods whose results are decoded when fuzzing.
+var resultMethods = []string{
+	MethodSubscribe,
+	MethodAuthorize,
+	MethodExtraNonceSubscribe,
+	MethodSubmit,
+}
+
+// testLines returns the lines received from Decred and ZIP 301 pools held in
+// testdata/lines, by file name.
+func testLines(tb testing.TB) map[string][]byte {
+	tb.Helper()
+	files, err := filepath.Glob(filepath.Join("testdata", "lines", "*"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if len(files) == 0 {
+		tb.Fatal("No lines in testdata/lines")
+	}
+	lines := make(map[string][]byte)
+	for _, file := range files {
+		line, err := ioutil.ReadFile(file)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		lines[filepath.Base(file)] = bytes.TrimSpace(line)
+	}
+	return lines
+}
+
+// FuzzDecode feeds lines as received from pools to the decoders of both
+// dialects to check that decoding never panics, starting from the lines of
+// testdata/lines:
+//
+//	go test -fuzz=FuzzDecode ./stratum/codec
+func FuzzDecode(f *testing.F) {
+	for _, line := range testLines(f) {
+		f.Add(line)
+	}
+	f.Fuzz(func(t *testing.T, line []byte) {
+		msg, err := Decode(line)
+		if err != nil {
+			return
+		}
+		if msg.IsResponse() {
+			msg.RequestID()
+			if msg.Error != nil {
+				_ = msg.Error.Error()
+			}
+			for _, method := range resultMethods {
+				Decred.DecodeResult(method, msg.Result)
+				ZIP301.DecodeResult(method, msg.Result)
+			}
+			return
+		}
+		Decred.DecodeParams(msg)
+		ZIP301.DecodeParams(msg)
+	})
+}
+
+func TestDecodeLines(t *testing.T) {
+	for name, line := range testLines(t) {
+		msg, err := Decode(line)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if msg.IsResponse() {
+			if _, ok := msg.RequestID(); !ok {
+				t.Errorf("%s: response without request id", name)
+			}
+			continue
+		}
+
+		// Requests are understood by at least one of the dialects,
+		// except for the methods gominer does not handle.
+		_, err = Decred.DecodeParams(msg)
+		_, zerr := ZIP301.DecodeParams(msg)
+		if name == "unknown-method" {
+			if err != ErrUnknownMethod || zerr != ErrUnknownMethod {
+				t.Errorf("%s: decoded with errors %v and %v, want %v",
+					name, err, zerr, ErrUnknownMethod)
+			}
+			continue
+		}
+		if err != nil && zerr != nil {
+			t.Errorf("%s: not decoded by any dialect: %v, %v", name,
+				err, zerr)
+		}
+	}
+}
+
+func TestDecodeNotifyZIP301(t *testing.T) {
+	line := string(testLines(t)["notify-zip301"])
+	reserved := strings.Repeat("00", ZIP301ReservedSize)
+	ext := strings.Repeat("00", ZIP301ExtensionSize)
+	withExtension := func(ext string) string {
+		return strings.Replace(line, "true]", "true,"+ext+"]", 1)
+	}
+	tests := []struct {
+		name, line string
+		ok         bool
+	}{
+		{"no extension", line, true},
+		{"extension", withExtension(`"` + ext + `"`), true},
+		{"null extension", withExtension("null"), true},
+		{"short extension", withExtension(`"` + ext[2:] + `"`), false},
+		{"long reserved field", strings.Replace(line, reserved,
+			reserved+strings.Repeat("00", 40), 1), false},
+	}
+	for _, test := range tests {
+		msg, err := Decode([]byte(test.line))
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		_, err = ZIP301.DecodeParams(msg)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error %v, want ok %v", test.name, err,
+				test.ok)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright (c) 2018 The ExchangeCoin team
+
+package codec
+
+import (
+	"sync"
+)
+
+// Pending tracks the requests sent to the pool which were not answered yet,
+// to find the request a response is for from its id.  It is safe for
+// concurrent use.
+type Pending struct {
+	mtx    sync.Mutex
+	nextID uint64
+	reqs   map[uint64]string
+}
+
+// NewPending returns an empty map of pending requests.
+func NewPending() *Pending {
+	return &Pending{
+		nextID: 1,
+		reqs:   make(map[uint64]string),
+	}
+}
+
+// Request returns a request for method with a new id, which is pending until
+// its response is resolved.
+func (p *Pending) Request(method string, params ...interface{}) *Request {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if params == nil {
+		params = []interface{}{}
+	}
+	req := &Request{
+		ID:     p.nextID,
+		Method: method,
+		Params: params,
+	}
+	p.reqs[req.ID] = method
+	p.nextID++
+	return req
+}
+
+// Resolve returns the method of the pending request with the passed id, which
+// is no longer pending afterwards.  It returns false when no such request is
+// pending.
+func (p *Pending) Resolve(id uint64) (string, bool) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	method, ok := p.reqs[id]
+	delete(p.reqs, id)
+	return method, ok
+}
+
+// Len returns the number of pending requests.
+func (p *Pending) Len() int {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return len(p.reqs)
+}
+
+// Reset forgets about all pending requests, whose responses will never come
+// once the connection they were sent on is lost.  Ids keep increasing so that
+// late responses are not mistaken for responses to new requests.
+func (p *Pending) Reset() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.reqs = make(map[uint64]string)
+}
@@ -0,0 +1,148 @@
+// Copyright (c) 2018 The ExchangeCoin team
+
+package codec
+
+import (
+	"bytes"
+	"testing"
+)
+
+// resolution is the resolution of a response to a pending request.
+type resolution struct {
+	id     uint64
+	method string
+	ok     bool
+}
+
+func TestPending(t *testing.T) {
+	tests := []struct {
+		name string
+
+		// sent are the methods of the requests sent before the
+		// connection is reset, and resent those sent after it, when
+		// reset is set.
+		sent   []string
+		reset  bool
+		resent []string
+
+		responses []resolution
+		pending   int
+	}{{
+		name:    "no request",
+		pending: 0,
+	}, {
+		name: "in order",
+		sent: []string{MethodSubscribe, MethodAuthorize},
+		responses: []resolution{
+			{1, MethodSubscribe, true},
+			{2, MethodAuthorize, true},
+		},
+		pending: 0,
+	}, {
+		name: "out of order",
+		sent: []string{MethodSubscribe, MethodAuthorize, MethodSubmit},
+		responses: []resolution{
+			{3, MethodSubmit, true},
+			{1, MethodSubscribe, true},
+		},
+		pending: 1,
+	}, {
+		name: "duplicate response",
+		sent: []string{MethodSubmit, MethodSubmit},
+		responses: []resolution{
+			{2, MethodSubmit, true},
+			{2, "", false},
+		},
+		pending: 1,
+	}, {
+		name: "unknown id",
+		sent: []string{MethodSubscribe},
+		responses: []resolution{
+			{0, "", false},
+			{42, "", false},
+		},
+		pending: 1,
+	}, {
+		name:   "reset",
+		sent:   []string{MethodSubscribe, MethodAuthorize},
+		reset:  true,
+		resent: []string{MethodSubscribe},
+		responses: []resolution{
+			// Late responses on the lost connection are ignored.
+			{1, "", false},
+			{2, "", false},
+			{3, MethodSubscribe, true},
+		},
+		pending: 0,
+	}, {
+		name:   "reset with responses pending",
+		sent:   []string{MethodSubmit},
+		reset:  true,
+		resent: []string{MethodSubscribe, MethodAuthorize},
+		responses: []resolution{
+			{3, MethodAuthorize, true},
+		},
+		pending: 1,
+	}}
+
+	for _, test := range tests {
+		p := NewPending()
+		var id uint64
+		send := func(methods []string) {
+			for _, method := range methods {
+				req := p.Request(method)
+				id++
+				if req.ID != id || req.Method != method {
+					t.Errorf("%s: request %d for %v, want %d for "+
+						"%v", test.name, req.ID, req.Method,
+						id, method)
+				}
+			}
+		}
+		send(test.sent)
+		if test.reset {
+			p.Reset()
+			if p.Len() != 0 {
+				t.Errorf("%s: %d requests pending after reset",
+					test.name, p.Len())
+			}
+		}
+		send(test.resent)
+
+		for _, want := range test.responses {
+			method, ok := p.Resolve(want.id)
+			if method != want.method || ok != want.ok {
+				t.Errorf("%s: response %d resolved to %q (%v), want "+
+					"%q (%v)", test.name, want.id, method, ok,
+					want.method, want.ok)
+			}
+		}
+		if p.Len() != test.pending {
+			t.Errorf("%s: %d requests pending, want %d", test.name,
+				p.Len(), test.pending)
+		}
+	}
+}
+
+func TestPendingRequestParams(t *testing.T) {
+	tests := []struct {
+		params []interface{}
+		want   string
+	}{
+		{nil, `{"id":1,"method":"mining.extranonce.subscribe","params":[]}`},
+		{[]interface{}{"user", "pass"},
+			`{"id":1,"method":"mining.extranonce.subscribe","params":["user","pass"]}`},
+	}
+	for _, test := range tests {
+		req := NewPending().Request(MethodExtraNonceSubscribe,
+			test.params...)
+		var b bytes.Buffer
+		if err := req.Encode(&b); err != nil {
+			t.Fatal(err)
+		}
+		if got := string(bytes.TrimSpace(b.Bytes())); got != test.want {
+			t.Errorf("Request with params %v encoded as %s, want %s",
+				test.params, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2018 The ExchangeCoin team
+
+package codec
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const (
+	// ZIP301NonceSize is the size of the nonce of ZIP 301 jobs, which
+	// starts with the nonce assigned by the pool on subscription and ends
+	// with the one rolled by the miner.
+	ZIP301NonceSize = 32
+
+	// ZIP301ReservedSize is the size of the reserved field of ZIP 301
+	// jobs, which comes after the merkle root as in Zcash headers.  For
+	// ExchangeCoin it holds the stake root, which is the field of the
+	// header at that position.
+	ZIP301ReservedSize = 32
+
+	// ZIP301ExtensionSize is the size of the header extension ExchangeCoin
+	// pools send after the clean jobs flag of ZIP 301 jobs.  It holds the
+	// fields of the header that Zcash headers have no room for: the
+	// serialized header from the vote bits up to the pool size, from the
+	// stake difficulty up to the size, and the stake version.
+	ZIP301ExtensionSize = 36
+)
+
+// NotifyZIP301 holds the job sent with mining.notify in the ZIP 301 dialect.
+// The fields are hex encoded as serialized in the header.  The extension is
+// empty when the pool does not send it.
+type NotifyZIP301 struct {
+	JobID      string
+	Version    string
+	PrevHash   string
+	MerkleRoot string
+	Reserved   string
+	Time       string
+	Bits       string
+	CleanJobs  bool
+	Extension  string
+}
+
+func decodeNotifyZIP301(params []json.RawMessage) (interface{}, error) {
+	var n NotifyZIP301
+	err := decodeParams(params, 8, &n.JobID, &n.Version, &n.PrevHash,
+		&n.MerkleRoot, &n.Reserved, &n.Time, &n.Bits, &n.CleanJobs,
+		&n.Extension)
+	if err != nil {
+		return nil, err
+	}
+	if n.JobID == "" {
+		return nil, errors.New("Empty job id")
+	}
+	for _, field := range []struct {
+		name, value string
+		size        int
+	}{
+		{"version", n.Version, 4},
+		{"previous hash", n.PrevHash, 32},
+		{"merkle root", n.MerkleRoot, 32},
+		{"reserved", n.Reserved, ZIP301ReservedSize},
+		{"time", n.Time, 4},
+		{"bits", n.Bits, 4},
+	} {
+		if err := checkHex(field.name, field.value, field.size); err != nil {
+			return nil, err
+		}
+	}
+	if n.Extension != "" {
+		err := checkHex("extension", n.Extension, ZIP301ExtensionSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &n, nil
+}
+
+// decodeSubscribeResultZIP301 decodes the result of mining.subscribe in the
+// ZIP 301 dialect, which is the session id and the first part of the nonce.
+// The extranonce2 is the rest of the nonce.
+func decodeSubscribeResultZIP301(result json.RawMessage) (interface{}, error) {
+	var res []json.RawMessage
+	if err := json.Unmarshal(result, &res); err != nil {
+		return nil, err
+	}
+	var sessionID *string
+	var r SubscribeResult
+	if err := decodeParams(res, 2, &sessionID, &r.ExtraNonce1); err != nil {
+		return nil, err
+	}
+	if sessionID != nil {
+		r.SubscriptionID = *sessionID
+	}
+	nonce1, err := hex.DecodeString(r.ExtraNonce1)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid nonce1: %v", err)
+	}
+	if len(nonce1) > ZIP301NonceSize {
+		return nil, fmt.Errorf("Invalid nonce1 length %d", len(nonce1))
+	}
+	r.ExtraNonce2Size = ZIP301NonceSize - len(nonce1)
+	return &r, nil
+}
@@ -0,0 +1,283 @@
+// Copyright (c) 2018 The ExchangeCoin team
+
+package stratum
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/EXCCoin/exccd/wire"
+
+	"github.com/EXCCoin/gominer/stratum/codec"
+	"github.com/EXCCoin/gominer/util"
+)
+
+// Names of the supported dialects of the stratum protocol.
+const (
+	DialectDecred = "decred"
+	DialectZIP301 = "zip301"
+)
+
+// Offsets of the fields of a serialized block header used to build the header
+// of jobs.
+const (
+	merkleRootOffset   = 36
+	stakeRootOffset    = 68
+	voteBitsOffset     = 100
+	bitsOffset         = 116
+	sBitsOffset        = 120
+	heightOffset       = 128
+	timestampOffset    = 136
+	extraDataOffset    = 144
+	stakeVersionOffset = 176
+
+	// headerLen is the length of the header without the solution, which
+	// is what jobs hold.
+	headerLen = 180
+)
+
+// zip301HeaderNonceLen is the length of the header nonce, which ends the
+// ZIP 301 nonce.  The rest of the ZIP 301 nonce is the start of the extra
+// data of the header.
+const zip301HeaderNonceLen = 4
+
+// dialect is a dialect of the stratum protocol.  Dialects differ in how the
+// jobs are sent and the shares submitted, while the work prepared from the
+// jobs is the same so that devices do not depend on the dialect.
+type dialect interface {
+	// name returns the name of the dialect.
+	name() string
+
+	// codec returns the codec dialect decoding the messages of the pool.
+	codec() *codec.Dialect
+
+	// subscribeParams returns the params of mining.subscribe sent to the
+	// pool at addr.
+	subscribeParams(addr, userAgent string) []interface{}
+
+	// subscribeExtraNonce returns whether to ask the pool to notify
+	// extranonce changes.
+	subscribeExtraNonce() bool
+
+	// extraNonce2Size returns the size of the extranonce2 rolled in the
+	// extra data of the header given the size announced by the pool, or
+	// a negative size when it leaves no room to roll.
+	extraNonce2Size(size int) int
+
+	// submitParams returns the params of mining.submit for the solved
+	// header of a job whose work has the passed time.  The extra data of
+	// the header starts with extraNonceLen bytes of extranonce, of which
+	// extraNonce1Len were assigned by the pool.
+	submitParams(user, jobID string, jobTime uint32, header *wire.BlockHeader, extraNonce1Len, extraNonceLen int) []interface{}
+}
+
+// dialects maps the names of the supported dialects to them.
+var dialects = map[string]dialect{
+	DialectDecred: decredDialect{},
+	DialectZIP301: zip301Dialect{},
+}
+
+// ValidDialect returns whether name is the name of a supported dialect.
+func ValidDialect(name string) bool {
+	_, ok := dialects[name]
+	return ok
+}
+
+// dialectByName returns the dialect with the passed name, the Decred one when
+// it is empty.
+func dialectByName(name string) (dialect, error) {
+	if name == "" {
+		name = DialectDecred
+	}
+	d, ok := dialects[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown stratum dialect %v", name)
+	}
+	return d, nil
+}
+
+// decredDialect is the dialect of ExchangeCoin pools, inherited from Decred
+// pools.  Jobs hold the header split in coinbase parts, and shares the
+// extranonce, time and nonce separately.
+type decredDialect struct{}
+
+func (decredDialect) name() string {
+	return DialectDecred
+}
+
+func (decredDialect) codec() *codec.Dialect {
+	return codec.Decred
+}
+
+func (decredDialect) subscribeParams(addr, userAgent string) []interface{} {
+	return []interface{}{userAgent}
+}
+
+func (decredDialect) subscribeExtraNonce() bool {
+	return true
+}
+
+func (decredDialect) extraNonce2Size(size int) int {
+	return size
+}
+
+func (decredDialect) submitParams(user, jobID string, jobTime uint32, header *wire.BlockHeader, extraNonce1Len, extraNonceLen int) []interface{} {
+	// The timestamp string should be:
+	//
+	//   timestampStr := fmt.Sprintf("%08x",
+	//     uint32(submittedHeader.Timestamp.Unix()))
+	//
+	// but the "stratum" protocol appears to only use this value
+	// to check if the miner is in sync with the latest announcement
+	// of work from the pool. If this value is anything other than
+	// the timestamp of the work of the job, work gets rejected from
+	// the current implementation.
+	timestampStr := fmt.Sprintf("%08x", jobTime)
+	xnonceStr := hex.EncodeToString(header.ExtraData[:extraNonceLen])
+	var nonce [4]byte
+	binary.LittleEndian.PutUint32(nonce[:], header.Nonce)
+	nonceStr := hex.EncodeToString(nonce[:])
+	solutionStr := hex.EncodeToString(header.EquihashSolution[:])
+
+	return []interface{}{user, jobID, xnonceStr, timestampStr, nonceStr,
+		solutionStr}
+}
+
+// decredHeader returns the header of a job sent in the Decred dialect, which
+// is the version, the previous block hash, the first coinbase part holding the
+// header from the merkle root up to the extra data, and the second coinbase
+// part holding the header after the extra data.
+func decredHeader(n *codec.Notify) ([]byte, error) {
+	// The first coinbase part holds the header up to the extra data.
+	if len(n.CoinbasePart1) < 2*coinbase1Len {
+		return nil, fmt.Errorf("Coinbase part 1 of job %v too short",
+			n.JobID)
+	}
+	cb1, err := hex.DecodeString(n.CoinbasePart1)
+	if err != nil {
+		return nil, err
+	}
+	// The second coinbase part holds the rest of the header.
+	cb2, err := hex.DecodeString(n.CoinbasePart2)
+	if err != nil {
+		return nil, err
+	}
+	if len(cb2) != headerLen-stakeVersionOffset {
+		return nil, fmt.Errorf("Coinbase part 2 of job %v is %d bytes, "+
+			"want %d", n.JobID, len(cb2), headerLen-stakeVersionOffset)
+	}
+	v, err := util.ReverseToInt(n.Version)
+	if err != nil {
+		return nil, err
+	}
+	prevHash, err := hex.DecodeString(n.PrevHash)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, headerLen)
+	binary.LittleEndian.PutUint32(header, uint32(v))
+	copy(header[4:], prevHash)
+	copy(header[merkleRootOffset:], cb1[:coinbase1Len])
+	copy(header[stakeVersionOffset:], cb2)
+	return header, nil
+}
+
+// zip301Dialect is the dialect of Equihash pools described by ZIP 301.  Jobs
+// hold the fields of the header, with the reserved field holding the stake
+// root and an extension after the clean jobs flag holding the other fields
+// Zcash headers do not have, and the share target is set with
+// mining.set_target.
+//
+// The 32-byte ZIP 301 nonce is the first 28 bytes of the extra data of the
+// header followed by the header nonce.  The pool assigns the start of the
+// nonce on subscription, while the miner rolls the rest of it, the last 4
+// bytes being the header nonce rolled by the devices.
+type zip301Dialect struct{}
+
+func (zip301Dialect) name() string {
+	return DialectZIP301
+}
+
+func (zip301Dialect) codec() *codec.Dialect {
+	return codec.ZIP301
+}
+
+func (zip301Dialect) subscribeParams(addr, userAgent string) []interface{} {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	var p interface{}
+	if n, err := strconv.Atoi(port); err == nil {
+		p = n
+	}
+	return []interface{}{host, p, userAgent, nil}
+}
+
+func (zip301Dialect) subscribeExtraNonce() bool {
+	return false
+}
+
+func (zip301Dialect) extraNonce2Size(size int) int {
+	return size - zip301HeaderNonceLen
+}
+
+func (zip301Dialect) submitParams(user, jobID string, jobTime uint32, header *wire.BlockHeader, extraNonce1Len, extraNonceLen int) []interface{} {
+	var ntime [4]byte
+	binary.LittleEndian.PutUint32(ntime[:], jobTime)
+
+	// The second part of the nonce is the extranonce2 followed by the
+	// header nonce.
+	nonce2 := make([]byte, 0, codec.ZIP301NonceSize-extraNonce1Len)
+	nonce2 = append(nonce2, header.ExtraData[extraNonce1Len:extraNonceLen]...)
+	var nonce [zip301HeaderNonceLen]byte
+	binary.LittleEndian.PutUint32(nonce[:], header.Nonce)
+	nonce2 = append(nonce2, nonce[:]...)
+
+	return []interface{}{user, jobID, hex.EncodeToString(ntime[:]),
+		hex.EncodeToString(nonce2),
+		hex.EncodeToString(header.EquihashSolution[:])}
+}
+
+// zip301Header returns the header of a job sent in the ZIP 301 dialect.  The
+// reserved field holds the stake root, and the extension the other fields
+// Zcash headers do not have, which are left zero when the pool does not send
+// it.
+func zip301Header(n *codec.NotifyZIP301) ([]byte, error) {
+	var fields [7][]byte
+	for i, s := range []string{n.Version, n.PrevHash, n.MerkleRoot,
+		n.Reserved, n.Bits, n.Time, n.Extension} {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		fields[i] = b
+	}
+	version, prevHash, merkleRoot := fields[0], fields[1], fields[2]
+	reserved, bits, ntime, ext := fields[3], fields[4], fields[5], fields[6]
+	if len(reserved) != codec.ZIP301ReservedSize {
+		return nil, fmt.Errorf("Invalid reserved field length %d",
+			len(reserved))
+	}
+	if len(ext) != 0 && len(ext) != codec.ZIP301ExtensionSize {
+		return nil, fmt.Errorf("Invalid extension length %d", len(ext))
+	}
+
+	header := make([]byte, headerLen)
+	copy(header, version)
+	copy(header[4:], prevHash)
+	copy(header[merkleRootOffset:], merkleRoot)
+	copy(header[stakeRootOffset:], reserved)
+	copy(header[bitsOffset:], bits)
+	copy(header[timestampOffset:], ntime)
+	if len(ext) != 0 {
+		ext = ext[copy(header[voteBitsOffset:bitsOffset], ext):]
+		ext = ext[copy(header[sBitsOffset:timestampOffset], ext):]
+		copy(header[stakeVersionOffset:], ext)
+	}
+	return header, nil
+}
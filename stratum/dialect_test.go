@@ -0,0 +1,132 @@
+// Copyright (c) 2018 The ExchangeCoin team
+
+package stratum
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/EXCCoin/gominer/stratum/codec"
+)
+
+func TestZIP301Header(t *testing.T) {
+	// header is a serialized header whose bytes are their offset, so that
+	// a field at the wrong place shows.
+	header := make([]byte, headerLen)
+	for i := range header {
+		header[i] = byte(i)
+	}
+	field := func(start, end int) string {
+		return hex.EncodeToString(header[start:end])
+	}
+	ext := field(voteBitsOffset, bitsOffset) +
+		field(sBitsOffset, timestampOffset) +
+		field(stakeVersionOffset, headerLen)
+
+	n := codec.NotifyZIP301{
+		JobID:      "1",
+		Version:    field(0, 4),
+		PrevHash:   field(4, merkleRootOffset),
+		MerkleRoot: field(merkleRootOffset, stakeRootOffset),
+		Reserved:   field(stakeRootOffset, voteBitsOffset),
+		Time:       field(timestampOffset, timestampOffset+4),
+		Bits:       field(bitsOffset, sBitsOffset),
+		Extension:  ext,
+	}
+	got, err := zip301Header(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The nonce and the extra data are rolled by the miner.
+	want := append([]byte(nil), header...)
+	for i := timestampOffset + 4; i < stakeVersionOffset; i++ {
+		want[i] = 0
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Header with extension %x, want %x", got, want)
+	}
+
+	// Without extension the fields Zcash headers do not have are zero.
+	n.Extension = ""
+	got, err = zip301Header(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range [][2]int{
+		{voteBitsOffset, bitsOffset},
+		{sBitsOffset, timestampOffset},
+		{stakeVersionOffset, headerLen},
+	} {
+		copy(want[r[0]:r[1]], make([]byte, r[1]-r[0]))
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Header without extension %x, want %x", got, want)
+	}
+
+	tests := []struct {
+		reserved, ext, err string
+	}{
+		{strings.Repeat("00", 72), "", "reserved"},
+		{n.Reserved, ext[2:], "extension"},
+	}
+	for _, test := range tests {
+		n.Reserved, n.Extension = test.reserved, test.ext
+		_, err := zip301Header(&n)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Reserved field %v and extension %v: got error "+
+				"%v, want one about the %v", test.reserved,
+				test.ext, err, test.err)
+		}
+	}
+}
+
+func TestDecredHeader(t *testing.T) {
+	header := make([]byte, headerLen)
+	for i := range header {
+		header[i] = byte(i)
+	}
+	field := func(start, end int) string {
+		return hex.EncodeToString(header[start:end])
+	}
+
+	n := codec.Notify{
+		JobID:         "1",
+		PrevHash:      field(4, merkleRootOffset),
+		CoinbasePart1: field(merkleRootOffset, extraDataOffset),
+		CoinbasePart2: field(stakeVersionOffset, headerLen),
+		Version:       "01000000",
+	}
+	got, err := decredHeader(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The extra data is rolled by the miner.
+	want := append([]byte(nil), header...)
+	copy(want, []byte{1, 0, 0, 0})
+	for i := extraDataOffset; i < stakeVersionOffset; i++ {
+		want[i] = 0
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Header %x, want %x", got, want)
+	}
+
+	tests := []struct {
+		cb1, cb2, err string
+	}{
+		{n.CoinbasePart1[2:], n.CoinbasePart2, "part 1"},
+		{n.CoinbasePart1, n.CoinbasePart2[2:], "part 2"},
+		{n.CoinbasePart1, n.CoinbasePart2 + "00", "part 2"},
+		{n.CoinbasePart1, "", "part 2"},
+	}
+	for _, test := range tests {
+		n.CoinbasePart1, n.CoinbasePart2 = test.cb1, test.cb2
+		_, err := decredHeader(&n)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Coinbase parts %v and %v: got error %v, want "+
+				"one about the coinbase %v", test.cb1, test.cb2, err,
+				test.err)
+		}
+	}
+}
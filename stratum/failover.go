@@ -0,0 +1,449 @@
+// Copyright (c) 2018 The ExchangeCoin team
+
+package stratum
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/EXCCoin/exccd/chaincfg"
+)
+
+const (
+	// readyTimeout is how long a new connection may take to deliver its
+	// first job before the pool is considered unusable.
+	readyTimeout = 30 * time.Second
+
+	// noWorkCheckInterval is how often the active pool is checked for
+	// having sent work recently.
+	noWorkCheckInterval = 10 * time.Second
+
+	// switchTimeout is how long a request to switch pools waits for the
+	// monitoring goroutine to take it, which it does not while connecting
+	// to a pool.
+	switchTimeout = 5 * time.Second
+)
+
+// errNoWork indicates that a pool did not send any job in time.
+var errNoWork = errors.New("No work received from pool")
+
+// errStopped indicates that the connection attempt was aborted by Stop.
+var errStopped = errors.New("Failover stopped")
+
+// errSwitchBusy indicates that a request to switch pools was made while the
+// pools are being reconnected to.
+var errSwitchBusy = errors.New("Busy reconnecting to the pools, try again " +
+	"later")
+
+// PoolConfig holds the address and credentials of a single pool.
+type PoolConfig struct {
+	URL  string
+	User string
+	Pass string
+}
+
+// FailoverConfig holds the options of a prioritized list of pools.
+type FailoverConfig struct {
+	// Pools holds the pools in priority order, the first being the
+	// primary pool.
+	Pools []PoolConfig
+
+	Proxy     string
+	ProxyUser string
+	ProxyPass string
+	Version   string
+
+	// Dialect is the dialect of the protocol spoken by the pools whose
+	// URL does not select one.
+	Dialect string
+
+	// TLS is the TLS configuration used for stratum+ssl:// and
+	// stratum+tls:// pools.
+	TLS *tls.Config
+
+	// ChainParams are the parameters of the network mined on.
+	ChainParams *chaincfg.Params
+
+	// MaxFailures is the number of consecutive connection or auth
+	// failures after which the next pool is tried.
+	MaxFailures int
+
+	// MaxReconnects is the number of attempts to reconnect to the active
+	// pool after losing the connection before it counts as failed, zero
+	// retrying forever.
+	MaxReconnects int
+
+	// NoWorkTimeout is how long the active pool may go without sending
+	// a mining.notify before switching to the next pool.  Zero disables
+	// the check.
+	NoWorkTimeout time.Duration
+
+	// ProbeInterval is how often pools of a higher priority than the
+	// active one are probed to fall back to them.  Zero disables probing.
+	ProbeInterval time.Duration
+
+	// Transcript records the sessions with all pools when set.
+	Transcript *Transcript
+
+	// KeepAlive, ReadTimeout and ResponseTimeout apply to the connections
+	// to all pools as described in Config.
+	KeepAlive       time.Duration
+	ReadTimeout     time.Duration
+	ResponseTimeout time.Duration
+}
+
+// Failover keeps a connection to the highest priority working pool of a list
+// of pools, switching to the next one when the active pool fails and back to
+// a higher priority pool once it recovers.
+type Failover struct {
+	// The following variables must only be used atomically.
+	validShares   uint64
+	invalidShares uint64
+	reconnects    uint64
+
+	sync.Mutex
+	cfg      FailoverConfig
+	active   int
+	pool     *Stratum
+	failures []int
+	shares   *ShareLog
+
+	switchPool chan switchRequest
+	quit       chan struct{}
+	wg         sync.WaitGroup
+}
+
+// switchRequest asks the monitoring goroutine to switch to pool, replying
+// with the result on err.
+type switchRequest struct {
+	pool int
+	err  chan error
+}
+
+// NewFailover connects to the first working pool of the list, in priority
+// order, and keeps monitoring it.
+func NewFailover(cfg FailoverConfig) (*Failover, error) {
+	if len(cfg.Pools) == 0 {
+		return nil, errors.New("No pools configured")
+	}
+	if cfg.MaxFailures < 1 {
+		cfg.MaxFailures = 1
+	}
+
+	f := &Failover{
+		cfg:        cfg,
+		failures:   make([]int, len(cfg.Pools)),
+		shares:     NewShareLog(),
+		switchPool: make(chan switchRequest),
+		quit:       make(chan struct{}),
+	}
+
+	for i := range cfg.Pools {
+		s, err := f.connect(i)
+		if err != nil {
+			log.Errorf("Unable to use pool %v: %v", cfg.Pools[i].URL, err)
+			continue
+		}
+		f.setActive(i, s)
+		f.wg.Add(1)
+		go f.run()
+		return f, nil
+	}
+
+	return nil, errors.New("Unable to connect to any pool")
+}
+
+// Pool returns the connection to the active pool.
+func (f *Failover) Pool() *Stratum {
+	f.Lock()
+	defer f.Unlock()
+	return f.pool
+}
+
+// Active returns the index into the pool list and the config of the active
+// pool.
+func (f *Failover) Active() (int, PoolConfig) {
+	f.Lock()
+	defer f.Unlock()
+	return f.active, f.cfg.Pools[f.active]
+}
+
+// ValidShares returns the number of shares accepted by all pools.
+func (f *Failover) ValidShares() uint64 {
+	pool := f.Pool()
+	return atomic.LoadUint64(&f.validShares) +
+		atomic.LoadUint64(&pool.ValidShares)
+}
+
+// InvalidShares returns the number of shares rejected by all pools.
+func (f *Failover) InvalidShares() uint64 {
+	pool := f.Pool()
+	return atomic.LoadUint64(&f.invalidShares) +
+		atomic.LoadUint64(&pool.InvalidShares)
+}
+
+// PendingShares returns the number of shares submitted to the active pool
+// which it did not respond to yet.
+func (f *Failover) PendingShares() int {
+	return f.Pool().PendingShares()
+}
+
+// Shares returns the log of the shares submitted to all pools.
+func (f *Failover) Shares() *ShareLog {
+	return f.shares
+}
+
+// Reconnects returns the number of times the connection to a pool was
+// reestablished, either to the same pool or by switching pools.
+func (f *Failover) Reconnects() uint64 {
+	pool := f.Pool()
+	return atomic.LoadUint64(&f.reconnects) +
+		atomic.LoadUint64(&pool.Reconnects)
+}
+
+// SwitchPool switches to pool i of the list, regardless of its priority.  The
+// active pool is kept if the new one is unusable.  Pools of a higher priority
+// are not probed again until the selected pool fails.
+//
+// An error is returned rather than waiting when the pools are being
+// reconnected to.  The switch itself takes up to the time a connection is
+// given to deliver its first job.
+func (f *Failover) SwitchPool(i int) error {
+	if i < 0 || i >= len(f.cfg.Pools) {
+		return fmt.Errorf("Invalid pool %d, %d pools configured", i,
+			len(f.cfg.Pools))
+	}
+
+	req := switchRequest{pool: i, err: make(chan error, 1)}
+	select {
+	case f.switchPool <- req:
+	case <-time.After(switchTimeout):
+		return errSwitchBusy
+	case <-f.quit:
+		return errStopped
+	}
+	select {
+	case err := <-req.err:
+		return err
+	case <-f.quit:
+		return errStopped
+	}
+}
+
+// Stop closes the connection to the active pool and stops switching pools.
+func (f *Failover) Stop() {
+	close(f.quit)
+	f.wg.Wait()
+}
+
+// connect connects to pool i and waits for its first job.
+func (f *Failover) connect(i int) (*Stratum, error) {
+	pc := f.cfg.Pools[i]
+	s, err := StratumConn(Config{
+		Pool:            pc.URL,
+		User:            pc.User,
+		Pass:            pc.Pass,
+		Proxy:           f.cfg.Proxy,
+		ProxyUser:       f.cfg.ProxyUser,
+		ProxyPass:       f.cfg.ProxyPass,
+		Version:         f.cfg.Version,
+		Dialect:         f.cfg.Dialect,
+		TLS:             f.cfg.TLS,
+		ChainParams:     f.cfg.ChainParams,
+		MaxReconnects:   f.cfg.MaxReconnects,
+		Shares:          f.shares,
+		Transcript:      f.cfg.Transcript,
+		KeepAlive:       f.cfg.KeepAlive,
+		ReadTimeout:     f.cfg.ReadTimeout,
+		ResponseTimeout: f.cfg.ResponseTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-s.Ready():
+		return s, nil
+	case <-s.Done():
+		return nil, s.Err()
+	case <-time.After(readyTimeout):
+		s.Close()
+		return nil, errNoWork
+	case <-f.quit:
+		s.Close()
+		return nil, errStopped
+	}
+}
+
+// setActive makes s, connected to pool i, the active pool.  The shares of the
+// previously active pool are kept in the totals.
+func (f *Failover) setActive(i int, s *Stratum) {
+	f.Lock()
+	old := f.pool
+	f.active = i
+	f.pool = s
+	f.Unlock()
+
+	f.failures[i] = 0
+	if old != nil {
+		old.Close()
+		atomic.AddUint64(&f.validShares, atomic.LoadUint64(&old.ValidShares))
+		atomic.AddUint64(&f.invalidShares, atomic.LoadUint64(&old.InvalidShares))
+		atomic.AddUint64(&f.reconnects, atomic.LoadUint64(&old.Reconnects)+1)
+	}
+	log.Infof("Mining on pool %v (priority %d)", f.cfg.Pools[i].URL, i)
+}
+
+// fail records a failure of pool i and returns the pool to try next, which is
+// the following one in the list once i failed MaxFailures times in a row.
+func (f *Failover) fail(i int) int {
+	f.failures[i]++
+	if f.failures[i] < f.cfg.MaxFailures {
+		return i
+	}
+
+	f.failures[i] = 0
+	next := (i + 1) % len(f.cfg.Pools)
+	if next != i {
+		log.Warnf("Pool %v failed %d times, switching to %v",
+			f.cfg.Pools[i].URL, f.cfg.MaxFailures, f.cfg.Pools[next].URL)
+	}
+	return next
+}
+
+// reconnect connects to pool i, moving on to the next pools as they keep
+// failing, until a connection succeeds.  The delay between attempts grows
+// with every failure.  It returns false if it was interrupted by Stop.
+func (f *Failover) reconnect(i int) bool {
+	for attempt := 1; ; attempt++ {
+		s, err := f.connect(i)
+		if err == nil {
+			f.setActive(i, s)
+			return true
+		}
+		if err == errStopped {
+			return false
+		}
+		log.Errorf("Unable to use pool %v: %v", f.cfg.Pools[i].URL, err)
+		i = f.fail(i)
+
+		delay := time.After(Backoff(attempt))
+	wait:
+		for {
+			select {
+			case <-f.quit:
+				return false
+			case req := <-f.switchPool:
+				req.err <- errSwitchBusy
+			case <-delay:
+				break wait
+			}
+		}
+	}
+}
+
+// probe tries to connect to the pools of a higher priority than the active
+// one and switches to the first one that works.
+func (f *Failover) probe() {
+	active, _ := f.Active()
+	for i := 0; i < active; i++ {
+		s, err := f.connect(i)
+		if err != nil {
+			log.Debugf("Pool %v is still unavailable: %v",
+				f.cfg.Pools[i].URL, err)
+			continue
+		}
+		log.Infof("Pool %v recovered, switching back", f.cfg.Pools[i].URL)
+		f.setActive(i, s)
+		return
+	}
+}
+
+// run monitors the active pool and switches pools as needed until Stop is
+// called.
+func (f *Failover) run() {
+	defer f.wg.Done()
+
+	// The active pool is checked at least twice within NoWorkTimeout.
+	interval := noWorkCheckInterval
+	if d := f.cfg.NoWorkTimeout / 2; d > 0 && d < interval {
+		interval = d
+	}
+	check := time.NewTicker(interval)
+	defer check.Stop()
+
+	var probe <-chan time.Time
+	if f.cfg.ProbeInterval > 0 {
+		t := time.NewTicker(f.cfg.ProbeInterval)
+		defer t.Stop()
+		probe = t.C
+	}
+
+	// pinned is set while on a pool chosen with SwitchPool.
+	var pinned bool
+
+	for {
+		active, pc := f.Active()
+		pool := f.Pool()
+
+		select {
+		case <-f.quit:
+			pool.Close()
+			return
+
+		case req := <-f.switchPool:
+			// The lost pool is reconnected to first.
+			select {
+			case <-pool.Done():
+				req.err <- errSwitchBusy
+				continue
+			default:
+			}
+			if req.pool == active {
+				pinned = true
+				req.err <- nil
+				continue
+			}
+			s, err := f.connect(req.pool)
+			if err != nil {
+				req.err <- err
+				continue
+			}
+			log.Infof("Switching to pool %v on request",
+				f.cfg.Pools[req.pool].URL)
+			f.setActive(req.pool, s)
+			pinned = true
+			req.err <- nil
+
+		case <-pool.Done():
+			pinned = false
+			log.Errorf("Lost pool %v: %v", pc.URL, pool.Err())
+			if !f.reconnect(f.fail(active)) {
+				return
+			}
+
+		case <-check.C:
+			if f.cfg.NoWorkTimeout <= 0 ||
+				time.Since(pool.LastNotify()) < f.cfg.NoWorkTimeout {
+				continue
+			}
+			log.Warnf("No work from pool %v for %v", pc.URL,
+				f.cfg.NoWorkTimeout)
+			pinned = false
+			pool.Close()
+			f.failures[active] = 0
+			if !f.reconnect((active + 1) % len(f.cfg.Pools)) {
+				return
+			}
+
+		case <-probe:
+			if active > 0 && !pinned {
+				f.probe()
+			}
+		}
+	}
+}
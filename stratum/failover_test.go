@@ -0,0 +1,216 @@
+// Copyright (c) 2018 The ExchangeCoin team
+
+package stratum
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/EXCCoin/gominer/stratum/stratumtest"
+)
+
+// testProbeInterval is how often the pools of a higher priority are probed in
+// the tests.
+const testProbeInterval = 100 * time.Millisecond
+
+// newTestFailover connects to the first working pool of srvs, in priority
+// order, with the limits of cfg.  The failover is stopped once the test
+// finished.
+func newTestFailover(t *testing.T, cfg FailoverConfig, srvs ...*stratumtest.Server) (*Failover, error) {
+	t.Helper()
+	for _, srv := range srvs {
+		cfg.Pools = append(cfg.Pools, PoolConfig{
+			URL:  srv.URL(),
+			User: "worker",
+			Pass: "x",
+		})
+	}
+	cfg.ChainParams = testParams
+	if cfg.MaxReconnects == 0 {
+		cfg.MaxReconnects = 1
+	}
+	f, err := NewFailover(cfg)
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(f.Stop)
+	return f, nil
+}
+
+// waitActive waits for pool i to become the active pool of f.
+func waitActive(t *testing.T, f *Failover, i int) {
+	t.Helper()
+	waitFor(t, fmt.Sprintf("pool %d to be active", i), func() bool {
+		active, _ := f.Active()
+		return active == i
+	})
+}
+
+func TestFailoverPriority(t *testing.T) {
+	tests := []struct {
+		down   []int
+		active int
+	}{
+		{nil, 0},
+		{[]int{0}, 1},
+		{[]int{0, 1}, 2},
+		{[]int{1}, 0},
+		{[]int{0, 1, 2}, -1},
+	}
+
+	for _, test := range tests {
+		var srvs []*stratumtest.Server
+		for i := 0; i < 3; i++ {
+			srvs = append(srvs, newTestPool(t, stratumtest.Config{}))
+		}
+		for _, i := range test.down {
+			srvs[i].Close()
+		}
+
+		f, err := newTestFailover(t, FailoverConfig{}, srvs...)
+		if test.active < 0 {
+			if err == nil {
+				t.Errorf("Pools %v down: connected to a pool", test.down)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Pools %v down: %v", test.down, err)
+		}
+		if active, _ := f.Active(); active != test.active {
+			t.Errorf("Pools %v down: mining on pool %d, want %d",
+				test.down, active, test.active)
+		}
+		if err := srvs[test.active].WaitAuthorized(1, testTimeout); err != nil {
+			t.Errorf("Pools %v down: %v", test.down, err)
+		}
+		for i := test.active + 1; i < len(srvs); i++ {
+			if err := srvs[i].WaitAuthorized(1, 0); err == nil {
+				t.Errorf("Pools %v down: lower priority pool %d "+
+					"connected to", test.down, i)
+			}
+		}
+	}
+}
+
+func TestFailoverFail(t *testing.T) {
+	f := &Failover{
+		cfg: FailoverConfig{
+			Pools:       make([]PoolConfig, 3),
+			MaxFailures: 2,
+		},
+		failures: make([]int, 3),
+	}
+
+	// Each pool is retried until it failed MaxFailures times in a row,
+	// wrapping around to the first pool after the last.
+	tests := []struct {
+		pool, next int
+	}{
+		{0, 0}, {0, 1},
+		{1, 1}, {1, 2},
+		{2, 2}, {2, 0},
+		{0, 0}, {0, 1},
+	}
+	for i, test := range tests {
+		if next := f.fail(test.pool); next != test.next {
+			t.Errorf("Failure %d of pool %d: next pool %d, want %d",
+				i+1, test.pool, next, test.next)
+		}
+	}
+
+	// The failures of a pool are forgotten once it works again.
+	f.fail(1)
+	f.setActive(1, nil)
+	if next := f.fail(1); next != 1 {
+		t.Errorf("Failure after pool 1 worked: next pool %d, want 1", next)
+	}
+}
+
+func TestFailoverPoolLost(t *testing.T) {
+	primary := newTestPool(t, stratumtest.Config{})
+	backup := newTestPool(t, stratumtest.Config{})
+	f, err := newTestFailover(t, FailoverConfig{MaxFailures: 2},
+		primary, backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The primary pool is tried again before falling back.
+	primary.Close()
+	waitActive(t, f, 1)
+	if err := backup.WaitAuthorized(1, testTimeout); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.Reconnects(); n != 1 {
+		t.Errorf("%d reconnections counted, want 1", n)
+	}
+}
+
+func TestFailoverNoWork(t *testing.T) {
+	// The pools never send another job after the first one.
+	primary := newTestPool(t, stratumtest.Config{})
+	backup := newTestPool(t, stratumtest.Config{})
+	f, err := newTestFailover(t, FailoverConfig{NoWorkTimeout: time.Second},
+		primary, backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitActive(t, f, 1)
+	if err := backup.WaitAuthorized(1, testTimeout); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFailoverSilentPool(t *testing.T) {
+	primary := newTestPool(t, stratumtest.Config{})
+	backup := newTestPool(t, stratumtest.Config{})
+	f, err := newTestFailover(t, FailoverConfig{ReadTimeout: watchdogTimeout},
+		primary, backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The primary pool is reconnected to once it goes silent, and given up
+	// on once it does not answer the new connection either.
+	primary.StopResponding()
+	waitActive(t, f, 1)
+	if err := backup.WaitAuthorized(1, testTimeout); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFailoverProbe(t *testing.T) {
+	primary := newTestPool(t, stratumtest.Config{})
+	backup := newTestPool(t, stratumtest.Config{})
+	addr := primary.Addr()
+	primary.Close()
+	f, err := newTestFailover(t, FailoverConfig{
+		ProbeInterval: testProbeInterval,
+	}, primary, backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if active, _ := f.Active(); active != 1 {
+		t.Fatalf("Mining on pool %d with the primary pool down", active)
+	}
+
+	// The primary pool is switched back to once it is up again.
+	primary = newTestPool(t, stratumtest.Config{Listen: addr})
+	waitActive(t, f, 0)
+	if err := primary.WaitAuthorized(1, testTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	// A pool switched to on request is kept.
+	if err := f.SwitchPool(1); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * testProbeInterval)
+	if active, _ := f.Active(); active != 1 {
+		t.Errorf("Switched back to pool %d from the requested pool",
+			active)
+	}
+}
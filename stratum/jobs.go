@@ -0,0 +1,135 @@
+// Copyright (c) 2018 The ExchangeCoin team
+
+package stratum
+
+import (
+	"fmt"
+	"math/big"
+	"sync"
+)
+
+const (
+	// maxActiveJobs is the number of jobs kept active when the pool does
+	// not clear them, since pools only accept shares for a few of their
+	// most recent jobs.
+	maxActiveJobs = 16
+
+	// maxRetiredJobs is the number of retired jobs remembered to tell why
+	// a share for them is stale.
+	maxRetiredJobs = 64
+)
+
+// job is an active job along with the share difficulty it was sent with.
+type job struct {
+	diff   float64
+	target *big.Int
+
+	// time is the time of the work prepared for the job, zero until the
+	// work is prepared.
+	time uint32
+}
+
+// jobRegistry tracks the jobs of the pool shares may still be submitted for,
+// along with why the jobs that are no longer active were retired.  It is
+// safe for concurrent use.
+type jobRegistry struct {
+	mtx sync.Mutex
+
+	// active holds the active jobs by job id, with order holding their
+	// ids from the oldest to the most recent.
+	active map[string]*job
+	order  []string
+
+	// retired holds why retired jobs were retired by job id, with
+	// retiredOrder holding their ids in the order they were retired.
+	retired      map[string]string
+	retiredOrder []string
+}
+
+// newJobRegistry returns a registry without any job.
+func newJobRegistry() *jobRegistry {
+	return &jobRegistry{
+		active:  make(map[string]*job),
+		retired: make(map[string]string),
+	}
+}
+
+// add registers a job sent with mining.notify, which shares are checked
+// against the target of the difficulty set by the pool before it for.  All
+// the active jobs are retired first when clean is set, as the pool no longer
+// accepts shares for them.  It returns whether no job registered before
+// remains active, in which case the work of previous jobs is stale.
+func (r *jobRegistry) add(jobID string, clean bool, diff float64, target *big.Int) bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if clean {
+		r.retireAll(fmt.Sprintf("cleared by job %v", jobID))
+	} else if _, ok := r.active[jobID]; ok {
+		return false
+	}
+	if len(r.order) == maxActiveJobs {
+		r.retire(r.order[0], fmt.Sprintf("superseded by %d newer jobs",
+			maxActiveJobs))
+		r.order = r.order[1:]
+	}
+	fresh := len(r.order) == 0
+	r.active[jobID] = &job{diff: diff, target: target}
+	r.order = append(r.order, jobID)
+	return fresh
+}
+
+// prepared records the time of the work prepared for an active job.
+func (r *jobRegistry) prepared(jobID string, jobTime uint32) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if j, ok := r.active[jobID]; ok {
+		j.time = jobTime
+	}
+}
+
+// check returns a job shares may be submitted for, or why shares for the job
+// are stale.
+func (r *jobRegistry) check(jobID string) (job, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if j, ok := r.active[jobID]; ok {
+		return *j, nil
+	}
+	if reason, ok := r.retired[jobID]; ok {
+		return job{}, fmt.Errorf("Job %v retired: %v", jobID, reason)
+	}
+	return job{}, fmt.Errorf("Job %v unknown", jobID)
+}
+
+// reset retires all the jobs for reason, as when the connection is lost.
+func (r *jobRegistry) reset(reason string) {
+	r.mtx.Lock()
+	r.retireAll(reason)
+	r.mtx.Unlock()
+}
+
+// retireAll retires all the active jobs for reason.  It must be called with
+// the mutex held.
+func (r *jobRegistry) retireAll(reason string) {
+	for _, jobID := range r.order {
+		r.retire(jobID, reason)
+	}
+	r.order = r.order[:0]
+}
+
+// retire moves a job from the active jobs to the retired ones, forgetting the
+// oldest retired job when too many are remembered.  The caller removes the
+// job from the order of the active jobs.  It must be called with the mutex
+// held.
+func (r *jobRegistry) retire(jobID, reason string) {
+	delete(r.active, jobID)
+	if _, ok := r.retired[jobID]; !ok {
+		if len(r.retiredOrder) == maxRetiredJobs {
+			delete(r.retired, r.retiredOrder[0])
+			r.retiredOrder = r.retiredOrder[1:]
+		}
+		r.retiredOrder = append(r.retiredOrder, jobID)
+	}
+	r.retired[jobID] = reason
+}
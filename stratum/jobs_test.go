@@ -0,0 +1,201 @@
+// Copyright (c) 2018 The ExchangeCoin team
+
+package stratum
+
+import (
+	"math/big"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// testJob is a job sent by the pool in the job registry tests.
+type testJob struct {
+	id    string
+	clean bool
+}
+
+// testJobs returns the jobs with the ids from first to last, of which only the
+// first is clean unless clean is set.
+func testJobs(first, last int, clean bool) []testJob {
+	var jobs []testJob
+	for i := first; i <= last; i++ {
+		jobs = append(jobs, testJob{strconv.Itoa(i), clean || i == first})
+	}
+	return jobs
+}
+
+// testJobIDs returns the ids of the jobs from first to last.
+func testJobIDs(first, last int) []string {
+	var ids []string
+	for _, j := range testJobs(first, last, false) {
+		ids = append(ids, j.id)
+	}
+	return ids
+}
+
+func TestJobRegistry(t *testing.T) {
+	tests := []struct {
+		name string
+		jobs []testJob
+
+		// fresh holds the ids of the jobs added while no job registered
+		// before was active.
+		fresh []string
+
+		// active holds the ids of the active jobs, retired those of the
+		// retired ones along with part of the reason, and unknown the
+		// ids of the jobs forgotten.
+		active  []string
+		retired map[string]string
+		unknown []string
+	}{{
+		name:   "new jobs",
+		jobs:   testJobs(1, 3, false),
+		fresh:  []string{"1"},
+		active: testJobIDs(1, 3),
+	}, {
+		name:   "clean jobs",
+		jobs:   []testJob{{"1", true}, {"2", false}, {"3", true}, {"4", false}},
+		fresh:  []string{"1", "3"},
+		active: []string{"3", "4"},
+		retired: map[string]string{
+			"1": "cleared by job 3",
+			"2": "cleared by job 3",
+		},
+	}, {
+		name:   "job sent again",
+		jobs:   []testJob{{"1", true}, {"2", false}, {"1", false}},
+		fresh:  []string{"1"},
+		active: []string{"1", "2"},
+	}, {
+		name:   "clean job sent again",
+		jobs:   []testJob{{"1", true}, {"2", false}, {"2", true}},
+		fresh:  []string{"1", "2"},
+		active: []string{"2"},
+		retired: map[string]string{
+			"1": "cleared by job 2",
+		},
+	}, {
+		name:   "too many active jobs",
+		jobs:   testJobs(1, maxActiveJobs+2, false),
+		fresh:  []string{"1"},
+		active: []string{"3", strconv.Itoa(maxActiveJobs + 2)},
+		retired: map[string]string{
+			"1": "superseded",
+			"2": "superseded",
+		},
+	}, {
+		name:   "too many retired jobs",
+		jobs:   testJobs(1, maxRetiredJobs+2, true),
+		fresh:  testJobIDs(1, maxRetiredJobs+2),
+		active: []string{strconv.Itoa(maxRetiredJobs + 2)},
+		retired: map[string]string{
+			"2": "cleared by job 3",
+			strconv.Itoa(maxRetiredJobs + 1): "cleared by job " +
+				strconv.Itoa(maxRetiredJobs+2),
+		},
+		unknown: []string{"1", "unsent"},
+	}}
+
+	for _, test := range tests {
+		r := newJobRegistry()
+		fresh := make(map[string]bool)
+		for _, j := range test.jobs {
+			if r.add(j.id, j.clean, 1, nil) {
+				fresh[j.id] = true
+			}
+		}
+		for _, jobID := range test.fresh {
+			if !fresh[jobID] {
+				t.Errorf("%s: job %v not fresh", test.name, jobID)
+			}
+			delete(fresh, jobID)
+		}
+		for jobID := range fresh {
+			t.Errorf("%s: job %v fresh", test.name, jobID)
+		}
+
+		for _, jobID := range test.active {
+			if _, err := r.check(jobID); err != nil {
+				t.Errorf("%s: job %v not active: %v", test.name,
+					jobID, err)
+			}
+		}
+		for jobID, reason := range test.retired {
+			_, err := r.check(jobID)
+			if err == nil || !strings.Contains(err.Error(), "retired") ||
+				!strings.Contains(err.Error(), reason) {
+				t.Errorf("%s: job %v: got error %v, want it retired "+
+					"as %q", test.name, jobID, err, reason)
+			}
+		}
+		for _, jobID := range test.unknown {
+			_, err := r.check(jobID)
+			if err == nil || !strings.Contains(err.Error(), "unknown") {
+				t.Errorf("%s: job %v: got error %v, want it unknown",
+					test.name, jobID, err)
+			}
+		}
+		if n := len(r.order); n > maxActiveJobs {
+			t.Errorf("%s: %d active jobs", test.name, n)
+		}
+		if n := len(r.retiredOrder); n > maxRetiredJobs ||
+			n != len(r.retired) {
+			t.Errorf("%s: %d retired jobs in order out of %d",
+				test.name, n, len(r.retired))
+		}
+	}
+}
+
+func TestJobRegistryReset(t *testing.T) {
+	r := newJobRegistry()
+	for _, j := range testJobs(1, 3, false) {
+		r.add(j.id, j.clean, 1, nil)
+	}
+	r.reset("connection lost")
+	for _, jobID := range []string{"1", "2", "3"} {
+		_, err := r.check(jobID)
+		if err == nil || !strings.Contains(err.Error(), "connection lost") {
+			t.Errorf("Job %v after reset: got error %v", jobID, err)
+		}
+	}
+
+	// The first job after the reset makes the work of previous jobs stale
+	// even if it is not clean.
+	if !r.add("4", false, 1, nil) {
+		t.Error("First job after reset not fresh")
+	}
+}
+
+func TestJobRegistryDifficulty(t *testing.T) {
+	tests := []struct {
+		jobID  string
+		clean  bool
+		diff   float64
+		target *big.Int
+	}{
+		{"1", true, 2, big.NewInt(2)},
+		{"2", false, 0.5, big.NewInt(5)},
+		{"3", false, 0.001, big.NewInt(1000)},
+	}
+	r := newJobRegistry()
+	for _, test := range tests {
+		r.add(test.jobID, test.clean, test.diff, test.target)
+	}
+
+	// A job sent again keeps the difficulty it was first sent with.
+	r.add("1", false, 4, big.NewInt(4))
+
+	for _, test := range tests {
+		j, err := r.check(test.jobID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if j.diff != test.diff || j.target.Cmp(test.target) != 0 {
+			t.Errorf("Job %v with difficulty %v and target %v, want "+
+				"%v and %v", test.jobID, j.diff, j.target, test.diff,
+				test.target)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright (c) 2018 The ExchangeCoin team
+
+package stratum
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/EXCCoin/exccd/chaincfg"
+	"github.com/EXCCoin/exccd/wire"
+)
+
+// errReplayDisconnect is the error the connection is lost with when a
+// transcript is replayed.
+var errReplayDisconnect = errors.New("Connection lost in transcript")
+
+// replayConn is a connection to a pool replayed from a transcript, which
+// collects the lines the client writes.  Nothing is ever read from it as the
+// lines received from the pool are handed to the client directly.
+type replayConn struct {
+	net.Conn
+	c *replayClient
+}
+
+func (rc *replayConn) Read(b []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (rc *replayConn) Write(b []byte) (int, error) {
+	rc.c.mtx.Lock()
+	defer rc.c.mtx.Unlock()
+	for _, line := range strings.SplitAfter(string(b), "\n") {
+		if line != "" {
+			rc.c.sent = append(rc.c.sent, strings.TrimSuffix(line, "\n"))
+		}
+	}
+	return len(b), nil
+}
+
+func (rc *replayConn) Close() error {
+	return nil
+}
+
+func (rc *replayConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (rc *replayConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (rc *replayConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// replayClient is a client the entries of a transcript for a pool are
+// replayed through.
+type replayClient struct {
+	s *Stratum
+
+	// dials is the number of connections the client made which were not
+	// matched with the transcript yet.
+	dials int
+
+	// sent holds the lines written by the client which were not matched
+	// with the transcript yet.
+	mtx  sync.Mutex
+	sent []string
+}
+
+// dial is the dialer of the replayed client.
+func (c *replayClient) dial() (net.Conn, error) {
+	c.dials++
+	return &replayConn{c: c}, nil
+}
+
+// next returns the oldest line written by the client which was not matched
+// with the transcript yet.
+func (c *replayClient) next() (string, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if len(c.sent) == 0 {
+		return "", false
+	}
+	line := c.sent[0]
+	c.sent = c.sent[1:]
+	return line, true
+}
+
+// checkSent returns an error when the client wrote lines the transcript does
+// not have.
+func (c *replayClient) checkSent() error {
+	if line, ok := c.next(); ok {
+		return fmt.Errorf("Client sent %s, which is not in the "+
+			"transcript", line)
+	}
+	return nil
+}
+
+// replayer replays a transcript through a client per pool, as the connections
+// to several pools are recorded when failing over and probing pools.
+type replayer struct {
+	params  *chaincfg.Params
+	clients map[string]*replayClient
+}
+
+// connect replays a connection to the pool.  A connection made by the client
+// itself, after losing the connection or being asked to reconnect, must have
+// been made already, while other connections start a new client for the pool.
+func (r *replayer) connect(e *TranscriptEntry) (*replayClient, error) {
+	c := r.clients[e.Pool]
+	if c != nil && c.dials > 0 {
+		c.dials--
+		return c, nil
+	}
+	if c != nil {
+		if err := c.checkSent(); err != nil {
+			return c, err
+		}
+		c.s.Close()
+	}
+
+	s, err := newStratum(Config{
+		Pool:        schemeTCP + e.Pool,
+		User:        e.User,
+		Pass:        redactedPass,
+		Version:     e.Version,
+		Dialect:     e.Dialect,
+		ChainParams: r.params,
+	})
+	if err != nil {
+		return nil, err
+	}
+	c = &replayClient{s: s}
+	s.dialer = c.dial
+	r.clients[e.Pool] = c
+	if err := s.connect(); err != nil {
+		return c, err
+	}
+	c.dials--
+	return c, nil
+}
+
+// replay replays an entry of the transcript and returns the client it was
+// replayed through.
+func (r *replayer) replay(e *TranscriptEntry) (*replayClient, error) {
+	if e.Kind == EntryConnect {
+		return r.connect(e)
+	}
+	c := r.clients[e.Pool]
+	if c == nil {
+		return nil, errors.New("Entry before any connection")
+	}
+	s := c.s
+
+	switch e.Kind {
+	case EntryDisconnect:
+		if err := s.reconnect(errReplayDisconnect); err != nil {
+			return c, err
+		}
+
+	case EntryIn:
+		s.handleLine(e.Line)
+
+		// The client moves to another pool when asked to reconnect
+		// to it.
+		if addr := s.poolAddr(); addr != e.Pool {
+			delete(r.clients, e.Pool)
+			r.clients[addr] = c
+		}
+
+	case EntryOut:
+		line, ok := c.next()
+		if !ok {
+			return c, fmt.Errorf("Client did not send %s", e.Line)
+		}
+		if line != e.Line {
+			return c, fmt.Errorf("Client sent %s instead of %s", line,
+				e.Line)
+		}
+
+	case EntryWork:
+		s.Lock()
+		s.PoolWork.NewWork = false
+		err := s.PrepWork()
+		s.Unlock()
+		if err != nil {
+			log.Errorf("Unable to prepare work for job %v: %v",
+				e.JobID, err)
+		}
+
+	case EntryShare:
+		header, err := hex.DecodeString(e.Header)
+		if err != nil || len(header) != wire.MaxBlockHeaderPayload {
+			return c, errors.New("Invalid share header")
+		}
+		s.Lock()
+		req, err := s.PrepSubmit(header, e.JobID, e.Device)
+		s.Unlock()
+		if err != nil {
+			log.Infof("Share for job %v not submitted: %v", e.JobID,
+				err)
+			break
+		}
+		if err := s.Send(req); err != nil {
+			return c, err
+		}
+
+	default:
+		return c, fmt.Errorf("Unknown entry kind %q", e.Kind)
+	}
+	return c, nil
+}
+
+// Replay feeds a recorded transcript back through the client, handling the
+// lines received from the pool and preparing work and submitting shares when
+// the recorded client did.  The lines the client sends are checked against the
+// recorded ones, so that a session with a pool can be reproduced without the
+// pool and the devices.  The replay is deterministic, the entries being
+// replayed in order without waiting between them.
+//
+// The client the last entry was replayed through is returned for its state to
+// be checked, along with an error referring to the first entry the replay
+// diverged at.
+func Replay(entries []TranscriptEntry, params *chaincfg.Params) (*Stratum, error) {
+	r := &replayer{
+		params:  params,
+		clients: make(map[string]*replayClient),
+	}
+	var last *Stratum
+	for i := range entries {
+		e := &entries[i]
+		c, err := r.replay(e)
+		if c != nil {
+			last = c.s
+		}
+		if err != nil {
+			return last, fmt.Errorf("Transcript entry %d (%v %v): %v",
+				i+1, e.Kind, e.Pool, err)
+		}
+	}
+	for pool, c := range r.clients {
+		if err := c.checkSent(); err != nil {
+			return last, fmt.Errorf("End of transcript for pool %v: %v",
+				pool, err)
+		}
+	}
+	return last, nil
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2018 The ExchangeCoin team
+
+package stratum
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/EXCCoin/gominer/stratum/codec"
+)
+
+// sessionPool is the pool of the session held in testdata/session.jsonl.
+const sessionPool = "127.0.0.1:3333"
+
+// readSession reads the transcript of testdata/session.jsonl, recorded with a
+// test pool: the client connects, gets a job and submits a share which is
+// accepted, then the same share which is rejected as a duplicate, before the
+// pool asks it to reconnect and it submits a share for the next job.
+func readSession(t *testing.T) []TranscriptEntry {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", "session.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	entries, err := ReadTranscript(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestReplay(t *testing.T) {
+	s, err := Replay(readSession(t), testParams)
+	if err != nil {
+		t.Fatalf("Replay diverged: %v", err)
+	}
+	defer s.Close()
+
+	if addr := s.poolAddr(); addr != sessionPool {
+		t.Errorf("Replayed client connected to %v, want %v", addr,
+			sessionPool)
+	}
+	s.Lock()
+	jobID := s.PoolWork.JobID
+	s.Unlock()
+	if jobID != "2" {
+		t.Errorf("Replayed client at job %v, want 2", jobID)
+	}
+	if n := s.PendingShares(); n != 0 {
+		t.Errorf("Replayed client has %d shares pending", n)
+	}
+}
+
+func TestReplayDivergence(t *testing.T) {
+	tests := []struct {
+		name string
+
+		// change changes the transcript, returning the number of the
+		// entry the replay is expected to diverge at.
+		change func(entries []TranscriptEntry) ([]TranscriptEntry, int)
+		err    string
+	}{{
+		name: "changed submit",
+		change: func(entries []TranscriptEntry) ([]TranscriptEntry, int) {
+			for i := range entries {
+				e := &entries[i]
+				if e.Kind == EntryOut &&
+					strings.Contains(e.Line, codec.MethodSubmit) {
+					e.Line = strings.Replace(e.Line,
+						`"worker"`, `"other"`, 1)
+					return entries, i + 1
+				}
+			}
+			return entries, 0
+		},
+		err: "instead of",
+	}, {
+		name: "missing request",
+		change: func(entries []TranscriptEntry) ([]TranscriptEntry, int) {
+			for i, e := range entries {
+				if e.Kind == EntryOut &&
+					strings.Contains(e.Line, codec.MethodAuthorize) {
+					return append(entries[:i:i], entries[i+1:]...),
+						i + 1
+				}
+			}
+			return entries, 0
+		},
+		err: "instead of",
+	}}
+
+	for _, test := range tests {
+		entries, n := test.change(readSession(t))
+		if n == 0 {
+			t.Fatalf("%s: entry to change not found", test.name)
+		}
+		s, err := Replay(entries, testParams)
+		if s != nil {
+			s.Close()
+		}
+		if err == nil {
+			t.Errorf("%s: replay did not diverge", test.name)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), "Transcript entry "+
+			strconv.Itoa(n)+" ") || !strings.Contains(err.Error(),
+			test.err) {
+			t.Errorf("%s: got error %v, want one about entry %d",
+				test.name, err, n)
+		}
+	}
+}
@@ -0,0 +1,966 @@
+// Copyright (c) 2018 The ExchangeCoin team
+
+package stratum
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/EXCCoin/exccd/blockchain"
+	"github.com/EXCCoin/exccd/chaincfg"
+	"github.com/EXCCoin/exccd/wire"
+
+	"github.com/EXCCoin/gominer/equihash"
+	"github.com/EXCCoin/gominer/stratum/codec"
+	"github.com/EXCCoin/gominer/util"
+	"github.com/EXCCoin/gominer/work"
+)
+
+// ServerDevice is the device the shares of the workers of a stratum server are
+// submitted to the pool as.
+const ServerDevice = -1
+
+const (
+	// workerIDSize is the size of the id the server assigns to every
+	// worker.  The extranonce1 of a worker is that of the work followed by
+	// its id, the rest of the extranonce2 of the work being left to the
+	// worker.  The zero id is never assigned, it is left to the devices of
+	// the miner running the server.
+	workerIDSize = 2
+
+	// maxWorkers is the number of ids which may be assigned to workers,
+	// which bounds the number of workers connected at once.
+	maxWorkers = 1<<(8*workerIDSize) - 1
+
+	// maxServerJobs is the number of jobs for the current block shares
+	// are accepted for.
+	maxServerJobs = 16
+
+	// maxJobShares is the number of shares recorded per job to reject
+	// duplicates, which bounds the memory a job takes.  Shares beyond it
+	// are rejected until new work is set.
+	maxJobShares = 1 << 14
+
+	// maxRequestLen is the length of the longest request accepted from a
+	// worker, which is well above that of a share.
+	maxRequestLen = 4096
+
+	// serverWriteTimeout is how long writing a message to a worker may
+	// take before the worker is disconnected.
+	serverWriteTimeout = 10 * time.Second
+
+	// serverQueueLen is the number of messages queued for a worker, which
+	// is disconnected when it does not read them fast enough.
+	serverQueueLen = 64
+
+	// jobRefreshInterval is how long the current job is kept before it
+	// is issued again when the work does not change, so that workers do
+	// not take the server for a pool without work.
+	jobRefreshInterval = time.Minute
+
+	// maxFutureTime is how far in the future the time of a share may be,
+	// as the daemon rejects blocks timestamped further ahead.
+	maxFutureTime = 2 * time.Hour
+
+	// nonceOffset is the offset of the nonce in a serialized header.
+	nonceOffset = 140
+
+	// extraDataSize is the size of the extra data of the header.
+	extraDataSize = 32
+)
+
+// ServerConfig holds the options of a stratum server.
+type ServerConfig struct {
+	// Listen is the address to listen on for workers.
+	Listen string
+
+	// ChainParams are the parameters of the network the work is for.
+	ChainParams *chaincfg.Params
+
+	// Difficulty is the share difficulty sent to the workers.
+	Difficulty float64
+
+	// Submit submits upstream the serialized header of a share meeting
+	// the target of the work, along with the job id of the work.  It is
+	// called from its own goroutine.
+	Submit func(header []byte, jobID string) error
+}
+
+// ServerStats holds the number of workers connected to a stratum server and
+// the outcome of the shares they submitted.
+type ServerStats struct {
+	Workers  int
+	Accepted uint64
+	Rejected uint64
+	Stale    uint64
+
+	// Forwarded is the number of shares meeting the target of the work
+	// which were submitted upstream, and ForwardErrors the number of them
+	// which could not be.
+	Forwarded     uint64
+	ForwardErrors uint64
+}
+
+// WorkerStats holds the outcome of the shares of a worker of a stratum server
+// over all its connections.
+type WorkerStats struct {
+	Name      string
+	Connected bool
+	Accepted  uint64
+	Rejected  uint64
+	Stale     uint64
+	Forwarded uint64
+	LastShare time.Time
+
+	// AcceptedDifficulty sums the share difficulty of the accepted shares
+	// over the Elapsed time since the worker first connected.
+	AcceptedDifficulty float64
+	Elapsed            time.Duration
+
+	// firstSeen is when the worker first connected.
+	firstSeen time.Time
+}
+
+// EffectiveHashRate returns the number of difficulty 1 solutions per second
+// the accepted shares of the worker account for.
+func (ws *WorkerStats) EffectiveHashRate() float64 {
+	if ws.Elapsed < time.Second {
+		return 0
+	}
+	return ws.AcceptedDifficulty / ws.Elapsed.Seconds()
+}
+
+// serverJob is a job issued by the server from work.
+type serverJob struct {
+	id     string
+	header []byte
+	target *big.Int
+	clean  bool
+
+	// workJobID is the job id of the work, which shares meeting its
+	// target are submitted upstream with.
+	workJobID string
+
+	// extraNonce1 is the start of the extra data of the work, which the
+	// extranonce1 of the workers starts with, and extraNonce2Size the size
+	// of the extranonce2 left to the workers.
+	extraNonce1     []byte
+	extraNonce2Size int
+
+	// submitted holds the part of the headers of the valid shares
+	// submitted for the job set by the workers along with their solution,
+	// to reject duplicates.
+	submitted map[string]struct{}
+}
+
+// notifyParams returns the params of the mining.notify for the job, in the
+// Decred dialect: the previous block hash, the header up to the extra data as
+// first coinbase part and the header after it as second coinbase part.
+func (j *serverJob) notifyParams() []interface{} {
+	version := util.Uint32EndiannessSwap(binary.LittleEndian.Uint32(j.header))
+	return []interface{}{
+		j.id,
+		hex.EncodeToString(j.header[4:merkleRootOffset]),
+		hex.EncodeToString(j.header[merkleRootOffset:extraDataOffset]),
+		hex.EncodeToString(j.header[stakeVersionOffset:headerLen]),
+		[]string{},
+		fmt.Sprintf("%08x", version),
+		fmt.Sprintf("%08x", binary.LittleEndian.Uint32(j.header[bitsOffset:])),
+		fmt.Sprintf("%08x", j.time()),
+		j.clean,
+	}
+}
+
+// time returns the timestamp of the header of the job.
+func (j *serverJob) time() uint32 {
+	return binary.LittleEndian.Uint32(j.header[timestampOffset:])
+}
+
+// sameExtraNonce returns whether the workers keep their extranonce from job o
+// to the job.
+func (j *serverJob) sameExtraNonce(o *serverJob) bool {
+	return bytes.Equal(j.extraNonce1, o.extraNonce1) &&
+		j.extraNonce2Size == o.extraNonce2Size
+}
+
+// Server is a stratum server handing the work of the miner to other miners,
+// its workers.  The work is fetched from a daemon or received from a pool, in
+// which case the workers share the connection of the miner to the pool.  Each
+// worker mines within its own part of the extranonce2 of the work.  Shares are
+// checked against the share difficulty and those meeting the target of the
+// work are submitted upstream.
+type Server struct {
+	cfg ServerConfig
+	ln  net.Listener
+
+	// shareTarget is the target of the share difficulty.
+	shareTarget *big.Int
+
+	// verify verifies the Equihash solution of a share.  It is
+	// equihash.Verify but for the tests, which can't solve the Equihash of
+	// the network in time, and is guarded by the mutex.
+	verify func(n, k int, input, solution []byte) error
+
+	mtx          sync.Mutex
+	conns        map[*serverConn]struct{}
+	ids          map[uint16]*serverConn
+	nextWorkerID uint16
+	workers      map[string]*WorkerStats
+	jobs         map[string]*serverJob
+	jobOrder     []string
+	nextJob      uint64
+	stats        ServerStats
+	stopped      bool
+
+	// issued is when the last job was issued.
+	issued time.Time
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewServer starts a stratum server listening for workers.  Workers may only
+// subscribe once work is set.
+func NewServer(cfg ServerConfig) (*Server, error) {
+	if cfg.ChainParams == nil {
+		return nil, errors.New("No chain parameters")
+	}
+	if cfg.Submit == nil {
+		return nil, errors.New("No share submission function")
+	}
+	shareTarget, err := util.DiffToTarget(cfg.Difficulty,
+		cfg.ChainParams.PowLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	ln, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Stratum server listening on %v", ln.Addr())
+
+	s := &Server{
+		cfg:         cfg,
+		ln:          ln,
+		shareTarget: shareTarget,
+		verify:      equihash.Verify,
+		conns:       make(map[*serverConn]struct{}),
+		ids:         make(map[uint16]*serverConn),
+		workers:     make(map[string]*WorkerStats),
+		jobs:        make(map[string]*serverJob),
+		quit:        make(chan struct{}),
+	}
+	s.wg.Add(2)
+	go s.accept()
+	go s.refreshJobs()
+	return s, nil
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() net.Addr {
+	return s.ln.Addr()
+}
+
+// LocalWork returns a copy of w for the devices of the miner running the
+// server.  Its extranonce2 follows the zero worker id, which is never assigned
+// to workers, so that the devices do not mine the work of a worker.
+func (s *Server) LocalWork(w *work.Work) *work.Work {
+	local := *w
+	for i := 0; i < workerIDSize; i++ {
+		local.BlockHeader.ExtraData[local.ExtraNonce2Offset+i] = 0
+	}
+	local.ExtraNonce2Offset += workerIDSize
+	local.ExtraNonce2Size -= workerIDSize
+	return &local
+}
+
+// SetWork issues a job for the work to all authorized workers.  Clean work
+// makes the shares for previous jobs stale.  When the extranonce of the work
+// changed, the workers which subscribed to extranonce changes are sent their
+// new extranonce while the others are disconnected.
+func (s *Server) SetWork(w *work.Work) error {
+	extraNonce2Size := w.ExtraNonce2Size - workerIDSize
+	if extraNonce2Size < 1 ||
+		w.ExtraNonce2Offset+w.ExtraNonce2Size > extraDataSize {
+		return fmt.Errorf("Extranonce2 of %d bytes can't be split among "+
+			"workers", w.ExtraNonce2Size)
+	}
+	serialized, err := w.BlockHeader.Bytes()
+	if err != nil {
+		return err
+	}
+	if len(serialized) < headerLen {
+		return fmt.Errorf("Header too short: %d bytes", len(serialized))
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	extraNonce1 := serialized[extraDataOffset : extraDataOffset+w.ExtraNonce2Offset]
+	job := s.addJob(&serverJob{
+		header:          serialized[:headerLen],
+		target:          w.Target,
+		clean:           w.Clean,
+		workJobID:       w.JobID,
+		extraNonce1:     append([]byte(nil), extraNonce1...),
+		extraNonce2Size: extraNonce2Size,
+	})
+	log.Debugf("Stratum server job %v for height %v (clean: %v)", job.id,
+		w.BlockHeader.Height, job.clean)
+	return nil
+}
+
+// addJob issues job to all authorized workers, after sending the subscribed
+// workers their new extranonce when it changed, and returns it.  It must be
+// called with the mutex held.
+func (s *Server) addJob(job *serverJob) *serverJob {
+	last := s.currentJob()
+	newExtraNonce := last != nil && !job.sameExtraNonce(last)
+
+	s.nextJob++
+	job.id = strconv.FormatUint(s.nextJob, 16)
+	job.clean = job.clean || last == nil || newExtraNonce
+	if job.submitted == nil {
+		job.submitted = make(map[string]struct{})
+	}
+	if job.clean {
+		s.jobs = make(map[string]*serverJob)
+		s.jobOrder = s.jobOrder[:0]
+	}
+	if len(s.jobOrder) == maxServerJobs {
+		delete(s.jobs, s.jobOrder[0])
+		s.jobOrder = s.jobOrder[1:]
+	}
+	s.jobs[job.id] = job
+	s.jobOrder = append(s.jobOrder, job.id)
+	s.issued = time.Now()
+
+	for c := range s.conns {
+		if newExtraNonce && c.subscribed {
+			if !c.extraNonceSubscribed {
+				log.Infof("Disconnecting stratum worker %v, "+
+					"which is not subscribed to extranonce "+
+					"changes", c.name())
+				c.conn.Close()
+				continue
+			}
+			c.send(codec.MethodSetExtraNonce, []interface{}{
+				hex.EncodeToString(c.extraNonce1(job)),
+				job.extraNonce2Size,
+			})
+		}
+		if c.authorized() {
+			c.notify(job)
+		}
+	}
+	return job
+}
+
+// currentJob returns the last issued job, or nil before work is set.  It must
+// be called with the mutex held.
+func (s *Server) currentJob() *serverJob {
+	if len(s.jobOrder) == 0 {
+		return nil
+	}
+	return s.jobs[s.jobOrder[len(s.jobOrder)-1]]
+}
+
+// refreshJobs issues the current job again once it is jobRefreshInterval old,
+// until the server is stopped.  The header is kept as is, as pools only accept
+// shares with the time of their job, so the shares already submitted are
+// still duplicates for the new job.
+func (s *Server) refreshJobs() {
+	defer s.wg.Done()
+
+	t := time.NewTicker(jobRefreshInterval / 4)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-t.C:
+		}
+
+		s.mtx.Lock()
+		last := s.currentJob()
+		if last != nil && time.Since(s.issued) >= jobRefreshInterval {
+			job := s.addJob(&serverJob{
+				header:          last.header,
+				target:          last.target,
+				workJobID:       last.workJobID,
+				extraNonce1:     last.extraNonce1,
+				extraNonce2Size: last.extraNonce2Size,
+				submitted:       last.submitted,
+			})
+			log.Debugf("Stratum server job %v refreshes job %v",
+				job.id, last.id)
+		}
+		s.mtx.Unlock()
+	}
+}
+
+// Stats returns the number of connected workers and the outcome of their
+// shares.
+func (s *Server) Stats() ServerStats {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	stats := s.stats
+	stats.Workers = 0
+	for c := range s.conns {
+		if c.authorized() {
+			stats.Workers++
+		}
+	}
+	return stats
+}
+
+// Workers returns the stats of all workers which were authorized since the
+// server started, sorted by name.
+func (s *Server) Workers() []WorkerStats {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	now := time.Now()
+	workers := make([]WorkerStats, 0, len(s.workers))
+	for _, ws := range s.workers {
+		stats := *ws
+		stats.Elapsed = now.Sub(ws.firstSeen)
+		workers = append(workers, stats)
+	}
+	sort.Slice(workers, func(i, j int) bool {
+		return workers[i].Name < workers[j].Name
+	})
+	return workers
+}
+
+// Stop stops listening, disconnects the workers and waits for the shares
+// being submitted upstream.
+func (s *Server) Stop() {
+	s.mtx.Lock()
+	if s.stopped {
+		s.mtx.Unlock()
+		return
+	}
+	s.stopped = true
+	close(s.quit)
+	s.ln.Close()
+	for c := range s.conns {
+		c.conn.Close()
+	}
+	s.mtx.Unlock()
+
+	s.wg.Wait()
+}
+
+// accept serves the workers connecting until the server is stopped.
+func (s *Server) accept() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			s.mtx.Lock()
+			stopped := s.stopped
+			s.mtx.Unlock()
+			if stopped {
+				return
+			}
+			log.Errorf("Stratum server failed to accept a worker: %v",
+				err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		s.mtx.Lock()
+		if s.stopped {
+			s.mtx.Unlock()
+			conn.Close()
+			return
+		}
+		if len(s.ids) == maxWorkers {
+			s.mtx.Unlock()
+			log.Warnf("Stratum server full, refusing worker from %v",
+				conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		c := &serverConn{
+			server: s,
+			conn:   conn,
+			id:     s.newWorkerID(),
+			out:    make(chan []byte, serverQueueLen),
+			done:   make(chan struct{}),
+		}
+		s.conns[c] = struct{}{}
+		s.ids[c.id] = c
+		s.mtx.Unlock()
+
+		log.Debugf("Stratum worker connected from %v", conn.RemoteAddr())
+		s.wg.Add(2)
+		go c.serve()
+		go c.writeMessages()
+	}
+}
+
+// newWorkerID returns an id no connected worker has, skipping the zero id of
+// the local devices.  There must be one left.  It must be called with the
+// mutex held.
+func (s *Server) newWorkerID() uint16 {
+	for {
+		s.nextWorkerID++
+		if s.nextWorkerID == 0 {
+			continue
+		}
+		if _, ok := s.ids[s.nextWorkerID]; !ok {
+			return s.nextWorkerID
+		}
+	}
+}
+
+// submit submits the header of a share meeting the target of the work of job
+// upstream.
+func (s *Server) submit(ws *WorkerStats, header []byte, jobID string) {
+	defer s.wg.Done()
+
+	err := s.cfg.Submit(header, jobID)
+	s.mtx.Lock()
+	if err != nil {
+		s.stats.ForwardErrors++
+	} else {
+		s.stats.Forwarded++
+		ws.Forwarded++
+	}
+	name := ws.Name
+	s.mtx.Unlock()
+
+	if err != nil {
+		log.Errorf("Failed to submit the share of worker %v: %v", name,
+			err)
+		return
+	}
+	log.Debugf("Submitted the share of worker %v for job %v", name, jobID)
+}
+
+// serverRequest is a request from a worker.
+type serverRequest struct {
+	ID     json.RawMessage   `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+// serverConn is the connection of a worker.
+type serverConn struct {
+	server *Server
+	conn   net.Conn
+	id     uint16
+
+	// out queues the messages to the worker, which are written by
+	// writeMessages until done is closed with the connection, so that
+	// a worker not reading them never blocks the server.
+	out  chan []byte
+	done chan struct{}
+
+	// The following fields are protected by the server mutex.
+	subscribed           bool
+	extraNonceSubscribed bool
+	stats                *WorkerStats
+}
+
+// authorized returns whether a worker was authorized on the connection.  It
+// must be called with the server mutex held.
+func (c *serverConn) authorized() bool {
+	return c.stats != nil
+}
+
+// name returns the name of the worker, or its address before it is
+// authorized.  It must be called with the server mutex held.
+func (c *serverConn) name() string {
+	if c.stats == nil {
+		return c.conn.RemoteAddr().String()
+	}
+	return c.stats.Name
+}
+
+// extraNonce1 returns the extranonce1 of the worker for job, which is the
+// start of the extra data of the work followed by the id of the worker.
+func (c *serverConn) extraNonce1(job *serverJob) []byte {
+	extraNonce1 := make([]byte, len(job.extraNonce1)+workerIDSize)
+	copy(extraNonce1, job.extraNonce1)
+	binary.BigEndian.PutUint16(extraNonce1[len(job.extraNonce1):], c.id)
+	return extraNonce1
+}
+
+// write queues a message to the worker without waiting for it to be written,
+// disconnecting the worker when its queue is full.
+func (c *serverConn) write(msg interface{}) {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		log.Errorf("Failed to encode message to worker: %v", err)
+		return
+	}
+
+	select {
+	case c.out <- append(b, '\n'):
+	default:
+		log.Warnf("Disconnecting stratum worker %v, which does not "+
+			"read its messages", c.conn.RemoteAddr())
+		c.conn.Close()
+	}
+}
+
+// writeMessages writes the messages queued for the worker until the
+// connection is closed, disconnecting the worker when a write fails.
+func (c *serverConn) writeMessages() {
+	defer c.server.wg.Done()
+	for {
+		select {
+		case b := <-c.out:
+			c.conn.SetWriteDeadline(time.Now().Add(serverWriteTimeout))
+			if _, err := c.conn.Write(b); err != nil {
+				log.Debugf("Failed to write to worker %v: %v",
+					c.conn.RemoteAddr(), err)
+				c.conn.Close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// send sends a notification to the worker.
+func (c *serverConn) send(method string, params []interface{}) {
+	c.write(map[string]interface{}{
+		"id":     nil,
+		"method": method,
+		"params": params,
+	})
+}
+
+// reply replies to request id with result, or the error when err is set.
+func (c *serverConn) reply(id json.RawMessage, result interface{}, err *codec.Error) {
+	var e interface{}
+	if err != nil {
+		e = []interface{}{err.Code, err.Message, nil}
+	}
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	c.write(map[string]interface{}{
+		"id":     id,
+		"result": result,
+		"error":  e,
+	})
+}
+
+// notify sends job to the worker.  It must be called with the server mutex
+// held.
+func (c *serverConn) notify(job *serverJob) {
+	c.send(codec.MethodNotify, job.notifyParams())
+}
+
+// serve handles the requests of the worker until the connection is closed.
+func (c *serverConn) serve() {
+	s := c.server
+	defer s.wg.Done()
+	defer func() {
+		s.mtx.Lock()
+		delete(s.conns, c)
+		delete(s.ids, c.id)
+		var worker string
+		if c.stats != nil {
+			c.stats.Connected = false
+			worker = c.stats.Name
+		}
+		s.mtx.Unlock()
+		c.conn.Close()
+		close(c.done)
+		if worker != "" {
+			log.Infof("Stratum worker %v disconnected", worker)
+		}
+	}()
+
+	scanner := bufio.NewScanner(c.conn)
+	scanner.Buffer(make([]byte, 0, maxRequestLen), maxRequestLen)
+	for scanner.Scan() {
+		var req serverRequest
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			log.Debugf("Invalid request from worker %v: %v",
+				c.conn.RemoteAddr(), err)
+			return
+		}
+
+		switch req.Method {
+		case codec.MethodSubscribe:
+			c.handleSubscribe(&req)
+		case codec.MethodAuthorize:
+			c.handleAuthorize(&req)
+		case codec.MethodExtraNonceSubscribe:
+			s.mtx.Lock()
+			c.extraNonceSubscribed = true
+			s.mtx.Unlock()
+			c.reply(req.ID, true, nil)
+		case codec.MethodSubmit:
+			c.handleSubmit(&req)
+		case "":
+			// Responses to the requests of the server, which
+			// sends none.
+		default:
+			c.reply(req.ID, nil, &codec.Error{
+				Code:    codec.ErrCodeOther,
+				Message: "Unsupported method " + req.Method,
+			})
+		}
+	}
+}
+
+// stringParams decodes the first n params of req as strings.
+func (req *serverRequest) stringParams(n int) ([]string, error) {
+	if len(req.Params) < n {
+		return nil, fmt.Errorf("%s expects %d params, got %d",
+			req.Method, n, len(req.Params))
+	}
+	params := make([]string, n)
+	for i := range params {
+		if err := json.Unmarshal(req.Params[i], &params[i]); err != nil {
+			return nil, fmt.Errorf("Invalid param %d: %v", i, err)
+		}
+	}
+	return params, nil
+}
+
+func (c *serverConn) handleSubscribe(req *serverRequest) {
+	s := c.server
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	// The extranonce of the worker depends on the work.
+	job := s.currentJob()
+	if job == nil {
+		c.reply(req.ID, nil, &codec.Error{
+			Code:    codec.ErrCodeOther,
+			Message: "No work available",
+		})
+		return
+	}
+
+	c.subscribed = true
+	extraNonce1 := hex.EncodeToString(c.extraNonce1(job))
+	c.reply(req.ID, []interface{}{
+		[][]string{
+			{codec.MethodSetDifficulty, extraNonce1},
+			{codec.MethodNotify, extraNonce1},
+		},
+		extraNonce1,
+		job.extraNonce2Size,
+	}, nil)
+}
+
+func (c *serverConn) handleAuthorize(req *serverRequest) {
+	s := c.server
+	params, err := req.stringParams(1)
+	if err != nil {
+		c.reply(req.ID, false, &codec.Error{
+			Code:    codec.ErrCodeOther,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if !c.subscribed {
+		c.reply(req.ID, false, &codec.Error{
+			Code:    codec.ErrCodeNotSubscribed,
+			Message: "Not subscribed",
+		})
+		return
+	}
+	if params[0] == "" {
+		c.reply(req.ID, false, &codec.Error{
+			Code:    codec.ErrCodeUnauthorized,
+			Message: "Empty worker name",
+		})
+		return
+	}
+
+	// The stats of a worker are kept across its connections.
+	if c.stats != nil {
+		c.stats.Connected = false
+	}
+	ws, ok := s.workers[params[0]]
+	if !ok {
+		ws = &WorkerStats{Name: params[0], firstSeen: time.Now()}
+		s.workers[ws.Name] = ws
+	}
+	ws.Connected = true
+	c.stats = ws
+
+	log.Infof("Stratum worker %v authorized from %v with id %d", ws.Name,
+		c.conn.RemoteAddr(), c.id)
+	c.reply(req.ID, true, nil)
+	c.send(codec.MethodSetDifficulty, []interface{}{s.cfg.Difficulty})
+	if last := s.currentJob(); last != nil {
+		job := *last
+		job.clean = true
+		c.notify(&job)
+	}
+}
+
+func (c *serverConn) handleSubmit(req *serverRequest) {
+	s := c.server
+	params, err := req.stringParams(6)
+	if err != nil {
+		c.reply(req.ID, false, &codec.Error{
+			Code:    codec.ErrCodeOther,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	job, header, serr := c.checkShare(params)
+	if ws := c.stats; ws != nil {
+		switch {
+		case serr == nil:
+			ws.Accepted++
+			ws.AcceptedDifficulty += s.cfg.Difficulty
+			ws.LastShare = time.Now()
+		case serr.Code == codec.ErrCodeJobNotFound:
+			ws.Stale++
+		default:
+			ws.Rejected++
+		}
+	}
+	switch {
+	case serr == nil:
+		s.stats.Accepted++
+	case serr.Code == codec.ErrCodeJobNotFound:
+		s.stats.Stale++
+	default:
+		s.stats.Rejected++
+	}
+	if serr != nil {
+		log.Debugf("Share from worker %v rejected: %v", c.name(),
+			serr.Message)
+		c.reply(req.ID, false, serr)
+		return
+	}
+	c.reply(req.ID, true, nil)
+
+	if header != nil && !s.stopped {
+		log.Infof("Share from worker %v meets the target of the work, "+
+			"submitting it", c.stats.Name)
+		s.wg.Add(1)
+		go s.submit(c.stats, header, job.workJobID)
+	}
+}
+
+// checkShare checks a share submitted with params, which are the worker, the
+// job id, the extranonce, the time, the nonce and the solution.  The job of
+// the share is returned, along with the header of the share when it meets the
+// target of the work.  It must be called with the server mutex held.
+func (c *serverConn) checkShare(params []string) (*serverJob, []byte, *codec.Error) {
+	s := c.server
+	shareErr := func(code int, msg string) (*serverJob, []byte, *codec.Error) {
+		return nil, nil, &codec.Error{Code: code, Message: msg}
+	}
+
+	if !c.authorized() || params[0] != c.stats.Name {
+		return shareErr(codec.ErrCodeUnauthorized, "Unauthorized worker")
+	}
+	job, ok := s.jobs[params[1]]
+	if !ok {
+		return shareErr(codec.ErrCodeJobNotFound, "Job not found")
+	}
+
+	// The extranonce sent back is the extranonce1 of the worker followed
+	// by the extranonce2 it rolled.
+	extraNonce1 := c.extraNonce1(job)
+	extraNonce, err := hex.DecodeString(params[2])
+	if err != nil || len(extraNonce) != len(extraNonce1)+job.extraNonce2Size ||
+		!bytes.HasPrefix(extraNonce, extraNonce1) {
+		return shareErr(codec.ErrCodeOther, "Invalid extranonce")
+	}
+	ntime, err := strconv.ParseUint(params[3], 16, 32)
+	if err != nil || len(params[3]) != 8 {
+		return shareErr(codec.ErrCodeOther, "Invalid time")
+	}
+	maxTime := time.Now().Add(maxFutureTime).Unix()
+	if uint32(ntime) < job.time() || int64(ntime) > maxTime {
+		return shareErr(codec.ErrCodeOther, "Time out of range")
+	}
+	nonce, err := hex.DecodeString(params[4])
+	if err != nil || len(nonce) != 4 {
+		return shareErr(codec.ErrCodeOther, "Invalid nonce")
+	}
+	solution, err := hex.DecodeString(params[5])
+	if err != nil || len(solution) != wire.EquihashSolutionLen {
+		return shareErr(codec.ErrCodeOther, "Invalid solution")
+	}
+
+	header := make([]byte, headerLen, headerLen+len(solution))
+	copy(header, job.header)
+	binary.LittleEndian.PutUint32(header[timestampOffset:], uint32(ntime))
+	copy(header[nonceOffset:], nonce)
+	copy(header[extraDataOffset:], extraNonce)
+	header = append(header, solution...)
+
+	key := hex.EncodeToString(header[timestampOffset:stakeVersionOffset]) +
+		hex.EncodeToString(solution)
+	if _, ok := job.submitted[key]; ok {
+		return shareErr(codec.ErrCodeDuplicateShare, "Duplicate share")
+	}
+	if len(job.submitted) >= maxJobShares {
+		return shareErr(codec.ErrCodeOther, "Too many shares for the job")
+	}
+
+	var bh wire.BlockHeader
+	if err := bh.FromBytes(header); err != nil {
+		return shareErr(codec.ErrCodeOther, "Invalid header: "+
+			err.Error())
+	}
+	chainParams := s.cfg.ChainParams
+	input, err := bh.SerializeEquihashHeaderBytes(
+		chainParams.Algorithm(bh.Height))
+	if err != nil {
+		return shareErr(codec.ErrCodeOther, err.Error())
+	}
+	err = s.verify(chainParams.N, chainParams.K, input, solution)
+	if err != nil {
+		return shareErr(codec.ErrCodeOther, "Invalid solution: "+
+			err.Error())
+	}
+
+	// Only valid shares are recorded, so that invalid ones neither make
+	// the valid share with the same header a duplicate nor fill the job.
+	job.submitted[key] = struct{}{}
+
+	// A share meeting the target of the work is accepted even when the
+	// share difficulty is above the difficulty of the work.
+	hash := bh.BlockHash()
+	hashNum := blockchain.HashToBig(&hash)
+	if job.target != nil && hashNum.Cmp(job.target) <= 0 {
+		return job, header, nil
+	}
+	if hashNum.Cmp(s.shareTarget) > 0 {
+		return shareErr(codec.ErrCodeLowDifficulty,
+			"Low difficulty share")
+	}
+	return job, nil, nil
+}
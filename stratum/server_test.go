@@ -0,0 +1,462 @@
+// Copyright (c) 2018 The ExchangeCoin team
+
+package stratum
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EXCCoin/exccd/wire"
+
+	"github.com/EXCCoin/gominer/internal/testsolution"
+	"github.com/EXCCoin/gominer/stratum/codec"
+	"github.com/EXCCoin/gominer/work"
+)
+
+// maxTestTarget is a target of the work which any hash meets.
+var maxTestTarget = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256),
+	big.NewInt(1))
+
+// forwardedShare is a share submitted upstream by a stratum server.
+type forwardedShare struct {
+	header []byte
+	jobID  string
+}
+
+// testServerWork returns work for job jobID of the upstream pool or daemon,
+// whose target is target.
+func testServerWork(jobID string, target *big.Int) *work.Work {
+	w := &work.Work{
+		JobID:             jobID,
+		Target:            target,
+		ExtraNonce2Offset: 4,
+		ExtraNonce2Size:   8,
+		Clean:             true,
+	}
+	w.BlockHeader.Height = 100
+	w.BlockHeader.Timestamp = time.Unix(time.Now().Unix(), 0)
+	return w
+}
+
+// newTestServer starts a stratum server checking test solutions with work
+// set, which is stopped once the test finished.  The shares it submits
+// upstream are sent on the returned channel.
+func newTestServer(t *testing.T) (*Server, <-chan forwardedShare) {
+	t.Helper()
+	forwarded := make(chan forwardedShare, maxServerJobs)
+	s, err := NewServer(ServerConfig{
+		Listen:      "127.0.0.1:0",
+		ChainParams: testParams,
+		Difficulty:  testDifficulty,
+		Submit: func(header []byte, jobID string) error {
+			forwarded <- forwardedShare{header, jobID}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Stop)
+	s.mtx.Lock()
+	s.verify = func(n, k int, input, solution []byte) error {
+		return testsolution.Verify(input, solution)
+	}
+	s.mtx.Unlock()
+
+	if err := s.SetWork(testServerWork("1", nil)); err != nil {
+		t.Fatal(err)
+	}
+	return s, forwarded
+}
+
+// testWorker is a worker connected to a stratum server.
+type testWorker struct {
+	t      *testing.T
+	conn   net.Conn
+	r      *bufio.Reader
+	nextID int
+
+	// extraNonce1 is the extranonce1 assigned on subscription.
+	extraNonce1 []byte
+}
+
+// dialTestServer connects a worker to s, subscribed and authorized.
+func dialTestServer(t *testing.T, s *Server) *testWorker {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	w := &testWorker{t: t, conn: conn, r: bufio.NewReader(conn)}
+
+	var sub []json.RawMessage
+	if err := w.call(codec.MethodSubscribe, &sub); err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	var extraNonce1 string
+	if len(sub) < 2 || json.Unmarshal(sub[1], &extraNonce1) != nil {
+		t.Fatalf("Invalid subscribe result %s", sub)
+	}
+	if w.extraNonce1, err = hex.DecodeString(extraNonce1); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.call(codec.MethodAuthorize, nil, "worker", "x"); err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+	return w
+}
+
+// next returns the params of the next notification for method, skipping the
+// other messages.
+func (w *testWorker) next(method string) []json.RawMessage {
+	w.t.Helper()
+	w.conn.SetDeadline(time.Now().Add(testTimeout))
+	for {
+		line, err := w.r.ReadBytes('\n')
+		if err != nil {
+			w.t.Fatalf("No %s received: %v", method, err)
+		}
+		var msg struct {
+			Method string
+			Params []json.RawMessage
+		}
+		if err := json.Unmarshal(line, &msg); err != nil {
+			w.t.Fatal(err)
+		}
+		if msg.Method == method {
+			return msg.Params
+		}
+	}
+}
+
+// call sends the request and decodes its result into result, skipping the
+// notifications sent meanwhile.  The error of the response is returned.
+func (w *testWorker) call(method string, result interface{}, params ...interface{}) error {
+	w.t.Helper()
+	w.nextID++
+	if params == nil {
+		params = []interface{}{}
+	}
+	req, err := json.Marshal(map[string]interface{}{
+		"id":     w.nextID,
+		"method": method,
+		"params": params,
+	})
+	if err != nil {
+		w.t.Fatal(err)
+	}
+	w.conn.SetDeadline(time.Now().Add(testTimeout))
+	if _, err := w.conn.Write(append(req, '\n')); err != nil {
+		w.t.Fatal(err)
+	}
+	for {
+		line, err := w.r.ReadBytes('\n')
+		if err != nil {
+			w.t.Fatal(err)
+		}
+		var resp struct {
+			ID     *int
+			Result json.RawMessage
+			Error  []interface{}
+		}
+		if err := json.Unmarshal(line, &resp); err != nil {
+			w.t.Fatal(err)
+		}
+		if resp.ID == nil || *resp.ID != w.nextID {
+			continue
+		}
+		if resp.Error != nil {
+			return fmt.Errorf("%v", resp.Error[1])
+		}
+		if result != nil {
+			if err := json.Unmarshal(resp.Result, result); err != nil {
+				w.t.Fatal(err)
+			}
+		}
+		return nil
+	}
+}
+
+// submit submits a share for the current job of s with the extranonce2 and
+// nonce, whose solution is valid unless invalid is set.  The header of the
+// share is returned along with the error of the response.
+func (w *testWorker) submit(s *Server, extraNonce2 []byte, nonce uint32, invalid bool) ([]byte, error) {
+	w.t.Helper()
+	s.mtx.Lock()
+	job := s.currentJob()
+	s.mtx.Unlock()
+
+	extraNonce := append(append([]byte(nil), w.extraNonce1...),
+		extraNonce2...)
+	header := make([]byte, headerLen+wire.EquihashSolutionLen)
+	copy(header, job.header)
+	binary.LittleEndian.PutUint32(header[nonceOffset:], nonce)
+	copy(header[extraDataOffset:], extraNonce)
+	var bh wire.BlockHeader
+	if err := bh.FromBytes(header); err != nil {
+		w.t.Fatal(err)
+	}
+	input, err := bh.SerializeEquihashHeaderBytes(
+		testParams.Algorithm(bh.Height))
+	if err != nil {
+		w.t.Fatal(err)
+	}
+	solution := testsolution.Solution(input)
+	if invalid {
+		solution[0] ^= 1
+	}
+	copy(header[headerLen:], solution)
+
+	var accepted bool
+	err = w.call(codec.MethodSubmit, &accepted, "worker", job.id,
+		hex.EncodeToString(extraNonce), fmt.Sprintf("%08x", job.time()),
+		hex.EncodeToString(header[nonceOffset:nonceOffset+4]),
+		hex.EncodeToString(solution))
+	if err == nil && !accepted {
+		w.t.Fatal("Share neither accepted nor rejected with an error")
+	}
+	return header, err
+}
+
+func TestServerSubmit(t *testing.T) {
+	s, _ := newTestServer(t)
+	w := dialTestServer(t, s)
+	extraNonce2 := make([]byte, 6)
+
+	tests := []struct {
+		name    string
+		nonce   uint32
+		invalid bool
+		err     string
+	}{
+		// Invalid shares are not recorded, so that they are reported
+		// as invalid again rather than as duplicates.
+		{"invalid", 1, true, "Invalid solution"},
+		{"invalid again", 1, true, "Invalid solution"},
+		{"valid", 1, false, ""},
+		{"duplicate", 1, false, "Duplicate share"},
+		{"other nonce", 2, false, ""},
+	}
+	for _, test := range tests {
+		_, err := w.submit(s, extraNonce2, test.nonce, test.invalid)
+		if (err == nil) != (test.err == "") ||
+			(err != nil && !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s share: got error %v, want %q", test.name,
+				err, test.err)
+		}
+	}
+
+	s.mtx.Lock()
+	job := s.currentJob()
+	if len(job.submitted) != 2 {
+		t.Errorf("Job recorded %d shares, want 2", len(job.submitted))
+	}
+	stats := s.stats
+	s.mtx.Unlock()
+	if stats.Accepted != 2 || stats.Rejected != 3 {
+		t.Errorf("Server counted %d accepted and %d rejected shares, "+
+			"want 2 and 3", stats.Accepted, stats.Rejected)
+	}
+}
+
+func TestServerSubmitCap(t *testing.T) {
+	s, _ := newTestServer(t)
+	w := dialTestServer(t, s)
+	extraNonce2 := make([]byte, 6)
+	if _, err := w.submit(s, extraNonce2, 1, false); err != nil {
+		t.Fatalf("Share rejected: %v", err)
+	}
+
+	// Fill the job up to the cap.
+	s.mtx.Lock()
+	job := s.currentJob()
+	for i := 0; len(job.submitted) < maxJobShares; i++ {
+		job.submitted[fmt.Sprint(i)] = struct{}{}
+	}
+	s.mtx.Unlock()
+
+	_, err := w.submit(s, extraNonce2, 2, false)
+	if err == nil || !strings.Contains(err.Error(), "Too many shares") {
+		t.Errorf("Share beyond the cap: got error %v", err)
+	}
+	_, err = w.submit(s, extraNonce2, 1, false)
+	if err == nil || !strings.Contains(err.Error(), "Duplicate share") {
+		t.Errorf("Duplicate share beyond the cap: got error %v", err)
+	}
+	s.mtx.Lock()
+	n := len(job.submitted)
+	s.mtx.Unlock()
+	if n != maxJobShares {
+		t.Errorf("Job recorded %d shares, want %d", n, maxJobShares)
+	}
+}
+
+func TestServerSlowWorker(t *testing.T) {
+	s, _ := newTestServer(t)
+	w := dialTestServer(t, s)
+
+	// The worker stops reading its messages, which soon fill the TCP
+	// window, while the work keeps changing.
+	if tc, ok := w.conn.(*net.TCPConn); ok {
+		tc.SetReadBuffer(4096)
+	}
+	deadline := time.Now().Add(testTimeout)
+	for i := 2; ; i++ {
+		start := time.Now()
+		next := testServerWork(strconv.Itoa(i), nil)
+		next.Clean = false
+		err := s.SetWork(next)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Fatalf("Setting work took %v with a worker not reading",
+				d)
+		}
+
+		s.mtx.Lock()
+		connected := len(s.conns)
+		s.mtx.Unlock()
+		if connected == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Worker not reading still connected after %d "+
+				"jobs", i)
+		}
+	}
+}
+
+func TestServerForward(t *testing.T) {
+	s, forwarded := newTestServer(t)
+	w := dialTestServer(t, s)
+	extraNonce2 := make([]byte, 6)
+
+	tests := []struct {
+		name    string
+		target  *big.Int
+		forward bool
+	}{
+		{"meeting the target", maxTestTarget, true},
+		{"above the target", big.NewInt(0), false},
+		{"without target", nil, false},
+		{"meeting the target again", maxTestTarget, true},
+	}
+	var want uint64
+	for i, test := range tests {
+		jobID := fmt.Sprintf("pool-%d", i)
+		if err := s.SetWork(testServerWork(jobID, test.target)); err != nil {
+			t.Fatal(err)
+		}
+		header, err := w.submit(s, extraNonce2, 1, false)
+		if err != nil {
+			t.Errorf("Share %s rejected: %v", test.name, err)
+			continue
+		}
+		if !test.forward {
+			continue
+		}
+		want++
+
+		select {
+		case share := <-forwarded:
+			if share.jobID != jobID {
+				t.Errorf("Share %s submitted for job %v, want %v",
+					test.name, share.jobID, jobID)
+			}
+			if !bytes.Equal(share.header, header) {
+				t.Errorf("Share %s submitted with header %x, "+
+					"want %x", test.name, share.header, header)
+			}
+		case <-time.After(testTimeout):
+			t.Errorf("Share %s not submitted", test.name)
+		}
+	}
+
+	// Stopping waits for the shares being submitted.
+	s.Stop()
+	select {
+	case share := <-forwarded:
+		t.Errorf("Share for job %v submitted, which does not meet the "+
+			"target", share.jobID)
+	default:
+	}
+	if n := s.Stats().Forwarded; n != want {
+		t.Errorf("Server submitted %d shares, want %d", n, want)
+	}
+}
+
+func TestServerSetExtraNonce(t *testing.T) {
+	s, forwarded := newTestServer(t)
+	w := dialTestServer(t, s)
+	if err := w.call(codec.MethodExtraNonceSubscribe, nil); err != nil {
+		t.Fatalf("Extranonce subscribe: %v", err)
+	}
+	unsubscribed := dialTestServer(t, s)
+
+	// The pool changes the extranonce1 of the miner.
+	next := testServerWork("2", maxTestTarget)
+	next.Clean = false
+	copy(next.BlockHeader.ExtraData[:], []byte{1, 2, 3, 4})
+	if err := s.SetWork(next); err != nil {
+		t.Fatal(err)
+	}
+
+	params := w.next(codec.MethodSetExtraNonce)
+	var extraNonce1 string
+	var extraNonce2Size int
+	if len(params) != 2 || json.Unmarshal(params[0], &extraNonce1) != nil ||
+		json.Unmarshal(params[1], &extraNonce2Size) != nil {
+		t.Fatalf("Invalid set_extranonce params %s", params)
+	}
+	want := append([]byte{1, 2, 3, 4}, w.extraNonce1[4:]...)
+	if extraNonce1 != hex.EncodeToString(want) || extraNonce2Size != 6 {
+		t.Errorf("Worker got extranonce1 %v with %d bytes of extranonce2, "+
+			"want %x with 6", extraNonce1, extraNonce2Size, want)
+	}
+	params = w.next(codec.MethodNotify)
+	var clean bool
+	if len(params) != 9 || json.Unmarshal(params[8], &clean) != nil ||
+		!clean {
+		t.Errorf("Job after the extranonce changed not clean: %s", params)
+	}
+
+	// Shares with the new extranonce are submitted upstream.
+	w.extraNonce1 = want
+	header, err := w.submit(s, make([]byte, 6), 1, false)
+	if err != nil {
+		t.Fatalf("Share with the new extranonce rejected: %v", err)
+	}
+	select {
+	case share := <-forwarded:
+		if !bytes.Equal(share.header, header) {
+			t.Errorf("Share submitted with header %x, want %x",
+				share.header, header)
+		}
+	case <-time.After(testTimeout):
+		t.Error("Share with the new extranonce not submitted")
+	}
+
+	// The worker which can't be sent its new extranonce is disconnected.
+	unsubscribed.conn.SetDeadline(time.Now().Add(testTimeout))
+	for {
+		if _, err := unsubscribed.r.ReadBytes('\n'); err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				t.Error("Worker not subscribed to extranonce " +
+					"changes still connected")
+			}
+			break
+		}
+	}
+}
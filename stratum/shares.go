@@ -0,0 +1,263 @@
+// Copyright (c) 2018 The ExchangeCoin team
+
+package stratum
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/EXCCoin/gominer/stratum/codec"
+)
+
+// recentShares is the number of submitted shares kept in a share log.
+const recentShares = 50
+
+// RejectReason classifies why a pool rejected a share.
+type RejectReason int
+
+// Reasons for a pool to reject a share.  Shares are rejected for an unknown
+// reason when the pool error is not recognized.
+const (
+	RejectUnknown RejectReason = iota
+	RejectDuplicate
+	RejectLowDifficulty
+	RejectStale
+)
+
+// RejectReasons lists all reject reasons.
+var RejectReasons = []RejectReason{
+	RejectUnknown,
+	RejectDuplicate,
+	RejectLowDifficulty,
+	RejectStale,
+}
+
+func (r RejectReason) String() string {
+	switch r {
+	case RejectUnknown:
+		return "unknown"
+	case RejectDuplicate:
+		return "duplicate"
+	case RejectLowDifficulty:
+		return "lowDifficulty"
+	case RejectStale:
+		return "stale"
+	}
+	return fmt.Sprintf("RejectReason(%d)", int(r))
+}
+
+// rejectReason classifies a rejection from the error returned by the pool.
+// The standard stratum error codes are used when present, with the message
+// being looked at otherwise since pools do not all send them.
+func rejectReason(rerr *codec.Error) RejectReason {
+	if rerr == nil {
+		return RejectUnknown
+	}
+	switch rerr.Code {
+	case codec.ErrCodeJobNotFound:
+		return RejectStale
+	case codec.ErrCodeDuplicateShare:
+		return RejectDuplicate
+	case codec.ErrCodeLowDifficulty:
+		return RejectLowDifficulty
+	}
+
+	msg := strings.ToLower(rerr.Message)
+	switch {
+	case msg == "duplicate", strings.Contains(msg, "duplicate share"):
+		return RejectDuplicate
+	case strings.Contains(msg, "low difficulty"),
+		strings.Contains(msg, "above target"):
+		return RejectLowDifficulty
+	case strings.Contains(msg, "stale"),
+		strings.Contains(msg, "job not found"):
+		return RejectStale
+	}
+	return RejectUnknown
+}
+
+// Share is a share submitted to a pool along with the response of the pool.
+type Share struct {
+	Pool       string
+	Device     int
+	JobID      string
+	Difficulty float64
+	Submitted  time.Time
+
+	// Latency is how long the pool took to respond, which is zero while
+	// the response is pending.
+	Latency  time.Duration
+	Accepted bool
+
+	// Reason, Code and Message describe why a rejected share was
+	// rejected, Code and Message being the error sent by the pool.
+	Reason  RejectReason
+	Code    int
+	Message string
+}
+
+// LatencyStats aggregates the round-trip times of the responses of a pool to
+// the shares submitted to it.
+type LatencyStats struct {
+	Responses uint64
+	Total     time.Duration
+	Min       time.Duration
+	Max       time.Duration
+	Last      time.Duration
+}
+
+// Average returns the average round-trip time.
+func (ls *LatencyStats) Average() time.Duration {
+	if ls.Responses == 0 {
+		return 0
+	}
+	return ls.Total / time.Duration(ls.Responses)
+}
+
+// add records the round-trip time of a response.
+func (ls *LatencyStats) add(latency time.Duration) {
+	if ls.Responses == 0 || latency < ls.Min {
+		ls.Min = latency
+	}
+	if latency > ls.Max {
+		ls.Max = latency
+	}
+	ls.Responses++
+	ls.Total += latency
+	ls.Last = latency
+}
+
+// ShareStats aggregates the responses to the shares submitted to pools.
+type ShareStats struct {
+	Accepted uint64
+	Rejected map[RejectReason]uint64
+
+	// Responses is the number of responses received, which took
+	// TotalLatency altogether.
+	Responses    uint64
+	TotalLatency time.Duration
+
+	// PoolLatency holds the round-trip times of the responses by the
+	// address of the pool, which tells apart a slow pool from a slow
+	// miner when failing over between pools.
+	PoolLatency map[string]LatencyStats
+
+	// AcceptedDifficulty sums the difficulty of the accepted shares, with
+	// DeviceDifficulty summing it per device, over the Elapsed time since
+	// the log was created.
+	AcceptedDifficulty float64
+	DeviceDifficulty   map[int]float64
+	Elapsed            time.Duration
+}
+
+// AverageLatency returns the average time pools took to respond to a share.
+func (st *ShareStats) AverageLatency() time.Duration {
+	if st.Responses == 0 {
+		return 0
+	}
+	return st.TotalLatency / time.Duration(st.Responses)
+}
+
+// EffectiveHashRate returns the number of difficulty 1 solutions per second
+// the accepted shares account for, which is comparable to the hash rate of
+// the devices while taking the shares lost to rejects into account.
+func (st *ShareStats) EffectiveHashRate() float64 {
+	return st.rate(st.AcceptedDifficulty)
+}
+
+// DeviceEffectiveHashRate returns the effective hash rate of a device.
+func (st *ShareStats) DeviceEffectiveHashRate(device int) float64 {
+	return st.rate(st.DeviceDifficulty[device])
+}
+
+// rate returns the rate of difficulty 1 solutions difficulty amounts to.
+func (st *ShareStats) rate(difficulty float64) float64 {
+	if st.Elapsed < time.Second {
+		return 0
+	}
+	return difficulty / st.Elapsed.Seconds()
+}
+
+// ShareLog records the shares submitted to pools once they got a response,
+// keeping the most recent ones along with statistics over all of them.  It is
+// safe for concurrent use.
+type ShareLog struct {
+	mtx     sync.Mutex
+	created time.Time
+	recent  []Share
+	next    int
+	stats   ShareStats
+}
+
+// NewShareLog returns an empty share log.
+func NewShareLog() *ShareLog {
+	return &ShareLog{
+		created: time.Now(),
+		recent:  make([]Share, 0, recentShares),
+		stats: ShareStats{
+			Rejected:         make(map[RejectReason]uint64),
+			DeviceDifficulty: make(map[int]float64),
+			PoolLatency:      make(map[string]LatencyStats),
+		},
+	}
+}
+
+// record adds a share which got a response to the log.
+func (l *ShareLog) record(share *Share) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if len(l.recent) < recentShares {
+		l.recent = append(l.recent, *share)
+	} else {
+		l.recent[l.next] = *share
+		l.next = (l.next + 1) % recentShares
+	}
+
+	if share.Accepted {
+		l.stats.Accepted++
+		l.stats.AcceptedDifficulty += share.Difficulty
+		l.stats.DeviceDifficulty[share.Device] += share.Difficulty
+	} else {
+		l.stats.Rejected[share.Reason]++
+	}
+	l.stats.Responses++
+	l.stats.TotalLatency += share.Latency
+	latency := l.stats.PoolLatency[share.Pool]
+	latency.add(share.Latency)
+	l.stats.PoolLatency[share.Pool] = latency
+}
+
+// Recent returns the most recent shares, oldest first.
+func (l *ShareLog) Recent() []Share {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	shares := make([]Share, 0, len(l.recent))
+	shares = append(shares, l.recent[l.next:]...)
+	return append(shares, l.recent[:l.next]...)
+}
+
+// Stats returns the statistics over all shares.
+func (l *ShareLog) Stats() ShareStats {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	stats := l.stats
+	stats.Rejected = make(map[RejectReason]uint64, len(l.stats.Rejected))
+	for reason, n := range l.stats.Rejected {
+		stats.Rejected[reason] = n
+	}
+	stats.DeviceDifficulty = make(map[int]float64,
+		len(l.stats.DeviceDifficulty))
+	for device, diff := range l.stats.DeviceDifficulty {
+		stats.DeviceDifficulty[device] = diff
+	}
+	stats.PoolLatency = make(map[string]LatencyStats,
+		len(l.stats.PoolLatency))
+	for pool, latency := range l.stats.PoolLatency {
+		stats.PoolLatency[pool] = latency
+	}
+	stats.Elapsed = time.Since(l.created)
+	return stats
+}
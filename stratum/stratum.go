@@ -5,16 +5,15 @@ package stratum
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/hex"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"math/big"
+	"math/rand"
 	"net"
-	"os"
-	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -26,39 +25,158 @@ import (
 	"github.com/EXCCoin/exccd/chaincfg"
 	"github.com/EXCCoin/exccd/wire"
 
+	"github.com/EXCCoin/gominer/stratum/codec"
 	"github.com/EXCCoin/gominer/util"
 	"github.com/EXCCoin/gominer/work"
 )
 
-var chainParams = &chaincfg.MainNetParams
-
 // ErrStratumStaleWork indicates that the work to send to the pool was stale.
 var ErrStratumStaleWork = fmt.Errorf("Stale work, throwing away")
 
+// ErrStratumAuth indicates that the pool rejected the worker credentials.
+var ErrStratumAuth = errors.New("Auth failure")
+
+// ErrStratumClosed indicates that the connection was closed by the miner.
+var ErrStratumClosed = errors.New("Connection closed")
+
+const (
+	// reconnectBaseDelay is the delay before the second attempt to
+	// reconnect, which doubles with every further attempt.
+	reconnectBaseDelay = time.Second
+
+	// reconnectMaxDelay caps the delay between attempts to reconnect.
+	reconnectMaxDelay = time.Minute
+
+	// dialTimeout is how long connecting to the pool, including the TLS
+	// handshake, may take.
+	dialTimeout = 30 * time.Second
+
+	// writeTimeout is how long writing a message to the pool may take
+	// before the connection is considered lost.
+	writeTimeout = 10 * time.Second
+
+	// coinbase1Len is the length of the first coinbase part of a job,
+	// which is the header from the merkle root up to the extra data.
+	coinbase1Len = 108
+)
+
+// State is the state of the connection to a pool.
+type State int
+
+// Connection states, in the order they are reached when connecting.
+const (
+	StateDisconnected State = iota
+	StateConnecting
+	StateSubscribed
+	StateAuthorized
+)
+
+func (st State) String() string {
+	switch st {
+	case StateDisconnected:
+		return "disconnected"
+	case StateConnecting:
+		return "connecting"
+	case StateSubscribed:
+		return "subscribed"
+	case StateAuthorized:
+		return "authorized"
+	}
+	return fmt.Sprintf("State(%d)", int(st))
+}
+
+// jitter randomizes the reconnection delays.  It is protected by jitterMtx
+// since it is shared by all connections.
+var (
+	jitter    = rand.New(rand.NewSource(time.Now().UnixNano()))
+	jitterMtx sync.Mutex
+)
+
+// Backoff returns the delay before the nth attempt to reconnect, counting
+// from 1.  The delay grows exponentially up to a minute, with up to half of it
+// dropped at random so that miners losing a pool at the same time do not all
+// come back at once.
+func Backoff(n int) time.Duration {
+	delay := reconnectMaxDelay
+	if n < 1 {
+		n = 1
+	}
+	if n < 32 && reconnectBaseDelay<<uint(n-1) < delay {
+		delay = reconnectBaseDelay << uint(n-1)
+	}
+
+	jitterMtx.Lock()
+	defer jitterMtx.Unlock()
+	return delay - time.Duration(jitter.Int63n(int64(delay/2)+1))
+}
+
 // Stratum holds all the shared information for a stratum connection.
 // XXX most of these should be unexported and use getters/setters.
 type Stratum struct {
 	// The following variables must only be used atomically.
 	ValidShares   uint64
 	InvalidShares uint64
-	latestJobTime uint32
+	Reconnects    uint64
+	lastNotify    int64
+	lastReceived  int64
+	closing       uint32
 
 	sync.Mutex
-	cfg       Config
-	Conn      net.Conn
-	Reader    *bufio.Reader
-	ID        uint64
-	authID    uint64
-	subID     uint64
-	submitIDs []uint64
-	Diff      float64
-	Target    *big.Int
-	PoolWork  NotifyWork
+	cfg      Config
+	dialect  dialect
+	Diff     float64
+	Target   *big.Int
+	PoolWork NotifyWork
+
+	// conn is the connection to the pool at addr, which is read through
+	// reader.  They change when reconnecting, addr doing so when the pool
+	// asks the miner to move to another one, and are protected by connMtx
+	// so that the writers use the current connection.
+	connMtx sync.Mutex
+	conn    net.Conn
+	reader  *bufio.Reader
+	addr    string
+
+	// pending tracks the requests awaiting a response from the pool.
+	pending *codec.Pending
+
+	// submits holds the shares awaiting a response by request id.
+	submitsMtx sync.Mutex
+	submits    map[uint64]*Share
+
+	// jobs tracks the jobs shares may be submitted for, with newJobs
+	// being signalled whenever there is new work to prepare.
+	jobs    *jobRegistry
+	newJobs chan struct{}
 
 	Started uint32
+
+	// state is the state of the connection, with stateChanged being
+	// closed and replaced whenever it changes.
+	stateMtx     sync.Mutex
+	state        State
+	stateChanged chan struct{}
+
+	// attempts is the number of attempts to reconnect since the worker
+	// was last authorized.  It is only used by the listener.
+	attempts int
+
+	// ready is closed once the first job has been received while done is
+	// closed with err set once the connection failed for good.
+	ready     chan struct{}
+	readyOnce sync.Once
+	done      chan struct{}
+	doneOnce  sync.Once
+	err       error
+
+	// dialer replaces dialing the pool when a transcript is replayed.
+	dialer func() (net.Conn, error)
 }
 
-// Config holdes the config options that may be used by a stratum pool.
+// Config holdes the config options that may be used by a stratum pool.  Pool
+// is the stratum+tcp://, stratum+ssl:// or stratum+tls:// URL of the pool, or
+// the zip301+tcp://, zip301+ssl:// or zip301+tls:// URL of a pool speaking
+// the ZIP 301 dialect.
 type Config struct {
 	Pool      string
 	User      string
@@ -67,8 +185,53 @@ type Config struct {
 	ProxyUser string
 	ProxyPass string
 	Version   string
+
+	// Dialect is the dialect of the protocol spoken by the pool when its
+	// URL does not select one, DialectDecred when empty.
+	Dialect string
+
+	// TLS is the TLS configuration used for stratum+ssl:// and
+	// stratum+tls:// pools, which is nil for plain stratum+tcp:// pools.
+	TLS *tls.Config
+
+	// ChainParams are the parameters of the network mined on, which the
+	// share targets are derived from.
+	ChainParams *chaincfg.Params
+
+	// MaxReconnects is the number of attempts to reconnect after losing
+	// the connection before giving up, zero retrying forever.
+	MaxReconnects int
+
+	// Shares records the submitted shares once the pool responded.  A
+	// share log of its own is used by the connection when it is nil.
+	Shares *ShareLog
+
+	// Transcript records the session with the pool when set.
+	Transcript *Transcript
+
+	// KeepAlive is the period of the TCP keepalive probes sent on direct
+	// connections to the pool, zero disabling them.
+	KeepAlive time.Duration
+
+	// ReadTimeout is how long the pool may go without sending any message
+	// and ResponseTimeout how long it may take to respond to a share
+	// before the connection is considered lost and reestablished, zero
+	// disabling the check.
+	ReadTimeout     time.Duration
+	ResponseTimeout time.Duration
 }
 
+// Supported pool URL schemes.
+const (
+	schemeTCP = "stratum+tcp://"
+	schemeSSL = "stratum+ssl://"
+	schemeTLS = "stratum+tls://"
+
+	schemeZIP301TCP = "zip301+tcp://"
+	schemeZIP301SSL = "zip301+ssl://"
+	schemeZIP301TLS = "zip301+tls://"
+)
+
 // NotifyWork holds all the info recieved from a mining.notify message along
 // with the Work data generate from it.
 type NotifyWork struct {
@@ -77,8 +240,7 @@ type NotifyWork struct {
 	ExtraNonce2       uint64
 	ExtraNonce2Length float64
 	Nonce2            uint32
-	CB1               string
-	CB2               string
+	Header            []byte
 	Height            int64
 	NtimeDelta        int64
 	JobID             string
@@ -87,825 +249,915 @@ type NotifyWork struct {
 	Ntime             string
 	Version           string
 	NewWork           bool
+	Received          time.Time
 	Work              *work.Work
 }
 
-// StratumMsg is the basic message object from stratum.
-type StratumMsg struct {
-	Method string `json:"method"`
-	// Need to make generic.
-	Params []string    `json:"params"`
-	ID     interface{} `json:"id"`
-}
-
-// StratumRsp is the basic response type from stratum.
-type StratumRsp struct {
-	Method string `json:"method"`
-	// Need to make generic.
-	ID     interface{}      `json:"id"`
-	Error  StratErr         `json:"error,omitempty"`
-	Result *json.RawMessage `json:"result,omitempty"`
-}
-
-// StratErr is the basic error type (a number and a string) sent by
-// the stratum server.
-type StratErr struct {
-	ErrNum uint64
-	ErrStr string
-	Result *json.RawMessage `json:"result,omitempty"`
-}
-
-type PoolError struct {
-	Code    uint64 `json:"code"`
-	Message string `json:"message"`
-	Data    string `json:"data,omitempty"`
-}
-
-// Basic reply is a reply type for any of the simple messages.
-type BasicReply struct {
-	ID     interface{} `json:"id"`
-	Error  StratErr    `json:"error,omitempty"`
-	Result bool        `json:"result"`
-}
-
-// SubscribeReply models the server response to a subscribe message.
-type SubscribeReply struct {
-	SubscribeID       string
-	ExtraNonce1       string
-	ExtraNonce2Length float64
-}
-
-// NotifyRes models the json from a mining.notify message.
-type NotifyRes struct {
-	JobID          string
-	Hash           string
-	GenTX1         string
-	GenTX2         string
-	MerkleBranches []string
-	BlockVersion   string
-	Nbits          string
-	Ntime          string
-	CleanJobs      bool
+// parsePoolURL returns the address of the passed pool URL, whether the
+// connection to it is secured with TLS, and the dialect selected by the
+// scheme, which is empty for stratum+ URLs.
+func parsePoolURL(pool string) (string, bool, string, error) {
+	for _, scheme := range []struct {
+		prefix  string
+		secure  bool
+		dialect string
+	}{
+		{schemeTCP, false, ""},
+		{schemeSSL, true, ""},
+		{schemeTLS, true, ""},
+		{schemeZIP301TCP, false, DialectZIP301},
+		{schemeZIP301SSL, true, DialectZIP301},
+		{schemeZIP301TLS, true, DialectZIP301},
+	} {
+		if strings.HasPrefix(pool, scheme.prefix) {
+			return strings.TrimPrefix(pool, scheme.prefix),
+				scheme.secure, scheme.dialect, nil
+		}
+	}
+	return "", false, "", errors.New("Only stratum pools supported.")
 }
 
-// Submit models a submission message.
-type Submit struct {
-	Params []string    `json:"params"`
-	ID     interface{} `json:"id"`
-	Method string      `json:"method"`
+// dial connects to the pool, recording the new connection in the transcript.
+func (s *Stratum) dial() (net.Conn, error) {
+	if s.dialer != nil {
+		return s.dialer()
+	}
+	conn, err := s.dialPool()
+	if err != nil {
+		return nil, err
+	}
+	s.record(TranscriptEntry{
+		Kind:    EntryConnect,
+		Dialect: s.dialect.name(),
+		User:    s.cfg.User,
+		Version: s.cfg.Version,
+	})
+	return conn, nil
 }
 
-// errJsonType is an error for json that we do not expect.
-var errJsonType = errors.New("Unexpected type in json.")
+// dialPool connects to the pool, through the proxy if one is configured, and
+// performs the TLS handshake for secure pools.
+func (s *Stratum) dialPool() (net.Conn, error) {
+	addr := s.poolAddr()
+	var conn net.Conn
+	var err error
+	if s.cfg.Proxy != "" {
+		proxy := &socks.Proxy{
+			Addr:     s.cfg.Proxy,
+			Username: s.cfg.ProxyUser,
+			Password: s.cfg.ProxyPass,
+		}
+		conn, err = proxy.DialTimeout("tcp", addr, dialTimeout)
+	} else {
+		// The dialer disables keepalives when the period is negative.
+		dialer := net.Dialer{Timeout: dialTimeout, KeepAlive: -1}
+		if s.cfg.KeepAlive > 0 {
+			dialer.KeepAlive = s.cfg.KeepAlive
+		}
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.cfg.TLS == nil {
+		return conn, nil
+	}
 
-func sliceContains(s []uint64, e uint64) bool {
-	for _, a := range s {
-		if a == e {
-			return true
+	tlsConfig := s.cfg.TLS.Clone()
+	if tlsConfig.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			conn.Close()
+			return nil, err
 		}
+		tlsConfig.ServerName = host
 	}
-	return false
+	tlsConn := tls.Client(conn, tlsConfig)
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	err = tlsConn.Handshake()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tlsConn, nil
 }
 
-func sliceRemove(s []uint64, e uint64) []uint64 {
-	for i, a := range s {
-		if a == e {
-			return append(s[:i], s[i+1:]...)
-		}
+// StratumConn starts the initial connection to a stratum pool and sets defaults
+// in the pool object.  The TLS configuration of cfg is used for
+// stratum+ssl:// and stratum+tls:// pools, with the default one being used
+// when it is nil.
+func StratumConn(cfg Config) (*Stratum, error) {
+	stratum, err := newStratum(cfg)
+	if err != nil {
+		return nil, err
+	}
+	err = stratum.connect()
+	if err != nil {
+		return nil, err
 	}
+	go stratum.Listen()
 
-	return s
+	return stratum, nil
 }
 
-// StratumConn starts the initial connection to a stratum pool and sets defaults
-// in the pool object.
-func StratumConn(pool, user, pass, proxy, proxyUser, proxyPass, version string) (*Stratum, error) {
-	var stratum Stratum
-	stratum.cfg.User = user
-	stratum.cfg.Pass = pass
-	stratum.cfg.Proxy = proxy
-	stratum.cfg.ProxyUser = proxyUser
-	stratum.cfg.ProxyPass = proxyPass
-	stratum.cfg.Version = version
-
-	log.Infof("Using pool: %v", pool)
-	proto := "stratum+tcp://"
-	if strings.HasPrefix(pool, proto) {
-		pool = strings.Replace(pool, proto, "", 1)
-	} else {
-		err := errors.New("Only stratum pools supported.")
+// newStratum returns the connection to the pool of cfg, which is yet to be
+// established.
+func newStratum(cfg Config) (*Stratum, error) {
+	stratum := &Stratum{
+		cfg:          cfg,
+		ready:        make(chan struct{}),
+		done:         make(chan struct{}),
+		stateChanged: make(chan struct{}),
+		lastNotify:   time.Now().Unix(),
+		pending:      codec.NewPending(),
+		submits:      make(map[uint64]*Share),
+		jobs:         newJobRegistry(),
+		newJobs:      make(chan struct{}, 1),
+	}
+	if stratum.cfg.Shares == nil {
+		stratum.cfg.Shares = NewShareLog()
+	}
+
+	log.Infof("Using pool: %v", cfg.Pool)
+	addr, secure, dialectName, err := parsePoolURL(cfg.Pool)
+	if err != nil {
 		return nil, err
 	}
-	var conn net.Conn
-	var err error
-	if stratum.cfg.Proxy != "" {
-		proxy := &socks.Proxy{
-			Addr:     stratum.cfg.Proxy,
-			Username: stratum.cfg.ProxyUser,
-			Password: stratum.cfg.ProxyPass,
-		}
-		conn, err = proxy.Dial("tcp", pool)
-	} else {
-		conn, err = net.Dial("tcp", pool)
+	if dialectName == "" {
+		dialectName = cfg.Dialect
 	}
+	stratum.dialect, err = dialectByName(dialectName)
 	if err != nil {
 		return nil, err
 	}
-	stratum.ID = 1
-	stratum.Conn = conn
-	stratum.cfg.Pool = pool
-
-	// We will set it for sure later but this really should be the value and
-	// setting it here will prevent so incorrect matches based on the
-	// default 0 value.
-	stratum.authID = 2
+	stratum.addr = addr
+	if secure {
+		if stratum.cfg.TLS == nil {
+			stratum.cfg.TLS = &tls.Config{}
+		}
+	} else {
+		stratum.cfg.TLS = nil
+	}
 
 	// Target for share is 1 unless we hear otherwise.
 	stratum.Diff = 1
-	stratum.Target, err = util.DiffToTarget(stratum.Diff, chainParams.PowLimit)
+	stratum.Target, err = util.DiffToTarget(stratum.Diff, stratum.cfg.ChainParams.PowLimit)
 	if err != nil {
 		return nil, err
 	}
 	stratum.PoolWork.NewWork = false
-	stratum.Reader = bufio.NewReader(stratum.Conn)
-	go stratum.Listen()
+	return stratum, nil
+}
 
-	err = stratum.Subscribe()
+// connect makes the initial connection to the pool, subscribing and
+// authorizing the worker.  The listener is left to the caller.
+func (s *Stratum) connect() error {
+	s.setState(StateConnecting)
+	conn, err := s.dial()
 	if err != nil {
-		return nil, err
+		s.setState(StateDisconnected)
+		return err
 	}
-	err = stratum.Auth()
+	s.setConnection(conn)
+	atomic.StoreInt64(&s.lastReceived, time.Now().UnixNano())
+
+	err = s.handshake()
 	if err != nil {
-		return nil, err
+		s.Close()
+		return err
 	}
 
-	stratum.Started = uint32(time.Now().Unix())
+	s.Started = uint32(time.Now().Unix())
+	return nil
+}
 
-	return &stratum, nil
+// handshake subscribes and authorizes the worker on a new connection to the
+// pool, subscribing to extranonce changes as well when the dialect supports
+// them.
+func (s *Stratum) handshake() error {
+	err := s.Subscribe()
+	if err == nil {
+		err = s.Auth()
+	}
+	if err == nil && s.dialect.subscribeExtraNonce() {
+		err = s.ExtraNonceSubscribe()
+	}
+	return err
 }
 
-// Reconnect reconnects to a stratum server if the connection has been lost.
+// Reconnect makes a new connection to the pool, subscribing and authorizing
+// the worker again.  The current connection is closed first.
 func (s *Stratum) Reconnect() error {
-	var conn net.Conn
-	var err error
-	if s.cfg.Proxy != "" {
-		proxy := &socks.Proxy{
-			Addr:     s.cfg.Proxy,
-			Username: s.cfg.ProxyUser,
-			Password: s.cfg.ProxyPass,
-		}
-		conn, err = proxy.Dial("tcp", s.cfg.Pool)
-	} else {
-		conn, err = net.Dial("tcp", s.cfg.Pool)
-	}
+	s.closeConnection()
+	s.setState(StateConnecting)
+	conn, err := s.dial()
 	if err != nil {
+		s.setState(StateDisconnected)
 		return err
 	}
-	s.Conn = conn
-	s.Reader = bufio.NewReader(s.Conn)
-	err = s.Subscribe()
-	if err != nil {
-		return nil
+	s.setConnection(conn)
+	atomic.StoreInt64(&s.lastReceived, time.Now().UnixNano())
+	s.pending.Reset()
+	s.submitsMtx.Lock()
+	if len(s.submits) > 0 {
+		log.Warnf("%d shares submitted to pool %v got no response",
+			len(s.submits), s.poolAddr())
 	}
-	// Should NOT need this.
-	time.Sleep(5 * time.Second)
-	// XXX Do I really need to re-auth here?
-	err = s.Auth()
+	s.submits = make(map[uint64]*Share)
+	s.submitsMtx.Unlock()
+	s.jobs.reset("connection to the pool reset")
+	err = s.handshake()
 	if err != nil {
-		return nil
+		conn.Close()
+		s.setState(StateDisconnected)
+		return err
 	}
 
 	// If we were able to reconnect, restart counter
 	s.Started = uint32(time.Now().Unix())
+	atomic.AddUint64(&s.Reconnects, 1)
 
 	return nil
 }
 
+// reconnect reconnects after the connection was lost, retrying with
+// increasing delays until it succeeds, MaxReconnects attempts were made since
+// the worker was last authorized, or the connection is closed.
+func (s *Stratum) reconnect(cause error) error {
+	s.closeConnection()
+	s.setState(StateDisconnected)
+
+	for {
+		if s.cfg.MaxReconnects > 0 && s.attempts >= s.cfg.MaxReconnects {
+			return fmt.Errorf("Giving up after %d attempts to "+
+				"reconnect: %v", s.attempts, cause)
+		}
+		s.attempts++
+
+		// The first attempt is immediate since the pool may just have
+		// dropped the connection.
+		if s.attempts > 1 {
+			delay := Backoff(s.attempts - 1)
+			log.Infof("Reconnecting to pool %v in %v (attempt %d)",
+				s.poolAddr(), delay.Round(time.Millisecond),
+				s.attempts)
+			select {
+			case <-time.After(delay):
+			case <-s.done:
+				return s.Err()
+			}
+		}
+
+		err := s.Reconnect()
+		if err == nil {
+			return nil
+		}
+		log.Errorf("Unable to reconnect to pool %v: %v", s.poolAddr(),
+			err)
+		cause = err
+	}
+}
+
+// connection returns the current connection to the pool and its reader.
+func (s *Stratum) connection() (net.Conn, *bufio.Reader) {
+	s.connMtx.Lock()
+	defer s.connMtx.Unlock()
+	return s.conn, s.reader
+}
+
+// setConnection makes conn the current connection to the pool.
+func (s *Stratum) setConnection(conn net.Conn) {
+	s.connMtx.Lock()
+	defer s.connMtx.Unlock()
+	s.conn = conn
+	s.reader = bufio.NewReader(conn)
+}
+
+// closeConnection closes the current connection to the pool, if any.
+func (s *Stratum) closeConnection() {
+	if conn, _ := s.connection(); conn != nil {
+		conn.Close()
+	}
+}
+
+// poolAddr returns the address of the pool.
+func (s *Stratum) poolAddr() string {
+	s.connMtx.Lock()
+	defer s.connMtx.Unlock()
+	return s.addr
+}
+
+// State returns the state of the connection.
+func (s *Stratum) State() State {
+	s.stateMtx.Lock()
+	defer s.stateMtx.Unlock()
+	return s.state
+}
+
+// StateChanged returns a channel that is closed on the next state change.
+func (s *Stratum) StateChanged() <-chan struct{} {
+	s.stateMtx.Lock()
+	defer s.stateMtx.Unlock()
+	return s.stateChanged
+}
+
+// setState records a state change.
+func (s *Stratum) setState(state State) {
+	s.stateMtx.Lock()
+	defer s.stateMtx.Unlock()
+	if state == s.state {
+		return
+	}
+	log.Infof("Pool %v: %v -> %v", s.poolAddr(), s.state, state)
+	s.state = state
+	close(s.stateChanged)
+	s.stateChanged = make(chan struct{})
+}
+
+// Connected returns whether the connection to the pool is usable, that is the
+// worker is authorized.
+func (s *Stratum) Connected() bool {
+	return s.State() == StateAuthorized
+}
+
+// Close closes the connection to the pool and stops its listener.
+func (s *Stratum) Close() {
+	atomic.StoreUint32(&s.closing, 1)
+	s.closeConnection()
+	s.setState(StateDisconnected)
+	s.fail(ErrStratumClosed)
+}
+
+// fail marks the connection as failed with err unless it already failed.
+func (s *Stratum) fail(err error) {
+	s.doneOnce.Do(func() {
+		s.err = err
+		close(s.done)
+	})
+}
+
+// Done returns a channel that is closed once the connection to the pool
+// failed and could not be reestablished, or was closed.
+func (s *Stratum) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns the reason the connection failed once Done is closed.
+func (s *Stratum) Err() error {
+	<-s.done
+	return s.err
+}
+
+// Ready returns a channel that is closed once the first job was received
+// from the pool.
+func (s *Stratum) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// LastNotify returns the time of the last mining.notify, or the time the
+// connection was established if none was received yet.
+func (s *Stratum) LastNotify() time.Time {
+	return time.Unix(atomic.LoadInt64(&s.lastNotify), 0)
+}
+
 // Listen is the listener for the incoming messages from the stratum pool.
 func (s *Stratum) Listen() {
 	log.Debug("Starting Listener")
 
 	for {
-		result, err := s.Reader.ReadString('\n')
+		s.setReadDeadline()
+		_, reader := s.connection()
+		result, err := reader.ReadString('\n')
 		if err != nil {
-			if err == io.EOF {
-				log.Error("Connection lost!  Reconnecting.")
-				err = s.Reconnect()
-				if err != nil {
-					log.Error(err)
-					log.Error("Reconnect failed.")
-					os.Exit(1)
-					return
-				}
-
-			} else {
+			if atomic.LoadUint32(&s.closing) == 1 {
+				return
+			}
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				err = s.silenceError()
+			}
+			log.Errorf("Connection to pool %v lost: %v", s.poolAddr(),
+				err)
+			s.record(TranscriptEntry{
+				Kind: EntryDisconnect,
+				Line: err.Error(),
+			})
+			err = s.reconnect(err)
+			if err != nil {
 				log.Error(err)
+				s.fail(err)
+				return
 			}
 			continue
 		}
 
-		log.Debug(strings.TrimSuffix(result, "\n"))
-		resp, err := s.Unmarshal([]byte(result))
-		if err != nil {
-			log.Error(err)
-			continue
+		atomic.StoreInt64(&s.lastReceived, time.Now().UnixNano())
+		line := strings.TrimSuffix(result, "\n")
+		s.record(TranscriptEntry{Kind: EntryIn, Line: line})
+		s.handleLine(line)
+	}
+}
+
+// setReadDeadline sets the deadline for the pool to send its next message,
+// which is ReadTimeout after the last message or ResponseTimeout after the
+// oldest share awaiting a response, whichever comes first.  The deadline
+// passing means that the pool went silent, as when the connection is
+// half-open, even though the connection was not closed.
+func (s *Stratum) setReadDeadline() {
+	var deadline time.Time
+	if s.cfg.ReadTimeout > 0 {
+		deadline = time.Unix(0, atomic.LoadInt64(&s.lastReceived)).Add(
+			s.cfg.ReadTimeout)
+	}
+	if submitted, ok := s.oldestSubmit(); ok && s.cfg.ResponseTimeout > 0 {
+		d := submitted.Add(s.cfg.ResponseTimeout)
+		if deadline.IsZero() || d.Before(deadline) {
+			deadline = d
 		}
+	}
+	conn, _ := s.connection()
+	conn.SetReadDeadline(deadline)
+}
 
-		switch resp.(type) {
-		case *BasicReply:
-			s.handleBasicReply(resp)
-		case StratumMsg:
-			s.handleStratumMsg(resp)
-		case NotifyRes:
-			s.handleNotifyRes(resp)
-		case *SubscribeReply:
-			s.handleSubscribeReply(resp)
-		default:
-			log.Info("Unhandled message: ", result)
+// oldestSubmit returns when the oldest share awaiting a response was
+// submitted, if any.
+func (s *Stratum) oldestSubmit() (time.Time, bool) {
+	s.submitsMtx.Lock()
+	defer s.submitsMtx.Unlock()
+	var oldest time.Time
+	for _, share := range s.submits {
+		if oldest.IsZero() || share.Submitted.Before(oldest) {
+			oldest = share.Submitted
 		}
 	}
+	return oldest, !oldest.IsZero()
 }
 
-func (s *Stratum) handleBasicReply(resp interface{}) {
-	s.Lock()
-	defer s.Unlock()
-	aResp := resp.(*BasicReply)
+// silenceError returns the reason the connection is considered lost once the
+// read deadline passed.
+func (s *Stratum) silenceError() error {
+	submitted, ok := s.oldestSubmit()
+	if ok && s.cfg.ResponseTimeout > 0 &&
+		time.Since(submitted) >= s.cfg.ResponseTimeout {
+		return fmt.Errorf("No response to a share for %v",
+			s.cfg.ResponseTimeout)
+	}
+	return fmt.Errorf("No message from pool for %v", s.cfg.ReadTimeout)
+}
 
-	if int(aResp.ID.(uint64)) == int(s.authID) {
-		if aResp.Result {
-			log.Debug("Logged in")
-		} else {
-			log.Error("Auth failure.")
-		}
+// handleLine handles a line received from the pool.
+func (s *Stratum) handleLine(line string) {
+	log.Debug(line)
+	msg, err := codec.Decode([]byte(line))
+	if err != nil {
+		log.Errorf("Invalid message from pool: %v", err)
+		return
 	}
-	if sliceContains(s.submitIDs, aResp.ID.(uint64)) {
-		if aResp.Result {
-			atomic.AddUint64(&s.ValidShares, 1)
-			log.Debug("Share accepted")
-		} else {
-			atomic.AddUint64(&s.InvalidShares, 1)
-			log.Error("Share rejected: ", aResp.Error.ErrStr)
-		}
-		s.submitIDs = sliceRemove(s.submitIDs, aResp.ID.(uint64))
+	if msg.IsResponse() {
+		s.handleResponse(msg)
+	} else {
+		s.handleRequest(msg)
 	}
 }
 
-func (s *Stratum) handleStratumMsg(resp interface{}) {
-	nResp := resp.(StratumMsg)
-	log.Trace(nResp)
-	// Too much is still handled in unmarshaler.  Need to
-	// move stuff other than unmarshalling here.
-	switch nResp.Method {
-	case "client.show_message":
-		log.Info(nResp.Params)
-	case "client.reconnect":
-		log.Debug("Reconnect requested")
-		wait, err := strconv.Atoi(nResp.Params[2])
-		if err != nil {
-			log.Error(err)
-			return
-		}
-		time.Sleep(time.Duration(wait) * time.Second)
-		pool := nResp.Params[0] + ":" + nResp.Params[1]
-		s.cfg.Pool = pool
-		err = s.Reconnect()
-		if err != nil {
-			log.Error(err)
-			// XXX should just die at this point
-			// but we don't really have access to
-			// the channel to end everything.
-			return
-		}
+// handleResponse handles the response to a request sent to the pool, which is
+// found from the id of the response.
+func (s *Stratum) handleResponse(msg *codec.Message) {
+	id, ok := msg.RequestID()
+	if !ok {
+		log.Debugf("Ignoring response without id (error: %v)", msg.Error)
+		return
+	}
+	method, ok := s.pending.Resolve(id)
+	if !ok {
+		log.Debugf("Ignoring response to unknown request %d", id)
+		return
+	}
 
-	case "client.get_version":
-		log.Debug("get_version request received.")
-		msg := StratumMsg{
-			Method: nResp.Method,
-			ID:     nResp.ID,
-			Params: []string{"excc-gominer/" + s.cfg.Version},
-		}
-		m, err := json.Marshal(msg)
-		if err != nil {
-			log.Error(err)
-			return
-		}
-		_, err = s.Conn.Write(m)
+	// The result of failed requests is usually null and not decoded.
+	var result interface{}
+	if msg.Error == nil {
+		var err error
+		result, err = s.dialect.codec().DecodeResult(method, msg.Result)
 		if err != nil {
 			log.Error(err)
 			return
 		}
-		_, err = s.Conn.Write([]byte("\n"))
-		if err != nil {
-			log.Error(err)
-			return
+	}
+
+	switch method {
+	case codec.MethodSubscribe:
+		s.handleSubscribeResult(result, msg.Error)
+	case codec.MethodAuthorize:
+		s.handleAuthorizeResult(result == true, msg.Error)
+	case codec.MethodExtraNonceSubscribe:
+		if result == true {
+			log.Debug("Subscribed to extranonce changes")
+		} else {
+			log.Debugf("Pool %v does not support extranonce changes",
+				s.poolAddr())
 		}
+	case codec.MethodSubmit:
+		s.handleSubmitResult(id, result == true, msg.Error)
 	}
 }
 
-func (s *Stratum) handleNotifyRes(resp interface{}) {
-	s.Lock()
-	defer s.Unlock()
-	nResp := resp.(NotifyRes)
-	s.PoolWork.JobID = nResp.JobID
-	s.PoolWork.CB1 = nResp.GenTX1
-	heightHex := nResp.GenTX1[186:188] + nResp.GenTX1[184:186]
-	height, err := strconv.ParseInt(heightHex, 16, 32)
-	if err != nil {
-		log.Debugf("failed to parse height %v", err)
-		height = 0
+// handleSubmitResult records the response to the submission of a share.
+func (s *Stratum) handleSubmitResult(id uint64, accepted bool, rerr *codec.Error) {
+	s.submitsMtx.Lock()
+	share, ok := s.submits[id]
+	delete(s.submits, id)
+	s.submitsMtx.Unlock()
+	if !ok {
+		return
 	}
 
-	s.PoolWork.Height = height
-	s.PoolWork.CB2 = nResp.GenTX2
-	s.PoolWork.Hash = nResp.Hash
-	s.PoolWork.Nbits = nResp.Nbits
-	s.PoolWork.Version = nResp.BlockVersion
-	parsedNtime, err := strconv.ParseInt(nResp.Ntime, 16, 64)
-	if err != nil {
-		log.Error(err)
+	share.Latency = time.Since(share.Submitted)
+	share.Accepted = accepted
+	if accepted {
+		atomic.AddUint64(&s.ValidShares, 1)
+		log.Debugf("Share from DEV #%d for job %v accepted in %v",
+			share.Device, share.JobID, share.Latency)
+	} else {
+		atomic.AddUint64(&s.InvalidShares, 1)
+		share.Reason = rejectReason(rerr)
+		if rerr != nil {
+			share.Code, share.Message = rerr.Code, rerr.Message
+		}
+		log.Errorf("Share from DEV #%d for job %v rejected (%v) in %v: %v",
+			share.Device, share.JobID, share.Reason, share.Latency, rerr)
 	}
-
-	s.PoolWork.Ntime = nResp.Ntime
-	s.PoolWork.NtimeDelta = parsedNtime - time.Now().Unix()
-	s.PoolWork.Clean = nResp.CleanJobs
-	s.PoolWork.NewWork = true
-	log.Trace("notify: ", spew.Sdump(nResp))
+	s.cfg.Shares.record(share)
 }
 
-func (s *Stratum) handleSubscribeReply(resp interface{}) {
-	nResp := resp.(*SubscribeReply)
-	s.PoolWork.ExtraNonce1 = nResp.ExtraNonce1
-	s.PoolWork.ExtraNonce2Length = nResp.ExtraNonce2Length
+func (s *Stratum) handleSubscribeResult(result interface{}, rerr *codec.Error) {
+	res, ok := result.(*codec.SubscribeResult)
+	if !ok {
+		log.Errorf("Subscription to pool %v failed: %v", s.poolAddr(),
+			rerr)
+		return
+	}
+	s.Lock()
+	s.PoolWork.ExtraNonce1 = res.ExtraNonce1
+	s.PoolWork.ExtraNonce2Length = float64(s.dialect.extraNonce2Size(
+		res.ExtraNonce2Size))
+	s.Unlock()
+	s.setState(StateSubscribed)
 	log.Debug("Subscribe reply received.")
-	log.Trace(spew.Sdump(resp))
+	log.Trace(spew.Sdump(res))
 }
 
-// Auth sends a message to the pool to authorize a worker.
-func (s *Stratum) Auth() error {
-	msg := StratumMsg{
-		Method: "mining.authorize",
-		ID:     s.ID,
-		Params: []string{s.cfg.User, s.cfg.Pass},
-	}
-	// Auth reply has no method so need a way to identify it.
-	// Ugly, but not much choice.
-	id, ok := msg.ID.(uint64)
-	if !ok {
-		return errJsonType
+func (s *Stratum) handleAuthorizeResult(authorized bool, rerr *codec.Error) {
+	if authorized {
+		log.Debug("Logged in")
+		s.attempts = 0
+		s.setState(StateAuthorized)
+		return
 	}
-	s.authID = id
-	s.ID++
-	log.Tracef("%v", msg)
-	m, err := json.Marshal(msg)
-	if err != nil {
-		return err
+	log.Errorf("Auth failure: %v", rerr)
+	s.fail(ErrStratumAuth)
+	s.Close()
+}
+
+// handleRequest handles a notification or a request from the pool.
+func (s *Stratum) handleRequest(msg *codec.Message) {
+	params, err := s.dialect.codec().DecodeParams(msg)
+	if err == codec.ErrUnknownMethod {
+		log.Infof("Unhandled message: %v", msg.Method)
+		return
 	}
-	_, err = s.Conn.Write(m)
 	if err != nil {
-		return err
+		log.Error(err)
+		return
 	}
-	_, err = s.Conn.Write([]byte("\n"))
-	if err != nil {
-		return err
+	log.Trace(spew.Sdump(params))
+
+	switch p := params.(type) {
+	case *codec.Notify:
+		s.handleNotify(p)
+	case *codec.NotifyZIP301:
+		s.handleNotifyZIP301(p)
+	case *codec.SetDifficulty:
+		s.setDifficulty(p.Difficulty)
+	case *codec.SetTarget:
+		s.setTarget(p.Target)
+	case *codec.SetExtraNonce:
+		s.setExtraNonce(p.ExtraNonce1, p.ExtraNonce2Size)
+	case *codec.ShowMessage:
+		log.Info(p.Message)
+	case *codec.Reconnect:
+		s.handleReconnect(p)
+	case *codec.GetVersion:
+		log.Debug("get_version request received.")
+		reply := codec.Reply{
+			ID:     msg.ID,
+			Result: "excc-gominer/" + s.cfg.Version,
+		}
+		if err := s.write(&reply); err != nil {
+			log.Error(err)
+		}
 	}
-	return nil
 }
 
-// Subscribe sends the subscribe message to get mining info for a worker.
-func (s *Stratum) Subscribe() error {
-	msg := StratumMsg{
-		Method: "mining.subscribe",
-		ID:     s.ID,
-		Params: []string{"excc-gominer/" + s.cfg.Version},
-	}
-	s.subID = msg.ID.(uint64)
-	s.ID++
-	m, err := json.Marshal(msg)
-	if err != nil {
-		return err
+// handleReconnect connects to the pool the miner was asked to move to, or to
+// the same pool when none was given, after the requested wait.  The wait is
+// capped as the delays between attempts to reconnect are, and cut short when
+// the connection is closed.
+func (s *Stratum) handleReconnect(r *codec.Reconnect) {
+	log.Debug("Reconnect requested")
+	wait := r.Wait
+	if wait > reconnectMaxDelay {
+		wait = reconnectMaxDelay
 	}
-	log.Tracef("%v", string(m))
-	_, err = s.Conn.Write(m)
-	if err != nil {
-		return err
+	if wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-s.done:
+			return
+		}
 	}
-	_, err = s.Conn.Write([]byte("\n"))
+
+	// The TLS settings of the connection are kept, with the
+	// certificate being verified against the new host.
+	if r.Host != "" {
+		s.connMtx.Lock()
+		s.addr = net.JoinHostPort(r.Host, r.Port)
+		s.connMtx.Unlock()
+	}
+	err := s.Reconnect()
 	if err != nil {
-		return err
+		log.Errorf("Unable to connect to pool %v: %v", s.poolAddr(), err)
+		err = s.reconnect(err)
+		if err != nil {
+			log.Error(err)
+			s.fail(err)
+			s.Close()
+		}
 	}
-	return nil
 }
 
-// Unmarshal provides a json unmarshaler for the commands.
-// I'm sure a lot of this can be generalized but the json we deal with
-// is pretty yucky.
-func (s *Stratum) Unmarshal(blob []byte) (interface{}, error) {
-	s.Lock()
-	defer s.Unlock()
-	var (
-		objmap map[string]json.RawMessage
-		method string
-		id     uint64
-	)
-
-	err := json.Unmarshal(blob, &objmap)
+// handleNotify handles a job sent in the Decred dialect.
+func (s *Stratum) handleNotify(n *codec.Notify) {
+	header, err := decredHeader(n)
 	if err != nil {
-		return nil, err
+		log.Errorf("Invalid job %v: %v", n.JobID, err)
+		return
 	}
-	// decode command
-	// Not everyone has a method.
-	err = json.Unmarshal(objmap["method"], &method)
+	s.handleJob(n.JobID, header, n.CleanJobs)
+}
+
+// handleNotifyZIP301 handles a job sent in the ZIP 301 dialect.
+func (s *Stratum) handleNotifyZIP301(n *codec.NotifyZIP301) {
+	header, err := zip301Header(n)
 	if err != nil {
-		method = ""
+		log.Errorf("Invalid job %v: %v", n.JobID, err)
+		return
 	}
+	s.handleJob(n.JobID, header, n.CleanJobs)
+}
 
-	if _, ok := objmap["id"]; ok {
-		err = json.Unmarshal(objmap["id"], &id)
-		if err != nil {
-			return nil, err
-		}
+// handleJob makes the job with the passed header, as built by the dialect of
+// the pool, the one to prepare work for.
+func (s *Stratum) handleJob(jobID string, header []byte, clean bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.PoolWork.JobID = jobID
+	s.PoolWork.Header = header
+	s.PoolWork.Height = int64(binary.LittleEndian.Uint32(header[heightOffset:]))
+	s.PoolWork.Hash = hex.EncodeToString(header[4:merkleRootOffset])
+	s.PoolWork.Nbits = fmt.Sprintf("%08x",
+		binary.LittleEndian.Uint32(header[bitsOffset:]))
+	s.PoolWork.Version = fmt.Sprintf("%08x",
+		binary.LittleEndian.Uint32(header))
+
+	ntime := binary.LittleEndian.Uint32(header[timestampOffset:])
+	s.PoolWork.Ntime = fmt.Sprintf("%08x", ntime)
+	s.PoolWork.NtimeDelta = int64(ntime) - time.Now().Unix()
+	if s.jobs.add(jobID, clean, s.Diff, s.Target) {
+		log.Debugf("Job %v makes the work of previous jobs stale",
+			jobID)
+		s.PoolWork.Clean = true
 	}
+	s.PoolWork.NewWork = true
+	s.PoolWork.Received = time.Now()
+	s.signalNewJob()
+	atomic.StoreInt64(&s.lastNotify, time.Now().Unix())
+	s.readyOnce.Do(func() { close(s.ready) })
+}
 
-	log.Trace("Received: method: ", method, " id: ", id)
-	if id == s.authID {
-		var (
-			objmap      map[string]json.RawMessage
-			id          uint64
-			result      bool
-			errorHolder PoolError
-		)
-		err := json.Unmarshal(blob, &objmap)
-		if err != nil {
-			return nil, err
-		}
-		resp := &BasicReply{}
-
-		err = json.Unmarshal(objmap["id"], &id)
-		if err != nil {
-			return nil, err
-		}
-		resp.ID = id
-
-		err = json.Unmarshal(objmap["result"], &result)
-		if err != nil {
-			return nil, err
-		}
-		err = json.Unmarshal(objmap["error"], &errorHolder)
-		if err != nil {
-			return nil, err
-		}
-		resp.Result = result
-
-		if !result {
-			resp.Error.ErrNum = uint64(errorHolder.Code)
-			resp.Error.ErrStr = errorHolder.Message
-		}
-
-		return resp, nil
-
+// signalNewJob signals that there is new work to prepare, without blocking
+// when the signal is still pending.
+func (s *Stratum) signalNewJob() {
+	select {
+	case s.newJobs <- struct{}{}:
+	default:
 	}
-	if id == s.subID {
-		var resi []interface{}
-		err := json.Unmarshal(objmap["result"], &resi)
-		if err != nil {
-			return nil, err
-		}
-		log.Trace(resi)
-		resp := &SubscribeReply{}
-
-		var objmap2 map[string]json.RawMessage
-		err = json.Unmarshal(blob, &objmap2)
-		if err != nil {
-			return nil, err
-		}
-
-		var resJS []json.RawMessage
-		err = json.Unmarshal(objmap["result"], &resJS)
-		if err != nil {
-			return nil, err
-		}
-
-		if len(resJS) == 0 {
-			return nil, errJsonType
-		}
-
-		var msgPeak []interface{}
-		err = json.Unmarshal(resJS[0], &msgPeak)
-		if err != nil {
-			return nil, err
-		}
-
-		// The pools do not all agree on what this message looks like
-		// so we need to actually look at it before unmarshalling for
-		// real so we can use the right form.  Yuck.
-		if msgPeak[0] == "mining.notify" {
-			var innerMsg []string
-			err = json.Unmarshal(resJS[0], &innerMsg)
-			if err != nil {
-				return nil, err
-			}
-			resp.SubscribeID = innerMsg[1]
-		} else {
-			var innerMsg = resi[0].([]interface{})
-			for i := 0; i < len(innerMsg); i++ {
-				msg := innerMsg[i].([]interface{})
-				if msg[0] == "mining.notify" {
-					resp.SubscribeID = msg[1].(string)
-				}
-				if msg[0] == "mining.set_difficulty" {
-					// Not all pools correctly put something
-					// in here so we will ignore it (we
-					// already have the default value of 1
-					// anyway and pool can send a new one.
-					// dcr.coinmine.pl puts something that
-					// is not a difficulty here which is why
-					// we ignore.
-				}
-			}
-		}
+}
 
-		resp.ExtraNonce1 = resi[1].(string)
-		resp.ExtraNonce2Length = resi[2].(float64)
-		return resp, nil
-	}
-	if sliceContains(s.submitIDs, id) {
-		var (
-			objmap      map[string]json.RawMessage
-			id          uint64
-			result      bool
-			errorHolder PoolError
-		)
-		err := json.Unmarshal(blob, &objmap)
-		if err != nil {
-			return nil, err
-		}
-		resp := &BasicReply{}
+// NewJobs returns a channel signalled whenever there is new work to prepare,
+// as when the pool sends a job, so that the devices are given the new work
+// right away.
+func (s *Stratum) NewJobs() <-chan struct{} {
+	return s.newJobs
+}
 
-		err = json.Unmarshal(objmap["id"], &id)
-		if err != nil {
-			return nil, err
-		}
-		resp.ID = id
+// PendingShares returns the number of shares submitted to the pool which it
+// did not respond to yet.
+func (s *Stratum) PendingShares() int {
+	s.submitsMtx.Lock()
+	defer s.submitsMtx.Unlock()
+	return len(s.submits)
+}
 
-		err = json.Unmarshal(objmap["result"], &result)
-		if err != nil {
-			return nil, err
-		}
-		err = json.Unmarshal(objmap["error"], &errorHolder)
-		if err != nil {
-			return nil, err
-		}
-		resp.Result = result
+// setDifficulty sets the share difficulty, and the target derived from it, of
+// the jobs sent from now on.
+func (s *Stratum) setDifficulty(difficulty float64) {
+	target, err := util.DiffToTarget(difficulty, s.cfg.ChainParams.PowLimit)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	s.Lock()
+	s.Target = target
+	s.Diff = difficulty
+	s.Unlock()
+	log.Infof("Stratum difficulty set to %v for the next jobs", difficulty)
+}
 
-		if !result {
-			resp.Error.ErrNum = uint64(errorHolder.Code)
-			resp.Error.ErrStr = errorHolder.Message
-		}
+// setTarget sets the share target of the jobs sent from now on, as sent with
+// mining.set_target, along with the difficulty it corresponds to.
+func (s *Stratum) setTarget(target *big.Int) {
+	difficulty := util.TargetToDiff(target, s.cfg.ChainParams.PowLimit)
+	s.Lock()
+	s.Target = target
+	s.Diff = difficulty
+	s.Unlock()
+	log.Infof("Stratum target set to %064x (difficulty %v) for the next "+
+		"jobs", target, difficulty)
+}
 
-		return resp, nil
+// setExtraNonce applies the extranonce sent with mining.set_extranonce.  The
+// current job is prepared again with it, while the shares found for the
+// previous extranonce are thrown away as stale on submission.
+func (s *Stratum) setExtraNonce(extraNonce1 string, extraNonce2Length int) {
+	extraNonce2Length = s.dialect.extraNonce2Size(extraNonce2Length)
+	s.Lock()
+	defer s.Unlock()
+	if extraNonce1 == s.PoolWork.ExtraNonce1 &&
+		float64(extraNonce2Length) == s.PoolWork.ExtraNonce2Length {
+		return
 	}
-	switch method {
-	case "mining.notify":
-		log.Trace("Unmarshal mining.notify")
-		var resi []interface{}
-		err := json.Unmarshal(objmap["params"], &resi)
-		if err != nil {
-			return nil, err
-		}
-		var nres = NotifyRes{}
-		jobID, ok := resi[0].(string)
-		if !ok {
-			return nil, errJsonType
-		}
-		nres.JobID = jobID
-		hash, ok := resi[1].(string)
-		if !ok {
-			return nil, errJsonType
-		}
-		nres.Hash = hash
-		genTX1, ok := resi[2].(string)
-		if !ok {
-			return nil, errJsonType
-		}
-		nres.GenTX1 = genTX1
-		genTX2, ok := resi[3].(string)
-		if !ok {
-			return nil, errJsonType
-		}
-		nres.GenTX2 = genTX2
-		//ccminer code also confirms this
-		//nres.MerkleBranches = resi[4].([]string)
-		blockVersion, ok := resi[5].(string)
-		if !ok {
-			return nil, errJsonType
-		}
-		nres.BlockVersion = blockVersion
-		nbits, ok := resi[6].(string)
-		if !ok {
-			return nil, errJsonType
-		}
-		nres.Nbits = nbits
-		ntime, ok := resi[7].(string)
-		if !ok {
-			return nil, errJsonType
-		}
-		nres.Ntime = ntime
-		cleanJobs, ok := resi[8].(bool)
-		if !ok {
-			return nil, errJsonType
-		}
-		nres.CleanJobs = cleanJobs
-		return nres, nil
+	s.PoolWork.ExtraNonce1 = extraNonce1
+	s.PoolWork.ExtraNonce2Length = float64(extraNonce2Length)
+	if s.PoolWork.JobID != "" {
+		s.PoolWork.Clean = true
+		s.PoolWork.NewWork = true
+		s.PoolWork.Received = time.Now()
+		s.signalNewJob()
+	}
+	log.Infof("Pool %v set extranonce1 %v with %d bytes of extranonce2",
+		s.poolAddr(), extraNonce1, extraNonce2Length)
+}
 
-	case "mining.set_difficulty":
-		log.Trace("Received new difficulty.")
-		var resi []interface{}
-		err := json.Unmarshal(objmap["params"], &resi)
-		if err != nil {
-			return nil, err
-		}
+// Send sends a request to the pool.  A request which could not be written is
+// no longer pending, and neither is the share it submits, since the pool
+// never gets it.
+func (s *Stratum) Send(req *codec.Request) error {
+	err := s.write(req)
+	if err != nil {
+		s.pending.Resolve(req.ID)
+		s.submitsMtx.Lock()
+		delete(s.submits, req.ID)
+		s.submitsMtx.Unlock()
+	}
+	return err
+}
 
-		difficulty, ok := resi[0].(float64)
-		if !ok {
-			return nil, errJsonType
-		}
-		s.Target, err = util.DiffToTarget(difficulty, chainParams.PowLimit)
-		if err != nil {
-			return nil, err
-		}
-		s.Diff = difficulty
-		var nres = StratumMsg{}
-		nres.Method = method
-		diffStr := strconv.FormatFloat(difficulty, 'E', -1, 32)
-		var params []string
-		params = append(params, diffStr)
-		nres.Params = params
-		log.Infof("Stratum difficulty set to %v", difficulty)
-		return nres, nil
-
-	case "client.show_message":
-		var resi []interface{}
-		err := json.Unmarshal(objmap["result"], &resi)
-		if err != nil {
-			return nil, err
-		}
-		msg, ok := resi[0].(string)
-		if !ok {
-			return nil, errJsonType
-		}
-		var nres = StratumMsg{}
-		nres.Method = method
-		var params []string
-		params = append(params, msg)
-		nres.Params = params
-		return nres, nil
-
-	case "client.get_version":
-		var nres = StratumMsg{}
-		var id uint64
-		err = json.Unmarshal(objmap["id"], &id)
-		if err != nil {
-			return nil, err
-		}
-		nres.Method = method
-		nres.ID = id
-		return nres, nil
-
-	case "client.reconnect":
-		var nres = StratumMsg{}
-		var id uint64
-		err = json.Unmarshal(objmap["id"], &id)
-		if err != nil {
-			return nil, err
-		}
-		nres.Method = method
-		nres.ID = id
+// encoder is a message written to the pool.
+type encoder interface {
+	Encode(w io.Writer) error
+}
 
-		var resi []interface{}
-		err := json.Unmarshal(objmap["params"], &resi)
-		if err != nil {
-			return nil, err
-		}
-		log.Trace(resi)
+// write writes msg to the pool, recording it in the transcript.  The
+// connection is closed when the write fails or times out, for the listener to
+// reconnect rather than keep writing to a connection the pool does not read.
+func (s *Stratum) write(msg encoder) error {
+	var b bytes.Buffer
+	if err := msg.Encode(&b); err != nil {
+		return err
+	}
+	if s.cfg.Transcript != nil {
+		line := bytes.TrimSuffix(b.Bytes(), []byte{'\n'})
+		s.record(TranscriptEntry{
+			Kind: EntryOut,
+			Line: transcriptLine(msg, line),
+		})
+	}
+	conn, _ := s.connection()
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := conn.Write(b.Bytes()); err != nil {
+		conn.Close()
+		return err
+	}
+	return nil
+}
 
-		if len(resi) < 3 {
-			return nil, errJsonType
-		}
-		hostname, ok := resi[0].(string)
-		if !ok {
-			return nil, errJsonType
-		}
-		p, ok := resi[1].(float64)
-		if !ok {
-			return nil, errJsonType
-		}
-		port := strconv.Itoa(int(p))
-		w, ok := resi[2].(float64)
-		if !ok {
-			return nil, errJsonType
-		}
-		wait := strconv.Itoa(int(w))
+// record records an entry for the pool in the transcript, if any.
+func (s *Stratum) record(e TranscriptEntry) {
+	if s.cfg.Transcript == nil {
+		return
+	}
+	e.Pool = s.poolAddr()
+	s.cfg.Transcript.Record(e)
+}
 
-		nres.Params = []string{hostname, port, wait}
+// Auth sends a message to the pool to authorize a worker.
+func (s *Stratum) Auth() error {
+	return s.Send(s.pending.Request(codec.MethodAuthorize, s.cfg.User,
+		s.cfg.Pass))
+}
 
-		return nres, nil
+// Subscribe sends the subscribe message to get mining info for a worker.
+func (s *Stratum) Subscribe() error {
+	params := s.dialect.subscribeParams(s.poolAddr(),
+		"excc-gominer/"+s.cfg.Version)
+	return s.Send(s.pending.Request(codec.MethodSubscribe, params...))
+}
 
-	default:
-		resp := &StratumRsp{}
-		err := json.Unmarshal(blob, &resp)
-		if err != nil {
-			return nil, err
-		}
-		return resp, nil
-	}
+// ExtraNonceSubscribe sends the message to be notified with
+// mining.set_extranonce when the pool changes the extranonce of the worker.
+// Pools not supporting it reply with an error, which is ignored.
+func (s *Stratum) ExtraNonceSubscribe() error {
+	return s.Send(s.pending.Request(codec.MethodExtraNonceSubscribe))
 }
 
 // PrepWork converts the stratum notify to getwork style data for mining.
 func (s *Stratum) PrepWork() error {
+	s.record(TranscriptEntry{Kind: EntryWork, JobID: s.PoolWork.JobID})
+
 	// Build final extranonce, which is basically the pool user and worker ID.
 	extraNonce, err := hex.DecodeString(s.PoolWork.ExtraNonce1)
 	if err != nil {
 		log.Error("Error decoding ExtraNonce1.")
 		return err
 	}
-
-	cb1, err := hex.DecodeString(s.PoolWork.CB1)
-	if err != nil {
-		log.Error("Error decoding Coinbase pt 1.")
-		return err
+	extraNonce2Size := int(s.PoolWork.ExtraNonce2Length)
+	if extraNonce2Size < 0 {
+		return fmt.Errorf("Extranonce of %d bytes leaves no room to roll",
+			len(extraNonce))
 	}
-
-	cb2, err := hex.DecodeString(s.PoolWork.CB2)
-	if err != nil {
-		log.Error("Error decoding Coinbase pt 2.")
-		return err
-	}
-
-	v, err := util.ReverseToInt(s.PoolWork.Version)
-	if err != nil {
-		return err
-	}
-	version := new(bytes.Buffer)
-	err = binary.Write(version, binary.LittleEndian, v)
-	if err != nil {
-		return err
-	}
-	prevHash, err := hex.DecodeString(s.PoolWork.Hash)
-	if err != nil {
-		log.Error("Error encoding previous hash.")
-		return err
+	if len(extraNonce)+extraNonce2Size > len(wire.BlockHeader{}.ExtraData) {
+		return fmt.Errorf("Extranonce of %d bytes does not fit the "+
+			"extra data of the header", len(extraNonce)+extraNonce2Size)
 	}
 
+	// The header of the job, as built by the dialect, is completed with
+	// the extranonce at the start of the extra data.
 	var workdata [work.GetworkDataLen]byte
-	workPosition := 0
-	copy(workdata[workPosition:], version.Bytes())
-	workPosition += 4
-	copy(workdata[workPosition:], prevHash)
-	workPosition += 32
-	copy(workdata[workPosition:], cb1[0:108])
-	workPosition = 144
-	copy(workdata[workPosition:], extraNonce)
-	workPosition = 176
-	copy(workdata[workPosition:], cb2[:])
+	copy(workdata[:], s.PoolWork.Header)
+	copy(workdata[extraDataOffset:], extraNonce)
 
 	bh := wire.BlockHeader{}
 	bh.FromBytes(workdata[:])
 
-	givenTs := binary.LittleEndian.Uint32(workdata[128+4*work.TimestampWord : 132+4*work.TimestampWord])
-	atomic.StoreUint32(&s.latestJobTime, givenTs)
+	givenTs := binary.LittleEndian.Uint32(workdata[timestampOffset:])
 
-	if s.Target == nil {
-		log.Errorf("No target set!  Reconnecting to pool.")
-		err = s.Reconnect()
-		if err != nil {
-			log.Error(err)
-			// XXX should just die at this point
-			// but we don't really have access to
-			// the channel to end everything.
-			return err
-		}
-		return nil
+	// Shares are checked against the target of the difficulty the job
+	// was sent with rather than the one set since.
+	j, err := s.jobs.check(s.PoolWork.JobID)
+	if err != nil {
+		return err
 	}
-
-	w := work.NewWork(bh, s.Target, givenTs, uint32(time.Now().Unix()), false, s.PoolWork.JobID)
+	s.jobs.prepared(s.PoolWork.JobID, givenTs)
+
+	w := work.NewWork(bh, j.target, givenTs, uint32(time.Now().Unix()), false, s.PoolWork.JobID)
+	w.ExtraNonce2Offset = len(extraNonce)
+	w.ExtraNonce2Size = extraNonce2Size
+	w.Clean = s.PoolWork.Clean
+	w.Received = s.PoolWork.Received
+	s.PoolWork.Clean = false
 	s.PoolWork.Work = w
 
 	return nil
 }
 
-// PrepSubmit formats a mining.sumbit message from the solved work.
-func (s *Stratum) PrepSubmit(data []byte, jobID string) (Submit, error) {
+// PrepSubmit formats a mining.submit request from the work solved by device,
+// which is pending until the pool responds.
+func (s *Stratum) PrepSubmit(data []byte, jobID string, device int) (*codec.Request, error) {
 	log.Debugf("Stratum got valid work to submit %x", data)
-
-	sub := Submit{}
-	sub.Method = "mining.submit"
+	s.record(TranscriptEntry{
+		Kind:   EntryShare,
+		JobID:  jobID,
+		Header: hex.EncodeToString(data[:wire.MaxBlockHeaderPayload]),
+		Device: device,
+	})
 
 	// Format data to send off.
 	hexData := hex.EncodeToString(data)
 	decodedData, err := hex.DecodeString(hexData)
 	if err != nil {
 		log.Error("Error decoding data")
-		return sub, err
+		return nil, err
 	}
 
 	var submittedHeader wire.BlockHeader
@@ -913,34 +1165,53 @@ func (s *Stratum) PrepSubmit(data []byte, jobID string) (Submit, error) {
 	err = submittedHeader.Deserialize(bhBuf)
 	if err != nil {
 		log.Error("Error generating header")
-		return sub, err
+		return nil, err
 	}
 
-	latestWorkTs := atomic.LoadUint32(&s.latestJobTime)
-	if uint32(submittedHeader.Timestamp.Unix()) != latestWorkTs {
-		return sub, ErrStratumStaleWork
+	// Shares are only accepted for the jobs the pool did not retire, with
+	// the timestamp of the work prepared for them.
+	j, err := s.jobs.check(jobID)
+	if err != nil {
+		log.Infof("Share from DEV #%d is stale: %v", device, err)
+		return nil, ErrStratumStaleWork
+	}
+	if uint32(submittedHeader.Timestamp.Unix()) != j.time {
+		log.Infof("Share from DEV #%d is stale: Timestamp differs "+
+			"from the work of job %v", device, jobID)
+		return nil, ErrStratumStaleWork
 	}
 
-	s.ID++
-	sub.ID = s.ID
-	s.submitIDs = append(s.submitIDs, s.ID)
+	// The work was prepared for a previous extranonce if the extra data
+	// does not start with the current one.
+	extraNonce, err := hex.DecodeString(s.PoolWork.ExtraNonce1)
+	if err != nil {
+		return nil, err
+	}
+	extraNonceLen := len(extraNonce) + int(s.PoolWork.ExtraNonce2Length)
+	if !bytes.HasPrefix(submittedHeader.ExtraData[:], extraNonce) ||
+		extraNonceLen > len(submittedHeader.ExtraData) {
+		log.Infof("Share from DEV #%d is stale: Extranonce changed",
+			device)
+		return nil, ErrStratumStaleWork
+	}
 
-	// The timestamp string should be:
-	//
-	//   timestampStr := fmt.Sprintf("%08x",
-	//     uint32(submittedHeader.Timestamp.Unix()))
-	//
-	// but the "stratum" protocol appears to only use this value
-	// to check if the miner is in sync with the latest announcement
-	// of work from the pool. If this value is anything other than
-	// the timestamp of the latest pool work timestamp, work gets
-	// rejected from the current implementation.
-	timestampStr := fmt.Sprintf("%08x", latestWorkTs)
-	xnonceStr := hex.EncodeToString(data[144:156])
-	nonceStr := hex.EncodeToString(data[140:144])
-	solutionStr := hex.EncodeToString(submittedHeader.EquihashSolution[:])
+	params := s.dialect.submitParams(s.cfg.User, jobID, j.time,
+		&submittedHeader, len(extraNonce), extraNonceLen)
+	req := s.pending.Request(codec.MethodSubmit, params...)
+
+	s.submitsMtx.Lock()
+	s.submits[req.ID] = &Share{
+		Pool:       s.poolAddr(),
+		Device:     device,
+		JobID:      jobID,
+		Difficulty: j.diff,
+		Submitted:  time.Now(),
+	}
+	s.submitsMtx.Unlock()
 
-	sub.Params = []string{s.cfg.User, jobID, xnonceStr, timestampStr, nonceStr, solutionStr}
+	// The pool has until the response timeout to respond to the share,
+	// which may be sooner than the current read deadline.
+	s.setReadDeadline()
 
-	return sub, nil
+	return req, nil
 }
@@ -0,0 +1,518 @@
+// Copyright (c) 2018 The ExchangeCoin team
+
+package stratum
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/EXCCoin/exccd/chaincfg"
+
+	"github.com/EXCCoin/gominer/internal/testsolution"
+	"github.com/EXCCoin/gominer/stratum/codec"
+	"github.com/EXCCoin/gominer/stratum/stratumtest"
+	"github.com/EXCCoin/gominer/work"
+)
+
+// testTimeout is how long the tests wait for the pool or the client.
+const testTimeout = 5 * time.Second
+
+// testParams are the parameters of the network mined on in the tests.
+var testParams = &chaincfg.SimNetParams
+
+// testDifficulty is the share difficulty of the pools of the tests, whose
+// target any hash meets.
+const testDifficulty = 1e-12
+
+// testDialects are the dialects spoken by the pools of the tests.
+var testDialects = []string{"", stratumtest.DialectZIP301}
+
+// newTestPool starts a pool for the test, which is closed once it finished.
+// The pool checks test solutions and uses testDifficulty unless cfg sets
+// another difficulty.
+func newTestPool(t *testing.T, cfg stratumtest.Config) *stratumtest.Server {
+	t.Helper()
+	cfg.ChainParams = testParams
+	cfg.Verify = testsolution.Verify
+	if cfg.Difficulty == 0 {
+		cfg.Difficulty = testDifficulty
+	}
+	srv, err := stratumtest.NewServer(cfg)
+	if err != nil {
+		t.Fatalf("Unable to start pool: %v", err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	return srv
+}
+
+// dialTestPool connects to srv as user, returning once the first job was
+// received.
+func dialTestPool(t *testing.T, srv *stratumtest.Server, user string) *Stratum {
+	t.Helper()
+	return dialTestPoolConfig(t, srv, Config{User: user})
+}
+
+// dialTestPoolConfig connects to srv with cfg, making a single attempt to
+// reconnect unless cfg sets another limit, and returns once the first job was
+// received.
+func dialTestPoolConfig(t *testing.T, srv *stratumtest.Server, cfg Config) *Stratum {
+	t.Helper()
+	cfg.Pool = srv.URL()
+	cfg.Pass = "x"
+	cfg.ChainParams = testParams
+	if cfg.MaxReconnects == 0 {
+		cfg.MaxReconnects = 1
+	}
+	s, err := StratumConn(cfg)
+	if err != nil {
+		t.Fatalf("Unable to connect to pool: %v", err)
+	}
+	t.Cleanup(s.Close)
+
+	select {
+	case <-s.Ready():
+	case <-s.Done():
+		t.Fatalf("Connection to pool failed: %v", s.Err())
+	case <-time.After(testTimeout):
+		t.Fatal("No job received from pool")
+	}
+	return s
+}
+
+// waitFor waits for cond to hold, failing the test after testTimeout.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// prepWork prepares work for the current job of s, as done by the miner.
+func prepWork(t *testing.T, s *Stratum) work.Work {
+	t.Helper()
+	s.Lock()
+	defer s.Unlock()
+	s.PoolWork.NewWork = false
+	if err := s.PrepWork(); err != nil {
+		t.Fatalf("Unable to prepare work: %v", err)
+	}
+	return *s.PoolWork.Work
+}
+
+// waitNewWork waits for the job sent by the pool and prepares work for it.
+func waitNewWork(t *testing.T, s *Stratum, jobID string) work.Work {
+	t.Helper()
+	waitFor(t, "job "+jobID, func() bool {
+		s.Lock()
+		defer s.Unlock()
+		return s.PoolWork.JobID == jobID
+	})
+	return prepWork(t, s)
+}
+
+// solve solves w with the test solution and returns the serialized header as
+// submitted by the miner.
+func solve(t *testing.T, w work.Work) []byte {
+	t.Helper()
+	algo := testParams.Algorithm(w.BlockHeader.Height)
+	input, err := w.BlockHeader.SerializeEquihashHeaderBytes(algo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(w.BlockHeader.EquihashSolution[:], testsolution.Solution(input))
+
+	var buf bytes.Buffer
+	if err := w.BlockHeader.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// submit submits the share of device 0 solving data for job.
+func submit(t *testing.T, s *Stratum, data []byte, jobID string) error {
+	t.Helper()
+	s.Lock()
+	req, err := s.PrepSubmit(data, jobID, 0)
+	s.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := s.Send(req); err != nil {
+		t.Fatalf("Unable to submit share: %v", err)
+	}
+	return nil
+}
+
+// waitResponses waits for the pool to respond to every submitted share.
+func waitResponses(t *testing.T, s *Stratum) {
+	t.Helper()
+	waitFor(t, "share responses", func() bool {
+		return s.PendingShares() == 0
+	})
+}
+
+func TestStratumConnect(t *testing.T) {
+	for _, dialect := range testDialects {
+		srv := newTestPool(t, stratumtest.Config{Dialect: dialect})
+		s := dialTestPool(t, srv, "worker")
+
+		if err := srv.WaitAuthorized(1, testTimeout); err != nil {
+			t.Fatalf("%q dialect: %v", dialect, err)
+		}
+		if !s.Connected() {
+			t.Errorf("%q dialect: connection is %v, want %v", dialect,
+				s.State(), StateAuthorized)
+		}
+
+		w := prepWork(t, s)
+		job := srv.CurrentJob()
+		if w.JobID != job.ID {
+			t.Errorf("%q dialect: work prepared for job %v, want %v",
+				dialect, w.JobID, job.ID)
+		}
+		if w.BlockHeader.PrevBlock != job.Header.PrevBlock ||
+			w.BlockHeader.Height != job.Header.Height {
+			t.Errorf("%q dialect: work header %v does not match job "+
+				"header %v", dialect, w.BlockHeader, job.Header)
+		}
+		if !w.Clean {
+			t.Errorf("%q dialect: work of first job is not clean",
+				dialect)
+		}
+	}
+}
+
+func TestStratumAuthFailure(t *testing.T) {
+	srv := newTestPool(t, stratumtest.Config{
+		Authorize: func(user, pass string) bool { return user == "worker" },
+	})
+	s, err := StratumConn(Config{
+		Pool:        srv.URL(),
+		User:        "intruder",
+		ChainParams: testParams,
+	})
+	if err != nil {
+		t.Fatalf("Unable to connect to pool: %v", err)
+	}
+	defer s.Close()
+
+	select {
+	case <-s.Done():
+	case <-time.After(testTimeout):
+		t.Fatal("Connection not failed after authorization failure")
+	}
+	if err := s.Err(); err != ErrStratumAuth {
+		t.Errorf("Connection failed with %v, want %v", err, ErrStratumAuth)
+	}
+	if s.Connected() {
+		t.Error("Connection still usable after authorization failure")
+	}
+}
+
+func TestStratumNotify(t *testing.T) {
+	for _, dialect := range testDialects {
+		srv := newTestPool(t, stratumtest.Config{Dialect: dialect})
+		s := dialTestPool(t, srv, "worker")
+		prepWork(t, s)
+
+		tests := []struct {
+			clean      bool
+			difficulty float64
+		}{
+			{false, 2},
+			{true, 2},
+			{false, 0.5},
+		}
+		for _, test := range tests {
+			srv.SetDifficulty(test.difficulty)
+			job, err := srv.NewJob(test.clean)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := waitNewWork(t, s, job.ID)
+			if w.Clean != test.clean {
+				t.Errorf("%q dialect: work of job %v clean %v, want "+
+					"%v", dialect, job.ID, w.Clean, test.clean)
+			}
+			if w.BlockHeader.Height != job.Header.Height {
+				t.Errorf("%q dialect: work of job %v for height %d, "+
+					"want %d", dialect, job.ID,
+					w.BlockHeader.Height, job.Header.Height)
+			}
+			if j, err := s.jobs.check(job.ID); err != nil {
+				t.Errorf("%q dialect: job %v: %v", dialect, job.ID, err)
+			} else if j.diff != test.difficulty {
+				t.Errorf("%q dialect: job %v difficulty %v, want %v",
+					dialect, job.ID, j.diff, test.difficulty)
+			}
+		}
+	}
+}
+
+func TestStratumSubmit(t *testing.T) {
+	for _, dialect := range testDialects {
+		srv := newTestPool(t, stratumtest.Config{Dialect: dialect})
+		s := dialTestPool(t, srv, "worker")
+		w := prepWork(t, s)
+		data := solve(t, w)
+
+		// The share is accepted the first time only.
+		for i, want := range []stratumtest.Result{
+			stratumtest.Accepted,
+			stratumtest.Duplicate,
+		} {
+			if err := submit(t, s, data, w.JobID); err != nil {
+				t.Fatalf("%q dialect: share not submitted: %v",
+					dialect, err)
+			}
+			shares, err := srv.WaitShares(i+1, testTimeout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			share := shares[i]
+			if share.Result != want {
+				t.Errorf("%q dialect: share %v (%v), want %v", dialect,
+					share.Result, share.Err, want)
+			}
+		}
+		waitResponses(t, s)
+		stats := s.cfg.Shares.Stats()
+		if stats.Accepted != 1 || stats.Rejected[RejectDuplicate] != 1 {
+			t.Errorf("%q dialect: %d shares accepted and %d rejected as "+
+				"duplicate, want 1 and 1", dialect, stats.Accepted,
+				stats.Rejected[RejectDuplicate])
+		}
+
+		// Shares for the jobs retired by a clean job are stale.
+		job, err := srv.NewJob(true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitNewWork(t, s, job.ID)
+		if err := submit(t, s, data, w.JobID); err != ErrStratumStaleWork {
+			t.Errorf("%q dialect: share for retired job submitted "+
+				"(error %v)", dialect, err)
+		}
+	}
+}
+
+func TestStratumSubmitLowDifficulty(t *testing.T) {
+	srv := newTestPool(t, stratumtest.Config{Difficulty: 1e30})
+	s := dialTestPool(t, srv, "worker")
+	w := prepWork(t, s)
+	if err := submit(t, s, solve(t, w), w.JobID); err != nil {
+		t.Fatalf("Share not submitted: %v", err)
+	}
+	shares, err := srv.WaitShares(1, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shares[0].Result != stratumtest.Rejected {
+		t.Errorf("Share %v, want %v", shares[0].Result,
+			stratumtest.Rejected)
+	}
+	waitResponses(t, s)
+	if n := s.cfg.Shares.Stats().Rejected[RejectLowDifficulty]; n != 1 {
+		t.Errorf("%d shares rejected for low difficulty, want 1", n)
+	}
+}
+
+func TestStratumSubmitInvalidSolution(t *testing.T) {
+	srv := newTestPool(t, stratumtest.Config{})
+	s := dialTestPool(t, srv, "worker")
+	w := prepWork(t, s)
+	data := solve(t, w)
+	data[len(data)-1] ^= 1
+	if err := submit(t, s, data, w.JobID); err != nil {
+		t.Fatalf("Share not submitted: %v", err)
+	}
+	shares, err := srv.WaitShares(1, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shares[0].Result != stratumtest.Rejected {
+		t.Errorf("Share %v, want %v", shares[0].Result,
+			stratumtest.Rejected)
+	}
+	waitResponses(t, s)
+	if n := s.cfg.Shares.Stats().Rejected[RejectUnknown]; n != 1 {
+		t.Errorf("%d shares rejected for an unknown reason, want 1", n)
+	}
+}
+
+func TestStratumReconnect(t *testing.T) {
+	srv := newTestPool(t, stratumtest.Config{})
+	moved := newTestPool(t, stratumtest.Config{})
+	s := dialTestPool(t, srv, "worker")
+
+	// The jobs of the pools are told apart by their ids.
+	if _, err := moved.NewJob(true); err != nil {
+		t.Fatal(err)
+	}
+	w := prepWork(t, s)
+	data := solve(t, w)
+
+	// Shares keep being submitted while the pool moves the miner, which
+	// writes through the connection being replaced.
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			s.Lock()
+			req, err := s.PrepSubmit(data, w.JobID, 0)
+			s.Unlock()
+			if err == nil {
+				s.Send(req)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	host, portStr, err := net.SplitHostPort(moved.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(portStr)
+	srv.Reconnect(host, port, 0)
+	if err := moved.WaitAuthorized(1, testTimeout); err != nil {
+		t.Fatalf("Miner did not move to the other pool: %v", err)
+	}
+	close(stop)
+	wg.Wait()
+
+	job := moved.CurrentJob()
+	w = waitNewWork(t, s, job.ID)
+	if addr := s.poolAddr(); addr != moved.Addr() {
+		t.Errorf("Connected to pool %v, want %v", addr, moved.Addr())
+	}
+	if err := submit(t, s, solve(t, w), w.JobID); err != nil {
+		t.Fatalf("Share not submitted: %v", err)
+	}
+	shares, err := moved.WaitShares(1, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shares[0].Result != stratumtest.Accepted {
+		t.Errorf("Share %v (%v), want %v", shares[0].Result,
+			shares[0].Err, stratumtest.Accepted)
+	}
+	waitResponses(t, s)
+	recent := s.cfg.Shares.Recent()
+	if last := recent[len(recent)-1]; last.Pool != moved.Addr() {
+		t.Errorf("Share recorded for pool %v, want %v", last.Pool,
+			moved.Addr())
+	}
+}
+
+func TestStratumReconnectWaitClosed(t *testing.T) {
+	srv := newTestPool(t, stratumtest.Config{})
+	s := dialTestPool(t, srv, "worker")
+
+	returned := make(chan struct{})
+	go func() {
+		s.handleReconnect(&codec.Reconnect{Wait: time.Hour})
+		close(returned)
+	}()
+	s.Close()
+	select {
+	case <-returned:
+	case <-time.After(testTimeout):
+		t.Fatal("Requested wait not cut short by closing the connection")
+	}
+}
+
+// watchdogTimeout is the read and response timeout of the connections watched
+// for silence in the tests.
+const watchdogTimeout = 300 * time.Millisecond
+
+func TestStratumSilentPool(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+
+		// share is set to submit a share once the pool went silent.
+		share bool
+	}{{
+		name: "read timeout",
+		cfg:  Config{ReadTimeout: watchdogTimeout},
+	}, {
+		name:  "response timeout",
+		cfg:   Config{ResponseTimeout: watchdogTimeout},
+		share: true,
+	}}
+
+	for _, test := range tests {
+		srv := newTestPool(t, stratumtest.Config{})
+		test.cfg.User = "worker"
+		s := dialTestPoolConfig(t, srv, test.cfg)
+		w := prepWork(t, s)
+
+		// The connection is half-open, which goes unnoticed until the
+		// deadline passes, and the connection made then is served.
+		srv.Freeze()
+		if test.share {
+			if err := submit(t, s, solve(t, w), w.JobID); err != nil {
+				t.Fatalf("%s: share not submitted: %v", test.name,
+					err)
+			}
+		}
+		if err := srv.WaitAuthorized(2, testTimeout); err != nil {
+			t.Fatalf("%s: no reconnection to the silent pool: %v",
+				test.name, err)
+		}
+		if n := atomic.LoadUint64(&s.Reconnects); n == 0 {
+			t.Errorf("%s: no reconnection counted", test.name)
+		}
+		select {
+		case <-s.Done():
+			t.Errorf("%s: connection failed: %v", test.name, s.Err())
+		default:
+		}
+		if test.share {
+			if n := s.PendingShares(); n != 0 {
+				t.Errorf("%s: %d shares still pending", test.name, n)
+			}
+		}
+	}
+}
+
+func TestStratumPoolStopsResponding(t *testing.T) {
+	srv := newTestPool(t, stratumtest.Config{})
+	s := dialTestPoolConfig(t, srv, Config{
+		User:        "worker",
+		ReadTimeout: watchdogTimeout,
+	})
+
+	// The pool accepts the new connection without serving it either, which
+	// exhausts the attempts to reconnect.
+	srv.StopResponding()
+	select {
+	case <-s.Done():
+	case <-time.After(testTimeout):
+		t.Fatal("Connection to the silent pool not given up")
+	}
+	if err := s.Err(); err == nil ||
+		!strings.Contains(err.Error(), "No message from pool") {
+		t.Errorf("Connection failed with %v, want the pool silent", err)
+	}
+	if n := atomic.LoadUint64(&s.Reconnects); n != 1 {
+		t.Errorf("%d reconnections counted, want 1", n)
+	}
+}
@@ -0,0 +1,955 @@
+// Copyright (c) 2018 The ExchangeCoin team
+
+// Package stratumtest provides a stratum pool running in the same process,
+// which issues jobs and validates the shares submitted for them, to exercise
+// the stratum client and the miner without a real pool.
+package stratumtest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/EXCCoin/exccd/blockchain"
+	"github.com/EXCCoin/exccd/chaincfg"
+	"github.com/EXCCoin/exccd/wire"
+
+	"github.com/EXCCoin/gominer/equihash"
+	"github.com/EXCCoin/gominer/util"
+)
+
+// Offsets of the fields of a serialized block header set by miners.
+const (
+	merkleRootOffset   = 36
+	stakeRootOffset    = 68
+	voteBitsOffset     = 100
+	bitsOffset         = 116
+	sBitsOffset        = 120
+	timestampOffset    = 136
+	nonceOffset        = 140
+	extraDataOffset    = 144
+	stakeVersionOffset = 176
+	solutionOffset     = 180
+
+	// coinbase1Offset and coinbase2Offset delimit the parts of the header
+	// sent as the first and second coinbase parts of mining.notify.
+	coinbase1Offset = 36
+	coinbase2Offset = 176
+)
+
+// Stratum error codes sent when rejecting a request.
+const (
+	ErrCodeOther          = 20
+	ErrCodeJobNotFound    = 21
+	ErrCodeDuplicateShare = 22
+	ErrCodeLowDifficulty  = 23
+	ErrCodeUnauthorized   = 24
+	ErrCodeNotSubscribed  = 25
+)
+
+const (
+	// extraNonce1Size is the size of the extranonce1 assigned to every
+	// connection.
+	extraNonce1Size = 4
+
+	// defaultExtraNonce2Size is the extranonce2 size announced to miners
+	// when none is configured, which together with the extranonce1 covers
+	// the part of the extra data sent back in mining.submit.
+	defaultExtraNonce2Size = 8
+
+	// maxJobs is the number of jobs shares are accepted for.
+	maxJobs = 16
+
+	// zip301NonceSize is the size of the nonce of the ZIP 301 dialect,
+	// which is the start of the extra data followed by the header nonce.
+	zip301NonceSize = 32
+)
+
+// DialectZIP301 is the name of the ZIP 301 dialect of the protocol.
+const DialectZIP301 = "zip301"
+
+// errClosed is returned when waiting on a closed server.
+var errClosed = errors.New("Server closed")
+
+// Result is the outcome of a submitted share.
+type Result int
+
+// Possible results of a submitted share.
+const (
+	Accepted Result = iota
+	Rejected
+	Stale
+	Duplicate
+)
+
+func (r Result) String() string {
+	switch r {
+	case Accepted:
+		return "accepted"
+	case Rejected:
+		return "rejected"
+	case Stale:
+		return "stale"
+	case Duplicate:
+		return "duplicate"
+	}
+	return fmt.Sprintf("Result(%d)", int(r))
+}
+
+// Share is a share submitted to the server along with its outcome.
+type Share struct {
+	Worker      string
+	JobID       string
+	ExtraNonce2 string
+	NTime       string
+	Nonce       string
+	Solution    string
+
+	// Difficulty is the difficulty the share was checked against.
+	Difficulty float64
+
+	Result Result
+
+	// Err holds the reason the share was not accepted.
+	Err error
+}
+
+// Job is a job issued by the server.
+type Job struct {
+	ID     string
+	Header wire.BlockHeader
+	Clean  bool
+
+	// header is the serialized header without solution.
+	header []byte
+}
+
+// notifyParams returns the parameters of the mining.notify for the job.  The
+// header is split as expected by the stratum client: the previous block hash,
+// the part up to the extra data as first coinbase part, and the part after it
+// as second coinbase part.  In the ZIP 301 dialect the fields of the header
+// are sent instead, with the stake root as reserved field and the fields
+// Zcash headers do not have as extension.
+func (j *Job) notifyParams(dialect string) []interface{} {
+	if dialect == DialectZIP301 {
+		ext := append(append(append([]byte(nil),
+			j.header[voteBitsOffset:bitsOffset]...),
+			j.header[sBitsOffset:timestampOffset]...),
+			j.header[stakeVersionOffset:solutionOffset]...)
+		return []interface{}{
+			j.ID,
+			hex.EncodeToString(j.header[:4]),
+			hex.EncodeToString(j.header[4:merkleRootOffset]),
+			hex.EncodeToString(j.header[merkleRootOffset:stakeRootOffset]),
+			hex.EncodeToString(j.header[stakeRootOffset:voteBitsOffset]),
+			hex.EncodeToString(j.header[timestampOffset:nonceOffset]),
+			hex.EncodeToString(j.header[bitsOffset:sBitsOffset]),
+			j.Clean,
+			hex.EncodeToString(ext),
+		}
+	}
+
+	version := util.Uint32EndiannessSwap(uint32(j.Header.Version))
+	return []interface{}{
+		j.ID,
+		hex.EncodeToString(j.header[4:coinbase1Offset]),
+		hex.EncodeToString(j.header[coinbase1Offset:extraDataOffset]),
+		hex.EncodeToString(j.header[coinbase2Offset:solutionOffset]),
+		[]string{},
+		fmt.Sprintf("%08x", version),
+		fmt.Sprintf("%08x", j.Header.Bits),
+		fmt.Sprintf("%08x", uint32(j.Header.Timestamp.Unix())),
+		j.Clean,
+	}
+}
+
+// Config holds the options of a server.
+type Config struct {
+	// ChainParams are the parameters of the network the jobs are for.
+	ChainParams *chaincfg.Params
+
+	// Listen is the address to listen on, a random port on the loopback
+	// interface by default.
+	Listen string
+
+	// TLS makes the server accept stratum+ssl:// connections when set.
+	TLS *tls.Config
+
+	// Difficulty is the initial share difficulty, 1 by default.
+	Difficulty float64
+
+	// ExtraNonce2Size is the extranonce2 size announced to miners.
+	ExtraNonce2Size int
+
+	// Dialect is the dialect of the protocol spoken by the server, the
+	// Decred one when empty or DialectZIP301.
+	Dialect string
+
+	// Authorize checks the worker credentials.  All workers are
+	// authorized when it is nil.
+	Authorize func(user, pass string) bool
+
+	// Verify checks the solution of a share against the Equihash input
+	// of its header, equihash.Verify with the parameters of the network
+	// when it is nil.  Tests not solving shares for real replace it.
+	Verify func(input, solution []byte) error
+}
+
+// Server is a stratum pool for tests.  It sends the current job and
+// difficulty to miners once they are authorized and validates their shares,
+// replying with the result.
+type Server struct {
+	cfg Config
+	ln  net.Listener
+
+	mtx             sync.Mutex
+	sessions        map[*session]struct{}
+	jobs            map[string]*Job
+	jobOrder        []string
+	nextJob         uint64
+	nextExtraNonce1 uint32
+	height          uint32
+	difficulty      float64
+	shares          []Share
+	authorized      int
+	closed          bool
+
+	// silent is set while the server stops responding, freezing the
+	// connections of miners as they connect.
+	silent bool
+
+	// changed is closed and replaced when shares are submitted or
+	// workers authorized, to wake up waiters.
+	changed chan struct{}
+
+	wg sync.WaitGroup
+}
+
+// NewServer starts a server and issues its first job.
+func NewServer(cfg Config) (*Server, error) {
+	if cfg.ChainParams == nil {
+		return nil, errors.New("No chain parameters")
+	}
+	if cfg.Listen == "" {
+		cfg.Listen = "127.0.0.1:0"
+	}
+	if cfg.Difficulty == 0 {
+		cfg.Difficulty = 1
+	}
+	if cfg.ExtraNonce2Size == 0 {
+		cfg.ExtraNonce2Size = defaultExtraNonce2Size
+	}
+	if cfg.Dialect == DialectZIP301 {
+		// The extranonce2 is the rest of the nonce before the
+		// header nonce.
+		cfg.ExtraNonce2Size = zip301NonceSize - extraNonce1Size - 4
+	}
+
+	ln, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.TLS != nil {
+		ln = tls.NewListener(ln, cfg.TLS)
+	}
+
+	s := &Server{
+		cfg:        cfg,
+		ln:         ln,
+		sessions:   make(map[*session]struct{}),
+		jobs:       make(map[string]*Job),
+		difficulty: cfg.Difficulty,
+		changed:    make(chan struct{}),
+	}
+	if _, err := s.NewJob(true); err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	s.wg.Add(1)
+	go s.accept()
+	return s, nil
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// URL returns the pool URL of the server, which selects the ZIP 301 dialect
+// when spoken by the server.
+func (s *Server) URL() string {
+	scheme := "stratum"
+	if s.cfg.Dialect == DialectZIP301 {
+		scheme = DialectZIP301
+	}
+	if s.cfg.TLS != nil {
+		return scheme + "+ssl://" + s.Addr()
+	}
+	return scheme + "+tcp://" + s.Addr()
+}
+
+// Close stops the server and drops all connections.
+func (s *Server) Close() error {
+	s.mtx.Lock()
+	if s.closed {
+		s.mtx.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.changed)
+	for ss := range s.sessions {
+		ss.conn.Close()
+	}
+	s.mtx.Unlock()
+
+	err := s.ln.Close()
+	s.wg.Wait()
+	return err
+}
+
+// DropConnections closes the connections of all miners, which may connect
+// again.
+func (s *Server) DropConnections() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for ss := range s.sessions {
+		ss.conn.Close()
+	}
+}
+
+// Freeze stops serving the connections of all miners without closing them,
+// ignoring their requests and sending them nothing, as when the connections
+// are half-open.  Miners which connect again are served as usual.
+func (s *Server) Freeze() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for ss := range s.sessions {
+		atomic.StoreUint32(&ss.frozen, 1)
+	}
+}
+
+// StopResponding freezes the connections of all miners, including those which
+// connect afterwards, as when the pool hangs while its host still accepts
+// connections.  Resume serves the miners which connect after it again.
+func (s *Server) StopResponding() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.silent = true
+	for ss := range s.sessions {
+		atomic.StoreUint32(&ss.frozen, 1)
+	}
+}
+
+// Resume serves the miners which connect once the server stopped responding.
+// The connections frozen until then stay frozen.
+func (s *Server) Resume() {
+	s.mtx.Lock()
+	s.silent = false
+	s.mtx.Unlock()
+}
+
+// NewJob issues a new job to all authorized miners.  A clean job builds on a
+// new block, which makes the shares of all previous jobs stale.
+func (s *Server) NewJob(clean bool) (*Job, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var header wire.BlockHeader
+	if clean || len(s.jobOrder) == 0 {
+		s.height++
+		if _, err := rand.Read(header.PrevBlock[:]); err != nil {
+			return nil, err
+		}
+	} else {
+		last := s.jobs[s.jobOrder[len(s.jobOrder)-1]]
+		header.PrevBlock = last.Header.PrevBlock
+	}
+	if _, err := rand.Read(header.MerkleRoot[:]); err != nil {
+		return nil, err
+	}
+	header.Version = 1
+	header.Bits = s.cfg.ChainParams.PowLimitBits
+	header.Height = s.height
+	header.Timestamp = time.Unix(time.Now().Unix(), 0)
+
+	serialized, err := header.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	if len(serialized) < solutionOffset {
+		return nil, fmt.Errorf("Header too short: %d bytes", len(serialized))
+	}
+
+	s.nextJob++
+	job := &Job{
+		ID:     strconv.FormatUint(s.nextJob, 16),
+		Header: header,
+		Clean:  clean,
+		header: serialized[:solutionOffset],
+	}
+
+	if clean {
+		s.jobs = make(map[string]*Job)
+		s.jobOrder = s.jobOrder[:0]
+	}
+	if len(s.jobOrder) == maxJobs {
+		delete(s.jobs, s.jobOrder[0])
+		s.jobOrder = s.jobOrder[1:]
+	}
+	s.jobs[job.ID] = job
+	s.jobOrder = append(s.jobOrder, job.ID)
+
+	for ss := range s.sessions {
+		if ss.isAuthorized() {
+			ss.notify(job, s.difficulty)
+		}
+	}
+	return job, nil
+}
+
+// CurrentJob returns the last issued job.
+func (s *Server) CurrentJob() *Job {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.jobs[s.jobOrder[len(s.jobOrder)-1]]
+}
+
+// SetDifficulty sends a new share difficulty to all authorized miners, which
+// applies to the jobs issued from now on.
+func (s *Server) SetDifficulty(diff float64) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.difficulty = diff
+	for ss := range s.sessions {
+		if ss.isAuthorized() {
+			ss.sendDifficulty(diff)
+		}
+	}
+}
+
+// RotateExtraNonce assigns a new extranonce1 to the miners which subscribed to
+// extranonce changes, making the shares for their previous one stale.  It
+// returns the number of miners notified.
+func (s *Server) RotateExtraNonce() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	n := 0
+	for ss := range s.sessions {
+		if !ss.xnSubscribed {
+			continue
+		}
+		ss.extraNonce1 = s.newExtraNonce1()
+		ss.send(nil, "mining.set_extranonce", []interface{}{
+			hex.EncodeToString(ss.extraNonce1),
+			s.cfg.ExtraNonce2Size,
+		})
+		n++
+	}
+	return n
+}
+
+// Reconnect asks all miners to connect to host and port after wait.
+func (s *Server) Reconnect(host string, port int, wait time.Duration) {
+	s.broadcast("client.reconnect", []interface{}{host, port,
+		int(wait / time.Second)})
+}
+
+// ShowMessage sends a message to be displayed to all miners.
+func (s *Server) ShowMessage(msg string) {
+	s.broadcast("client.show_message", []interface{}{msg})
+}
+
+// broadcast sends a notification to all miners.
+func (s *Server) broadcast(method string, params []interface{}) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for ss := range s.sessions {
+		ss.send(nil, method, params)
+	}
+}
+
+// Shares returns the shares submitted so far.
+func (s *Server) Shares() []Share {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return append([]Share(nil), s.shares...)
+}
+
+// WaitShares waits until n shares were submitted and returns them.
+func (s *Server) WaitShares(n int, timeout time.Duration) ([]Share, error) {
+	err := s.wait(timeout, func() bool { return len(s.shares) >= n })
+	return s.Shares(), err
+}
+
+// WaitAuthorized waits until n workers were authorized since the server
+// started, counting reconnections.
+func (s *Server) WaitAuthorized(n int, timeout time.Duration) error {
+	return s.wait(timeout, func() bool { return s.authorized >= n })
+}
+
+// wait waits until cond, which is called with the mutex held, is true.
+func (s *Server) wait(timeout time.Duration, cond func() bool) error {
+	deadline := time.After(timeout)
+	for {
+		s.mtx.Lock()
+		ok, closed, changed := cond(), s.closed, s.changed
+		s.mtx.Unlock()
+		if ok {
+			return nil
+		}
+		if closed {
+			return errClosed
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return fmt.Errorf("Timed out after %v", timeout)
+		}
+	}
+}
+
+// signal wakes up waiters.  It must be called with the mutex held.
+func (s *Server) signal() {
+	if !s.closed {
+		close(s.changed)
+		s.changed = make(chan struct{})
+	}
+}
+
+// accept serves the incoming connections until the listener is closed.
+func (s *Server) accept() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mtx.Lock()
+		if s.closed {
+			s.mtx.Unlock()
+			conn.Close()
+			return
+		}
+		ss := &session{
+			server:      s,
+			conn:        conn,
+			extraNonce1: s.newExtraNonce1(),
+			diffs:       make(map[string]float64),
+			submitted:   make(map[string]struct{}),
+		}
+		if s.silent {
+			ss.frozen = 1
+		}
+		s.sessions[ss] = struct{}{}
+		s.mtx.Unlock()
+
+		s.wg.Add(1)
+		go ss.serve()
+	}
+}
+
+// newExtraNonce1 returns an unused extranonce1.  It must be called with the
+// mutex held.
+func (s *Server) newExtraNonce1() []byte {
+	s.nextExtraNonce1++
+	extraNonce1 := make([]byte, extraNonce1Size)
+	binary.BigEndian.PutUint32(extraNonce1, s.nextExtraNonce1)
+	return extraNonce1
+}
+
+// request models a request from a miner.
+type request struct {
+	ID     interface{}       `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+// stratumError models the error of a reply.
+type stratumError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *stratumError) Error() string {
+	return e.Message
+}
+
+// session is the connection of a miner.
+type session struct {
+	server *Server
+	conn   net.Conn
+
+	// writeMtx serializes the writes to the connection.
+	writeMtx sync.Mutex
+
+	// frozen is set once the connection is frozen, which must only be
+	// used atomically.
+	frozen uint32
+
+	// The following fields are protected by the server mutex.
+	extraNonce1  []byte
+	subscribed   bool
+	xnSubscribed bool
+	worker       string
+	diffs        map[string]float64
+	submitted    map[string]struct{}
+}
+
+// isAuthorized returns whether a worker was authorized on the connection.  It
+// must be called with the server mutex held.
+func (ss *session) isAuthorized() bool {
+	return ss.worker != ""
+}
+
+// write sends a message to the miner, unless the connection is frozen.
+func (ss *session) write(msg interface{}) {
+	if atomic.LoadUint32(&ss.frozen) == 1 {
+		return
+	}
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	ss.writeMtx.Lock()
+	defer ss.writeMtx.Unlock()
+	ss.conn.Write(append(b, '\n'))
+}
+
+// send sends a notification, or a request when id is set, to the miner.
+func (ss *session) send(id interface{}, method string, params []interface{}) {
+	ss.write(map[string]interface{}{
+		"id":     id,
+		"method": method,
+		"params": params,
+	})
+}
+
+// reply replies to request id with result, or the error when err is set.
+func (ss *session) reply(id, result interface{}, err *stratumError) {
+	ss.write(map[string]interface{}{
+		"id":     id,
+		"result": result,
+		"error":  err,
+	})
+}
+
+// notify sends job to the miner, recording the difficulty its shares are
+// checked against.  It must be called with the server mutex held.
+func (ss *session) notify(job *Job, diff float64) {
+	if job.Clean {
+		ss.diffs = make(map[string]float64)
+		ss.submitted = make(map[string]struct{})
+	}
+	ss.diffs[job.ID] = diff
+	ss.send(nil, "mining.notify", job.notifyParams(ss.server.cfg.Dialect))
+}
+
+// sendDifficulty sends the share difficulty to the miner, as a target in the
+// ZIP 301 dialect.
+func (ss *session) sendDifficulty(diff float64) {
+	s := ss.server
+	if s.cfg.Dialect != DialectZIP301 {
+		ss.send(nil, "mining.set_difficulty", []interface{}{diff})
+		return
+	}
+	target, err := util.DiffToTarget(diff, s.cfg.ChainParams.PowLimit)
+	if err != nil {
+		return
+	}
+	ss.send(nil, "mining.set_target", []interface{}{
+		fmt.Sprintf("%064x", target)})
+}
+
+// serve handles the requests of the miner until the connection is closed.
+func (ss *session) serve() {
+	s := ss.server
+	defer s.wg.Done()
+	defer func() {
+		s.mtx.Lock()
+		delete(s.sessions, ss)
+		s.mtx.Unlock()
+		ss.conn.Close()
+	}()
+
+	reader := bufio.NewReader(ss.conn)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		if atomic.LoadUint32(&ss.frozen) == 1 {
+			continue
+		}
+
+		var req request
+		if err := json.Unmarshal(line, &req); err != nil {
+			ss.reply(nil, nil, &stratumError{ErrCodeOther,
+				"Invalid request: " + err.Error()})
+			continue
+		}
+
+		switch req.Method {
+		case "mining.subscribe":
+			ss.handleSubscribe(&req)
+		case "mining.authorize":
+			ss.handleAuthorize(&req)
+		case "mining.extranonce.subscribe":
+			s.mtx.Lock()
+			ss.xnSubscribed = true
+			s.mtx.Unlock()
+			ss.reply(req.ID, true, nil)
+		case "mining.submit":
+			ss.handleSubmit(&req)
+		case "":
+			// Replies to requests such as client.get_version.
+		default:
+			ss.reply(req.ID, nil, &stratumError{ErrCodeOther,
+				"Unsupported method " + req.Method})
+		}
+	}
+}
+
+// stringParams decodes the first n params of req as strings.
+func stringParams(req *request, n int) ([]string, error) {
+	if len(req.Params) < n {
+		return nil, fmt.Errorf("%s expects %d params, got %d",
+			req.Method, n, len(req.Params))
+	}
+	params := make([]string, n)
+	for i := range params {
+		if err := json.Unmarshal(req.Params[i], &params[i]); err != nil {
+			return nil, fmt.Errorf("Invalid param %d: %v", i, err)
+		}
+	}
+	return params, nil
+}
+
+func (ss *session) handleSubscribe(req *request) {
+	s := ss.server
+	s.mtx.Lock()
+	ss.subscribed = true
+	extraNonce1 := hex.EncodeToString(ss.extraNonce1)
+	s.mtx.Unlock()
+
+	if s.cfg.Dialect == DialectZIP301 {
+		ss.reply(req.ID, []interface{}{nil, extraNonce1}, nil)
+		return
+	}
+	ss.reply(req.ID, []interface{}{
+		[][]string{
+			{"mining.set_difficulty", extraNonce1},
+			{"mining.notify", extraNonce1},
+		},
+		extraNonce1,
+		s.cfg.ExtraNonce2Size,
+	}, nil)
+}
+
+func (ss *session) handleAuthorize(req *request) {
+	s := ss.server
+	params, err := stringParams(req, 2)
+	if err != nil {
+		ss.reply(req.ID, false, &stratumError{ErrCodeOther, err.Error()})
+		return
+	}
+	user, pass := params[0], params[1]
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if !ss.subscribed {
+		ss.reply(req.ID, false, &stratumError{ErrCodeNotSubscribed,
+			"Not subscribed"})
+		return
+	}
+	if s.cfg.Authorize != nil && !s.cfg.Authorize(user, pass) {
+		ss.reply(req.ID, false, &stratumError{ErrCodeUnauthorized,
+			"Unauthorized worker"})
+		return
+	}
+
+	ss.worker = user
+	s.authorized++
+	s.signal()
+
+	ss.reply(req.ID, true, nil)
+	ss.sendDifficulty(s.difficulty)
+	job := *s.jobs[s.jobOrder[len(s.jobOrder)-1]]
+	job.Clean = true
+	ss.notify(&job, s.difficulty)
+}
+
+func (ss *session) handleSubmit(req *request) {
+	s := ss.server
+	var share Share
+	var err error
+	if s.cfg.Dialect == DialectZIP301 {
+		share, err = zip301Share(req)
+	} else {
+		var params []string
+		params, err = stringParams(req, 6)
+		if err == nil {
+			share = Share{
+				Worker:      params[0],
+				JobID:       params[1],
+				ExtraNonce2: params[2],
+				NTime:       params[3],
+				Nonce:       params[4],
+				Solution:    params[5],
+			}
+		}
+	}
+	if err != nil {
+		ss.reply(req.ID, false, &stratumError{ErrCodeOther, err.Error()})
+		return
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	serr := ss.checkShare(&share)
+	if serr != nil {
+		share.Err = serr
+		ss.reply(req.ID, false, serr)
+	} else {
+		ss.reply(req.ID, true, nil)
+	}
+	s.shares = append(s.shares, share)
+	s.signal()
+}
+
+// zip301Share decodes a share submitted in the ZIP 301 dialect, which has
+// the time as serialized in the header and the second part of the nonce.  The
+// share is returned as submitted in the Decred dialect, with the extranonce
+// lacking the extranonce1 which is added when checking it.
+func zip301Share(req *request) (Share, error) {
+	params, err := stringParams(req, 5)
+	if err != nil {
+		return Share{}, err
+	}
+	ntime, err := hex.DecodeString(params[2])
+	if err != nil || len(ntime) != 4 {
+		return Share{}, errors.New("Invalid time")
+	}
+	nonce2, err := hex.DecodeString(params[3])
+	if err != nil || len(nonce2) < 4 {
+		return Share{}, errors.New("Invalid nonce")
+	}
+	split := len(nonce2) - 4
+	return Share{
+		Worker:      params[0],
+		JobID:       params[1],
+		ExtraNonce2: hex.EncodeToString(nonce2[:split]),
+		NTime:       fmt.Sprintf("%08x", binary.LittleEndian.Uint32(ntime)),
+		Nonce:       hex.EncodeToString(nonce2[split:]),
+		Solution:    params[4],
+	}, nil
+}
+
+// checkShare validates a share against its job, setting its result.  It must
+// be called with the server mutex held.
+func (ss *session) checkShare(share *Share) *stratumError {
+	s := ss.server
+	share.Result = Rejected
+
+	if !ss.isAuthorized() || share.Worker != ss.worker {
+		return &stratumError{ErrCodeUnauthorized, "Unauthorized worker"}
+	}
+
+	job, ok := s.jobs[share.JobID]
+	diff, sent := ss.diffs[share.JobID]
+	if !ok || !sent {
+		share.Result = Stale
+		return &stratumError{ErrCodeJobNotFound, "Job not found"}
+	}
+	share.Difficulty = diff
+
+	// The extra data sent back is the extranonce1 followed by the
+	// extranonce2 rolled by the miner.  Shares for a previous extranonce1
+	// are stale.
+	extraNonceHex := share.ExtraNonce2
+	if s.cfg.Dialect == DialectZIP301 {
+		extraNonceHex = hex.EncodeToString(ss.extraNonce1) + extraNonceHex
+	}
+	extraNonce, err := hex.DecodeString(extraNonceHex)
+	if err != nil || len(extraNonce) != len(ss.extraNonce1)+s.cfg.ExtraNonce2Size {
+		return &stratumError{ErrCodeOther, "Invalid extranonce"}
+	}
+	if !bytes.HasPrefix(extraNonce, ss.extraNonce1) {
+		share.Result = Stale
+		return &stratumError{ErrCodeJobNotFound, "Stale extranonce"}
+	}
+	ntime, err := strconv.ParseUint(share.NTime, 16, 32)
+	if err != nil || len(share.NTime) != 8 {
+		return &stratumError{ErrCodeOther, "Invalid ntime"}
+	}
+	if ntime < uint64(job.Header.Timestamp.Unix()) {
+		return &stratumError{ErrCodeOther, "Ntime out of range"}
+	}
+	nonce, err := hex.DecodeString(share.Nonce)
+	if err != nil || len(nonce) != 4 {
+		return &stratumError{ErrCodeOther, "Invalid nonce"}
+	}
+	solution, err := hex.DecodeString(share.Solution)
+	if err != nil {
+		return &stratumError{ErrCodeOther, "Invalid solution"}
+	}
+
+	header := make([]byte, solutionOffset, solutionOffset+len(solution))
+	copy(header, job.header)
+	binary.LittleEndian.PutUint32(header[timestampOffset:], uint32(ntime))
+	copy(header[nonceOffset:], nonce)
+	copy(header[extraDataOffset:], extraNonce)
+	header = append(header, solution...)
+
+	key := share.JobID + ":" + hex.EncodeToString(header[timestampOffset:])
+	if _, ok := ss.submitted[key]; ok {
+		share.Result = Duplicate
+		return &stratumError{ErrCodeDuplicateShare, "Duplicate share"}
+	}
+	ss.submitted[key] = struct{}{}
+
+	var bh wire.BlockHeader
+	if err := bh.FromBytes(header); err != nil {
+		return &stratumError{ErrCodeOther, "Invalid header: " + err.Error()}
+	}
+	params := s.cfg.ChainParams
+	input, err := bh.SerializeEquihashHeaderBytes(params.Algorithm(bh.Height))
+	if err != nil {
+		return &stratumError{ErrCodeOther, err.Error()}
+	}
+	verify := s.cfg.Verify
+	if verify == nil {
+		verify = func(input, solution []byte) error {
+			return equihash.Verify(params.N, params.K, input, solution)
+		}
+	}
+	if err := verify(input, solution); err != nil {
+		return &stratumError{ErrCodeOther, "Invalid solution: " + err.Error()}
+	}
+
+	target, err := util.DiffToTarget(diff, params.PowLimit)
+	if err != nil {
+		return &stratumError{ErrCodeOther, err.Error()}
+	}
+	hash := bh.BlockHash()
+	if blockchain.HashToBig(&hash).Cmp(target) > 0 {
+		return &stratumError{ErrCodeLowDifficulty, "Low difficulty share"}
+	}
+
+	share.Result = Accepted
+	return nil
+}
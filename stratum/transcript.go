@@ -0,0 +1,168 @@
+// Copyright (c) 2018 The ExchangeCoin team
+
+package stratum
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/EXCCoin/gominer/stratum/codec"
+)
+
+// EntryKind is the kind of an entry of a transcript.
+type EntryKind string
+
+// Kinds of the entries of a transcript.  Besides the lines exchanged with the
+// pool, a transcript records the events of the client the lines depend on, so
+// that replaying it drives the client the same way.
+const (
+	// EntryConnect records a new connection to the pool, along with the
+	// dialect, user and version the client subscribes and authorizes with.
+	EntryConnect EntryKind = "connect"
+
+	// EntryDisconnect records the loss of the connection to the pool,
+	// with the error as line.
+	EntryDisconnect EntryKind = "disconnect"
+
+	// EntryIn and EntryOut record the lines received from and sent to
+	// the pool, without the trailing newline.
+	EntryIn  EntryKind = "in"
+	EntryOut EntryKind = "out"
+
+	// EntryWork records the preparation of work for the devices from the
+	// job JobID.
+	EntryWork EntryKind = "work"
+
+	// EntryShare records a solution found by a device, with the solved
+	// Header, about to be submitted for job JobID.
+	EntryShare EntryKind = "share"
+)
+
+// redactedPass replaces the password of the worker in the recorded
+// mining.authorize requests, so that transcripts may be shared.
+const redactedPass = "x"
+
+// TranscriptEntry is an entry of a transcript, stored as a JSON object per
+// line.
+type TranscriptEntry struct {
+	Time time.Time `json:"time"`
+	Pool string    `json:"pool"`
+	Kind EntryKind `json:"kind"`
+	Line string    `json:"line,omitempty"`
+
+	// Dialect, User and Version are set for EntryConnect.
+	Dialect string `json:"dialect,omitempty"`
+	User    string `json:"user,omitempty"`
+	Version string `json:"version,omitempty"`
+
+	// JobID is set for EntryWork and EntryShare, along with the Header
+	// serialized in hex and the Device for EntryShare.
+	JobID  string `json:"jobID,omitempty"`
+	Header string `json:"header,omitempty"`
+	Device int    `json:"device,omitempty"`
+}
+
+// Transcript records the sessions with pools, one entry per line.  It is safe
+// for concurrent use, so that the connections to all pools may share it.
+type Transcript struct {
+	mtx    sync.Mutex
+	w      io.Writer
+	closer io.Closer
+	err    error
+}
+
+// NewTranscript returns a transcript recording to w.
+func NewTranscript(w io.Writer) *Transcript {
+	return &Transcript{w: w}
+}
+
+// CreateTranscript returns a transcript recording to the file at path, which
+// is appended to when it exists.
+func CreateTranscript(path string) (*Transcript, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Transcript{w: f, closer: f}, nil
+}
+
+// Record appends an entry to the transcript, timestamped now unless its time
+// is set.  Recording stops after the first write error, which is logged.
+func (t *Transcript) Record(e TranscriptEntry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b, err := json.Marshal(&e)
+	if err != nil {
+		log.Errorf("Unable to encode transcript entry: %v", err)
+		return
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.err != nil {
+		return
+	}
+	if _, err := t.w.Write(append(b, '\n')); err != nil {
+		t.err = err
+		log.Errorf("Unable to record transcript, recording stopped: %v",
+			err)
+	}
+}
+
+// Close closes the file the transcript is recorded to, if any.
+func (t *Transcript) Close() error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.err == nil {
+		t.err = ErrStratumClosed
+	}
+	if t.closer == nil {
+		return nil
+	}
+	return t.closer.Close()
+}
+
+// ReadTranscript reads the entries of a transcript.
+func ReadTranscript(r io.Reader) ([]TranscriptEntry, error) {
+	var entries []TranscriptEntry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e TranscriptEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("Invalid transcript entry on line "+
+				"%d: %v", n, err)
+		}
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// transcriptLine returns the line recorded for msg as encoded in b, with the
+// password of mining.authorize requests redacted.
+func transcriptLine(msg interface{}, b []byte) string {
+	req, ok := msg.(*codec.Request)
+	if !ok || req.Method != codec.MethodAuthorize || len(req.Params) < 2 {
+		return string(b)
+	}
+	redacted := *req
+	redacted.Params = append([]interface{}(nil), req.Params...)
+	redacted.Params[1] = redactedPass
+	rb, err := json.Marshal(&redacted)
+	if err != nil {
+		return string(b)
+	}
+	return string(rb)
+}
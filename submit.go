@@ -0,0 +1,168 @@
+// Copyright (c) 2018 The ExchangeCoin team
+
+package main
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/EXCCoin/gominer/stratum"
+	"github.com/EXCCoin/gominer/work"
+)
+
+const (
+	// submitQueueLen is the number of solutions found by the devices which
+	// may wait for submission.  Devices drop solutions rather than wait
+	// while the queue is full.
+	submitQueueLen = 64
+
+	// submitWorkers is the number of solutions submitted concurrently, so
+	// that a slow submission does not hold back the others.
+	submitWorkers = 4
+
+	// maxSubmitAttempts is the number of attempts to submit a solution
+	// to the daemon when it fails with a network error, with
+	// submitRetryDelay between them.
+	maxSubmitAttempts = 3
+	submitRetryDelay  = 2 * time.Second
+)
+
+// isTransientError returns whether a submission failed because of the network
+// rather than being refused, so that it may succeed when tried again.
+func isTransientError(err error) bool {
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// workSubmitThread submits the solutions found by the devices until they
+// stopped and no solution is left.  Several of them run so that the
+// submissions are done concurrently.
+func (m *Miner) workSubmitThread() {
+	defer m.submitWg.Done()
+
+	for workResult := range m.workDone {
+		m.submitWork(workResult)
+	}
+}
+
+// submitWork submits a solution, trying again after network errors when it is
+// submitted to the daemon.  Every attempt checks the solution for being stale
+// first, so that it is dropped once the daemon moved on.  Shares are not
+// submitted to the pool again: a failed write closes the connection, whose
+// jobs are gone once reconnected.  Solutions are dropped once abandoned on
+// shutdown.
+func (m *Miner) submitWork(workResult WorkResult) {
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-m.abort:
+			return
+		default:
+		}
+
+		err := m.trySubmitWork(workResult)
+		if err == nil {
+			return
+		}
+		if m.pools != nil || !isTransientError(err) ||
+			attempt == maxSubmitAttempts {
+			atomic.AddUint64(&m.invalidShares, 1)
+			minrLog.Errorf("Error submitting work from DEV #%d: %v",
+				workResult.device, err)
+			return
+		}
+
+		minrLog.Warnf("Unable to submit work from DEV #%d, retrying in "+
+			"%v (attempt %d): %v", workResult.device, submitRetryDelay,
+			attempt, err)
+		select {
+		case <-time.After(submitRetryDelay):
+		case <-m.abort:
+			return
+		}
+	}
+}
+
+// trySubmitWork submits a solution to the block template daemon, the getwork
+// daemon or the pool, and accounts for the outcome.  It returns an error only
+// if the solution could not be submitted.
+func (m *Miner) trySubmitWork(workResult WorkResult) error {
+	switch {
+	case m.templates != nil:
+		accepted, err := m.SubmitBlock(workResult.data, workResult.jobID)
+		if err != nil {
+			return err
+		}
+		if accepted {
+			atomic.AddUint64(&m.validShares, 1)
+		} else {
+			atomic.AddUint64(&m.staleShares, 1)
+			minrLog.Debugf("Block solution for an outdated template")
+		}
+
+	// Only use that is we are not using a pool.
+	case m.pools == nil:
+		accepted, err := GetWorkSubmit(workResult.data)
+		if err != nil {
+			return err
+		}
+		if accepted {
+			atomic.AddUint64(&m.validShares, 1)
+			minrLog.Debugf("Submitted work successfully: %v", accepted)
+		} else {
+			atomic.AddUint64(&m.invalidShares, 1)
+		}
+		m.refreshWork()
+
+	default:
+		submitted, err := GetPoolWorkSubmit(workResult.data, m.pools.Pool(),
+			workResult.jobID, workResult.device)
+		if err == stratum.ErrStratumStaleWork {
+			atomic.AddUint64(&m.staleShares, 1)
+			minrLog.Debugf("Share submitted to pool was stale")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if submitted {
+			minrLog.Debugf("Submitted work to pool successfully: %v", submitted)
+		}
+		m.refreshWork()
+	}
+	return nil
+}
+
+// submitServerWork submits the header of a share found by a worker of the
+// stratum server, which meets the target of the work of job jobID, to the pool
+// or the getwork daemon.  The pool responds to the share asynchronously, while
+// the daemon must accept the block.
+func (m *Miner) submitServerWork(header []byte, jobID string) error {
+	data := make([]byte, work.GetworkDataLen)
+	copy(data, header)
+
+	if m.pools != nil {
+		_, err := GetPoolWorkSubmit(data, m.pools.Pool(), jobID,
+			stratum.ServerDevice)
+		return err
+	}
+
+	accepted, err := GetWorkSubmit(data)
+	if err != nil {
+		return err
+	}
+	m.refreshWork()
+	if !accepted {
+		return errors.New("Block rejected")
+	}
+	return nil
+}
+
+// refreshWork asks for the work to be refreshed, unless it already was.
+func (m *Miner) refreshWork() {
+	select {
+	case m.needsWorkRefresh <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2018 The ExchangeCoin team
+
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/EXCCoin/exccd/chaincfg"
+
+	"github.com/EXCCoin/gominer/internal/testsolution"
+	"github.com/EXCCoin/gominer/stratum"
+	"github.com/EXCCoin/gominer/stratum/stratumtest"
+	"github.com/EXCCoin/gominer/work"
+)
+
+// newTestPools starts a pool checking test solutions and connects to it,
+// which are stopped once the test finished.
+func newTestPools(t *testing.T) (*stratumtest.Server, *stratum.Failover) {
+	t.Helper()
+	srv, err := stratumtest.NewServer(stratumtest.Config{
+		ChainParams: &chaincfg.SimNetParams,
+		// Any hash meets the target of the difficulty.
+		Difficulty: 1e-12,
+		Verify:     testsolution.Verify,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	f, err := stratum.NewFailover(stratum.FailoverConfig{
+		Pools: []stratum.PoolConfig{{
+			URL:  srv.URL(),
+			User: "worker",
+			Pass: "x",
+		}},
+		ChainParams:   &chaincfg.SimNetParams,
+		MaxReconnects: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(f.Stop)
+	return srv, f
+}
+
+// poolWork returns the work for the current job of pool.
+func poolWork(t *testing.T, pool *stratum.Stratum) work.Work {
+	t.Helper()
+	pool.Lock()
+	defer pool.Unlock()
+	pool.PoolWork.NewWork = true
+	w, err := GetPoolWork(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *w
+}
+
+func TestSubmitWorkPoolClosed(t *testing.T) {
+	srv, f := newTestPools(t)
+	pool := f.Pool()
+	w := poolWork(t, pool)
+	data := solveWork(t, &w)
+
+	// The pool closes the connection before the share is written, which
+	// fails on the connection closed in turn.
+	srv.Close()
+	select {
+	case <-pool.Done():
+	case <-time.After(controlTimeout):
+		t.Fatal("Connection to the closed pool not lost")
+	}
+
+	miner := &Miner{
+		pools:            f,
+		needsWorkRefresh: make(chan struct{}, 1),
+		abort:            make(chan struct{}),
+	}
+	start := time.Now()
+	miner.submitWork(WorkResult{data: data, jobID: w.JobID})
+	if d := time.Since(start); d >= submitRetryDelay {
+		t.Errorf("Share submitted to the closed pool for %v", d)
+	}
+	if n := atomic.LoadUint64(&miner.invalidShares); n != 1 {
+		t.Errorf("Miner counted %d invalid shares, want 1", n)
+	}
+	if n := pool.PendingShares(); n != 0 {
+		t.Errorf("Pool has %d shares pending", n)
+	}
+	if shares := srv.Shares(); len(shares) != 0 {
+		t.Errorf("Closed pool got shares %+v", shares)
+	}
+}
+
+func TestSubmitServerWorkPool(t *testing.T) {
+	srv, f := newTestPools(t)
+	w := poolWork(t, f.Pool())
+	miner := &Miner{
+		pools:            f,
+		needsWorkRefresh: make(chan struct{}, 1),
+		abort:            make(chan struct{}),
+	}
+
+	// The stratum server submits the serialized header of the share,
+	// without the padding of the getwork data.
+	solveWork(t, &w)
+	header, err := w.BlockHeader.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := miner.submitServerWork(header, w.JobID); err != nil {
+		t.Fatalf("Share not submitted: %v", err)
+	}
+	shares, err := srv.WaitShares(1, controlTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shares[0].JobID != w.JobID || shares[0].Result != stratumtest.Accepted {
+		t.Errorf("Pool got share for job %v (%v), want job %v accepted",
+			shares[0].JobID, shares[0].Result, w.JobID)
+	}
+}
@@ -56,35 +56,68 @@ func RevHash(hash string) string {
 	return revHash
 }
 
-// DiffToTarget converts a whole number difficulty into a target.
+// maxTarget is the largest target, which any 256-bit hash meets.
+var maxTarget = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256),
+	big.NewInt(1))
+
+// DiffToTarget converts a difficulty into a target by dividing the proof of
+// work limit by it.  Fractional difficulties are converted exactly, with those
+// under 1 giving targets above the limit, up to the largest 256-bit target.
 func DiffToTarget(diff float64, powLimit *big.Int) (*big.Int, error) {
-	if diff <= 0 {
+	if diff <= 0 || math.IsNaN(diff) || math.IsInf(diff, 0) {
 		return nil, fmt.Errorf("invalid pool difficulty %v (0 or less than "+
 			"zero passed)", diff)
 	}
 
-	// Round down in the case of a non-integer diff since we only support
-	// ints (unless diff < 1 since we don't allow 0)..
-	if diff < 1 {
-		diff = 1
-	} else {
-		diff = math.Floor(diff)
+	// The quotient is precise enough for the integer part of it to be
+	// exact for targets of up to 256 bits.
+	quo := new(big.Float).SetPrec(512).SetInt(powLimit)
+	quo.Quo(quo, big.NewFloat(diff))
+	target, _ := quo.Int(nil)
+	if target.Cmp(maxTarget) > 0 {
+		target.Set(maxTarget)
 	}
-	divisor := new(big.Int).SetInt64(int64(diff))
-	max := powLimit
-	target := new(big.Int)
-	target.Div(max, divisor)
 
 	return target, nil
 }
 
-// RolloverExtraNonce rolls over the extraNonce if it goes over 0x00FFFFFF many
-// hashes, since the first byte is reserved for the ID.
-func RolloverExtraNonce(v *uint32) {
-	if *v&0x00FFFFFF == 0x00FFFFFF {
-		*v = *v & 0xFF000000
-	} else {
-		*v++
+// TargetToDiff converts a target into the difficulty it corresponds to, which
+// is the proof of work limit divided by it.  It returns zero for targets of
+// zero or less.
+func TargetToDiff(target, powLimit *big.Int) float64 {
+	if target.Sign() <= 0 {
+		return 0
+	}
+	quo := new(big.Float).SetInt(powLimit)
+	quo.Quo(quo, new(big.Float).SetInt(target))
+	diff, _ := quo.Float64()
+	return diff
+}
+
+// ExtraNonce2Range returns the number of values of an extranonce2 of size
+// bytes in each of the partitions equal ranges its space is split in, so that
+// every device rolls its own range.  Only up to 8 bytes are rolled.  It
+// returns zero when there are fewer values than partitions.
+func ExtraNonce2Range(size, partitions int) uint64 {
+	if partitions < 1 {
+		partitions = 1
+	}
+	if size >= 8 {
+		return math.MaxUint64 / uint64(partitions)
+	}
+	return (uint64(1) << uint(8*size)) / uint64(partitions)
+}
+
+// PutExtraNonce2 writes the nth value of the range of partition to the
+// extranonce2 b, in little endian.  The ranges hold rangeSize values as
+// returned by ExtraNonce2Range, with n wrapping around within the range.
+func PutExtraNonce2(b []byte, partition int, rangeSize, n uint64) {
+	if rangeSize == 0 {
+		rangeSize = 1
+	}
+	v := uint64(partition)*rangeSize + n%rangeSize
+	for i := 0; i < len(b) && i < 8; i++ {
+		b[i] = byte(v >> uint(8*i))
 	}
 }
 
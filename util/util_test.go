@@ -0,0 +1,77 @@
+// Copyright (c) 2018 The ExchangeCoin team
+
+package util
+
+import (
+	"math"
+	"math/big"
+	"testing"
+)
+
+func TestDiffToTarget(t *testing.T) {
+	// powLimit is an odd proof of work limit, so that divisions by it are
+	// not exact.
+	powLimit := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 224),
+		big.NewInt(1))
+	pow2 := func(n uint) *big.Int {
+		return new(big.Int).Lsh(big.NewInt(1), n)
+	}
+	quo := func(n, d *big.Int) *big.Int {
+		return new(big.Int).Quo(n, d)
+	}
+
+	tests := []struct {
+		diff   float64
+		target *big.Int
+	}{
+		{1, powLimit},
+		{2, quo(powLimit, big.NewInt(2))},
+		{3, quo(powLimit, big.NewInt(3))},
+		{1 << 40, quo(powLimit, pow2(40))},
+		{1.5, quo(new(big.Int).Lsh(powLimit, 1), big.NewInt(3))},
+		{0.75, quo(new(big.Int).Lsh(powLimit, 2), big.NewInt(3))},
+		{0.5, new(big.Int).Lsh(powLimit, 1)},
+		{1.0 / (1 << 32), new(big.Int).Lsh(powLimit, 32)},
+
+		// Difficulties so low that the target does not fit in 256 bits
+		// give the largest target.
+		{1.0 / (1 << 33), maxTarget},
+		{1e-30, maxTarget},
+		{math.SmallestNonzeroFloat64, maxTarget},
+	}
+	for _, test := range tests {
+		target, err := DiffToTarget(test.diff, powLimit)
+		if err != nil {
+			t.Errorf("Difficulty %v: %v", test.diff, err)
+			continue
+		}
+		if target.Cmp(test.target) != 0 {
+			t.Errorf("Difficulty %v: got target %064x, want %064x",
+				test.diff, target, test.target)
+		}
+	}
+
+	for _, diff := range []float64{0, -1, math.NaN(), math.Inf(1),
+		math.Inf(-1)} {
+		if _, err := DiffToTarget(diff, powLimit); err == nil {
+			t.Errorf("Difficulty %v converted", diff)
+		}
+	}
+}
+
+func TestTargetToDiff(t *testing.T) {
+	powLimit := new(big.Int).Lsh(big.NewInt(1), 224)
+	for _, diff := range []float64{1, 2, 0.5, 1.5, 0.001, 1 << 40} {
+		target, err := DiffToTarget(diff, powLimit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := TargetToDiff(target, powLimit); math.Abs(got-diff) >
+			diff*1e-12 {
+			t.Errorf("Difficulty %v converted back to %v", diff, got)
+		}
+	}
+	if diff := TargetToDiff(big.NewInt(0), powLimit); diff != 0 {
+		t.Errorf("Target zero converted to difficulty %v", diff)
+	}
+}
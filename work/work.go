@@ -6,6 +6,7 @@ import (
 	"github.com/EXCCoin/exccd/chaincfg/chainhash"
 	"github.com/EXCCoin/exccd/wire"
 	"math/big"
+	"time"
 )
 
 // These are the locations of various data inside Work.Data.
@@ -15,15 +16,21 @@ const (
 	GetworkDataLen = (1 + ((wire.MaxBlockHeaderPayload*8 + 65) / (chainhash.HashBlockSize * 8))) * chainhash.HashBlockSize
 )
 
+// SoloExtraNonce2Size is the size of the extranonce rolled by the miner at
+// the start of the extra data of the header when mining solo.
+const SoloExtraNonce2Size = 8
+
 // NewWork is the constructor for Work.
 func NewWork(blockHeader wire.BlockHeader, target *big.Int, jobTime uint32, timeReceived uint32, isGetWork bool, jobID string) *Work {
 	return &Work{
-		BlockHeader:  blockHeader,
-		Target:       target,
-		JobTime:      jobTime,
-		TimeReceived: timeReceived,
-		IsGetWork:    isGetWork,
-		JobID:        jobID,
+		BlockHeader:     blockHeader,
+		Target:          target,
+		JobTime:         jobTime,
+		TimeReceived:    timeReceived,
+		IsGetWork:       isGetWork,
+		JobID:           jobID,
+		ExtraNonce2Size: SoloExtraNonce2Size,
+		Received:        time.Now(),
 	}
 }
 
@@ -35,4 +42,25 @@ type Work struct {
 	TimeReceived uint32
 	IsGetWork    bool
 	JobID        string
+
+	// ExtraNonce2Offset and ExtraNonce2Size locate the part of the extra
+	// data of the header rolled by the miner.  For stratum work it follows
+	// the extranonce1 assigned by the pool.
+	ExtraNonce2Offset int
+	ExtraNonce2Size   int
+
+	// Clean is set when the work makes any previous work stale, so that
+	// devices drop their current work for it right away.
+	Clean bool
+
+	// Received is when the work was received from the pool or daemon,
+	// which the time devices take to switch to it is measured from.
+	Received time.Time
+}
+
+// ExtraNonce2 returns the part of the extra data of the header rolled by the
+// miner.
+func (w *Work) ExtraNonce2() []byte {
+	end := w.ExtraNonce2Offset + w.ExtraNonce2Size
+	return w.BlockHeader.ExtraData[w.ExtraNonce2Offset:end]
 }